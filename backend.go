@@ -2,6 +2,7 @@ package gostatsd
 
 import (
 	"context"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -19,8 +20,10 @@ type Backend interface {
 	// Name returns the name of the backend.
 	Name() string
 	// SendMetricsAsync flushes the metrics to the backend, preparing payload synchronously but doing the send asynchronously.
+	// The time.Time is the start of the flush interval the metrics were aggregated over, and should be used as the
+	// timestamp of the data points sent.
 	// Must not read/write MetricMap asynchronously.
-	SendMetricsAsync(context.Context, *MetricMap, SendCallback)
+	SendMetricsAsync(context.Context, *MetricMap, time.Time, SendCallback)
 	// SendEvent sends event to the backend.
 	SendEvent(context.Context, *Event) error
 }
@@ -2,21 +2,49 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
 
 	"github.com/atlassian/gostatsd/pkg/cluster/nodes"
 )
 
+// Secrets are read from the environment or a file rather than flags, so they aren't visible in the process list.
+const (
+	envRedisPassword = "CLUSTER_REDIS_PASSWORD"
+	envSigningKey    = "CLUSTER_SIGNING_KEY"
+)
+
 // Cluster is everything for running a single node in a cluster
 type Cluster struct {
-	RedisAddr      string
-	Namespace      string
-	Target         string
-	UpdateInterval time.Duration
-	ExpiryInterval time.Duration
+	Type              string
+	RedisAddr         string
+	RedisPasswordFile string
+	RedisTLS          bool
+	SentinelAddrs     []string
+	SentinelMaster    string
+	SigningKeyFile    string
+	Namespace         string
+	Target            string
+	UpdateInterval    time.Duration
+	ExpiryInterval    time.Duration
+	Nodes             []string
+	DNSName           string
+	DNSRecord         string
+	DNSPort           int
+	DNSServer         string
+	DNSMinInterval    time.Duration
+	DNSMaxInterval    time.Duration
+	GossipBind        string
+	GossipAdvert      string
+	GossipSeeds       []string
+	GossipZone        string
+	GossipWeight      float64
+	GossipKeys        []string
 }
 
 // newCluster will create a new Cluster with default values.
@@ -28,36 +56,100 @@ func newCluster() *Cluster {
 	}
 
 	return &Cluster{
+		Type:           "redis",
 		RedisAddr:      "127.0.0.1:6379",
 		Namespace:      "namespace",
 		Target:         local.String() + ":8125",
 		UpdateInterval: time.Second,
 		ExpiryInterval: 30 * time.Second,
+		DNSRecord:      "srv",
+		DNSMinInterval: 5 * time.Second,
+		DNSMaxInterval: time.Minute,
+		GossipBind:     "0.0.0.0:7946",
+		GossipWeight:   1,
 	}
 }
 
 // AddFlags adds flags for a specific Server to the specified FlagSet.
 func (c *Cluster) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&c.Type, "type", c.Type, "Node tracker type [redis, static, dns, gossip]")
 	fs.StringVar(&c.RedisAddr, "redis-addr", c.RedisAddr, "Redis address")
+	fs.StringVar(&c.RedisPasswordFile, "redis-password-file", c.RedisPasswordFile, "File containing the Redis password, or set "+envRedisPassword)
+	fs.BoolVar(&c.RedisTLS, "redis-tls", c.RedisTLS, "Connect to Redis with TLS")
+	fs.StringSliceVar(&c.SentinelAddrs, "redis-sentinel-addrs", c.SentinelAddrs, "Redis Sentinel addresses")
+	fs.StringVar(&c.SentinelMaster, "redis-sentinel-master", c.SentinelMaster, "Name of the master monitored by Redis Sentinel")
+	fs.StringVar(&c.SigningKeyFile, "signing-key-file", c.SigningKeyFile, "File containing the key Redis presence messages are signed with, or set "+envSigningKey)
 	fs.StringVar(&c.Namespace, "namespace", c.Namespace, "Namespace")
-	fs.StringVar(&c.Target, "target", c.Target, "Target port")
+	fs.StringVar(&c.Target, "target", c.Target, "Target port, empty to only watch the cluster")
 	fs.DurationVar(&c.UpdateInterval, "update-interval", c.UpdateInterval, "Cluster update interval")
 	fs.DurationVar(&c.ExpiryInterval, "expiry-interval", c.ExpiryInterval, "Cluster expiry interval")
+	fs.StringSliceVar(&c.Nodes, "nodes", c.Nodes, "Nodes of a static cluster, optionally weighted as address=weight")
+	fs.StringVar(&c.DNSName, "dns-name", c.DNSName, "Fully qualified name to resolve the cluster from")
+	fs.StringVar(&c.DNSRecord, "dns-record", c.DNSRecord, "DNS record type [srv, a]")
+	fs.IntVar(&c.DNSPort, "dns-port", c.DNSPort, "Port of the nodes resolved from A records")
+	fs.StringVar(&c.DNSServer, "dns-server", c.DNSServer, "DNS server address, empty to use /etc/resolv.conf")
+	fs.DurationVar(&c.DNSMinInterval, "dns-min-interval", c.DNSMinInterval, "Minimum interval between DNS lookups")
+	fs.DurationVar(&c.DNSMaxInterval, "dns-max-interval", c.DNSMaxInterval, "Maximum interval between DNS lookups")
+	fs.StringVar(&c.GossipBind, "gossip-bind", c.GossipBind, "Gossip UDP address to listen on")
+	fs.StringVar(&c.GossipAdvert, "gossip-advertise", c.GossipAdvert, "Gossip address other members reach this member on")
+	fs.StringSliceVar(&c.GossipSeeds, "gossip-seeds", c.GossipSeeds, "Gossip addresses of members to join through")
+	fs.StringVar(&c.GossipZone, "gossip-zone", c.GossipZone, "Zone of this member")
+	fs.Float64Var(&c.GossipWeight, "gossip-weight", c.GossipWeight, "Relative share of keys this member owns")
+	fs.StringSliceVar(&c.GossipKeys, "gossip-keys", c.GossipKeys, "Base64 encoded gossip encryption keys")
 }
 
 // Run runs the specified Cluster.
 func (c *Cluster) Run() error {
-	rnt := nodes.NewRedisNodeTracker(c.RedisAddr, c.Namespace, c.Target, c.UpdateInterval, c.ExpiryInterval)
+	v := viper.New()
+	v.Set("type", c.Type)
+	v.Set("redis-addr", c.RedisAddr)
+	v.Set("redis-password", os.Getenv(envRedisPassword))
+	v.Set("redis-password-file", c.RedisPasswordFile)
+	v.Set("redis-tls", c.RedisTLS)
+	v.Set("redis-sentinel-addrs", c.SentinelAddrs)
+	v.Set("redis-sentinel-master", c.SentinelMaster)
+	v.Set("signing-key", os.Getenv(envSigningKey))
+	v.Set("signing-key-file", c.SigningKeyFile)
+	v.Set("namespace", c.Namespace)
+	v.Set("update-interval", c.UpdateInterval)
+	v.Set("expiry-interval", c.ExpiryInterval)
+	v.Set("nodes", c.Nodes)
+	v.Set("dns-name", c.DNSName)
+	v.Set("dns-record", c.DNSRecord)
+	v.Set("dns-port", c.DNSPort)
+	v.Set("dns-server", c.DNSServer)
+	v.Set("dns-min-interval", c.DNSMinInterval)
+	v.Set("dns-max-interval", c.DNSMaxInterval)
+	v.Set("gossip-bind", c.GossipBind)
+	v.Set("gossip-advertise", c.GossipAdvert)
+	v.Set("gossip-seeds", c.GossipSeeds)
+	v.Set("gossip-zone", c.GossipZone)
+	v.Set("gossip-weight", c.GossipWeight)
+	v.Set("gossip-keys", c.GossipKeys)
+
+	tracker, err := nodes.NewNodeTrackerFromViper(v, c.Target)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return err
+	}
+	if tracker == nil {
+		err = errors.New("a type is required")
+		fmt.Printf("%v\n", err)
+		return err
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	go rnt.Run(ctx)
-
-	t := time.NewTicker(time.Second)
-	defer t.Stop()
+	changes := tracker.Watch()
+	go tracker.Run(ctx)
 
-	for range t.C {
-		nodes := rnt.List()
-		fmt.Printf("%v\n", nodes)
+	fmt.Printf("nodes: %v\n", tracker.List())
+	for change := range changes {
+		fmt.Printf("added: %v removed: %v nodes: %v\n", change.Added, change.Removed, change.Nodes)
+		if gnt, ok := tracker.(*nodes.GossipNodeTracker); ok {
+			for _, m := range gnt.Members() {
+				fmt.Printf("  %s node: %q zone: %q weight: %v state: %s\n", m.Addr, m.NodeID, m.Zone, m.Weight, m.State)
+			}
+		}
 	}
 
 	return nil
@@ -9,7 +9,6 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -43,7 +42,7 @@ const EnvPrefix = "GSD" //Go Stats D
 
 func main() {
 	rand.Seed(time.Now().UnixNano())
-	v, version, err := setupConfiguration()
+	v, newViper, version, err := setupConfiguration()
 	if err != nil {
 		if err == pflag.ErrHelp {
 			return
@@ -54,12 +53,12 @@ func main() {
 		fmt.Printf("Version: %s - Commit: %s - Date: %s\n", Version, GitCommit, BuildDate)
 		return
 	}
-	if err := run(v); err != nil {
+	if err := run(v, newViper); err != nil {
 		logrus.Fatalf("%v", err)
 	}
 }
 
-func run(v *viper.Viper) error {
+func run(v *viper.Viper, newViper func() *viper.Viper) error {
 	profileAddr := v.GetString(ParamProfile)
 	if profileAddr != "" {
 		go func() {
@@ -68,7 +67,7 @@ func run(v *viper.Viper) error {
 	}
 
 	logrus.Info("Starting server")
-	s, err := constructServer(v)
+	s, err := constructServer(v, newViper)
 	if err != nil {
 		return err
 	}
@@ -83,7 +82,7 @@ func run(v *viper.Viper) error {
 	return nil
 }
 
-func constructServer(v *viper.Viper) (*statsd.Server, error) {
+func constructServer(v *viper.Viper, newViper func() *viper.Viper) (*statsd.Server, error) {
 	// Logger
 	logger := logrus.StandardLogger()
 
@@ -93,17 +92,12 @@ func constructServer(v *viper.Viper) (*statsd.Server, error) {
 		return nil, err
 	}
 	// Backends
-	backendNames := v.GetStringSlice(statsd.ParamBackends)
-	backendsList := make([]gostatsd.Backend, len(backendNames))
-	for i, backendName := range backendNames {
-		backend, errBackend := backends.InitBackend(backendName, v)
-		if errBackend != nil {
-			return nil, errBackend
-		}
-		backendsList[i] = backend
+	backendsList, backendFlushIntervals, err := newBackends(v)
+	if err != nil {
+		return nil, err
 	}
 	// Percentiles
-	pt, err := getPercentiles(v.GetStringSlice(statsd.ParamPercentThreshold))
+	pt, err := statsd.ParsePercentThresholds(v.GetStringSlice(statsd.ParamPercentThreshold))
 	if err != nil {
 		return nil, err
 	}
@@ -118,6 +112,7 @@ func constructServer(v *viper.Viper) (*statsd.Server, error) {
 		Hostname:            v.GetString(statsd.ParamHostname),
 		ExpiryInterval:      v.GetDuration(statsd.ParamExpiryInterval),
 		FlushInterval:       v.GetDuration(statsd.ParamFlushInterval),
+		FlushAligned:        v.GetBool(statsd.ParamFlushAligned),
 		IgnoreHost:          v.GetBool(statsd.ParamIgnoreHost),
 		MaxReaders:          v.GetInt(statsd.ParamMaxReaders),
 		MaxParsers:          v.GetInt(statsd.ParamMaxParsers),
@@ -143,22 +138,40 @@ func constructServer(v *viper.Viper) (*statsd.Server, error) {
 			fmt.Sprintf("version:%s", Version),
 			fmt.Sprintf("commit:%s", GitCommit),
 		},
+		BackendFlushIntervals:     backendFlushIntervals,
+		NewBackends:               newBackends,
+		ConfigReloadInterval:      v.GetDuration(statsd.ParamConfigReloadInterval),
 		DisabledSubTypes:          gostatsd.DisabledSubMetrics(v),
+		IntegerCounters:           v.GetBool(statsd.ParamIntegerCounters),
+		LateGracePeriod:           v.GetDuration(statsd.ParamLateGracePeriod),
+		LateFlush:                 v.GetBool(statsd.ParamLateFlush),
 		BadLineRateLimitPerSecond: rate.Limit(v.GetFloat64(statsd.ParamBadLinesPerMinute) / 60.0),
 		Viper:                     v,
+		NewViper:                  newViper,
 	}, nil
 }
 
-func getPercentiles(s []string) ([]float64, error) {
-	percentThresholds := make([]float64, len(s))
-	for i, sPercentThreshold := range s {
-		pt, err := strconv.ParseFloat(sPercentThreshold, 64)
+// newBackends creates the configured backends, and returns them with any per backend flush intervals.
+func newBackends(v *viper.Viper) ([]gostatsd.Backend, map[string]time.Duration, error) {
+	backendNames := v.GetStringSlice(statsd.ParamBackends)
+	backendsList := make([]gostatsd.Backend, len(backendNames))
+	backendFlushIntervals := make(map[string]time.Duration)
+	seen := make(map[string]bool, len(backendNames))
+	for i, backendName := range backendNames {
+		if seen[backendName] {
+			return nil, nil, fmt.Errorf("backend %q is listed more than once", backendName)
+		}
+		seen[backendName] = true
+		backend, err := backends.InitBackend(backendName, v)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		backendsList[i] = backend
+		if interval := v.GetDuration(backendName + "." + statsd.ParamFlushInterval); interval != 0 {
+			backendFlushIntervals[backend.Name()] = interval
 		}
-		percentThresholds[i] = pt
 	}
-	return percentThresholds, nil
+	return backendsList, backendFlushIntervals, nil
 }
 
 // cancelOnInterrupt calls f when os.Interrupt or SIGTERM is received.
@@ -174,14 +187,23 @@ func cancelOnInterrupt(ctx context.Context, f context.CancelFunc) {
 	}()
 }
 
-func setupConfiguration() (*viper.Viper, bool, error) {
+// newViper creates a viper reading the environment and the flags in cmd, which take precedence over the configuration
+// file.
+func newViper(cmd *pflag.FlagSet) *viper.Viper {
 	v := viper.New()
-	defer setupLogger(v) // Apply logging configuration in case of early exit
 	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 	v.SetEnvPrefix(EnvPrefix)
 	v.SetTypeByDefaultValue(true)
 	v.AutomaticEnv()
+	cmd.VisitAll(func(flag *pflag.Flag) {
+		if err := v.BindPFlag(flag.Name, flag); err != nil {
+			panic(err) // Should never happen
+		}
+	})
+	return v
+}
 
+func setupConfiguration() (*viper.Viper, func() *viper.Viper, bool, error) {
 	var version bool
 
 	cmd := pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
@@ -194,25 +216,24 @@ func setupConfiguration() (*viper.Viper, bool, error) {
 
 	statsd.AddFlags(cmd)
 
-	cmd.VisitAll(func(flag *pflag.Flag) {
-		if err := v.BindPFlag(flag.Name, flag); err != nil {
-			panic(err) // Should never happen
-		}
-	})
+	v := newViper(cmd)
+	defer setupLogger(v) // Apply logging configuration in case of early exit
 
 	if err := cmd.Parse(os.Args[1:]); err != nil {
-		return nil, false, err
+		return nil, nil, false, err
 	}
 
 	configPath := v.GetString(ParamConfigPath)
 	if configPath != "" {
 		v.SetConfigFile(configPath)
 		if err := v.ReadInConfig(); err != nil {
-			return nil, false, err
+			return nil, nil, false, err
 		}
 	}
 
-	return v, version, nil
+	return v, func() *viper.Viper {
+		return newViper(cmd)
+	}, version, nil
 }
 
 func setupLogger(v *viper.Viper) {
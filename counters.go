@@ -3,14 +3,14 @@ package gostatsd
 // Counter is used for storing aggregated values for counters.
 type Counter struct {
 	PerSecond float64  // The calculated per second rate
-	Value     int64    // The numeric value of the metric
+	Value     float64  // The numeric value of the metric
 	Timestamp Nanotime // Last time value was updated
 	Hostname  string   // Hostname of the source of the metric
 	Tags      Tags     // The tags for the counter
 }
 
 // NewCounter initialises a new counter.
-func NewCounter(timestamp Nanotime, value int64, hostname string, tags Tags) Counter {
+func NewCounter(timestamp Nanotime, value float64, hostname string, tags Tags) Counter {
 	return Counter{Value: value, Timestamp: timestamp, Hostname: hostname, Tags: tags.Copy()}
 }
 
@@ -19,4 +19,5 @@ require (
 	github.com/tilinna/clock v1.0.2
 	golang.org/x/net v0.0.0-20190301231341-16b79f2e4e95
 	golang.org/x/time v0.0.0-20181108054448-85acf8d2951c
+	google.golang.org/grpc v1.19.0
 )
@@ -0,0 +1,94 @@
+// Package tlsconfig builds the TLS configurations of the clients and servers of gostatsd from certificate files.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Client returns the TLS configuration for a client which verifies servers with the CA in caPath, or the system CAs
+// if it is empty, and presents the certificate and key in certPath and keyPath if they are set.  Returns nil if
+// enable is false.
+func Client(caPath, certPath, keyPath string, enable bool) (*tls.Config, error) {
+	if !enable {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		// Can't use SSLv3 because of POODLE and BEAST
+		// Can't use TLSv1.0 because of POODLE and BEAST using CBC cipher
+		// Can't use TLSv1.1 because of RC4 cipher usage
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caPath != "" {
+		pool, err := readCertPool(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading TLS CA: %v", err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if certPath != "" || keyPath != "" {
+		cert, err := loadKeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %v", err)
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	}
+
+	return tlsConfig, nil
+}
+
+// Server returns the TLS configuration for a server which presents the certificate and key in certPath and keyPath.
+// If clientCAPath is set, clients must present a certificate signed by it.  Returns nil if no certificate is set.
+func Server(certPath, keyPath, clientCAPath string) (*tls.Config, error) {
+	if certPath == "" && keyPath == "" {
+		if clientCAPath != "" {
+			return nil, errors.New("a client CA requires a certificate and key")
+		}
+		return nil, nil
+	}
+
+	cert, err := loadKeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading server certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if clientCAPath != "" {
+		pool, err := readCertPool(clientCAPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading client CA: %v", err)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+func readCertPool(path string) (*x509.CertPool, error) {
+	caPEM, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if ok := pool.AppendCertsFromPEM(caPEM); !ok {
+		return nil, errors.New("no certificates found")
+	}
+	return pool, nil
+}
+
+func loadKeyPair(certPath, keyPath string) (tls.Certificate, error) {
+	if certPath == "" || keyPath == "" {
+		return tls.Certificate{}, errors.New("the certificate and key must be set together")
+	}
+	return tls.LoadX509KeyPair(certPath, keyPath)
+}
@@ -0,0 +1,49 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient(t *testing.T) {
+	t.Parallel()
+	tlsConfig, err := Client("/nonexistent", "", "", false)
+	require.NoError(t, err)
+	assert.Nil(t, tlsConfig, "TLS is disabled, so nothing is read")
+
+	tlsConfig, err = Client("", "", "", true)
+	require.NoError(t, err)
+	assert.EqualValues(t, tls.VersionTLS12, tlsConfig.MinVersion)
+	assert.Nil(t, tlsConfig.RootCAs)
+
+	_, err = Client("", "cert.pem", "", true)
+	assert.Error(t, err)
+	_, err = Client("/nonexistent", "", "", true)
+	assert.Error(t, err)
+
+	f, err := ioutil.TempFile("", "ca")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	require.NoError(t, f.Close())
+	_, err = Client(f.Name(), "", "", true)
+	assert.Error(t, err, "a CA file without certificates is invalid")
+}
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+	tlsConfig, err := Server("", "", "")
+	require.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+
+	_, err = Server("", "", "ca.pem")
+	assert.Error(t, err)
+	_, err = Server("cert.pem", "", "")
+	assert.Error(t, err)
+	_, err = Server("/nonexistent/cert.pem", "/nonexistent/key.pem", "")
+	assert.Error(t, err)
+}
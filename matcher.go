@@ -1,6 +1,8 @@
 package gostatsd
 
 import (
+	"fmt"
+	"regexp"
 	"strings"
 )
 
@@ -8,11 +10,60 @@ type StringMatch struct {
 	test        string
 	invertMatch bool
 	prefixMatch bool
+	regex       *regexp.Regexp // Set for regex and glob matches
 }
 
 type StringMatchList []StringMatch
 
+// NewStringMatch creates a StringMatch from s.  See ParseStringMatch for the syntax.  If s is not valid, it is matched
+// exactly, or as a prefix if it ends in *.
 func NewStringMatch(s string) StringMatch {
+	sm, err := ParseStringMatch(s)
+	if err != nil {
+		return parseLiteralMatch(s)
+	}
+	return sm
+}
+
+// ParseStringMatch creates a StringMatch from s, or returns an error if s is not valid.  A leading ! inverts the
+// match.  The rest of s is either:
+// - ~ followed by a regular expression, which may match any part of the string
+// - glob: followed by a glob matching the whole string
+// - a string to match exactly, or as a prefix if it ends in *
+// In a glob, * matches one or more characters other than ., ** matches one or more of any characters, and ? matches a
+// single character.
+func ParseStringMatch(s string) (StringMatch, error) {
+	invert := false
+	if strings.HasPrefix(s, "!") {
+		invert = true
+		s = s[1:]
+	}
+
+	var pattern string
+	switch {
+	case strings.HasPrefix(s, "~"):
+		pattern = s[1:]
+	case strings.HasPrefix(s, "glob:"):
+		pattern = globToRegex(s[len("glob:"):])
+	default:
+		sm := parseLiteralMatch(s)
+		sm.invertMatch = invert
+		return sm, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return StringMatch{}, fmt.Errorf("invalid regex %q: %v", pattern, err)
+	}
+	return StringMatch{
+		test:        s,
+		invertMatch: invert,
+		regex:       re,
+	}, nil
+}
+
+// parseLiteralMatch creates a StringMatch matching s exactly, or as a prefix if it ends in *, after an optional !.
+func parseLiteralMatch(s string) StringMatch {
 	invert := false
 	if strings.HasPrefix(s, "!") {
 		invert = true
@@ -32,8 +83,36 @@ func NewStringMatch(s string) StringMatch {
 	}
 }
 
+// globToRegex returns an anchored regular expression matching the glob.  * and ** mean the same as they do in a
+// mapping's glob.
+func globToRegex(glob string) string {
+	var sb strings.Builder
+	sb.WriteByte('^')
+	runes := []rune(glob)
+	for i := 0; i < len(runes); i++ {
+		switch r := runes[i]; r {
+		case '*':
+			if i+1 < len(runes) && runes[i+1] == '*' {
+				sb.WriteString(".+")
+				i++
+			} else {
+				sb.WriteString("[^.]+")
+			}
+		case '?':
+			sb.WriteByte('.')
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteByte('$')
+	return sb.String()
+}
+
 // Match indicates if the provided string matches the criteria for this StringMatch
 func (sm StringMatch) Match(s string) bool {
+	if sm.regex != nil {
+		return sm.regex.MatchString(s) != sm.invertMatch
+	}
 	if sm.prefixMatch {
 		return strings.HasPrefix(s, sm.test) != sm.invertMatch
 	}
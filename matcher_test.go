@@ -189,6 +189,75 @@ func TestStringMatchSuffixInvertEmpty(t *testing.T) {
 	}
 }
 
+func TestStringMatchRegex(t *testing.T) {
+	tests := []struct {
+		match    string
+		input    string
+		expected bool
+	}{
+		{"~^abc", "abcd", true},
+		{"~^abc", "zabc", false},
+		{"~b.d", "abcde", true},
+		{"~^(get|put)\\.\\d+$", "get.200", true},
+		{"~^(get|put)\\.\\d+$", "post.200", false},
+		{"!~^abc", "abcd", false},
+		{"!~^abc", "zabc", true},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.match+"/"+test.input, func(t *testing.T) {
+			assert.EqualValues(t, test.expected, NewStringMatch(test.match).Match(test.input))
+		})
+	}
+}
+
+func TestStringMatchGlob(t *testing.T) {
+	tests := []struct {
+		match    string
+		input    string
+		expected bool
+	}{
+		{"glob:*.requests", "api.requests", true},
+		{"glob:*.requests", "api.requests.count", false},
+		{"glob:api.*.count", "api.a.count", true},
+		{"glob:api.*.count", "api.a.b.count", false},
+		{"glob:api.**.count", "api.a.b.count", true},
+		{"glob:api.*.count", "api.count", false},
+		{"glob:api.**", "api.a.b", true},
+		{"glob:héllo.*", "héllo.a", true},
+		{"glob:code:?xx", "code:5xx", true},
+		{"glob:code:?xx", "code:50xx", false},
+		{"glob:a+b.*", "a+b.c", true},
+		{"!glob:*.requests", "api.requests", false},
+		{"!glob:*.requests", "api.errors", true},
+		// Without glob:, * and ? keep their old meaning
+		{"code:?xx", "code:?xx", true},
+		{"code:?xx", "code:5xx", false},
+		{"api.*.count", "api.*.count", true},
+		{"api.*.count", "api.a.count", false},
+		{"api.*.c*", "api.*.count", true},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.match+"/"+test.input, func(t *testing.T) {
+			assert.EqualValues(t, test.expected, NewStringMatch(test.match).Match(test.input))
+		})
+	}
+}
+
+func TestParseStringMatchInvalid(t *testing.T) {
+	_, err := ParseStringMatch("~(abc")
+	assert.Error(t, err)
+	_, err = ParseStringMatch("glob:[")
+	assert.NoError(t, err, "glob special characters are quoted")
+
+	// NewStringMatch falls back to an exact or prefix match
+	assert.Equal(t, StringMatch{test: "~[", invertMatch: true}, NewStringMatch("!~["))
+	assert.True(t, NewStringMatch("~(*").Match("~(abc"))
+}
+
 func TestStringMatchListAny(t *testing.T) {
 	sml := StringMatchList{} // no filters matches nothing
 	assert.Equal(t, false, sml.MatchAny("abc"))
@@ -46,85 +46,125 @@ func (mm *MetricMap) Receive(m *Metric) {
 }
 
 func (mm *MetricMap) Merge(mmFrom *MetricMap) {
-	mmFrom.Counters.Each(func(metricName string, tagsKey string, counterFrom Counter) {
-		v, ok := mm.Counters[metricName]
+	mmFrom.Counters.Each(mm.MergeCounter)
+	mmFrom.Gauges.Each(mm.MergeGauge)
+	mmFrom.Timers.Each(mm.MergeTimer)
+	mmFrom.Sets.Each(mm.MergeSet)
+}
+
+// MergeCounter adds a single counter series to the MetricMap, merging it with any series with the same name and tags
+// key.
+func (mm *MetricMap) MergeCounter(metricName string, tagsKey string, counterFrom Counter) {
+	v, ok := mm.Counters[metricName]
+	if ok {
+		counterInto, ok := v[tagsKey]
 		if ok {
-			counterInto, ok := v[tagsKey]
-			if ok {
-				if counterInto.Timestamp < counterFrom.Timestamp {
-					counterInto.Timestamp = counterFrom.Timestamp
-				}
-				counterInto.Value += counterFrom.Value
-			} else {
-				counterInto = counterFrom
+			if counterInto.Timestamp < counterFrom.Timestamp {
+				counterInto.Timestamp = counterFrom.Timestamp
 			}
-			v[tagsKey] = counterInto
+			counterInto.Value += counterFrom.Value
 		} else {
-			mm.Counters[metricName] = map[string]Counter{
-				tagsKey: counterFrom,
-			}
+			counterInto = counterFrom
 		}
-	})
+		v[tagsKey] = counterInto
+	} else {
+		mm.Counters[metricName] = map[string]Counter{
+			tagsKey: counterFrom,
+		}
+	}
+}
 
-	mmFrom.Gauges.Each(func(metricName string, tagsKey string, gaugeFrom Gauge) {
-		v, ok := mm.Gauges[metricName]
+// MergeGauge adds a single gauge series to the MetricMap, merging it with any series with the same name and tags key.
+func (mm *MetricMap) MergeGauge(metricName string, tagsKey string, gaugeFrom Gauge) {
+	v, ok := mm.Gauges[metricName]
+	if ok {
+		gaugeInto, ok := v[tagsKey]
 		if ok {
-			gaugeInto, ok := v[tagsKey]
-			if ok {
-				if gaugeInto.Timestamp < gaugeFrom.Timestamp {
-					gaugeInto.Timestamp = gaugeFrom.Timestamp
-					gaugeInto.Value = gaugeFrom.Value
-				}
-			} else {
-				gaugeInto = gaugeFrom
+			if gaugeInto.Timestamp < gaugeFrom.Timestamp {
+				gaugeInto.Timestamp = gaugeFrom.Timestamp
+				gaugeInto.Value = gaugeFrom.Value
 			}
-			v[tagsKey] = gaugeInto
 		} else {
-			mm.Gauges[metricName] = map[string]Gauge{
-				tagsKey: gaugeFrom,
-			}
+			gaugeInto = gaugeFrom
 		}
-	})
+		v[tagsKey] = gaugeInto
+	} else {
+		mm.Gauges[metricName] = map[string]Gauge{
+			tagsKey: gaugeFrom,
+		}
+	}
+}
 
-	mmFrom.Timers.Each(func(metricName string, tagsKey string, timerFrom Timer) {
-		v, ok := mm.Timers[metricName]
+// MergeTimer adds a single timer series to the MetricMap, merging it with any series with the same name and tags key.
+func (mm *MetricMap) MergeTimer(metricName string, tagsKey string, timerFrom Timer) {
+	v, ok := mm.Timers[metricName]
+	if ok {
+		timerInto, ok := v[tagsKey]
 		if ok {
-			timerInto, ok := v[tagsKey]
-			if ok {
-				if timerInto.Timestamp < timerFrom.Timestamp {
-					timerInto.Timestamp = timerFrom.Timestamp
-				}
-				timerInto.Values = append(timerInto.Values, timerFrom.Values...)
-				timerInto.SampledCount += timerFrom.SampledCount
-			} else {
-				timerInto = timerFrom
+			if timerInto.Timestamp < timerFrom.Timestamp {
+				timerInto.Timestamp = timerFrom.Timestamp
 			}
-			v[tagsKey] = timerInto
+			timerInto.Values = append(timerInto.Values, timerFrom.Values...)
+			timerInto.SampledCount += timerFrom.SampledCount
 		} else {
-			mm.Timers[metricName] = map[string]Timer{
-				tagsKey: timerFrom,
-			}
+			timerInto = timerFrom
 		}
-	})
-	mmFrom.Sets.Each(func(metricName string, tagsKey string, setFrom Set) {
-		v, ok := mm.Sets[metricName]
+		v[tagsKey] = timerInto
+	} else {
+		mm.Timers[metricName] = map[string]Timer{
+			tagsKey: timerFrom,
+		}
+	}
+}
+
+// MergeSet adds a single set series to the MetricMap, merging it with any series with the same name and tags key.
+func (mm *MetricMap) MergeSet(metricName string, tagsKey string, setFrom Set) {
+	v, ok := mm.Sets[metricName]
+	if ok {
+		setInto, ok := v[tagsKey]
 		if ok {
-			setInto, ok := v[tagsKey]
-			if ok {
-				if setInto.Timestamp < setFrom.Timestamp {
-					setInto.Timestamp = setFrom.Timestamp
-				}
-				for setValue := range setFrom.Values {
-					setInto.Values[setValue] = struct{}{}
-				}
-			} else {
-				setInto = setFrom
+			if setInto.Timestamp < setFrom.Timestamp {
+				setInto.Timestamp = setFrom.Timestamp
 			}
-			v[tagsKey] = setInto
-		} else {
-			mm.Sets[metricName] = map[string]Set{
-				tagsKey: setFrom,
+			for setValue := range setFrom.Values {
+				setInto.Values[setValue] = struct{}{}
 			}
+		} else {
+			setInto = setFrom
+		}
+		v[tagsKey] = setInto
+	} else {
+		mm.Sets[metricName] = map[string]Set{
+			tagsKey: setFrom,
+		}
+	}
+}
+
+// SplitFunc returns the MetricMap a series is added to by SplitByFunc, or nil to drop the series.  It may rename the
+// series by changing *metricName, or change its tags by changing *tags, in which case it must set *tagsKey to match.
+type SplitFunc func(metricName, tagsKey *string, hostname string, tags *Tags) *MetricMap
+
+// SplitByFunc adds each series in the MetricMap to the MetricMap returned by f for it.  Series which end up with the
+// same name and tags key are merged.  Series which aren't merged share their values with the original MetricMap.
+func (mm *MetricMap) SplitByFunc(f SplitFunc) {
+	mm.Counters.Each(func(metricName string, tagsKey string, c Counter) {
+		if mmSplit := f(&metricName, &tagsKey, c.Hostname, &c.Tags); mmSplit != nil {
+			mmSplit.MergeCounter(metricName, tagsKey, c)
+		}
+	})
+	mm.Gauges.Each(func(metricName string, tagsKey string, g Gauge) {
+		if mmSplit := f(&metricName, &tagsKey, g.Hostname, &g.Tags); mmSplit != nil {
+			mmSplit.MergeGauge(metricName, tagsKey, g)
+		}
+	})
+	mm.Timers.Each(func(metricName string, tagsKey string, t Timer) {
+		if mmSplit := f(&metricName, &tagsKey, t.Hostname, &t.Tags); mmSplit != nil {
+			mmSplit.MergeTimer(metricName, tagsKey, t)
+		}
+	})
+	mm.Sets.Each(func(metricName string, tagsKey string, s Set) {
+		if mmSplit := f(&metricName, &tagsKey, s.Hostname, &s.Tags); mmSplit != nil {
+			mmSplit.MergeSet(metricName, tagsKey, s)
 		}
 	})
 }
@@ -177,7 +217,7 @@ func (mm *MetricMap) Split(count int) []*MetricMap {
 }
 
 func (mm *MetricMap) receiveCounter(m *Metric, tagsKey string) {
-	value := int64(m.Value / m.Rate)
+	value := m.Value / m.Rate
 	v, ok := mm.Counters[m.Name]
 	if ok {
 		c, ok := v[tagsKey]
@@ -265,7 +305,7 @@ func (mm *MetricMap) receiveSet(m *Metric, tagsKey string) {
 func (mm *MetricMap) String() string {
 	buf := new(bytes.Buffer)
 	mm.Counters.Each(func(k, tags string, counter Counter) {
-		_, _ = fmt.Fprintf(buf, "stats.counter.%s: %d tags=%s\n", k, counter.Value, tags)
+		_, _ = fmt.Fprintf(buf, "stats.counter.%s: %g tags=%s\n", k, counter.Value, tags)
 	})
 	mm.Timers.Each(func(k, tags string, timer Timer) {
 		for _, value := range timer.Values {
@@ -289,7 +329,7 @@ func (mm *MetricMap) DispatchMetrics(ctx context.Context, handler RawMetricHandl
 		m := &Metric{
 			Name:      metricName,
 			Type:      COUNTER,
-			Value:     float64(c.Value),
+			Value:     c.Value,
 			Rate:      1,
 			Tags:      c.Tags.Copy(),
 			TagsKey:   tagsKey,
@@ -104,6 +104,16 @@ func TestReceive(t *testing.T) {
 	assrt.Equal(expectedSets, mm.Sets)
 }
 
+func TestReceiveCounterFraction(t *testing.T) {
+	t.Parallel()
+
+	mm := NewMetricMap()
+	mm.Receive(&Metric{Name: "bytes", Value: 0.5, Rate: 1, Type: COUNTER, Timestamp: 10})
+	mm.Receive(&Metric{Name: "bytes", Value: 1, Rate: 0.4, Type: COUNTER, Timestamp: 10})
+
+	require.Equal(t, 3.0, mm.Counters["bytes"][""].Value)
+}
+
 func benchmarkReceive(metric Metric, b *testing.B) {
 	ma := NewMetricMap()
 	b.ReportAllocs()
@@ -312,6 +322,48 @@ func TestMetricMapSplit(t *testing.T) {
 	require.EqualValues(t, mmOriginal, mmMerged)
 }
 
+func TestMetricMapSplitByFunc(t *testing.T) {
+	mmOriginal := NewMetricMap()
+	mmOriginal.Counters["a"] = map[string]Counter{
+		"t:1": {Tags: Tags{"t:1"}, Value: 1},
+		"t:2": {Tags: Tags{"t:2"}, Value: 2},
+	}
+	mmOriginal.Gauges["b"] = map[string]Gauge{
+		"t:1": {Tags: Tags{"t:1"}, Value: 3},
+	}
+	mmOriginal.Timers["c"] = map[string]Timer{
+		"t:2": {Tags: Tags{"t:2"}, Values: []float64{4}},
+	}
+	mmOriginal.Sets["d"] = map[string]Set{
+		"t:3": {Tags: Tags{"t:3"}, Values: map[string]struct{}{"5": {}}},
+	}
+
+	// Series are split by tag, and series tagged t:3 are dropped
+	maps := map[string]*MetricMap{"t:1": NewMetricMap(), "t:2": NewMetricMap()}
+	mmOriginal.SplitByFunc(func(metricName, tagsKey *string, hostname string, tags *Tags) *MetricMap {
+		return maps[*tagsKey]
+	})
+	expected1 := NewMetricMap()
+	expected1.Counters["a"] = map[string]Counter{"t:1": {Tags: Tags{"t:1"}, Value: 1}}
+	expected1.Gauges["b"] = map[string]Gauge{"t:1": {Tags: Tags{"t:1"}, Value: 3}}
+	require.EqualValues(t, expected1, maps["t:1"])
+	expected2 := NewMetricMap()
+	expected2.Counters["a"] = map[string]Counter{"t:2": {Tags: Tags{"t:2"}, Value: 2}}
+	expected2.Timers["c"] = map[string]Timer{"t:2": {Tags: Tags{"t:2"}, Values: []float64{4}}}
+	require.EqualValues(t, expected2, maps["t:2"])
+
+	// Renamed series with the same tags are merged
+	mmRenamed := NewMetricMap()
+	mmOriginal.SplitByFunc(func(metricName, tagsKey *string, hostname string, tags *Tags) *MetricMap {
+		*metricName = "x." + *metricName
+		*tags = Tags{"t"}
+		*tagsKey = FormatTagsKey(hostname, *tags)
+		return mmRenamed
+	})
+	require.EqualValues(t, map[string]Counter{"t": {Tags: Tags{"t"}, Value: 3}}, mmRenamed.Counters["x.a"])
+	require.Len(t, mmRenamed.Sets["x.d"], 1)
+}
+
 func TestMetricMapIsEmpty(t *testing.T) {
 	mm := NewMetricMap()
 	require.True(t, mm.IsEmpty())
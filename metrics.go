@@ -36,17 +36,18 @@ func (m MetricType) String() string {
 
 // Metric represents a single data collected datapoint.
 type Metric struct {
-	Name        string     // The name of the metric
-	Value       float64    // The numeric value of the metric
-	Rate        float64    // The sampling rate of the metric
-	Tags        Tags       // The tags for the metric
-	TagsKey     string     // The tags rendered as a string to uniquely identify the tagset in a map.  Sort of a cache.  Will be removed at some point.
-	StringValue string     // The string value for some metrics e.g. Set
-	Hostname    string     // Hostname of the source of the metric
-	SourceIP    IP         // IP of the source of the metric
-	Timestamp   Nanotime   // Most accurate known timestamp of this metric
-	Type        MetricType // The type of metric
-	DoneFunc    func()     // Returns the metric to the pool. May be nil. Call Metric.Done(), not this.
+	Name            string     // The name of the metric
+	Value           float64    // The numeric value of the metric
+	Rate            float64    // The sampling rate of the metric
+	Tags            Tags       // The tags for the metric
+	TagsKey         string     // The tags rendered as a string to uniquely identify the tagset in a map.  Sort of a cache.  Will be removed at some point.
+	StringValue     string     // The string value for some metrics e.g. Set
+	Hostname        string     // Hostname of the source of the metric
+	SourceIP        IP         // IP of the source of the metric
+	Timestamp       Nanotime   // Most accurate known timestamp of this metric
+	ClientTimestamp bool       // Timestamp was sent by the client, rather than being the time the metric was received
+	Type            MetricType // The type of metric
+	DoneFunc        func()     // Returns the metric to the pool. May be nil. Call Metric.Done(), not this.
 }
 
 // Reset is used to reset a metric to as clean state, called on re-use from the pool.
@@ -60,6 +61,7 @@ func (m *Metric) Reset() {
 	m.Hostname = ""
 	m.SourceIP = ""
 	m.Timestamp = 0
+	m.ClientTimestamp = false
 	m.Type = 0
 }
 
@@ -0,0 +1,260 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: pb/forwarder.proto
+
+package pb
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+type SendReplyV2 struct {
+	Received             uint64   `protobuf:"varint,1,opt,name=Received,proto3" json:"Received,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SendReplyV2) Reset()         { *m = SendReplyV2{} }
+func (m *SendReplyV2) String() string { return proto.CompactTextString(m) }
+func (*SendReplyV2) ProtoMessage()    {}
+func (*SendReplyV2) Descriptor() ([]byte, []int) {
+	return fileDescriptor_6b96e6aef81e33a5, []int{0}
+}
+
+func (m *SendReplyV2) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SendReplyV2.Unmarshal(m, b)
+}
+func (m *SendReplyV2) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SendReplyV2.Marshal(b, m, deterministic)
+}
+func (m *SendReplyV2) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SendReplyV2.Merge(m, src)
+}
+func (m *SendReplyV2) XXX_Size() int {
+	return xxx_messageInfo_SendReplyV2.Size(m)
+}
+func (m *SendReplyV2) XXX_DiscardUnknown() {
+	xxx_messageInfo_SendReplyV2.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SendReplyV2 proto.InternalMessageInfo
+
+func (m *SendReplyV2) GetReceived() uint64 {
+	if m != nil {
+		return m.Received
+	}
+	return 0
+}
+
+func init() {
+	proto.RegisterType((*SendReplyV2)(nil), "pb.SendReplyV2")
+}
+
+func init() { proto.RegisterFile("pb/forwarder.proto", fileDescriptor_6b96e6aef81e33a5) }
+
+var fileDescriptor_6b96e6aef81e33a5 = []byte{
+	// 167 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0x12, 0x2a, 0x48, 0xd2, 0x4f,
+	0xcb, 0x2f, 0x2a, 0x4f, 0x2c, 0x4a, 0x49, 0x2d, 0xd2, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62,
+	0x2a, 0x48, 0x92, 0x12, 0x2c, 0x48, 0xd2, 0x4f, 0xcf, 0x2f, 0x2e, 0x49, 0x2c, 0x29, 0x4e, 0x81,
+	0x08, 0x2b, 0x69, 0x72, 0x71, 0x07, 0xa7, 0xe6, 0xa5, 0x04, 0xa5, 0x16, 0xe4, 0x54, 0x86, 0x19,
+	0x09, 0x49, 0x71, 0x71, 0x04, 0xa5, 0x26, 0xa7, 0x66, 0x96, 0xa5, 0xa6, 0x48, 0x30, 0x2a, 0x30,
+	0x6a, 0xb0, 0x04, 0xc1, 0xf9, 0x46, 0xf9, 0x5c, 0xdc, 0x6e, 0x30, 0x43, 0xc3, 0x8c, 0x84, 0x8c,
+	0x20, 0x3a, 0x7d, 0x53, 0x4b, 0x8a, 0x32, 0x93, 0x8b, 0x85, 0x04, 0xf4, 0x0a, 0x92, 0xf4, 0x82,
+	0x12, 0xcb, 0x7d, 0x53, 0x8b, 0x8b, 0x13, 0xd3, 0x53, 0xc3, 0x8c, 0xa4, 0xf8, 0x41, 0x22, 0x48,
+	0x86, 0x6b, 0x30, 0x0a, 0xe9, 0x70, 0x71, 0x81, 0x04, 0x5c, 0xcb, 0x52, 0xf3, 0x4a, 0x8a, 0x85,
+	0xb8, 0x41, 0x0a, 0xc0, 0x6c, 0xac, 0xaa, 0x93, 0xd8, 0xc0, 0x4e, 0x34, 0x06, 0x0c, 0x00, 0x0f,
+	0x0e, 0xe4, 0x8f, 0xcf, 0x00, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// ForwarderV2Client is the client API for ForwarderV2 service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type ForwarderV2Client interface {
+	// SendMetrics receives a stream of metric maps, and replies with how many were received once it is closed.
+	SendMetrics(ctx context.Context, opts ...grpc.CallOption) (ForwarderV2_SendMetricsClient, error)
+	// SendEvents receives a stream of events, and replies with how many were received once it is closed.
+	SendEvents(ctx context.Context, opts ...grpc.CallOption) (ForwarderV2_SendEventsClient, error)
+}
+
+type forwarderV2Client struct {
+	cc *grpc.ClientConn
+}
+
+func NewForwarderV2Client(cc *grpc.ClientConn) ForwarderV2Client {
+	return &forwarderV2Client{cc}
+}
+
+func (c *forwarderV2Client) SendMetrics(ctx context.Context, opts ...grpc.CallOption) (ForwarderV2_SendMetricsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_ForwarderV2_serviceDesc.Streams[0], "/pb.ForwarderV2/SendMetrics", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &forwarderV2SendMetricsClient{stream}
+	return x, nil
+}
+
+type ForwarderV2_SendMetricsClient interface {
+	Send(*RawMessageV2) error
+	CloseAndRecv() (*SendReplyV2, error)
+	grpc.ClientStream
+}
+
+type forwarderV2SendMetricsClient struct {
+	grpc.ClientStream
+}
+
+func (x *forwarderV2SendMetricsClient) Send(m *RawMessageV2) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *forwarderV2SendMetricsClient) CloseAndRecv() (*SendReplyV2, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(SendReplyV2)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *forwarderV2Client) SendEvents(ctx context.Context, opts ...grpc.CallOption) (ForwarderV2_SendEventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_ForwarderV2_serviceDesc.Streams[1], "/pb.ForwarderV2/SendEvents", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &forwarderV2SendEventsClient{stream}
+	return x, nil
+}
+
+type ForwarderV2_SendEventsClient interface {
+	Send(*EventV2) error
+	CloseAndRecv() (*SendReplyV2, error)
+	grpc.ClientStream
+}
+
+type forwarderV2SendEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *forwarderV2SendEventsClient) Send(m *EventV2) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *forwarderV2SendEventsClient) CloseAndRecv() (*SendReplyV2, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(SendReplyV2)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ForwarderV2Server is the server API for ForwarderV2 service.
+type ForwarderV2Server interface {
+	// SendMetrics receives a stream of metric maps, and replies with how many were received once it is closed.
+	SendMetrics(ForwarderV2_SendMetricsServer) error
+	// SendEvents receives a stream of events, and replies with how many were received once it is closed.
+	SendEvents(ForwarderV2_SendEventsServer) error
+}
+
+func RegisterForwarderV2Server(s *grpc.Server, srv ForwarderV2Server) {
+	s.RegisterService(&_ForwarderV2_serviceDesc, srv)
+}
+
+func _ForwarderV2_SendMetrics_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ForwarderV2Server).SendMetrics(&forwarderV2SendMetricsServer{stream})
+}
+
+type ForwarderV2_SendMetricsServer interface {
+	SendAndClose(*SendReplyV2) error
+	Recv() (*RawMessageV2, error)
+	grpc.ServerStream
+}
+
+type forwarderV2SendMetricsServer struct {
+	grpc.ServerStream
+}
+
+func (x *forwarderV2SendMetricsServer) SendAndClose(m *SendReplyV2) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *forwarderV2SendMetricsServer) Recv() (*RawMessageV2, error) {
+	m := new(RawMessageV2)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _ForwarderV2_SendEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ForwarderV2Server).SendEvents(&forwarderV2SendEventsServer{stream})
+}
+
+type ForwarderV2_SendEventsServer interface {
+	SendAndClose(*SendReplyV2) error
+	Recv() (*EventV2, error)
+	grpc.ServerStream
+}
+
+type forwarderV2SendEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *forwarderV2SendEventsServer) SendAndClose(m *SendReplyV2) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *forwarderV2SendEventsServer) Recv() (*EventV2, error) {
+	m := new(EventV2)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var _ForwarderV2_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "pb.ForwarderV2",
+	HandlerType: (*ForwarderV2Server)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SendMetrics",
+			Handler:       _ForwarderV2_SendMetrics_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "SendEvents",
+			Handler:       _ForwarderV2_SendEvents_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "pb/forwarder.proto",
+}
@@ -38,7 +38,7 @@ func (x EventV2_EventPriority) String() string {
 	return proto.EnumName(EventV2_EventPriority_name, int32(x))
 }
 func (EventV2_EventPriority) EnumDescriptor() ([]byte, []int) {
-	return fileDescriptor_gostatsd_02649f73f2826ea1, []int{9, 0}
+	return fileDescriptor_gostatsd_4b9c1ba07a616b1f, []int{9, 0}
 }
 
 type EventV2_AlertType int32
@@ -67,7 +67,7 @@ func (x EventV2_AlertType) String() string {
 	return proto.EnumName(EventV2_AlertType_name, int32(x))
 }
 func (EventV2_AlertType) EnumDescriptor() ([]byte, []int) {
-	return fileDescriptor_gostatsd_02649f73f2826ea1, []int{9, 1}
+	return fileDescriptor_gostatsd_4b9c1ba07a616b1f, []int{9, 1}
 }
 
 type RawMessageV2 struct {
@@ -84,7 +84,7 @@ func (m *RawMessageV2) Reset()         { *m = RawMessageV2{} }
 func (m *RawMessageV2) String() string { return proto.CompactTextString(m) }
 func (*RawMessageV2) ProtoMessage()    {}
 func (*RawMessageV2) Descriptor() ([]byte, []int) {
-	return fileDescriptor_gostatsd_02649f73f2826ea1, []int{0}
+	return fileDescriptor_gostatsd_4b9c1ba07a616b1f, []int{0}
 }
 func (m *RawMessageV2) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_RawMessageV2.Unmarshal(m, b)
@@ -143,7 +143,7 @@ func (m *CounterTagV2) Reset()         { *m = CounterTagV2{} }
 func (m *CounterTagV2) String() string { return proto.CompactTextString(m) }
 func (*CounterTagV2) ProtoMessage()    {}
 func (*CounterTagV2) Descriptor() ([]byte, []int) {
-	return fileDescriptor_gostatsd_02649f73f2826ea1, []int{1}
+	return fileDescriptor_gostatsd_4b9c1ba07a616b1f, []int{1}
 }
 func (m *CounterTagV2) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_CounterTagV2.Unmarshal(m, b)
@@ -181,7 +181,7 @@ func (m *GaugeTagV2) Reset()         { *m = GaugeTagV2{} }
 func (m *GaugeTagV2) String() string { return proto.CompactTextString(m) }
 func (*GaugeTagV2) ProtoMessage()    {}
 func (*GaugeTagV2) Descriptor() ([]byte, []int) {
-	return fileDescriptor_gostatsd_02649f73f2826ea1, []int{2}
+	return fileDescriptor_gostatsd_4b9c1ba07a616b1f, []int{2}
 }
 func (m *GaugeTagV2) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_GaugeTagV2.Unmarshal(m, b)
@@ -219,7 +219,7 @@ func (m *SetTagV2) Reset()         { *m = SetTagV2{} }
 func (m *SetTagV2) String() string { return proto.CompactTextString(m) }
 func (*SetTagV2) ProtoMessage()    {}
 func (*SetTagV2) Descriptor() ([]byte, []int) {
-	return fileDescriptor_gostatsd_02649f73f2826ea1, []int{3}
+	return fileDescriptor_gostatsd_4b9c1ba07a616b1f, []int{3}
 }
 func (m *SetTagV2) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_SetTagV2.Unmarshal(m, b)
@@ -257,7 +257,7 @@ func (m *TimerTagV2) Reset()         { *m = TimerTagV2{} }
 func (m *TimerTagV2) String() string { return proto.CompactTextString(m) }
 func (*TimerTagV2) ProtoMessage()    {}
 func (*TimerTagV2) Descriptor() ([]byte, []int) {
-	return fileDescriptor_gostatsd_02649f73f2826ea1, []int{4}
+	return fileDescriptor_gostatsd_4b9c1ba07a616b1f, []int{4}
 }
 func (m *TimerTagV2) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_TimerTagV2.Unmarshal(m, b)
@@ -288,6 +288,7 @@ type RawCounterV2 struct {
 	Tags                 []string `protobuf:"bytes,1,rep,name=Tags,proto3" json:"Tags,omitempty"`
 	Hostname             string   `protobuf:"bytes,2,opt,name=Hostname,proto3" json:"Hostname,omitempty"`
 	Value                int64    `protobuf:"varint,3,opt,name=Value,proto3" json:"Value,omitempty"`
+	FloatValue           float64  `protobuf:"fixed64,4,opt,name=FloatValue,proto3" json:"FloatValue,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -297,7 +298,7 @@ func (m *RawCounterV2) Reset()         { *m = RawCounterV2{} }
 func (m *RawCounterV2) String() string { return proto.CompactTextString(m) }
 func (*RawCounterV2) ProtoMessage()    {}
 func (*RawCounterV2) Descriptor() ([]byte, []int) {
-	return fileDescriptor_gostatsd_02649f73f2826ea1, []int{5}
+	return fileDescriptor_gostatsd_4b9c1ba07a616b1f, []int{5}
 }
 func (m *RawCounterV2) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_RawCounterV2.Unmarshal(m, b)
@@ -338,6 +339,13 @@ func (m *RawCounterV2) GetValue() int64 {
 	return 0
 }
 
+func (m *RawCounterV2) GetFloatValue() float64 {
+	if m != nil {
+		return m.FloatValue
+	}
+	return 0
+}
+
 type RawGaugeV2 struct {
 	Tags                 []string `protobuf:"bytes,1,rep,name=Tags,proto3" json:"Tags,omitempty"`
 	Hostname             string   `protobuf:"bytes,2,opt,name=Hostname,proto3" json:"Hostname,omitempty"`
@@ -351,7 +359,7 @@ func (m *RawGaugeV2) Reset()         { *m = RawGaugeV2{} }
 func (m *RawGaugeV2) String() string { return proto.CompactTextString(m) }
 func (*RawGaugeV2) ProtoMessage()    {}
 func (*RawGaugeV2) Descriptor() ([]byte, []int) {
-	return fileDescriptor_gostatsd_02649f73f2826ea1, []int{6}
+	return fileDescriptor_gostatsd_4b9c1ba07a616b1f, []int{6}
 }
 func (m *RawGaugeV2) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_RawGaugeV2.Unmarshal(m, b)
@@ -405,7 +413,7 @@ func (m *RawSetV2) Reset()         { *m = RawSetV2{} }
 func (m *RawSetV2) String() string { return proto.CompactTextString(m) }
 func (*RawSetV2) ProtoMessage()    {}
 func (*RawSetV2) Descriptor() ([]byte, []int) {
-	return fileDescriptor_gostatsd_02649f73f2826ea1, []int{7}
+	return fileDescriptor_gostatsd_4b9c1ba07a616b1f, []int{7}
 }
 func (m *RawSetV2) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_RawSetV2.Unmarshal(m, b)
@@ -460,7 +468,7 @@ func (m *RawTimerV2) Reset()         { *m = RawTimerV2{} }
 func (m *RawTimerV2) String() string { return proto.CompactTextString(m) }
 func (*RawTimerV2) ProtoMessage()    {}
 func (*RawTimerV2) Descriptor() ([]byte, []int) {
-	return fileDescriptor_gostatsd_02649f73f2826ea1, []int{8}
+	return fileDescriptor_gostatsd_4b9c1ba07a616b1f, []int{8}
 }
 func (m *RawTimerV2) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_RawTimerV2.Unmarshal(m, b)
@@ -528,7 +536,7 @@ func (m *EventV2) Reset()         { *m = EventV2{} }
 func (m *EventV2) String() string { return proto.CompactTextString(m) }
 func (*EventV2) ProtoMessage()    {}
 func (*EventV2) Descriptor() ([]byte, []int) {
-	return fileDescriptor_gostatsd_02649f73f2826ea1, []int{9}
+	return fileDescriptor_gostatsd_4b9c1ba07a616b1f, []int{9}
 }
 func (m *EventV2) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_EventV2.Unmarshal(m, b)
@@ -641,51 +649,52 @@ func init() {
 	proto.RegisterEnum("pb.EventV2_AlertType", EventV2_AlertType_name, EventV2_AlertType_value)
 }
 
-func init() { proto.RegisterFile("pb/gostatsd.proto", fileDescriptor_gostatsd_02649f73f2826ea1) }
-
-var fileDescriptor_gostatsd_02649f73f2826ea1 = []byte{
-	// 684 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x55, 0x5d, 0x6f, 0xd3, 0x30,
-	0x14, 0x9d, 0x9b, 0xb4, 0x4d, 0x6e, 0xbb, 0x29, 0x58, 0x03, 0x85, 0x6a, 0x42, 0x55, 0x34, 0x4d,
-	0xe5, 0xa5, 0xa0, 0x02, 0x12, 0xda, 0xdb, 0x04, 0xd5, 0x56, 0x8d, 0x4d, 0x93, 0x5b, 0x8d, 0x67,
-	0x77, 0x33, 0x51, 0x45, 0x9b, 0x44, 0x8e, 0xbb, 0xd2, 0x1f, 0xc0, 0x13, 0x4f, 0xf0, 0x67, 0xf8,
-	0x7b, 0xc8, 0x76, 0x9a, 0xc6, 0x6d, 0xd0, 0x36, 0xc1, 0x53, 0x7d, 0x3f, 0xce, 0xb9, 0xc7, 0xe7,
-	0x46, 0x2e, 0x3c, 0x49, 0xc6, 0xaf, 0xc2, 0x38, 0x15, 0x54, 0xa4, 0xb7, 0xdd, 0x84, 0xc7, 0x22,
-	0xc6, 0x95, 0x64, 0x1c, 0xfc, 0xb2, 0xa1, 0x49, 0xe8, 0xe2, 0x82, 0xa5, 0x29, 0x0d, 0xd9, 0x75,
-	0x0f, 0x1f, 0x83, 0xf3, 0x21, 0x9e, 0x47, 0x82, 0xf1, 0xd4, 0x47, 0x6d, 0xab, 0xd3, 0xe8, 0xbd,
-	0xe8, 0x26, 0xe3, 0x6e, 0xb1, 0xa7, 0xbb, 0x6a, 0xe8, 0x47, 0x82, 0x2f, 0x49, 0xde, 0x8f, 0xdf,
-	0x42, 0xed, 0x94, 0xce, 0x43, 0x96, 0xfa, 0x15, 0x85, 0x3c, 0xd8, 0x42, 0xea, 0xb2, 0xc6, 0x65,
-	0xbd, 0xb8, 0x0b, 0xf6, 0x90, 0x89, 0xd4, 0xb7, 0x14, 0xa6, 0xb5, 0x85, 0x91, 0x45, 0x8d, 0x50,
-	0x7d, 0x72, 0xca, 0x68, 0x32, 0x93, 0xfa, 0xec, 0xbf, 0x4c, 0xd1, 0xe5, 0x6c, 0x8a, 0x0e, 0x5a,
-	0x17, 0xb0, 0x6b, 0xc8, 0xc6, 0x1e, 0x58, 0x5f, 0xd9, 0xd2, 0x47, 0x6d, 0xd4, 0x71, 0x89, 0x3c,
-	0xe2, 0x23, 0xa8, 0xde, 0xd1, 0xe9, 0x9c, 0xf9, 0x95, 0x36, 0xea, 0x34, 0x7a, 0x9e, 0xe4, 0xcd,
-	0x30, 0x23, 0x1a, 0x5e, 0xf7, 0x88, 0x2e, 0x1f, 0x57, 0xde, 0xa3, 0xd6, 0x00, 0x1a, 0x85, 0xbb,
-	0x94, 0x90, 0x1d, 0x9a, 0x64, 0x7b, 0x92, 0x4c, 0x21, 0xb6, 0xa8, 0xfa, 0xe0, 0xe6, 0x57, 0x2c,
-	0x21, 0x0a, 0x4c, 0xa2, 0xa6, 0x24, 0x1a, 0x32, 0x51, 0xa6, 0xa8, 0x70, 0xef, 0x07, 0x2a, 0x52,
-	0x88, 0x4d, 0xaa, 0xe0, 0x27, 0x82, 0x66, 0xf1, 0xe2, 0xca, 0x72, 0x1a, 0x5e, 0xd0, 0x24, 0xfb,
-	0x24, 0x0e, 0x36, 0xad, 0xe9, 0xea, 0xf2, 0xca, 0x72, 0x15, 0xb4, 0xce, 0xa1, 0x51, 0x48, 0x3f,
-	0xd0, 0x70, 0x42, 0x17, 0x19, 0xb1, 0xa9, 0xe9, 0x07, 0x02, 0x58, 0xfb, 0x87, 0x7b, 0x1b, 0x8a,
-	0x5a, 0xa6, 0xbf, 0xa5, 0x7a, 0x06, 0xf7, 0xe9, 0x29, 0x73, 0x88, 0xd0, 0x85, 0xa2, 0x35, 0xd5,
-	0x7c, 0x47, 0xe0, 0xac, 0x96, 0x80, 0x5f, 0x6f, 0x68, 0xf1, 0x8b, 0x2b, 0x2a, 0x55, 0x72, 0x7a,
-	0x9f, 0x92, 0xb2, 0xa5, 0x13, 0xba, 0x18, 0x32, 0xb1, 0xed, 0xca, 0x7a, 0x87, 0xe5, 0xae, 0xac,
-	0xeb, 0xff, 0xd5, 0x15, 0x45, 0x6b, 0xaa, 0x19, 0xa9, 0xb7, 0x24, 0x5f, 0x1f, 0xc6, 0x60, 0x8f,
-	0x68, 0xa8, 0xdf, 0x11, 0x97, 0xa8, 0x33, 0x6e, 0x81, 0x73, 0x16, 0xa7, 0x22, 0xa2, 0x33, 0x4d,
-	0xe8, 0x92, 0x3c, 0xc6, 0xfb, 0x50, 0xbd, 0x56, 0x93, 0xac, 0x36, 0xea, 0x58, 0x44, 0x07, 0x01,
-	0x01, 0x58, 0x2f, 0xe1, 0xdf, 0x38, 0xd1, 0x9a, 0xd3, 0x59, 0xd9, 0xf9, 0x68, 0xc6, 0x67, 0x50,
-	0x53, 0x24, 0xfa, 0xc5, 0x72, 0x49, 0x16, 0x05, 0x77, 0x4a, 0x67, 0x66, 0xcb, 0xa3, 0x59, 0xdb,
-	0xd0, 0x18, 0xd2, 0x59, 0x32, 0x65, 0xca, 0xbe, 0x4c, 0x6d, 0x31, 0x55, 0x98, 0x2b, 0xdf, 0x3d,
-	0x94, 0xcf, 0xfd, 0x6d, 0x41, 0xbd, 0x7f, 0xc7, 0x22, 0x79, 0x97, 0x7d, 0xa8, 0x8e, 0x26, 0x62,
-	0xca, 0xb2, 0xfd, 0xe9, 0x40, 0x69, 0x61, 0xdf, 0x44, 0x36, 0x53, 0x9d, 0x71, 0x00, 0xcd, 0x8f,
-	0x54, 0xb0, 0x33, 0x9a, 0x24, 0x2c, 0x62, 0xb7, 0x99, 0xe5, 0x46, 0xce, 0xd0, 0x6b, 0x6f, 0xe8,
-	0x3d, 0x82, 0xbd, 0x93, 0x30, 0xe4, 0x2c, 0xa4, 0x62, 0x12, 0x47, 0xe7, 0x6c, 0xe9, 0x57, 0x55,
-	0xc7, 0x46, 0x56, 0xf6, 0x0d, 0xe3, 0x39, 0xbf, 0x61, 0xa3, 0x65, 0xc2, 0x2e, 0x25, 0x53, 0x4d,
-	0xf7, 0x99, 0xd9, 0xdc, 0xaf, 0xba, 0xe9, 0x97, 0xee, 0x1a, 0x5c, 0xf9, 0x8e, 0x9e, 0xbf, 0x8a,
-	0xf1, 0x3b, 0x70, 0xae, 0xf8, 0x24, 0xe6, 0x13, 0xb1, 0xf4, 0xdd, 0x36, 0xea, 0xec, 0xf5, 0x9e,
-	0xcb, 0x0f, 0x33, 0x33, 0x42, 0xff, 0xae, 0x1a, 0x48, 0xde, 0x8a, 0x5f, 0x82, 0x2d, 0x47, 0xfa,
-	0xa0, 0x20, 0x4f, 0x8b, 0x90, 0x93, 0x29, 0xe3, 0x42, 0x16, 0x89, 0x6a, 0x09, 0x0e, 0x61, 0xd7,
-	0x60, 0xc1, 0x00, 0xb5, 0xcb, 0x98, 0xcf, 0xe8, 0xd4, 0xdb, 0xc1, 0x75, 0xb0, 0x3e, 0xc5, 0x0b,
-	0x0f, 0x05, 0xc7, 0xe0, 0xe6, 0x40, 0xec, 0x80, 0x3d, 0x88, 0xbe, 0xc4, 0xde, 0x0e, 0x6e, 0x40,
-	0xfd, 0x33, 0xe5, 0xd1, 0x24, 0x0a, 0x3d, 0x84, 0x5d, 0xa8, 0xf6, 0x39, 0x8f, 0xb9, 0x57, 0x91,
-	0xf9, 0xe1, 0xfc, 0xe6, 0x86, 0xa5, 0xa9, 0x67, 0x8d, 0x6b, 0xea, 0x7f, 0xf8, 0xcd, 0x9f, 0x00,
-	0x00, 0x00, 0xff, 0xff, 0x08, 0x18, 0x8e, 0x08, 0x9c, 0x07, 0x00, 0x00,
+func init() { proto.RegisterFile("pb/gostatsd.proto", fileDescriptor_gostatsd_4b9c1ba07a616b1f) }
+
+var fileDescriptor_gostatsd_4b9c1ba07a616b1f = []byte{
+	// 697 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x55, 0x5f, 0x6f, 0xd3, 0x3e,
+	0x14, 0x9d, 0x9b, 0xf4, 0x4f, 0x6e, 0xbb, 0x29, 0x3f, 0x6b, 0x3f, 0x14, 0x2a, 0x34, 0x45, 0xd1,
+	0x34, 0x95, 0x97, 0x82, 0x0a, 0x48, 0x68, 0x6f, 0x13, 0x94, 0xad, 0x1a, 0x9b, 0x26, 0xb7, 0x1a,
+	0xcf, 0xee, 0x66, 0xa2, 0x8a, 0x36, 0x8e, 0x1c, 0x77, 0xa5, 0x1f, 0x80, 0x27, 0x9e, 0xe0, 0xcb,
+	0xf0, 0xf5, 0x90, 0xed, 0x34, 0x4d, 0xda, 0xa0, 0x6d, 0x82, 0xa7, 0xfa, 0xde, 0x7b, 0xee, 0xb9,
+	0xc7, 0xe7, 0x56, 0x0e, 0xfc, 0x17, 0x8f, 0x5f, 0x84, 0x3c, 0x91, 0x54, 0x26, 0xb7, 0xdd, 0x58,
+	0x70, 0xc9, 0x71, 0x25, 0x1e, 0x07, 0x3f, 0x6d, 0x68, 0x11, 0xba, 0xb8, 0x60, 0x49, 0x42, 0x43,
+	0x76, 0xdd, 0xc3, 0xc7, 0xd0, 0x78, 0xc7, 0xe7, 0x91, 0x64, 0x22, 0xf1, 0x90, 0x6f, 0x75, 0x9a,
+	0xbd, 0x83, 0x6e, 0x3c, 0xee, 0xe6, 0x31, 0xdd, 0x15, 0xa0, 0x1f, 0x49, 0xb1, 0x24, 0x19, 0x1e,
+	0xbf, 0x86, 0xda, 0x29, 0x9d, 0x87, 0x2c, 0xf1, 0x2a, 0xba, 0xf3, 0xd9, 0x56, 0xa7, 0x29, 0x9b,
+	0xbe, 0x14, 0x8b, 0xbb, 0x60, 0x0f, 0x99, 0x4c, 0x3c, 0x4b, 0xf7, 0xb4, 0xb7, 0x7a, 0x54, 0xd1,
+	0x74, 0x68, 0x9c, 0x9a, 0x32, 0x9a, 0xcc, 0x94, 0x3e, 0xfb, 0x0f, 0x53, 0x4c, 0x39, 0x9d, 0x62,
+	0x82, 0xf6, 0x05, 0xec, 0x16, 0x64, 0x63, 0x17, 0xac, 0x2f, 0x6c, 0xe9, 0x21, 0x1f, 0x75, 0x1c,
+	0xa2, 0x8e, 0xf8, 0x08, 0xaa, 0x77, 0x74, 0x3a, 0x67, 0x5e, 0xc5, 0x47, 0x9d, 0x66, 0xcf, 0x55,
+	0xbc, 0x69, 0xcf, 0x88, 0x86, 0xd7, 0x3d, 0x62, 0xca, 0xc7, 0x95, 0xb7, 0xa8, 0x3d, 0x80, 0x66,
+	0xee, 0x2e, 0x25, 0x64, 0x87, 0x45, 0xb2, 0x3d, 0x45, 0xa6, 0x3b, 0xb6, 0xa8, 0xfa, 0xe0, 0x64,
+	0x57, 0x2c, 0x21, 0x0a, 0x8a, 0x44, 0x2d, 0x45, 0x34, 0x64, 0xb2, 0x4c, 0x51, 0xee, 0xde, 0x0f,
+	0x54, 0xa4, 0x3b, 0x36, 0xa9, 0x82, 0x1f, 0x08, 0x5a, 0xf9, 0x8b, 0x6b, 0xcb, 0x69, 0x78, 0x41,
+	0x63, 0x0f, 0xad, 0x2d, 0xcf, 0x23, 0xba, 0xa6, 0xbc, 0xb2, 0x5c, 0x07, 0xed, 0x73, 0x68, 0xe6,
+	0xd2, 0x0f, 0x34, 0x9c, 0xd0, 0x45, 0x4a, 0x5c, 0xd4, 0xf4, 0x1d, 0x01, 0xac, 0xfd, 0xc3, 0xbd,
+	0x0d, 0x45, 0xed, 0xa2, 0xbf, 0xa5, 0x7a, 0x06, 0xf7, 0xe9, 0x29, 0x73, 0x88, 0xd0, 0x85, 0xa6,
+	0x2d, 0xaa, 0xf9, 0x86, 0xa0, 0xb1, 0x5a, 0x02, 0x7e, 0xb9, 0xa1, 0xc5, 0xcb, 0xaf, 0xa8, 0x54,
+	0xc9, 0xe9, 0x7d, 0x4a, 0xca, 0x96, 0x4e, 0xe8, 0x62, 0xc8, 0xe4, 0xb6, 0x2b, 0xeb, 0x1d, 0x96,
+	0xbb, 0xb2, 0xae, 0xff, 0x53, 0x57, 0x34, 0x6d, 0x51, 0x8d, 0x84, 0x56, 0x7e, 0x7d, 0x18, 0x83,
+	0x3d, 0xa2, 0xa1, 0x79, 0x47, 0x1c, 0xa2, 0xcf, 0xb8, 0x0d, 0x8d, 0x33, 0x9e, 0xc8, 0x88, 0xce,
+	0x0c, 0xa1, 0x43, 0xb2, 0x18, 0xef, 0x43, 0xf5, 0x5a, 0x4f, 0xb2, 0x7c, 0xd4, 0xb1, 0x88, 0x09,
+	0xf0, 0x01, 0xc0, 0x87, 0x29, 0xa7, 0xd2, 0x94, 0x6c, 0x1f, 0x75, 0x10, 0xc9, 0x65, 0x02, 0x02,
+	0xb0, 0x5e, 0xd2, 0xdf, 0xcd, 0x44, 0xe9, 0xcc, 0x80, 0x40, 0x63, 0x65, 0xf7, 0xa3, 0x19, 0x9f,
+	0x40, 0x4d, 0x93, 0x98, 0x17, 0xcd, 0x21, 0x69, 0x14, 0xdc, 0x01, 0xac, 0x6d, 0x7b, 0x34, 0xab,
+	0x0f, 0xcd, 0x21, 0x9d, 0xc5, 0x53, 0xa6, 0xed, 0x4d, 0xd5, 0xe6, 0x53, 0xb9, 0xb9, 0xea, 0x5d,
+	0x44, 0xd9, 0xdc, 0x5f, 0x16, 0xd4, 0xfb, 0x77, 0x2c, 0x52, 0x77, 0xd9, 0x87, 0xea, 0x68, 0x22,
+	0xa7, 0x2c, 0xdd, 0xaf, 0x09, 0xb4, 0x16, 0xf6, 0x55, 0xa6, 0x33, 0xf5, 0x19, 0x07, 0xd0, 0x7a,
+	0x4f, 0x25, 0x3b, 0xa3, 0x71, 0xcc, 0x22, 0x76, 0x9b, 0xae, 0xa4, 0x90, 0x2b, 0xe8, 0xb5, 0x37,
+	0xf4, 0x1e, 0xc1, 0xde, 0x49, 0x18, 0x0a, 0x16, 0x52, 0x39, 0xe1, 0xd1, 0x39, 0x5b, 0x7a, 0x55,
+	0x8d, 0xd8, 0xc8, 0x2a, 0xdc, 0x90, 0xcf, 0xc5, 0x0d, 0x1b, 0x2d, 0x63, 0x76, 0xa9, 0x98, 0x6a,
+	0x06, 0x57, 0xcc, 0x66, 0x7e, 0xd5, 0x8b, 0x7e, 0x19, 0xd4, 0xe0, 0xca, 0x6b, 0x98, 0xf9, 0xab,
+	0x18, 0xbf, 0x81, 0xc6, 0x95, 0x98, 0x70, 0x31, 0x91, 0x4b, 0xcf, 0xf1, 0x51, 0x67, 0xaf, 0xf7,
+	0x54, 0xfd, 0x71, 0x53, 0x23, 0xcc, 0xef, 0x0a, 0x40, 0x32, 0x28, 0x7e, 0x0e, 0xb6, 0x1a, 0xe9,
+	0x81, 0x6e, 0xf9, 0x3f, 0xdf, 0x72, 0x32, 0x65, 0x42, 0xaa, 0x22, 0xd1, 0x90, 0xe0, 0x10, 0x76,
+	0x0b, 0x2c, 0x18, 0xa0, 0x76, 0xc9, 0xc5, 0x8c, 0x4e, 0xdd, 0x1d, 0x5c, 0x07, 0xeb, 0x23, 0x5f,
+	0xb8, 0x28, 0x38, 0x06, 0x27, 0x6b, 0xc4, 0x0d, 0xb0, 0x07, 0xd1, 0x67, 0xee, 0xee, 0xe0, 0x26,
+	0xd4, 0x3f, 0x51, 0x11, 0x4d, 0xa2, 0xd0, 0x45, 0xd8, 0x81, 0x6a, 0x5f, 0x08, 0x2e, 0xdc, 0x8a,
+	0xca, 0x0f, 0xe7, 0x37, 0x37, 0x2c, 0x49, 0x5c, 0x6b, 0x5c, 0xd3, 0xdf, 0xe9, 0x57, 0xbf, 0x07,
+	0x00, 0x97, 0xe5, 0xb5, 0x7c, 0xbc, 0x07, 0x00, 0x00,
 }
@@ -0,0 +1,130 @@
+package pb
+
+import (
+	"github.com/atlassian/gostatsd"
+)
+
+// FromMetricMap converts a MetricMap to a RawMessageV2.
+func FromMetricMap(metricMap *gostatsd.MetricMap) *RawMessageV2 {
+	var pbMetricMap RawMessageV2
+
+	pbMetricMap.Gauges = map[string]*GaugeTagV2{}
+	for metricName, m := range metricMap.Gauges {
+		pbMetricMap.Gauges[metricName] = &GaugeTagV2{TagMap: map[string]*RawGaugeV2{}}
+		for tagsKey, metric := range m {
+			pbMetricMap.Gauges[metricName].TagMap[tagsKey] = &RawGaugeV2{
+				Tags:     metric.Tags,
+				Hostname: metric.Hostname,
+				Value:    metric.Value,
+			}
+		}
+	}
+
+	pbMetricMap.Counters = map[string]*CounterTagV2{}
+	for metricName, m := range metricMap.Counters {
+		pbMetricMap.Counters[metricName] = &CounterTagV2{TagMap: map[string]*RawCounterV2{}}
+		for tagsKey, metric := range m {
+			pbMetricMap.Counters[metricName].TagMap[tagsKey] = &RawCounterV2{
+				Tags:       metric.Tags,
+				Hostname:   metric.Hostname,
+				Value:      int64(metric.Value), // for aggregators which predate FloatValue
+				FloatValue: metric.Value,
+			}
+		}
+	}
+
+	pbMetricMap.Sets = map[string]*SetTagV2{}
+	for metricName, m := range metricMap.Sets {
+		pbMetricMap.Sets[metricName] = &SetTagV2{TagMap: map[string]*RawSetV2{}}
+		for tagsKey, metric := range m {
+			var values []string
+			for key := range metric.Values {
+				values = append(values, key)
+			}
+			pbMetricMap.Sets[metricName].TagMap[tagsKey] = &RawSetV2{
+				Tags:     metric.Tags,
+				Hostname: metric.Hostname,
+				Values:   values,
+			}
+		}
+	}
+
+	pbMetricMap.Timers = map[string]*TimerTagV2{}
+	for metricName, m := range metricMap.Timers {
+		pbMetricMap.Timers[metricName] = &TimerTagV2{TagMap: map[string]*RawTimerV2{}}
+		for tagsKey, metric := range m {
+			pbMetricMap.Timers[metricName].TagMap[tagsKey] = &RawTimerV2{
+				Tags:        metric.Tags,
+				Hostname:    metric.Hostname,
+				SampleCount: metric.SampledCount,
+				Values:      metric.Values,
+			}
+		}
+	}
+
+	return &pbMetricMap
+}
+
+// ToMetricMap converts a RawMessageV2 to a MetricMap, with now as the timestamp of every metric.
+func ToMetricMap(pbMetricMap *RawMessageV2, now gostatsd.Nanotime) *gostatsd.MetricMap {
+	mm := gostatsd.NewMetricMap()
+
+	for metricName, tagMap := range pbMetricMap.Gauges {
+		mm.Gauges[metricName] = map[string]gostatsd.Gauge{}
+		for tagsKey, gauge := range tagMap.TagMap {
+			mm.Gauges[metricName][tagsKey] = gostatsd.Gauge{
+				Value:     gauge.Value,
+				Timestamp: now,
+				Hostname:  gauge.Hostname,
+				Tags:      gauge.Tags,
+			}
+		}
+	}
+
+	for metricName, tagMap := range pbMetricMap.Counters {
+		mm.Counters[metricName] = map[string]gostatsd.Counter{}
+		for tagsKey, counter := range tagMap.TagMap {
+			value := counter.FloatValue
+			if value == 0 {
+				// Sent by a forwarder which predates FloatValue
+				value = float64(counter.Value)
+			}
+			mm.Counters[metricName][tagsKey] = gostatsd.Counter{
+				Value:     value,
+				Timestamp: now,
+				Tags:      counter.Tags,
+				Hostname:  counter.Hostname,
+			}
+		}
+	}
+
+	for metricName, tagMap := range pbMetricMap.Timers {
+		mm.Timers[metricName] = map[string]gostatsd.Timer{}
+		for tagsKey, timer := range tagMap.TagMap {
+			mm.Timers[metricName][tagsKey] = gostatsd.Timer{
+				Values:       timer.Values,
+				Timestamp:    now,
+				Tags:         timer.Tags,
+				Hostname:     timer.Hostname,
+				SampledCount: timer.SampleCount,
+			}
+		}
+	}
+
+	for metricName, tagMap := range pbMetricMap.Sets {
+		mm.Sets[metricName] = map[string]gostatsd.Set{}
+		for tagsKey, set := range tagMap.TagMap {
+			mm.Sets[metricName][tagsKey] = gostatsd.Set{
+				Values:    map[string]struct{}{},
+				Timestamp: now,
+				Tags:      set.Tags,
+				Hostname:  set.Hostname,
+			}
+			for _, value := range set.Values {
+				mm.Sets[metricName][tagsKey].Values[value] = struct{}{}
+			}
+		}
+	}
+
+	return mm
+}
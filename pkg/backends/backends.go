@@ -2,6 +2,7 @@ package backends
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/backends/cloudwatch"
@@ -40,21 +41,56 @@ func GetBackend(name string, v *viper.Viper) (gostatsd.Backend, error) {
 	return f(v)
 }
 
-// InitBackend creates an instance of the named backend.
+// InitBackend creates an instance of the named backend.  The name is either a backend type, configured in the section
+// named after the type, or a named instance of a backend type in the form <type>:<instance>, configured in the section
+// with the whole name.
 func InitBackend(name string, v *viper.Viper) (gostatsd.Backend, error) {
 	if name == "" {
 		log.Info("No backend specified")
 		return nil, nil
 	}
 
-	backend, err := GetBackend(name, v)
+	backendType := name
+	vBackend := v
+	if idx := strings.IndexByte(name, ':'); idx >= 0 {
+		backendType = name[:idx]
+		if backendType == "" || idx == len(name)-1 {
+			return nil, fmt.Errorf("invalid backend instance %q, must be <type>:<instance>", name)
+		}
+		vBackend = instanceViper(v, backendType, name)
+	}
+
+	backend, err := GetBackend(backendType, vBackend)
 	if err != nil {
 		return nil, fmt.Errorf("could not init backend %q: %v", name, err)
 	}
 	if backend == nil {
 		return nil, fmt.Errorf("unknown backend %q", name)
 	}
+	if backendType != name {
+		backend = newInstance(backend, name)
+	}
 	log.Infof("Initialised backend %q", name)
 
 	return backend, nil
 }
+
+// globalBackendSettings are the settings outside of its own section which a backend may read.
+var globalBackendSettings = []string{
+	"disabled-sub-metrics",
+	"flush-interval",
+	"statser-type",
+}
+
+// instanceViper returns a viper with only the section for the instance, which is moved to the section for backendType
+// as backends read their configuration from the section named after their type, and the globalBackendSettings.
+func instanceViper(v *viper.Viper, backendType, instanceName string) *viper.Viper {
+	vInstance := viper.New()
+	vInstance.Set(backendType, v.GetStringMap(instanceName))
+	for _, key := range globalBackendSettings {
+		if v.IsSet(key) {
+			vInstance.Set(key, v.Get(key))
+		}
+	}
+	return vInstance
+}
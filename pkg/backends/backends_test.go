@@ -0,0 +1,159 @@
+package backends
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type addressBackend struct {
+	address string
+	tags    gostatsd.Tags
+}
+
+func (ab *addressBackend) Name() string {
+	return "address"
+}
+
+func (ab *addressBackend) Run(ctx context.Context) {
+	stats.FromContext(ctx).Increment("run", nil)
+}
+
+func (ab *addressBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, intervalStart time.Time, callback gostatsd.SendCallback) {
+	stats.FromContext(ctx).Increment("send", nil)
+	callback(nil)
+}
+
+func (ab *addressBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	stats.FromContext(ctx).Increment("event", nil)
+	return nil
+}
+
+type tagCapturingStatser struct {
+	stats.NullStatser
+	tags gostatsd.Tags
+}
+
+func (tcs *tagCapturingStatser) WithTags(tags gostatsd.Tags) stats.Statser {
+	tcs.tags = append(tcs.tags, tags...)
+	return tcs
+}
+
+// Not parallel, as it registers a backend type
+func TestInitBackendInstances(t *testing.T) {
+	var settings []map[string]interface{}
+	backends["address"] = func(v *viper.Viper) (gostatsd.Backend, error) {
+		settings = append(settings, v.AllSettings())
+		return &addressBackend{address: v.Sub("address").GetString("address")}, nil
+	}
+	defer delete(backends, "address")
+
+	v := viper.New()
+	v.Set("address.address", "default")
+	v.Set("address:primary.address", "primary")
+	v.Set("address:dr.address", "dr")
+	v.Set("disabled-sub-metrics.lower", true)
+	v.Set("flush-interval", "10s")
+	v.Set("unrelated", "setting")
+
+	backend, err := InitBackend("address", v)
+	require.NoError(t, err)
+	assert.Equal(t, "address", backend.Name())
+	assert.Equal(t, "default", backend.(*addressBackend).address)
+
+	for _, name := range []string{"address:primary", "address:dr"} {
+		backend, err = InitBackend(name, v)
+		require.NoError(t, err)
+		assert.Equal(t, name, backend.Name())
+		ri, ok := backend.(*runnerInstance)
+		require.True(t, ok, "instance must still be a Runner")
+		assert.Equal(t, name[len("address:"):], ri.Backend.(*addressBackend).address)
+
+		// Every statser the instance is given is tagged
+		statser := &tagCapturingStatser{}
+		ctx := stats.NewContext(context.Background(), statser)
+		ri.Run(ctx)
+		ri.SendMetricsAsync(ctx, gostatsd.NewMetricMap(), time.Unix(1, 0), func([]error) {})
+		assert.NoError(t, ri.SendEvent(ctx, &gostatsd.Event{}))
+		tag := "backend_instance:" + name
+		assert.Equal(t, gostatsd.Tags{tag, tag, tag}, statser.tags)
+
+		// The instance only sees its own section, and the global settings backends use
+		assert.Equal(t, map[string]interface{}{
+			"address":              map[string]interface{}{"address": name[len("address:"):]},
+			"disabled-sub-metrics": map[string]interface{}{"lower": true},
+			"flush-interval":       "10s",
+		}, settings[len(settings)-1])
+	}
+	assert.Equal(t, "default", v.Sub("address").GetString("address"))
+
+	for _, name := range []string{"unknown:x", ":x", "address:"} {
+		_, err = InitBackend(name, v)
+		assert.Error(t, err, name)
+	}
+}
+
+// seriesIntervals returns a server which sends the interval of each series posted to it to the returned channel.
+func seriesIntervals(t *testing.T) (*httptest.Server, <-chan float64) {
+	intervals := make(chan float64, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Series []struct {
+				Interval float64 `json:"interval"`
+			} `json:"series"`
+		}
+		if assert.NoError(t, json.NewDecoder(r.Body).Decode(&body)) {
+			for _, series := range body.Series {
+				intervals <- series.Interval
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	return ts, intervals
+}
+
+func TestInitBackendInstanceFlushInterval(t *testing.T) {
+	t.Parallel()
+	ts, intervals := seriesIntervals(t)
+	defer ts.Close()
+
+	v := viper.New()
+	v.Set("flush-interval", "10s")
+	v.Set("datadog:primary.api_endpoint", ts.URL)
+	v.Set("datadog:primary.api_key", "key")
+	v.Set("datadog:primary.compress_payload", false)
+	backend, err := InitBackend("datadog:primary", v)
+	require.NoError(t, err)
+
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["c"] = map[string]gostatsd.Counter{"": {Value: 1, PerSecond: 0.1}}
+	errs := make(chan []error, 1)
+	backend.SendMetricsAsync(context.Background(), mm, time.Unix(100, 0), func(e []error) {
+		errs <- e
+	})
+	for _, err := range <-errs {
+		require.NoError(t, err)
+	}
+	require.NotEmpty(t, intervals)
+	for len(intervals) > 0 {
+		assert.Equal(t, 10.0, <-intervals, "an instance should use the top level flush-interval")
+	}
+}
+
+func TestInstanceOfNonRunner(t *testing.T) {
+	t.Parallel()
+	backend := newInstance(struct{ gostatsd.Backend }{&addressBackend{}}, "null:a")
+	_, ok := backend.(*instance)
+	assert.True(t, ok)
+	assert.Equal(t, "null:a", backend.Name())
+}
@@ -84,11 +84,10 @@ func extractDimensions(tags gostatsd.Tags) (dimensions []*cloudwatch.Dimension)
 	return dimensions
 }
 
-func (client Client) buildMetricData(metrics *gostatsd.MetricMap) (metricData []*cloudwatch.MetricDatum) {
+func (client Client) buildMetricData(metrics *gostatsd.MetricMap, now time.Time) (metricData []*cloudwatch.MetricDatum) {
 	disabled := client.disabledSubtypes
 
 	metricData = []*cloudwatch.MetricDatum{}
-	now := time.Now()
 	prefix := ""
 
 	addMetricData := func(key string, unit string, value float64, tags gostatsd.Tags) {
@@ -106,7 +105,7 @@ func (client Client) buildMetricData(metrics *gostatsd.MetricMap) (metricData []
 
 	prefix = "stats.counter."
 	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
-		addMetricData(key+".count", "Count", float64(counter.Value), counter.Tags)
+		addMetricData(key+".count", "Count", counter.Value, counter.Tags)
 		addMetricData(key+".per_second", "Count/Second", counter.PerSecond, counter.Tags)
 	})
 
@@ -159,9 +158,9 @@ func (client Client) buildMetricData(metrics *gostatsd.MetricMap) (metricData []
 
 // SendMetricsAsync sends the metrics in a MetricsMap to AWS Cloudwatch,
 // preparing payload synchronously but doing the send asynchronously.
-func (client Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+func (client Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, intervalStart time.Time, cb gostatsd.SendCallback) {
 	api := client.cloudwatch
-	metricData := client.buildMetricData(metrics)
+	metricData := client.buildMetricData(metrics, intervalStart)
 	length := len(metricData)
 	errors := []error{}
 
@@ -3,6 +3,7 @@ package cloudwatch
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/atlassian/gostatsd"
 
@@ -69,7 +70,7 @@ func TestSendMetrics(t *testing.T) {
 	}
 
 	res := make(chan []error, 1)
-	cli.SendMetricsAsync(context.Background(), metricsOneOfEach(), func(errs []error) {
+	cli.SendMetricsAsync(context.Background(), metricsOneOfEach(), time.Now(), func(errs []error) {
 		res <- errs
 	})
 	errs := <-res
@@ -122,7 +123,7 @@ func TestSendMetricDimensions(t *testing.T) {
 	}
 
 	res := make(chan []error, 1)
-	cli.SendMetricsAsync(context.Background(), metricMap, func(errs []error) {
+	cli.SendMetricsAsync(context.Background(), metricMap, time.Now(), func(errs []error) {
 		res <- errs
 	})
 	errs := <-res
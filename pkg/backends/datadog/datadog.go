@@ -69,7 +69,6 @@ type Client struct {
 	metricsPerBatch       uint
 	metricsBufferSem      chan *bytes.Buffer // Two in one - a semaphore and a buffer pool
 	eventsBufferSem       chan *bytes.Buffer // Two in one - a semaphore and a buffer pool
-	now                   func() time.Time   // Returns current time. Useful for testing.
 	compressPayload       bool
 
 	disabledSubtypes gostatsd.TimerSubtypes
@@ -90,10 +89,10 @@ type event struct {
 }
 
 // SendMetricsAsync flushes the metrics to Datadog, preparing payload synchronously but doing the send asynchronously.
-func (d *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+func (d *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, intervalStart time.Time, cb gostatsd.SendCallback) {
 	counter := 0
 	results := make(chan error)
-	d.processMetrics(metrics, func(ts *timeSeries) {
+	d.processMetrics(metrics, intervalStart, func(ts *timeSeries) {
 		// This section would be likely be better if it pushed all ts's in to a single channel
 		// which n goroutines then read from.  Current behavior still spins up many goroutines
 		// and has them all hit the same channel.
@@ -152,12 +151,12 @@ func (d *Client) Run(ctx context.Context) {
 	}
 }
 
-func (d *Client) processMetrics(metrics *gostatsd.MetricMap, cb func(*timeSeries)) {
+func (d *Client) processMetrics(metrics *gostatsd.MetricMap, intervalStart time.Time, cb func(*timeSeries)) {
 	fl := flush{
 		ts: &timeSeries{
 			Series: make([]metric, 0, d.metricsPerBatch),
 		},
-		timestamp:        float64(d.now().Unix()),
+		timestamp:        float64(intervalStart.Unix()),
 		flushIntervalSec: d.flushInterval.Seconds(),
 		metricsPerBatch:  d.metricsPerBatch,
 		cb:               cb,
@@ -165,7 +164,7 @@ func (d *Client) processMetrics(metrics *gostatsd.MetricMap, cb func(*timeSeries
 
 	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
 		fl.addMetric(rate, counter.PerSecond, counter.Hostname, counter.Tags, key)
-		fl.addMetricf(gauge, float64(counter.Value), counter.Hostname, counter.Tags, "%s.count", key)
+		fl.addMetricf(gauge, counter.Value, counter.Hostname, counter.Tags, "%s.count", key)
 		fl.maybeFlush()
 	})
 
@@ -359,6 +358,13 @@ func NewClientFromViper(v *viper.Viper) (gostatsd.Backend, error) {
 	dd.SetDefault("enable-http2", defaultEnableHttp2)
 	dd.SetDefault("user-agent", defaultUserAgent)
 
+	// A backend with its own flush interval is sent rollups of that interval, otherwise it is flushed every
+	// flush-interval of the main viper.
+	flushInterval := v.GetDuration("flush-interval")
+	if dd.IsSet("flush-interval") {
+		flushInterval = dd.GetDuration("flush-interval")
+	}
+
 	return NewClient(
 		dd.GetString("api_endpoint"),
 		dd.GetString("api_key"),
@@ -370,7 +376,7 @@ func NewClientFromViper(v *viper.Viper) (gostatsd.Backend, error) {
 		dd.GetBool("enable-http2"),
 		dd.GetDuration("client_timeout"),
 		dd.GetDuration("max_request_elapsed_time"),
-		v.GetDuration("flush-interval"), // Main viper, not sub-viper
+		flushInterval,
 		gostatsd.DisabledSubMetrics(v),
 	)
 }
@@ -445,7 +451,6 @@ func NewClient(apiEndpoint, apiKey, userAgent, network string, metricsPerBatch i
 		metricsBufferSem: metricsBufferSem,
 		eventsBufferSem:  eventsBufferSem,
 		compressPayload:  compressPayload,
-		now:              time.Now,
 		flushInterval:    flushInterval,
 		disabledSubtypes: disabled,
 	}, nil
@@ -13,6 +13,7 @@ import (
 
 	"github.com/atlassian/gostatsd"
 
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -40,7 +41,7 @@ func TestRetries(t *testing.T) {
 	client, err := NewClient(ts.URL, "apiKey123", "agent", "tcp", defaultMetricsPerBatch, defaultMaxRequests, true, false, 1*time.Second, 2*time.Second, 1*time.Second, gostatsd.TimerSubtypes{})
 	require.NoError(t, err)
 	res := make(chan []error, 1)
-	client.SendMetricsAsync(context.Background(), twoCounters(), func(errs []error) {
+	client.SendMetricsAsync(context.Background(), twoCounters(), time.Now(), func(errs []error) {
 		res <- errs
 	})
 	errs := <-res
@@ -69,7 +70,7 @@ func TestSendMetricsInMultipleBatches(t *testing.T) {
 	client, err := NewClient(ts.URL, "apiKey123", "agent", "tcp", 1, defaultMaxRequests, true, false, 1*time.Second, 2*time.Second, 1*time.Second, gostatsd.TimerSubtypes{})
 	require.NoError(t, err)
 	res := make(chan []error, 1)
-	client.SendMetricsAsync(context.Background(), twoCounters(), func(errs []error) {
+	client.SendMetricsAsync(context.Background(), twoCounters(), time.Now(), func(errs []error) {
 		res <- errs
 	})
 	errs := <-res
@@ -118,11 +119,8 @@ func TestSendMetrics(t *testing.T) {
 
 	cli, err := NewClient(ts.URL, "apiKey123", "agent", "tcp", 1000, defaultMaxRequests, true, false, 1*time.Second, 2*time.Second, 1100*time.Millisecond, gostatsd.TimerSubtypes{})
 	require.NoError(t, err)
-	cli.now = func() time.Time {
-		return time.Unix(100, 0)
-	}
 	res := make(chan []error, 1)
-	cli.SendMetricsAsync(context.Background(), metricsOneOfEach(), func(errs []error) {
+	cli.SendMetricsAsync(context.Background(), metricsOneOfEach(), time.Unix(100, 0), func(errs []error) {
 		res <- errs
 	})
 	errs := <-res
@@ -196,3 +194,20 @@ func metricsOneOfEach() *gostatsd.MetricMap {
 		},
 	}
 }
+
+func TestNewClientFromViperFlushInterval(t *testing.T) {
+	t.Parallel()
+	for _, backendInterval := range []string{"", "60s"} {
+		v := viper.New()
+		v.Set("flush-interval", "10s")
+		v.Set("datadog.api_key", "key")
+		expected := 10 * time.Second
+		if backendInterval != "" {
+			v.Set("datadog.flush-interval", backendInterval)
+			expected = time.Minute // Rolled up, so each send covers the backend's own interval
+		}
+		backend, err := NewClientFromViper(v)
+		require.NoError(t, err)
+		assert.Equal(t, expected, backend.(*Client).flushInterval)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"regexp"
+	"strconv"
 	"sync"
 	"time"
 
@@ -84,8 +85,8 @@ func (client *Client) Run(ctx context.Context) {
 }
 
 // SendMetricsAsync flushes the metrics to the Graphite server, preparing payload synchronously but doing the send asynchronously.
-func (client *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
-	buf := client.preparePayload(metrics, time.Now())
+func (client *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, intervalStart time.Time, cb gostatsd.SendCallback) {
+	buf := client.preparePayload(metrics, intervalStart)
 	sink := make(chan *bytes.Buffer, 1)
 	sink <- buf
 	close(sink)
@@ -103,14 +104,14 @@ func (client *Client) preparePayload(metrics *gostatsd.MetricMap, ts time.Time)
 	if client.legacyNamespace {
 		metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
 			k := sk(key)
-			fmt.Fprintf(buf, "stats_counts.%s%s %d %d\n", k, client.globalSuffix, counter.Value, now)                   // #nosec
+			fmt.Fprintf(buf, "stats_counts.%s%s %s %d\n", k, client.globalSuffix, fv(counter.Value), now)               // #nosec
 			fmt.Fprintf(buf, "%s%s%s %f %d\n", client.counterNamespace, k, client.globalSuffix, counter.PerSecond, now) // #nosec
 		})
 	} else {
 		metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
 			k := sk(key)
-			fmt.Fprintf(buf, "%s%s.count%s %d %d\n", client.counterNamespace, k, client.globalSuffix, counter.Value, now)    // #nosec
-			fmt.Fprintf(buf, "%s%s.rate%s %f %d\n", client.counterNamespace, k, client.globalSuffix, counter.PerSecond, now) // #nosec
+			fmt.Fprintf(buf, "%s%s.count%s %s %d\n", client.counterNamespace, k, client.globalSuffix, fv(counter.Value), now) // #nosec
+			fmt.Fprintf(buf, "%s%s.rate%s %f %d\n", client.counterNamespace, k, client.globalSuffix, counter.PerSecond, now)  // #nosec
 		})
 	}
 	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
@@ -283,6 +284,11 @@ func sk(s string) []byte {
 	return regNonAlphaNum.ReplaceAllLiteral(r2, nil)
 }
 
+// fv formats a float without an exponent or trailing zeros, so integral values render as integers.
+func fv(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
 func addr(s string) *string {
 	return &s
 }
@@ -0,0 +1,62 @@
+package backends
+
+import (
+	"context"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+// instance is a named instance of a backend type, so that more than one backend of the same type can be configured.
+type instance struct {
+	gostatsd.Backend
+	name string
+}
+
+// runnerInstance is an instance of a backend which is a gostatsd.Runner.
+type runnerInstance struct {
+	instance
+	runner gostatsd.Runner
+}
+
+// newInstance wraps backend so it is identified by name, and its internal metrics are tagged with the name.
+func newInstance(backend gostatsd.Backend, name string) gostatsd.Backend {
+	i := instance{
+		Backend: backend,
+		name:    name,
+	}
+	if runner, ok := backend.(gostatsd.Runner); ok {
+		return &runnerInstance{
+			instance: i,
+			runner:   runner,
+		}
+	}
+	return &i
+}
+
+// Name returns the name of the instance.
+func (i *instance) Name() string {
+	return i.name
+}
+
+// SendMetricsAsync sends the metrics to the backend, with internal metrics tagged with the name of the instance.
+func (i *instance) SendMetricsAsync(ctx context.Context, mm *gostatsd.MetricMap, intervalStart time.Time, cb gostatsd.SendCallback) {
+	i.Backend.SendMetricsAsync(i.context(ctx), mm, intervalStart, cb)
+}
+
+// SendEvent sends the event to the backend, with internal metrics tagged with the name of the instance.
+func (i *instance) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return i.Backend.SendEvent(i.context(ctx), e)
+}
+
+// context returns ctx with its Statser tagged with the name of the instance.
+func (i *instance) context(ctx context.Context) context.Context {
+	statser := stats.FromContext(ctx).WithTags(gostatsd.Tags{"backend_instance:" + i.name})
+	return stats.NewContext(ctx, statser)
+}
+
+// Run runs the backend, with internal metrics tagged with the name of the instance.
+func (ri *runnerInstance) Run(ctx context.Context) {
+	ri.runner.Run(ri.context(ctx))
+}
@@ -83,7 +83,6 @@ type Client struct {
 	client                http.Client
 	metricsPerBatch       uint
 	metricsBufferSem      chan *bytes.Buffer // Two in one - a semaphore and a buffer pool
-	now                   func() time.Time   // Returns current time. Useful for testing.
 
 	disabledSubtypes gostatsd.TimerSubtypes
 	flushInterval    time.Duration
@@ -98,11 +97,11 @@ type NewRelicInfraPayload struct {
 }
 
 // SendMetricsAsync flushes the metrics to New Relic, preparing payload synchronously but doing the send asynchronously.
-func (n *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+func (n *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, intervalStart time.Time, cb gostatsd.SendCallback) {
 
 	counter := 0
 	results := make(chan error)
-	n.processMetrics(metrics, func(ts *timeSeries) {
+	n.processMetrics(metrics, intervalStart, func(ts *timeSeries) {
 		// This section would be likely be better if it pushed all ts's in to a single channel
 		// which n goroutines then read from.  Current behavior still spins up many goroutines
 		// and has them all hit the same channel.
@@ -161,12 +160,12 @@ func (n *Client) RunMetrics(ctx context.Context, statser stats.Statser) {
 	}
 }
 
-func (n *Client) processMetrics(metrics *gostatsd.MetricMap, cb func(*timeSeries)) {
+func (n *Client) processMetrics(metrics *gostatsd.MetricMap, intervalStart time.Time, cb func(*timeSeries)) {
 	fl := flush{
 		ts: &timeSeries{
 			Metrics: make([]interface{}, 0, n.metricsPerBatch),
 		},
-		timestamp:        float64(n.now().Unix()),
+		timestamp:        float64(intervalStart.Unix()),
 		flushIntervalSec: n.flushInterval.Seconds(),
 		metricsPerBatch:  n.metricsPerBatch,
 		cb:               cb,
@@ -178,7 +177,7 @@ func (n *Client) processMetrics(metrics *gostatsd.MetricMap, cb func(*timeSeries
 	})
 
 	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
-		fl.addMetric(n, "counter", float64(counter.Value), counter.PerSecond, counter.Hostname, counter.Tags, key, counter.Timestamp)
+		fl.addMetric(n, "counter", counter.Value, counter.PerSecond, counter.Hostname, counter.Tags, key, counter.Timestamp)
 		fl.maybeFlush()
 	})
 
@@ -342,6 +341,13 @@ func NewClientFromViper(v *viper.Viper) (gostatsd.Backend, error) {
 		log.Infof("[%s] internal metrics OFF, to enable set 'statser-type' to 'logging' or 'internal'", BackendName)
 	}
 
+	// A backend with its own flush interval is sent rollups of that interval, otherwise it is flushed every
+	// flush-interval of the main viper.
+	flushInterval := v.GetDuration("flush-interval")
+	if nr.IsSet("flush-interval") {
+		flushInterval = nr.GetDuration("flush-interval")
+	}
+
 	return NewClient(
 		nr.GetString("address"),
 		nr.GetString("event-type"),
@@ -367,7 +373,7 @@ func NewClientFromViper(v *viper.Viper) (gostatsd.Backend, error) {
 		nr.GetBool("enable-http2"),
 		nr.GetDuration("client-timeout"),
 		nr.GetDuration("max-request-elapsed-time"),
-		v.GetDuration("flush-interval"), // Main viper, not sub-viper
+		flushInterval,
 		gostatsd.DisabledSubMetrics(v),
 	)
 }
@@ -461,7 +467,6 @@ func NewClient(address, eventType, flushType, apiKey, tagPrefix,
 		},
 		metricsPerBatch:  uint(metricsPerBatch),
 		metricsBufferSem: metricsBufferSem,
-		now:              time.Now,
 		flushInterval:    flushInterval,
 		disabledSubtypes: disabled,
 	}, nil
@@ -11,6 +11,7 @@ import (
 
 	"github.com/atlassian/gostatsd"
 
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -42,7 +43,7 @@ func TestRetries(t *testing.T) {
 
 	require.NoError(t, err)
 	res := make(chan []error, 1)
-	client.SendMetricsAsync(context.Background(), twoCounters(), func(errs []error) {
+	client.SendMetricsAsync(context.Background(), twoCounters(), time.Now(), func(errs []error) {
 		res <- errs
 	})
 	errs := <-res
@@ -74,7 +75,7 @@ func TestSendMetricsInMultipleBatches(t *testing.T) {
 		1, defaultMaxRequests, false, 1*time.Second, 2*time.Second, 1*time.Second, gostatsd.TimerSubtypes{})
 	require.NoError(t, err)
 	res := make(chan []error, 1)
-	client.SendMetricsAsync(context.Background(), twoCounters(), func(errs []error) {
+	client.SendMetricsAsync(context.Background(), twoCounters(), time.Now(), func(errs []error) {
 		res <- errs
 	})
 	errs := <-res
@@ -109,11 +110,8 @@ func TestSendMetrics(t *testing.T) {
 		defaultMetricsPerBatch, defaultMaxRequests, false, 1*time.Second, 2*time.Second, 1*time.Second, gostatsd.TimerSubtypes{})
 
 	require.NoError(t, err)
-	client.now = func() time.Time {
-		return time.Unix(100, 0)
-	}
 	res := make(chan []error, 1)
-	client.SendMetricsAsync(context.Background(), metricsOneOfEach(), func(errs []error) {
+	client.SendMetricsAsync(context.Background(), metricsOneOfEach(), time.Unix(100, 0), func(errs []error) {
 		res <- errs
 	})
 	errs := <-res
@@ -186,3 +184,19 @@ func metricsOneOfEach() *gostatsd.MetricMap {
 		},
 	}
 }
+
+func TestNewClientFromViperFlushInterval(t *testing.T) {
+	t.Parallel()
+	for _, backendInterval := range []string{"", "60s"} {
+		v := viper.New()
+		v.Set("flush-interval", "10s")
+		expected := 10 * time.Second
+		if backendInterval != "" {
+			v.Set("newrelic.flush-interval", backendInterval)
+			expected = time.Minute // Rolled up, so each send covers the backend's own interval
+		}
+		backend, err := NewClientFromViper(v)
+		require.NoError(t, err)
+		assert.Equal(t, expected, backend.(*Client).flushInterval)
+	}
+}
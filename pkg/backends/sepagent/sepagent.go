@@ -82,9 +82,9 @@ func (Client) Name() string {
 // Must not read/write MetricMap asynchronously.
 // NOTE: in this implementation "sepagent backend", the send is done
 // syncrhonously (is just UDP)
-func (client Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+func (client Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, intervalStart time.Time, cb gostatsd.SendCallback) {
 	log.Infof("[%s] SendMetricsAsync", BackendName)
-	now := time.Now().Unix()
+	now := intervalStart.Unix()
 	errs := make([]error, 0, 10)
 	s := client.sepastats
 	u := client.udpclient
@@ -92,7 +92,7 @@ func (client Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.Met
 
 	metrics.Counters.Each(func(key string, tagsKey string, counter gostatsd.Counter) {
 		if s.IsSep(key) {
-			if err := s.AddItem("counter", key, "count", float64(counter.Value), now); err != nil {
+			if err := s.AddItem("counter", key, "count", counter.Value, now); err != nil {
 				errs = append(errs, err)
 			}
 			if err := s.AddItem("counter", key, "per_second", counter.PerSecond, now); err != nil {
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/internal/tlsconfig"
 	"github.com/atlassian/gostatsd/pkg/backends/sender"
 
 	log "github.com/sirupsen/logrus"
@@ -52,7 +53,7 @@ func (client *Client) Run(ctx context.Context) {
 }
 
 // SendMetricsAsync flushes the metrics to the statsd server, preparing payload synchronously but doing the send asynchronously.
-func (client *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+func (client *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, intervalStart time.Time, cb gostatsd.SendCallback) {
 	sink := make(chan *bytes.Buffer, sendChannelSize)
 	select {
 	case <-ctx.Done():
@@ -109,7 +110,7 @@ func (client *Client) processMetrics(metrics *gostatsd.MetricMap, handler overfl
 	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
 		// do not send statsd stats as they will be recalculated on the master instead
 		if !strings.HasPrefix(key, "statsd.") {
-			writeLine("%s:%d|c", key, tagsKey, counter.Value)
+			writeLine("%s:%s|c", key, tagsKey, strconv.FormatFloat(counter.Value, 'f', -1, 64))
 		}
 	})
 	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
@@ -257,13 +258,13 @@ func NewClientFromViper(v *viper.Viper) (gostatsd.Backend, error) {
 	g.SetDefault("disable_tags", false)
 	g.SetDefault("tcp_transport", false)
 	g.SetDefault("tls_transport", false)
-	maybeTLSConfig, err := getTLSConfiguration(
+	maybeTLSConfig, err := tlsconfig.Client(
 		g.GetString("tls_ca_path"),
 		g.GetString("tls_cert_path"),
 		g.GetString("tls_key_path"),
 		g.GetBool("tls_transport"))
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("[%s] %v", BackendName, err)
 	}
 	return NewClient(
 		g.GetString("address"),
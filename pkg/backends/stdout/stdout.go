@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -52,8 +53,8 @@ func tagToMetricName(tag string) string {
 }
 
 // SendMetricsAsync prints the metrics in a MetricsMap to the stdout, preparing payload synchronously but doing the send asynchronously.
-func (client Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
-	buf := preparePayload(metrics, &client.disabledSubtypes)
+func (client Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, intervalStart time.Time, cb gostatsd.SendCallback) {
+	buf := preparePayload(metrics, intervalStart, &client.disabledSubtypes)
 	go func() {
 		cb([]error{writePayload(buf)})
 	}()
@@ -70,13 +71,13 @@ func writePayload(buf *bytes.Buffer) (retErr error) {
 	return err
 }
 
-func preparePayload(metrics *gostatsd.MetricMap, disabled *gostatsd.TimerSubtypes) *bytes.Buffer {
+func preparePayload(metrics *gostatsd.MetricMap, ts time.Time, disabled *gostatsd.TimerSubtypes) *bytes.Buffer {
 	buf := new(bytes.Buffer)
-	now := time.Now().Unix()
+	now := ts.Unix()
 	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
 		nk := composeMetricName(key, tagsKey)
-		fmt.Fprintf(buf, "stats.counter.%s.count %d %d\n", nk, counter.Value, now)          // #nosec
-		fmt.Fprintf(buf, "stats.counter.%s.per_second %f %d\n", nk, counter.PerSecond, now) // #nosec
+		fmt.Fprintf(buf, "stats.counter.%s.count %s %d\n", nk, strconv.FormatFloat(counter.Value, 'f', -1, 64), now) // #nosec
+		fmt.Fprintf(buf, "stats.counter.%s.per_second %f %d\n", nk, counter.PerSecond, now)                          // #nosec
 	})
 	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
 		nk := composeMetricName(key, tagsKey)
@@ -2,10 +2,22 @@ package nodes
 
 import (
 	"context"
+	"errors"
+	"hash/fnv"
+	"math"
 	"net"
+	"sort"
+	"sync"
 	"time"
 )
 
+var (
+	errNoNodes = errors.New("no nodes available")
+)
+
+// watchBuffer is the number of membership changes buffered for each watcher.
+const watchBuffer = 16
+
 // NodeTracker is an interface for tracking and selecting nodes in a cluster
 type NodeTracker interface {
 	// Runs the node tracker until the context is closed.
@@ -17,14 +29,61 @@ type NodeTracker interface {
 	List() []string
 
 	// Select will use the provided key to pick a node from the list of tracked
-	// nodes and return it.  Returns an error if there are no nodes available.
-	// Thread safe.
+	// nodes and return it.  Keys are assigned with weighted rendezvous hashing,
+	// so when a node joins or leaves, only the keys it gains or loses move.
+	// Nodes have a weight of 1 unless the tracker sets one.
+	// Returns an error if there are no nodes available.  Thread safe.
 	Select(key uint64) (string, error)
+
+	// Watch returns a channel which receives every change to the tracked
+	// nodes.  A watcher which falls behind misses changes, but each change
+	// carries the full list of nodes.  Thread safe.
+	Watch() <-chan MembershipChange
+}
+
+// MembershipChange describes nodes joining or leaving the cluster.
+type MembershipChange struct {
+	Added   []string
+	Removed []string
+	Nodes   []string // All nodes after the change
 }
 
 type node struct {
 	nodeid string
 	expiry time.Time
+	weight float64 // Relative share of keys, 1 if not weighted
+	hash   uint64  // Hash of the nodeid, used to score keys
+}
+
+func newNode(nodeid string, weight float64, expiry time.Time) *node {
+	if weight <= 0 {
+		weight = 1
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(nodeid))
+	return &node{
+		nodeid: nodeid,
+		expiry: expiry,
+		weight: weight,
+		hash:   h.Sum64(),
+	}
+}
+
+// score returns the weighted rendezvous score of the node for a key.  The node with the highest score owns the key.
+func (n *node) score(key uint64) float64 {
+	// Map the hash of the node and key to (0, 1)
+	u := (float64(mix64(n.hash^mix64(key))>>11) + 0.5) / (1 << 53)
+	return -n.weight / math.Log(u)
+}
+
+// mix64 is the finalizer of splitmix64, which spreads the bits of x.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
 }
 
 type nodeList []*node
@@ -33,6 +92,119 @@ func (nl nodeList) Len() int           { return len(nl) }
 func (nl nodeList) Swap(i, j int)      { nl[i], nl[j] = nl[j], nl[i] }
 func (nl nodeList) Less(i, j int) bool { return nl[i].nodeid < nl[j].nodeid }
 
+// selectNode returns the node which owns key.
+func (nl nodeList) selectNode(key uint64) (string, error) {
+	if len(nl) == 0 {
+		return "", errNoNodes
+	}
+	best := nl[0]
+	bestScore := best.score(key)
+	for _, n := range nl[1:] {
+		if score := n.score(key); score > bestScore {
+			best, bestScore = n, score
+		}
+	}
+	return best.nodeid, nil
+}
+
+// ids returns the nodeid of every node.
+func (nl nodeList) ids() []string {
+	ids := make([]string, len(nl))
+	for idx, n := range nl {
+		ids[idx] = n.nodeid
+	}
+	return ids
+}
+
+// watchers notifies every channel returned by watch of membership changes.
+type watchers struct {
+	mu  sync.Mutex
+	chs []chan MembershipChange
+}
+
+func (w *watchers) watch() <-chan MembershipChange {
+	ch := make(chan MembershipChange, watchBuffer)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.chs = append(w.chs, ch)
+	return ch
+}
+
+// notify sends the change to every watcher, unless it is empty.  It never blocks.
+func (w *watchers) notify(change MembershipChange) {
+	if len(change.Added) == 0 && len(change.Removed) == 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, ch := range w.chs {
+		select {
+		case ch <- change:
+		default:
+		}
+	}
+}
+
+// diffNodes returns the change from the nodes in before to the nodes in after.
+func diffNodes(before, after nodeList) MembershipChange {
+	seen := make(map[string]bool, len(before))
+	for _, n := range before {
+		seen[n.nodeid] = true
+	}
+	change := MembershipChange{Nodes: after.ids()}
+	for _, n := range after {
+		if seen[n.nodeid] {
+			delete(seen, n.nodeid)
+		} else {
+			change.Added = append(change.Added, n.nodeid)
+		}
+	}
+	for _, n := range before {
+		if seen[n.nodeid] {
+			change.Removed = append(change.Removed, n.nodeid)
+		}
+	}
+	return change
+}
+
+// nodeSet tracks nodes which are discovered all at once, rather than one at a time.  It provides the List, Select and
+// Watch methods of a NodeTracker.
+type nodeSet struct {
+	rw       sync.RWMutex // protects nodes
+	nodes    nodeList
+	watchers watchers
+}
+
+// List returns a list of all the nodes currently tracked.  Thread safe.
+func (ns *nodeSet) List() []string {
+	ns.rw.RLock()
+	defer ns.rw.RUnlock()
+	return ns.nodes.ids()
+}
+
+// Select will use the provided key to pick a node and return it.  An error will
+// be returned if no nodes are available.  Thread safe.
+func (ns *nodeSet) Select(key uint64) (string, error) {
+	ns.rw.RLock()
+	defer ns.rw.RUnlock()
+	return ns.nodes.selectNode(key)
+}
+
+// Watch returns a channel which receives changes to the tracked nodes.  Thread safe.
+func (ns *nodeSet) Watch() <-chan MembershipChange {
+	return ns.watchers.watch()
+}
+
+// replace replaces the tracked nodes with nl, and notifies watchers of any change.  Thread safe.
+func (ns *nodeSet) replace(nl nodeList) {
+	sort.Sort(nl)
+	ns.rw.Lock()
+	defer ns.rw.Unlock()
+	change := diffNodes(ns.nodes, nl)
+	ns.nodes = nl
+	ns.watchers.notify(change)
+}
+
 // LocalAddress is a helper function to return the local IP address that would
 // be used to connect to a specified target.  Useful to get the IP that should
 // be advertised externally.
@@ -0,0 +1,337 @@
+package nodes
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tilinna/clock"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// dnsTimeout is how long a lookup from each name server may take.
+	dnsTimeout = 5 * time.Second
+	// dnsJitter is the largest fraction of the refresh interval added to it, so forwarders don't all look up at once.
+	dnsJitter = 0.2
+	// resolvConf is where the default name servers are read from.
+	resolvConf = "/etc/resolv.conf"
+	// srvZeroWeight is the weight of an SRV record with a weight of 0, which should rarely be selected while records
+	// with a weight are available.
+	srvZeroWeight = 0.01
+)
+
+type dnsNodeTracker struct {
+	nodeSet
+
+	name        string // Fully qualified
+	recordType  dnsmessage.Type
+	port        int      // Port of the nodes, for A records
+	servers     []string // Name servers, tried in order until one answers
+	resolvConf  string   // Read again for the name servers before each lookup, empty if a server was given
+	minInterval time.Duration
+	maxInterval time.Duration
+}
+
+// NewDNSNodeTracker returns a NodeTracker which periodically resolves name to the nodes in the cluster.  If recordType
+// is "srv", each SRV record of the lowest priority is a node, weighted by the weight of the record.  If recordType is
+// "a", each A record is a node, listening on port.  SRV records with a weight of 0 are rarely selected, unless every
+// record has a weight of 0.  Lookups are sent to server, or if server is empty to each name server in /etc/resolv.conf
+// in turn until one answers, reading the file again before every lookup.  Lookups are repeated when the records
+// expire, but no more often than minInterval, and at least every maxInterval.  The nodes are kept if a lookup fails.
+func NewDNSNodeTracker(name, recordType string, port int, server string, minInterval, maxInterval time.Duration) (NodeTracker, error) {
+	if name == "" {
+		return nil, errors.New("a name to resolve is required")
+	}
+	dnt := &dnsNodeTracker{
+		name:        strings.TrimSuffix(name, ".") + ".",
+		port:        port,
+		minInterval: minInterval,
+		maxInterval: maxInterval,
+	}
+	switch recordType {
+	case "srv":
+		dnt.recordType = dnsmessage.TypeSRV
+	case "a":
+		if port <= 0 {
+			return nil, errors.New("a port is required to resolve A records")
+		}
+		dnt.recordType = dnsmessage.TypeA
+	default:
+		return nil, fmt.Errorf("unknown DNS record type %q, must be srv or a", recordType)
+	}
+	if minInterval <= 0 || maxInterval < minInterval {
+		return nil, fmt.Errorf("invalid DNS refresh intervals %v and %v", minInterval, maxInterval)
+	}
+	if server != "" {
+		dnt.servers = []string{server}
+	} else {
+		var err error
+		if dnt.servers, err = nameServers(resolvConf); err != nil {
+			return nil, err
+		}
+		dnt.resolvConf = resolvConf
+	}
+	return dnt, nil
+}
+
+// Run will resolve the nodes until the context is closed.
+func (dnt *dnsNodeTracker) Run(ctx context.Context) {
+	for {
+		timer := clock.NewTimer(ctx, dnt.refresh(ctx))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// refresh resolves the nodes, and returns how long to wait before resolving them again.
+func (dnt *dnsNodeTracker) refresh(ctx context.Context) time.Duration {
+	nl, ttl, err := dnt.resolve(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			logrus.WithError(err).WithField("name", dnt.name).Warn("Failed to resolve cluster")
+		}
+		return dnt.interval(dnt.minInterval)
+	}
+	dnt.replace(nl)
+	return dnt.interval(ttl)
+}
+
+// interval returns ttl limited to the refresh intervals, with jitter added.
+func (dnt *dnsNodeTracker) interval(ttl time.Duration) time.Duration {
+	if ttl < dnt.minInterval {
+		ttl = dnt.minInterval
+	} else if ttl > dnt.maxInterval {
+		ttl = dnt.maxInterval
+	}
+	return ttl + time.Duration(rand.Float64()*dnsJitter*float64(ttl))
+}
+
+// resolve looks up the nodes from each name server in turn until one answers, and returns them with the time until
+// the first record used expires.
+func (dnt *dnsNodeTracker) resolve(ctx context.Context) (nodeList, time.Duration, error) {
+	if dnt.resolvConf != "" {
+		if servers, err := nameServers(dnt.resolvConf); err == nil {
+			dnt.servers = servers
+		} else {
+			logrus.WithError(err).Warn("Failed to read name servers, using the previous ones")
+		}
+	}
+	var err error
+	for _, server := range dnt.servers {
+		var nl nodeList
+		var ttl time.Duration
+		if nl, ttl, err = dnt.resolveFrom(ctx, server); err == nil {
+			return nl, ttl, nil
+		} else if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, 0, err
+}
+
+// resolveFrom looks up the nodes from a single name server.
+func (dnt *dnsNodeTracker) resolveFrom(ctx context.Context, server string) (nodeList, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+
+	name, err := dnsmessage.NewName(dnt.name)
+	if err != nil {
+		return nil, 0, err
+	}
+	id := uint16(rand.Uint32())
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: dnt.recordType, Class: dnsmessage.ClassINET},
+		},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	response, err := exchange(ctx, "udp", server, packed)
+	if err != nil {
+		return nil, 0, err
+	}
+	var p dnsmessage.Parser
+	header, err := p.Start(response)
+	if err != nil {
+		return nil, 0, err
+	}
+	if header.Truncated {
+		if response, err = exchange(ctx, "tcp", server, packed); err != nil {
+			return nil, 0, err
+		}
+		if header, err = p.Start(response); err != nil {
+			return nil, 0, err
+		}
+	}
+	if header.ID != id {
+		return nil, 0, errors.New("DNS response does not match the query")
+	}
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("DNS lookup failed: %v", header.RCode)
+	}
+	if err = p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+	return dnt.parseAnswers(&p)
+}
+
+// parseAnswers returns the nodes in the answers to a lookup, and the time until the first record used expires.
+func (dnt *dnsNodeTracker) parseAnswers(p *dnsmessage.Parser) (nodeList, time.Duration, error) {
+	var nl nodeList
+	var ttl uint32
+	priority := -1
+	var srvWeights []uint16 // Weight of each SRV record in nl
+	for {
+		h, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+		if h.Class != dnsmessage.ClassINET || h.Type != dnt.recordType {
+			if err = p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+
+		var n *node
+		switch h.Type {
+		case dnsmessage.TypeSRV:
+			srv, err := p.SRVResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			if priority >= 0 && int(srv.Priority) > priority {
+				continue
+			} else if int(srv.Priority) < priority {
+				nl = nl[:0] // Only the lowest priority records are used
+				srvWeights = srvWeights[:0]
+			}
+			priority = int(srv.Priority)
+			srvWeights = append(srvWeights, srv.Weight)
+			host := strings.TrimSuffix(srv.Target.String(), ".")
+			n = newNode(net.JoinHostPort(host, strconv.Itoa(int(srv.Port))), float64(srv.Weight), time.Time{})
+		case dnsmessage.TypeA:
+			a, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			n = newNode(net.JoinHostPort(net.IP(a.A[:]).String(), strconv.Itoa(dnt.port)), 1, time.Time{})
+		}
+		if len(nl) == 0 || h.TTL < ttl {
+			ttl = h.TTL
+		}
+		nl = append(nl, n)
+	}
+	if len(nl) == 0 {
+		return nil, 0, fmt.Errorf("no records found for %s", dnt.name)
+	}
+	setSRVZeroWeights(nl, srvWeights)
+	return nl, time.Duration(ttl) * time.Second, nil
+}
+
+// setSRVZeroWeights gives the nodes of SRV records with a weight of 0 a small weight, so they are rarely selected while
+// other records have a weight.  If every record has a weight of 0 they keep the same weight, and are selected equally.
+func setSRVZeroWeights(nl nodeList, srvWeights []uint16) {
+	weighted := false
+	for _, weight := range srvWeights {
+		weighted = weighted || weight > 0
+	}
+	if !weighted {
+		return
+	}
+	for i, weight := range srvWeights {
+		if weight == 0 {
+			nl[i].weight = srvZeroWeight
+		}
+	}
+}
+
+// exchange sends a DNS query to server, and returns the response.
+func exchange(ctx context.Context, network, server string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	if network == "udp" {
+		if _, err = conn.Write(query); err != nil {
+			return nil, err
+		}
+		response := make([]byte, 512)
+		n, err := conn.Read(response)
+		if err != nil {
+			return nil, err
+		}
+		return response[:n], nil
+	}
+
+	// Messages over TCP are prefixed with their length
+	framed := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	copy(framed[2:], query)
+	if _, err = conn.Write(framed); err != nil {
+		return nil, err
+	}
+	var length uint16
+	if err = binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	response := make([]byte, length)
+	if _, err = io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// nameServers returns the addresses of the name servers in a resolv.conf file, in the order they are listed.
+func nameServers(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no name server found in %s", path)
+	}
+	return servers, nil
+}
@@ -0,0 +1,232 @@
+package nodes
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeNameServer answers every query on a loopback UDP socket with the same answers.
+func fakeNameServer(t *testing.T, answers []dnsmessage.Resource) (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err = query.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			response := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true},
+				Questions: query.Questions,
+				Answers:   answers,
+			}
+			packed, err := response.Pack()
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteTo(packed, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), func() { _ = conn.Close() }
+}
+
+func srvRecord(target string, port, priority, weight uint16, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName("_statsd._tcp.aggregators.local."),
+			Type:  dnsmessage.TypeSRV,
+			Class: dnsmessage.ClassINET,
+			TTL:   ttl,
+		},
+		Body: &dnsmessage.SRVResource{
+			Priority: priority,
+			Weight:   weight,
+			Port:     port,
+			Target:   dnsmessage.MustNewName(target),
+		},
+	}
+}
+
+func aRecord(ip string, ttl uint32) dnsmessage.Resource {
+	var a [4]byte
+	copy(a[:], net.ParseIP(ip).To4())
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName("aggregators.local."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+			TTL:   ttl,
+		},
+		Body: &dnsmessage.AResource{A: a},
+	}
+}
+
+func TestDNSNodeTrackerSRV(t *testing.T) {
+	t.Parallel()
+
+	server, stop := fakeNameServer(t, []dnsmessage.Resource{
+		srvRecord("agg-2.aggregators.local.", 8080, 10, 2, 30),
+		srvRecord("agg-1.aggregators.local.", 8080, 10, 1, 20),
+		srvRecord("backup.aggregators.local.", 8080, 20, 1, 5),
+	})
+	defer stop()
+
+	tracker, err := NewDNSNodeTracker("_statsd._tcp.aggregators.local", "srv", 0, server, time.Second, time.Minute)
+	require.NoError(t, err)
+	dnt := tracker.(*dnsNodeTracker)
+	changes := dnt.Watch()
+
+	interval := dnt.refresh(context.Background())
+	assert.True(t, interval >= 20*time.Second && interval <= 24*time.Second, "%v", interval)
+	assert.Equal(t, MembershipChange{
+		Added: []string{"agg-1.aggregators.local:8080", "agg-2.aggregators.local:8080"},
+		Nodes: []string{"agg-1.aggregators.local:8080", "agg-2.aggregators.local:8080"},
+	}, <-changes)
+	assert.Equal(t, 2.0, dnt.nodes[1].weight)
+}
+
+func TestDNSNodeTrackerA(t *testing.T) {
+	t.Parallel()
+
+	server, stop := fakeNameServer(t, []dnsmessage.Resource{
+		aRecord("10.0.0.1", 1),
+		aRecord("10.0.0.2", 1),
+	})
+	defer stop()
+
+	tracker, err := NewDNSNodeTracker("aggregators.local", "a", 8080, server, 10*time.Second, time.Minute)
+	require.NoError(t, err)
+	dnt := tracker.(*dnsNodeTracker)
+
+	interval := dnt.refresh(context.Background())
+	assert.True(t, interval >= 10*time.Second && interval <= 12*time.Second, "the interval must be at least the minimum, but was %v", interval)
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080"}, dnt.List())
+}
+
+func TestDNSNodeTrackerKeepsNodesOnFailure(t *testing.T) {
+	t.Parallel()
+
+	server, stop := fakeNameServer(t, []dnsmessage.Resource{
+		aRecord("10.0.0.1", 1),
+	})
+	tracker, err := NewDNSNodeTracker("aggregators.local", "a", 8080, server, time.Second, time.Minute)
+	require.NoError(t, err)
+	dnt := tracker.(*dnsNodeTracker)
+	dnt.refresh(context.Background())
+	stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	dnt.refresh(ctx)
+	assert.Equal(t, []string{"10.0.0.1:8080"}, dnt.List())
+}
+
+func TestNewDNSNodeTrackerInvalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewDNSNodeTracker("", "srv", 0, "127.0.0.1:53", time.Second, time.Minute)
+	assert.Error(t, err)
+	_, err = NewDNSNodeTracker("aggregators.local", "a", 0, "127.0.0.1:53", time.Second, time.Minute)
+	assert.Error(t, err)
+	_, err = NewDNSNodeTracker("aggregators.local", "txt", 0, "127.0.0.1:53", time.Second, time.Minute)
+	assert.Error(t, err)
+	_, err = NewDNSNodeTracker("aggregators.local", "srv", 0, "127.0.0.1:53", time.Minute, time.Second)
+	assert.Error(t, err)
+}
+
+func TestNameServers(t *testing.T) {
+	t.Parallel()
+
+	f, err := ioutil.TempFile("", "resolv.conf")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("# comment\nsearch local\nnameserver fd00::1\nnameserver 10.0.0.53\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	servers, err := nameServers(f.Name())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"[fd00::1]:53", "10.0.0.53:53"}, servers)
+}
+
+func TestDNSNodeTrackerSRVZeroWeight(t *testing.T) {
+	t.Parallel()
+
+	server, stop := fakeNameServer(t, []dnsmessage.Resource{
+		srvRecord("agg-1.aggregators.local.", 8080, 10, 0, 30),
+		srvRecord("agg-2.aggregators.local.", 8080, 10, 5, 30),
+	})
+	defer stop()
+	tracker, err := NewDNSNodeTracker("_statsd._tcp.aggregators.local", "srv", 0, server, time.Second, time.Minute)
+	require.NoError(t, err)
+	dnt := tracker.(*dnsNodeTracker)
+	dnt.refresh(context.Background())
+	assert.Equal(t, srvZeroWeight, dnt.nodes[0].weight)
+	assert.Equal(t, 5.0, dnt.nodes[1].weight)
+
+	// If every record has a weight of 0, they are selected equally
+	server, stop = fakeNameServer(t, []dnsmessage.Resource{
+		srvRecord("agg-1.aggregators.local.", 8080, 10, 0, 30),
+		srvRecord("agg-2.aggregators.local.", 8080, 10, 0, 30),
+	})
+	defer stop()
+	dnt.servers = []string{server}
+	dnt.refresh(context.Background())
+	assert.Equal(t, 1.0, dnt.nodes[0].weight)
+	assert.Equal(t, 1.0, dnt.nodes[1].weight)
+}
+
+func TestDNSNodeTrackerFallsBackToOtherNameServers(t *testing.T) {
+	t.Parallel()
+
+	server, stop := fakeNameServer(t, []dnsmessage.Resource{
+		aRecord("10.0.0.1", 1),
+	})
+	defer stop()
+	down, stopDown := fakeNameServer(t, nil)
+	stopDown()
+
+	tracker, err := NewDNSNodeTracker("aggregators.local", "a", 8080, down, time.Second, time.Minute)
+	require.NoError(t, err)
+	dnt := tracker.(*dnsNodeTracker)
+	dnt.servers = append(dnt.servers, server)
+	dnt.refresh(context.Background())
+	assert.Equal(t, []string{"10.0.0.1:8080"}, dnt.List())
+}
+
+func TestDNSNodeTrackerRereadsResolvConf(t *testing.T) {
+	t.Parallel()
+
+	f, err := ioutil.TempFile("", "resolv.conf")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	require.NoError(t, f.Close())
+	require.NoError(t, ioutil.WriteFile(f.Name(), []byte("nameserver 127.0.0.1\n"), 0600))
+
+	dnt := &dnsNodeTracker{
+		name:        "aggregators.local.",
+		recordType:  dnsmessage.TypeA,
+		port:        8080,
+		servers:     []string{"10.0.0.53:53"},
+		resolvConf:  f.Name(),
+		minInterval: time.Second,
+		maxInterval: time.Minute,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, _, _ = dnt.resolve(ctx)
+	assert.Equal(t, []string{"127.0.0.1:53"}, dnt.servers)
+}
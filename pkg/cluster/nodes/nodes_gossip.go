@@ -0,0 +1,691 @@
+package nodes
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	mrand "math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// gossipIndirectProbes is how many members are asked to probe a member which didn't answer a ping.
+	gossipIndirectProbes = 3
+	// gossipMaxPiggyback is the most updates sent with each message.
+	gossipMaxPiggyback = 8
+	// gossipRetransmitMult scales how many times each update is sent, by the log of the number of members.
+	gossipRetransmitMult = 4
+	// gossipSyncProbes is how many probes happen between each full state sync with a random member.
+	gossipSyncProbes = 10
+	// gossipReapMult scales the suspect timeout to how long a dead member is remembered.
+	gossipReapMult = 6
+	// gossipMaxMessageSize is the largest message which can be received.
+	gossipMaxMessageSize = 65507
+	// gossipEncrypted marks an encrypted message, which is the version followed by the nonce and the ciphertext.
+	gossipEncrypted = byte(1)
+)
+
+// gossipState is the state of a member, in order of precedence for the same incarnation.
+type gossipState uint8
+
+const (
+	gossipAlive gossipState = iota
+	gossipSuspect
+	gossipDead
+)
+
+func (gs gossipState) String() string {
+	switch gs {
+	case gossipAlive:
+		return "alive"
+	case gossipSuspect:
+		return "suspect"
+	default:
+		return "dead"
+	}
+}
+
+type gossipMessageType uint8
+
+const (
+	gossipPing gossipMessageType = iota
+	gossipAck
+	gossipPingReq   // Asks the receiver to ping Target, and ack the sender if Target acks
+	gossipSync      // Carries the full state of the sender, and asks the receiver to reply with its full state
+	gossipSyncReply // Carries the full state of the sender
+)
+
+// gossipMember is the state of a member, as sent between members.
+type gossipMember struct {
+	Addr        string      `json:"addr"`           // Gossip address, which identifies the member
+	NodeID      string      `json:"node,omitempty"` // Empty if the member only watches the cluster
+	Zone        string      `json:"zone,omitempty"`
+	Weight      float64     `json:"weight,omitempty"`
+	Incarnation uint64      `json:"inc"` // Only the member itself increases it, to refute suspicion
+	State       gossipState `json:"state"`
+}
+
+type gossipMessage struct {
+	Type    gossipMessageType `json:"type"`
+	Seq     uint64            `json:"seq,omitempty"`
+	From    string            `json:"from"`
+	Target  string            `json:"target,omitempty"`
+	Members []gossipMember    `json:"members,omitempty"` // Updates piggybacked on the message, or the full state
+}
+
+type gossipMemberState struct {
+	gossipMember
+	changed time.Time // When the state last changed
+}
+
+type gossipBroadcast struct {
+	member    gossipMember
+	transmits int
+}
+
+// GossipConfig configures a GossipNodeTracker.
+type GossipConfig struct {
+	BindAddr       string        // UDP address to listen on
+	AdvertiseAddr  string        // Address other members reach this member on, defaults to the bound address
+	NodeID         string        // Address announced to forwarders, empty to only watch the cluster
+	Zone           string        // Zone of this member
+	Weight         float64       // Relative share of keys this member owns
+	PreferZone     bool          // Only select nodes in the same zone, while any are alive
+	Seeds          []string      // Gossip addresses of members to join the cluster through
+	Keys           []string      // Base64 encoded AES keys.  The first key encrypts, and any key decrypts.  Without keys, only messages sent from the gossip address of their sender are accepted
+	ProbeInterval  time.Duration // How often a member is probed for failure
+	SuspectTimeout time.Duration // How long a member is suspected of failure before it is declared dead
+}
+
+// GossipMember describes a member of a gossip cluster.
+type GossipMember struct {
+	Addr   string
+	NodeID string
+	Zone   string
+	Weight float64
+	State  string
+}
+
+// GossipNodeTracker is a NodeTracker which finds the nodes of a cluster by gossiping with its other members, with
+// SWIM style failure detection.  Members may also join only to watch the cluster, without being selectable.
+type GossipNodeTracker struct {
+	nodeSet
+
+	config  GossipConfig
+	conn    net.PacketConn
+	self    string
+	ciphers []cipher.AEAD
+
+	mu         sync.Mutex
+	members    map[string]*gossipMemberState // Includes this member
+	broadcasts []*gossipBroadcast
+	acks       map[uint64]func()
+	seq        uint64
+	probeOrder []string
+}
+
+// NewGossipNodeTracker returns a GossipNodeTracker listening on config.BindAddr.  The socket is closed when Run
+// returns.
+func NewGossipNodeTracker(config GossipConfig) (*GossipNodeTracker, error) {
+	if config.ProbeInterval <= 0 || config.SuspectTimeout <= 0 {
+		return nil, fmt.Errorf("invalid gossip intervals %v and %v", config.ProbeInterval, config.SuspectTimeout)
+	}
+	ciphers, err := gossipCiphers(config.Keys)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp", config.BindAddr)
+	if err != nil {
+		return nil, err
+	}
+	self, err := advertiseAddr(config.AdvertiseAddr, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	gnt := &GossipNodeTracker{
+		config:  config,
+		conn:    conn,
+		self:    self,
+		ciphers: ciphers,
+		members: map[string]*gossipMemberState{},
+		acks:    map[uint64]func(){},
+	}
+	gnt.members[self] = &gossipMemberState{
+		gossipMember: gossipMember{
+			Addr:        self,
+			NodeID:      config.NodeID,
+			Zone:        config.Zone,
+			Weight:      config.Weight,
+			Incarnation: uint64(time.Now().UnixNano()), // Newer than any incarnation from a previous run
+			State:       gossipAlive,
+		},
+		changed: time.Now(),
+	}
+	gnt.updateNodes()
+	return gnt, nil
+}
+
+// gossipCiphers returns an AEAD for each base64 encoded AES key.
+func gossipCiphers(keys []string) ([]cipher.AEAD, error) {
+	var ciphers []cipher.AEAD
+	for _, key := range keys {
+		raw, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gossip key: %v", err)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gossip key: %v", err)
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		ciphers = append(ciphers, gcm)
+	}
+	return ciphers, nil
+}
+
+// advertiseAddr returns the configured address, or the bound address with an address other hosts can reach if it
+// is unspecified.
+func advertiseAddr(configured string, bound *net.UDPAddr) (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+	ip := bound.IP
+	if ip.IsUnspecified() {
+		local, err := LocalAddress("1.1.1.1:1")
+		if err != nil {
+			return "", fmt.Errorf("failed to find the address to advertise: %v", err)
+		}
+		ip = local
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(bound.Port)), nil
+}
+
+// Addr returns the gossip address of this member.
+func (gnt *GossipNodeTracker) Addr() string {
+	return gnt.self
+}
+
+// Members returns every member of the cluster known to this member, including itself and recently dead members,
+// sorted by address.  Thread safe.
+func (gnt *GossipNodeTracker) Members() []GossipMember {
+	gnt.mu.Lock()
+	defer gnt.mu.Unlock()
+	members := make([]GossipMember, 0, len(gnt.members))
+	for _, m := range gnt.members {
+		members = append(members, GossipMember{
+			Addr:   m.Addr,
+			NodeID: m.NodeID,
+			Zone:   m.Zone,
+			Weight: m.Weight,
+			State:  m.State.String(),
+		})
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Addr < members[j].Addr })
+	return members
+}
+
+// Run will gossip with the cluster until the context is closed, and then leave it.
+func (gnt *GossipNodeTracker) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer func() {
+		_ = gnt.conn.Close()
+		wg.Wait()
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		gnt.receive()
+	}()
+
+	gnt.join()
+	ticker := time.NewTicker(gnt.config.ProbeInterval)
+	defer ticker.Stop()
+	for probes := 1; ; probes++ {
+		select {
+		case <-ctx.Done():
+			gnt.leave()
+			return
+		case <-ticker.C:
+		}
+		gnt.expire()
+		gnt.probe(ctx)
+		if probes%gossipSyncProbes == 0 {
+			gnt.sync()
+		}
+	}
+}
+
+// join asks every seed for its state.
+func (gnt *GossipNodeTracker) join() {
+	for _, seed := range gnt.config.Seeds {
+		if seed != gnt.self {
+			gnt.send(seed, &gossipMessage{Type: gossipSync, Members: gnt.state()})
+		}
+	}
+}
+
+// sync exchanges the full state with a random member, or with the seeds if no other member is known, so a member
+// which missed updates catches up.  The state is also exchanged with a random seed, even if it is thought to be dead,
+// so the two sides of a partition find each other again once it heals.
+func (gnt *GossipNodeTracker) sync() {
+	peers := gnt.peers("")
+	if len(peers) == 0 {
+		gnt.join()
+		return
+	}
+	peer := peers[mrand.Intn(len(peers))]
+	gnt.send(peer, &gossipMessage{Type: gossipSync, Members: gnt.state()})
+	if seeds := gnt.config.Seeds; len(seeds) > 0 {
+		if seed := seeds[mrand.Intn(len(seeds))]; seed != gnt.self && seed != peer {
+			gnt.send(seed, &gossipMessage{Type: gossipSync, Members: gnt.state()})
+		}
+	}
+}
+
+// leave tells the other members this member is leaving, so they don't wait for it to time out.
+func (gnt *GossipNodeTracker) leave() {
+	gnt.mu.Lock()
+	self := gnt.members[gnt.self]
+	self.Incarnation++
+	self.State = gossipDead
+	leaving := []gossipMember{self.gossipMember}
+	gnt.mu.Unlock()
+
+	for _, peer := range gnt.peers("") {
+		gnt.sendRaw(peer, &gossipMessage{Type: gossipPing, From: gnt.self, Members: leaving})
+	}
+}
+
+// probe checks that the next member is alive, directly and then through other members, and suspects it if not.
+func (gnt *GossipNodeTracker) probe(ctx context.Context) {
+	target, ok := gnt.nextProbe()
+	if !ok {
+		return
+	}
+
+	acked := make(chan struct{})
+	var once sync.Once
+	onAck := func() { once.Do(func() { close(acked) }) }
+	seq := gnt.registerAck(onAck)
+	defer gnt.cancelAck(seq)
+
+	timeout := gnt.config.ProbeInterval / 2
+	gnt.send(target, &gossipMessage{Type: gossipPing, Seq: seq})
+	timer := time.NewTimer(timeout)
+	select {
+	case <-acked:
+		timer.Stop()
+		return
+	case <-ctx.Done():
+		timer.Stop()
+		return
+	case <-timer.C:
+	}
+
+	peers := gnt.peers(target)
+	mrand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if len(peers) > gossipIndirectProbes {
+		peers = peers[:gossipIndirectProbes]
+	}
+	for _, peer := range peers {
+		gnt.send(peer, &gossipMessage{Type: gossipPingReq, Seq: seq, Target: target})
+	}
+	timer = time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-acked:
+	case <-ctx.Done():
+	case <-timer.C:
+		gnt.suspect(target)
+	}
+}
+
+// nextProbe returns the next member to probe, going round the members in a random order.
+func (gnt *GossipNodeTracker) nextProbe() (string, bool) {
+	gnt.mu.Lock()
+	defer gnt.mu.Unlock()
+	for {
+		if len(gnt.probeOrder) == 0 {
+			for addr, m := range gnt.members {
+				if addr != gnt.self && m.State != gossipDead {
+					gnt.probeOrder = append(gnt.probeOrder, addr)
+				}
+			}
+			if len(gnt.probeOrder) == 0 {
+				return "", false
+			}
+			mrand.Shuffle(len(gnt.probeOrder), func(i, j int) {
+				gnt.probeOrder[i], gnt.probeOrder[j] = gnt.probeOrder[j], gnt.probeOrder[i]
+			})
+		}
+		addr := gnt.probeOrder[0]
+		gnt.probeOrder = gnt.probeOrder[1:]
+		if m, ok := gnt.members[addr]; ok && m.State != gossipDead {
+			return addr, true
+		}
+	}
+}
+
+// peers returns the other members which are not dead, excluding exclude.
+func (gnt *GossipNodeTracker) peers(exclude string) []string {
+	gnt.mu.Lock()
+	defer gnt.mu.Unlock()
+	var peers []string
+	for addr, m := range gnt.members {
+		if addr != gnt.self && addr != exclude && m.State != gossipDead {
+			peers = append(peers, addr)
+		}
+	}
+	return peers
+}
+
+// suspect marks an alive member as suspected of failure.
+func (gnt *GossipNodeTracker) suspect(addr string) {
+	gnt.mu.Lock()
+	defer gnt.mu.Unlock()
+	if m, ok := gnt.members[addr]; ok && m.State == gossipAlive {
+		suspected := m.gossipMember
+		suspected.State = gossipSuspect
+		gnt.mergeLocked(suspected)
+	}
+}
+
+// expire declares suspects which haven't refuted the suspicion dead, and forgets members which have been dead for a
+// while.
+func (gnt *GossipNodeTracker) expire() {
+	now := time.Now()
+	gnt.mu.Lock()
+	defer gnt.mu.Unlock()
+	for addr, m := range gnt.members {
+		switch {
+		case m.State == gossipSuspect && now.Sub(m.changed) >= gnt.config.SuspectTimeout:
+			dead := m.gossipMember
+			dead.State = gossipDead
+			gnt.mergeLocked(dead)
+		case m.State == gossipDead && addr != gnt.self && now.Sub(m.changed) >= gossipReapMult*gnt.config.SuspectTimeout:
+			delete(gnt.members, addr)
+		}
+	}
+}
+
+// state returns the state of every member.
+func (gnt *GossipNodeTracker) state() []gossipMember {
+	gnt.mu.Lock()
+	defer gnt.mu.Unlock()
+	state := make([]gossipMember, 0, len(gnt.members))
+	for _, m := range gnt.members {
+		state = append(state, m.gossipMember)
+	}
+	return state
+}
+
+// merge applies updates from another member.
+func (gnt *GossipNodeTracker) merge(updates []gossipMember) {
+	gnt.mu.Lock()
+	defer gnt.mu.Unlock()
+	for _, update := range updates {
+		gnt.mergeLocked(update)
+	}
+}
+
+// mergeLocked applies an update if it is newer than the known state of the member, and broadcasts it if it is
+// applied.  An update suspecting this member is refuted.  Must be called with gnt.mu held.
+func (gnt *GossipNodeTracker) mergeLocked(update gossipMember) {
+	if update.Addr == "" {
+		return
+	}
+	current, ok := gnt.members[update.Addr]
+	if update.Addr == gnt.self {
+		if current.State == gossipAlive && update.State != gossipAlive && update.Incarnation >= current.Incarnation {
+			current.Incarnation = update.Incarnation + 1 // Sent with every message, see piggyback
+		}
+		return
+	}
+
+	switch {
+	case !ok && update.State == gossipDead:
+		return // Nothing to forget
+	case !ok:
+		current = &gossipMemberState{}
+		gnt.members[update.Addr] = current
+	case update.Incarnation < current.Incarnation:
+		return
+	case update.Incarnation == current.Incarnation && update.State <= current.State:
+		return
+	}
+	if !ok || update.State != current.State {
+		logrus.WithFields(logrus.Fields{
+			"member": update.Addr,
+			"node":   update.NodeID,
+			"state":  update.State.String(),
+		}).Debug("Gossip member changed")
+	}
+	current.gossipMember = update
+	current.changed = time.Now()
+	gnt.queueBroadcast(update)
+	gnt.updateNodes()
+}
+
+// queueBroadcast queues an update to be piggybacked on messages, replacing any older update for the same member.
+// Must be called with gnt.mu held.
+func (gnt *GossipNodeTracker) queueBroadcast(update gossipMember) {
+	transmits := gossipRetransmitMult * int(math.Ceil(math.Log10(float64(len(gnt.members)+1))))
+	for _, b := range gnt.broadcasts {
+		if b.member.Addr == update.Addr {
+			b.member = update
+			b.transmits = transmits
+			return
+		}
+	}
+	gnt.broadcasts = append(gnt.broadcasts, &gossipBroadcast{member: update, transmits: transmits})
+}
+
+// piggyback returns the updates to send with a message, which always include the state of this member.
+func (gnt *GossipNodeTracker) piggyback() []gossipMember {
+	gnt.mu.Lock()
+	defer gnt.mu.Unlock()
+	updates := []gossipMember{gnt.members[gnt.self].gossipMember}
+	kept := gnt.broadcasts[:0]
+	for _, b := range gnt.broadcasts {
+		if len(updates) <= gossipMaxPiggyback {
+			updates = append(updates, b.member)
+			b.transmits--
+		}
+		if b.transmits > 0 {
+			kept = append(kept, b)
+		}
+	}
+	gnt.broadcasts = kept
+	return updates
+}
+
+// updateNodes updates the selectable nodes from the members.  Must be called with gnt.mu held.
+func (gnt *GossipNodeTracker) updateNodes() {
+	var all, zone nodeList
+	for _, m := range gnt.members {
+		if m.NodeID == "" || m.State == gossipDead {
+			continue
+		}
+		n := newNode(m.NodeID, m.Weight, time.Time{})
+		all = append(all, n)
+		if m.Zone == gnt.config.Zone {
+			zone = append(zone, n)
+		}
+	}
+	if gnt.config.PreferZone && len(zone) > 0 {
+		all = zone
+	}
+	gnt.replace(all)
+}
+
+func (gnt *GossipNodeTracker) registerAck(onAck func()) uint64 {
+	gnt.mu.Lock()
+	defer gnt.mu.Unlock()
+	gnt.seq++
+	gnt.acks[gnt.seq] = onAck
+	return gnt.seq
+}
+
+func (gnt *GossipNodeTracker) cancelAck(seq uint64) {
+	gnt.mu.Lock()
+	defer gnt.mu.Unlock()
+	delete(gnt.acks, seq)
+}
+
+// receive handles messages until the socket is closed.
+func (gnt *GossipNodeTracker) receive() {
+	buf := make([]byte, gossipMaxMessageSize)
+	for {
+		n, from, err := gnt.conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		msg, err := gnt.decode(buf[:n])
+		if err != nil {
+			logrus.WithError(err).WithField("from", from.String()).Debug("Invalid gossip message")
+			continue
+		}
+		if len(gnt.ciphers) == 0 && !sentFrom(from, msg.From) {
+			// Without keys the sender is not authenticated, so it must at least send from the address it claims
+			logrus.WithFields(logrus.Fields{"from": from.String(), "claimed": msg.From}).Debug("Gossip message not sent from its member")
+			continue
+		}
+		gnt.handle(msg)
+	}
+}
+
+// sentFrom returns true if addr is the gossip address claimed by the sender of a message.
+func sentFrom(addr net.Addr, claimed string) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	claimedAddr, err := net.ResolveUDPAddr("udp", claimed)
+	if err != nil {
+		return false
+	}
+	return udpAddr.IP.Equal(claimedAddr.IP) && udpAddr.Port == claimedAddr.Port
+}
+
+func (gnt *GossipNodeTracker) handle(msg *gossipMessage) {
+	if msg.From == "" || msg.From == gnt.self {
+		return
+	}
+	gnt.merge(msg.Members)
+
+	switch msg.Type {
+	case gossipPing:
+		gnt.send(msg.From, &gossipMessage{Type: gossipAck, Seq: msg.Seq})
+	case gossipAck:
+		gnt.mu.Lock()
+		onAck, ok := gnt.acks[msg.Seq]
+		gnt.mu.Unlock()
+		if ok {
+			onAck()
+		}
+	case gossipPingReq:
+		requester, requestSeq := msg.From, msg.Seq
+		var seq uint64
+		seq = gnt.registerAck(func() {
+			gnt.cancelAck(seq)
+			gnt.send(requester, &gossipMessage{Type: gossipAck, Seq: requestSeq})
+		})
+		time.AfterFunc(gnt.config.ProbeInterval, func() { gnt.cancelAck(seq) })
+		gnt.send(msg.Target, &gossipMessage{Type: gossipPing, Seq: seq})
+	case gossipSync:
+		gnt.send(msg.From, &gossipMessage{Type: gossipSyncReply, Members: gnt.state()})
+	}
+}
+
+// send sends a message with piggybacked updates, or the full state for a sync.
+func (gnt *GossipNodeTracker) send(addr string, msg *gossipMessage) {
+	msg.From = gnt.self
+	if msg.Type != gossipSync && msg.Type != gossipSyncReply {
+		msg.Members = gnt.piggyback()
+	}
+	gnt.sendRaw(addr, msg)
+}
+
+func (gnt *GossipNodeTracker) sendRaw(addr string, msg *gossipMessage) {
+	packet, err := gnt.encode(msg)
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to encode gossip message")
+		return
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		logrus.WithError(err).WithField("member", addr).Debug("Failed to resolve gossip member")
+		return
+	}
+	if _, err = gnt.conn.WriteTo(packet, udpAddr); err != nil {
+		logrus.WithError(err).WithField("member", addr).Debug("Failed to send gossip message")
+	}
+}
+
+// encode serializes a message, and encrypts it with the first key if there are any.
+func (gnt *GossipNodeTracker) encode(msg *gossipMessage) ([]byte, error) {
+	plaintext, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(gnt.ciphers) == 0 {
+		return plaintext, nil
+	}
+	gcm := gnt.ciphers[0]
+	packet := make([]byte, 1+gcm.NonceSize(), 1+gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	packet[0] = gossipEncrypted
+	if _, err = rand.Read(packet[1:]); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(packet, packet[1:], plaintext, nil), nil
+}
+
+// decode decrypts a message with any of the keys, and deserializes it.  Unencrypted messages are rejected if there
+// are keys.
+func (gnt *GossipNodeTracker) decode(packet []byte) (*gossipMessage, error) {
+	plaintext := packet
+	if len(gnt.ciphers) > 0 {
+		if len(packet) == 0 || packet[0] != gossipEncrypted {
+			return nil, errors.New("message is not encrypted")
+		}
+		plaintext = nil
+		for _, gcm := range gnt.ciphers {
+			if len(packet) < 1+gcm.NonceSize() {
+				break
+			}
+			nonce := packet[1 : 1+gcm.NonceSize()]
+			if decrypted, err := gcm.Open(nil, nonce, packet[1+gcm.NonceSize():], nil); err == nil {
+				plaintext = decrypted
+				break
+			}
+		}
+		if plaintext == nil {
+			return nil, errors.New("failed to decrypt message")
+		}
+	}
+	var msg gossipMessage
+	if err := json.Unmarshal(plaintext, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
@@ -0,0 +1,259 @@
+package nodes
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	gossipKey1 = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	gossipKey2 = base64.StdEncoding.EncodeToString([]byte("fedcba9876543210"))
+)
+
+// gossipCluster runs in-process gossip members on loopback.
+type gossipCluster struct {
+	t       *testing.T
+	wg      sync.WaitGroup
+	members []*GossipNodeTracker
+	cancels []context.CancelFunc
+}
+
+func (gc *gossipCluster) start(config GossipConfig) *GossipNodeTracker {
+	config.BindAddr = "127.0.0.1:0"
+	if config.ProbeInterval == 0 {
+		config.ProbeInterval = 20 * time.Millisecond
+	}
+	if config.SuspectTimeout == 0 {
+		config.SuspectTimeout = 100 * time.Millisecond
+	}
+	if len(gc.members) > 0 && config.Seeds == nil {
+		config.Seeds = []string{gc.members[0].Addr()}
+	}
+	gnt, err := NewGossipNodeTracker(config)
+	require.NoError(gc.t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	gc.members = append(gc.members, gnt)
+	gc.cancels = append(gc.cancels, cancel)
+	gc.wg.Add(1)
+	go func() {
+		defer gc.wg.Done()
+		gnt.Run(ctx)
+	}()
+	return gnt
+}
+
+func (gc *gossipCluster) stop() {
+	for _, cancel := range gc.cancels {
+		cancel()
+	}
+	gc.wg.Wait()
+}
+
+// waitFor waits for condition to be true, and fails the test if it isn't within the timeout.
+func waitFor(t *testing.T, timeout time.Duration, condition func() bool, msg string) {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			require.FailNow(t, msg)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func listsEqual(gnt *GossipNodeTracker, expected []string) func() bool {
+	return func() bool {
+		return fmt.Sprint(gnt.List()) == fmt.Sprint(expected)
+	}
+}
+
+func TestGossipJoinAndFailure(t *testing.T) {
+	t.Parallel()
+	gc := &gossipCluster{t: t}
+	defer gc.stop()
+
+	a := gc.start(GossipConfig{NodeID: "10.0.0.1:8080", Zone: "a"})
+	b := gc.start(GossipConfig{NodeID: "10.0.0.2:8080", Zone: "b", Weight: 2})
+	c := gc.start(GossipConfig{NodeID: "10.0.0.3:8080", Zone: "a"})
+	watcher := gc.start(GossipConfig{}) // Only watches the cluster
+	changes := watcher.Watch()
+
+	all := []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080"}
+	for _, member := range gc.members {
+		waitFor(t, 5*time.Second, listsEqual(member, all), "members did not find each other")
+	}
+	members := a.Members()
+	require.Len(t, members, 4)
+	for _, m := range members {
+		if m.NodeID == "10.0.0.2:8080" {
+			assert.Equal(t, GossipMember{Addr: b.Addr(), NodeID: "10.0.0.2:8080", Zone: "b", Weight: 2, State: "alive"}, m)
+		}
+	}
+
+	// b fails without leaving, so it is suspected and then declared dead
+	require.NoError(t, b.conn.Close())
+	remaining := []string{"10.0.0.1:8080", "10.0.0.3:8080"}
+	for _, member := range []*GossipNodeTracker{a, c, watcher} {
+		waitFor(t, 5*time.Second, listsEqual(member, remaining), "failed member was not removed")
+	}
+
+	var added, removed []string
+	for len(changes) > 0 {
+		change := <-changes
+		added = append(added, change.Added...)
+		removed = append(removed, change.Removed...)
+	}
+	assert.ElementsMatch(t, all, added)
+	assert.Equal(t, []string{"10.0.0.2:8080"}, removed)
+}
+
+func TestGossipLeave(t *testing.T) {
+	t.Parallel()
+	gc := &gossipCluster{t: t}
+	defer gc.stop()
+
+	// A long suspect timeout, so members are only removed this quickly if they leave
+	a := gc.start(GossipConfig{NodeID: "10.0.0.1:8080", SuspectTimeout: time.Minute})
+	gc.start(GossipConfig{NodeID: "10.0.0.2:8080", SuspectTimeout: time.Minute})
+	waitFor(t, 5*time.Second, listsEqual(a, []string{"10.0.0.1:8080", "10.0.0.2:8080"}), "members did not find each other")
+
+	gc.cancels[1]()
+	waitFor(t, 5*time.Second, listsEqual(a, []string{"10.0.0.1:8080"}), "member which left was not removed")
+}
+
+func TestGossipEncryption(t *testing.T) {
+	t.Parallel()
+	gc := &gossipCluster{t: t}
+	defer gc.stop()
+
+	a := gc.start(GossipConfig{NodeID: "10.0.0.1:8080", Keys: []string{gossipKey1}})
+	// Decrypts with either key while the keys are rotated
+	b := gc.start(GossipConfig{NodeID: "10.0.0.2:8080", Keys: []string{gossipKey1, gossipKey2}})
+	wrongKey := gc.start(GossipConfig{NodeID: "10.0.0.3:8080", Keys: []string{gossipKey2}})
+	unencrypted := gc.start(GossipConfig{NodeID: "10.0.0.4:8080"})
+
+	waitFor(t, 5*time.Second, listsEqual(b, []string{"10.0.0.1:8080", "10.0.0.2:8080"}), "members did not find each other")
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080"}, a.List())
+	assert.Equal(t, []string{"10.0.0.3:8080"}, wrongKey.List())
+	assert.Equal(t, []string{"10.0.0.4:8080"}, unencrypted.List())
+}
+
+func TestGossipRefutesSuspicion(t *testing.T) {
+	t.Parallel()
+	gnt, err := NewGossipNodeTracker(GossipConfig{BindAddr: "127.0.0.1:0", ProbeInterval: time.Second, SuspectTimeout: time.Second})
+	require.NoError(t, err)
+	defer gnt.conn.Close()
+
+	self := gnt.members[gnt.self].gossipMember
+	suspected := self
+	suspected.State = gossipSuspect
+	gnt.merge([]gossipMember{suspected})
+	refuted := gnt.members[gnt.self].gossipMember
+	assert.Equal(t, gossipAlive, refuted.State)
+	assert.Equal(t, self.Incarnation+1, refuted.Incarnation)
+
+	// Stale updates about other members are ignored
+	other := gossipMember{Addr: "127.0.0.1:1", NodeID: "10.0.0.1:8080", Incarnation: 5}
+	gnt.merge([]gossipMember{other})
+	stale := other
+	stale.Incarnation = 4
+	stale.State = gossipDead
+	gnt.merge([]gossipMember{stale})
+	assert.Equal(t, []string{"10.0.0.1:8080"}, gnt.List())
+	dead := other
+	dead.State = gossipDead
+	gnt.merge([]gossipMember{dead})
+	assert.Empty(t, gnt.List())
+}
+
+func TestGossipPreferZone(t *testing.T) {
+	t.Parallel()
+	gnt, err := NewGossipNodeTracker(GossipConfig{BindAddr: "127.0.0.1:0", Zone: "a", PreferZone: true, ProbeInterval: time.Second, SuspectTimeout: time.Second})
+	require.NoError(t, err)
+	defer gnt.conn.Close()
+
+	gnt.merge([]gossipMember{{Addr: "127.0.0.1:1", NodeID: "10.0.0.1:8080", Zone: "b"}})
+	assert.Equal(t, []string{"10.0.0.1:8080"}, gnt.List(), "other zones are used if there are no nodes in the same zone")
+	gnt.merge([]gossipMember{{Addr: "127.0.0.1:2", NodeID: "10.0.0.2:8080", Zone: "a"}})
+	assert.Equal(t, []string{"10.0.0.2:8080"}, gnt.List())
+}
+
+func TestNewGossipNodeTrackerInvalid(t *testing.T) {
+	t.Parallel()
+	_, err := NewGossipNodeTracker(GossipConfig{BindAddr: "127.0.0.1:0", Keys: []string{"not base64!"}, ProbeInterval: time.Second, SuspectTimeout: time.Second})
+	assert.Error(t, err)
+	_, err = NewGossipNodeTracker(GossipConfig{BindAddr: "127.0.0.1:0", Keys: []string{base64.StdEncoding.EncodeToString([]byte("short"))}, ProbeInterval: time.Second, SuspectTimeout: time.Second})
+	assert.Error(t, err)
+	_, err = NewGossipNodeTracker(GossipConfig{BindAddr: "127.0.0.1:0"})
+	assert.Error(t, err)
+}
+
+func TestGossipSentFrom(t *testing.T) {
+	t.Parallel()
+	from := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 7946}
+	assert.True(t, sentFrom(from, "127.0.0.1:7946"))
+	assert.False(t, sentFrom(from, "127.0.0.2:7946"), "another member's address")
+	assert.False(t, sentFrom(from, "127.0.0.1:7947"))
+	assert.False(t, sentFrom(from, "not an address"))
+}
+
+func TestGossipIgnoresSpoofedSender(t *testing.T) {
+	t.Parallel()
+	gnt, err := NewGossipNodeTracker(GossipConfig{BindAddr: "127.0.0.1:0", ProbeInterval: time.Second, SuspectTimeout: time.Second})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		gnt.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	send := func(from string, member gossipMember) {
+		packet, err := json.Marshal(&gossipMessage{Type: gossipSyncReply, From: from, Members: []gossipMember{member}})
+		require.NoError(t, err)
+		_, err = conn.WriteTo(packet, gnt.conn.LocalAddr())
+		require.NoError(t, err)
+	}
+
+	send("127.0.0.1:1", gossipMember{Addr: "127.0.0.1:1", NodeID: "10.0.0.1:8080", Incarnation: 1})
+	send(conn.LocalAddr().String(), gossipMember{Addr: conn.LocalAddr().String(), NodeID: "10.0.0.2:8080", Incarnation: 1})
+	waitFor(t, time.Second, listsEqual(gnt, []string{"10.0.0.2:8080"}), "the member sending from its own address must be accepted")
+	assert.Equal(t, []string{"10.0.0.2:8080"}, gnt.List(), "the spoofed member must be ignored")
+}
+
+func TestGossipSyncContactsSeeds(t *testing.T) {
+	t.Parallel()
+	seed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer seed.Close()
+	gnt, err := NewGossipNodeTracker(GossipConfig{BindAddr: "127.0.0.1:0", Seeds: []string{seed.LocalAddr().String()}, ProbeInterval: time.Second, SuspectTimeout: time.Second})
+	require.NoError(t, err)
+	defer gnt.conn.Close()
+
+	// A peer other than the seed is known, but the seed is still contacted
+	gnt.merge([]gossipMember{{Addr: "127.0.0.1:1", Incarnation: 1}})
+	gnt.sync()
+	require.NoError(t, seed.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, gossipMaxMessageSize)
+	n, _, err := seed.ReadFrom(buf)
+	require.NoError(t, err)
+	var msg gossipMessage
+	require.NoError(t, json.Unmarshal(buf[:n], &msg))
+	assert.Equal(t, gossipSync, msg.Type)
+}
@@ -2,49 +2,122 @@ package nodes
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"os"
 	"sort"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"github.com/go-redis/redis"
 	"github.com/sirupsen/logrus"
 )
 
-var (
-	errNoNodes = errors.New("no nodes available")
+const (
+	// presenceVersion is the version of the presence message format.
+	presenceVersion = 1
+	// maxNodeIDLength is the longest node ID accepted in a presence message.
+	maxNodeIDLength = 256
 )
 
+// RedisConfig configures a NodeTracker based on a Redis backend.
+type RedisConfig struct {
+	Addr           string      // Address of the Redis server, unless using Sentinel
+	Password       string      // Password for the Redis server, empty for none
+	DB             int         // Database number
+	TLSConfig      *tls.Config // Connects with TLS if not nil
+	SentinelAddrs  []string    // Addresses of Sentinels to find the master through, instead of using Addr
+	SentinelMaster string      // Name of the master monitored by the Sentinels
+
+	Namespace      string        // PubSub channel the cluster uses
+	NodeID         string        // Address announced to the cluster, empty to only watch the cluster
+	Weight         float64       // Relative share of keys this node owns
+	SigningKey     string        // Key presence messages are signed and verified with, empty to not sign them
+	UpdateInterval time.Duration // How often this node announces itself
+	ExpiryInterval time.Duration // How long a node is tracked after it last announced itself
+}
+
+// presence is the message a node announces itself to the cluster with.
+type presence struct {
+	Version   int     `json:"v"`
+	NodeID    string  `json:"node"`             // Address metrics are sent to
+	Host      string  `json:"host,omitempty"`   // Hostname of the node, for diagnostics
+	Weight    float64 `json:"weight,omitempty"` // Relative share of keys the node owns
+	Timestamp int64   `json:"ts"`               // Unix time in nanoseconds when the message was sent
+	Signature string  `json:"sig,omitempty"`    // Hex encoded HMAC-SHA256 of the message without the signature
+}
+
 type redisNodeTracker struct {
-	client    *redis.Client
-	namespace string
-	nodeid    string
-	nodes     nodeList
+	client     *redis.Client
+	namespace  string
+	nodeid     string
+	weight     float64
+	host       string
+	signingKey []byte
+	nodes      nodeList
 
 	updateInterval time.Duration
 	expiryInterval time.Duration
 
 	rw sync.RWMutex // protects the nodes list, not the individual members in the list
 
+	watchers watchers
+
 	// for testing
 	now func() time.Time
 }
 
 // NewRedisNodeTracker returns a NodeTracker based on a Redis backend
 func NewRedisNodeTracker(redisAddr, namespace, nodeid string, updateInterval, expiryInterval time.Duration) NodeTracker {
-	options := &redis.Options{
-		Addr: redisAddr,
-		DB:   0,
+	return NewRedisNodeTrackerFromConfig(RedisConfig{
+		Addr:           redisAddr,
+		Namespace:      namespace,
+		NodeID:         nodeid,
+		UpdateInterval: updateInterval,
+		ExpiryInterval: expiryInterval,
+	})
+}
+
+// NewRedisNodeTrackerFromConfig returns a NodeTracker based on a Redis backend, which connects to a single server or
+// through Sentinel, optionally with a password and TLS.
+func NewRedisNodeTrackerFromConfig(config RedisConfig) NodeTracker {
+	var client *redis.Client
+	if len(config.SentinelAddrs) > 0 {
+		client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    config.SentinelMaster,
+			SentinelAddrs: config.SentinelAddrs,
+			Password:      config.Password,
+			DB:            config.DB,
+			TLSConfig:     config.TLSConfig,
+		})
+	} else {
+		client = redis.NewClient(&redis.Options{
+			Addr:      config.Addr,
+			Password:  config.Password,
+			DB:        config.DB,
+			TLSConfig: config.TLSConfig,
+		})
 	}
+	host, _ := os.Hostname()
 
 	return &redisNodeTracker{
-		client:    redis.NewClient(options),
-		namespace: namespace,
-		nodeid:    nodeid,
-		nodes:     make(nodeList, 0, 10),
+		client:     client,
+		namespace:  config.Namespace,
+		nodeid:     config.NodeID,
+		weight:     config.Weight,
+		host:       host,
+		signingKey: []byte(config.SigningKey),
+		nodes:      make(nodeList, 0, 10),
 
-		updateInterval: updateInterval,
-		expiryInterval: expiryInterval,
+		updateInterval: config.UpdateInterval,
+		expiryInterval: config.ExpiryInterval,
 
 		now: time.Now,
 	}
@@ -68,15 +141,14 @@ func (rnt *redisNodeTracker) Run(ctx context.Context) {
 			return
 		case <-ticker.C:
 			rnt.expireNodes()
-			if rnt.nodeid != "" {
-				err := rnt.emitPresence()
-				if err != nil {
-					logrus.Warningf("Failed to check in to cluster")
-				}
+			err := rnt.emitPresence()
+			if err != nil {
+				logrus.WithError(err).Warning("Failed to check in to cluster")
 			}
 		case msg := <-psChan:
-			// TODO: Validate msg
-			rnt.updateNode(msg.Payload)
+			if err := rnt.handlePresence(msg.Payload); err != nil {
+				logrus.WithError(err).Warning("Invalid cluster presence message")
+			}
 		}
 	}
 }
@@ -87,11 +159,7 @@ func (rnt *redisNodeTracker) List() []string {
 	// Does not talk to Redis
 	rnt.rw.RLock()
 	defer rnt.rw.RUnlock()
-	nodes := make([]string, len(rnt.nodes))
-	for idx, node := range rnt.nodes {
-		nodes[idx] = node.nodeid
-	}
-	return nodes
+	return rnt.nodes.ids()
 }
 
 // Select will use the provided key to pick a node and return it.  An error will
@@ -100,10 +168,12 @@ func (rnt *redisNodeTracker) Select(key uint64) (string, error) {
 	// Does not talk to Redis
 	rnt.rw.RLock()
 	defer rnt.rw.RUnlock()
-	if len(rnt.nodes) == 0 {
-		return "", errNoNodes
-	}
-	return rnt.nodes[key%uint64(len(rnt.nodes))].nodeid, nil
+	return rnt.nodes.selectNode(key)
+}
+
+// Watch returns a channel which receives changes to the tracked nodes.  Thread safe.
+func (rnt *redisNodeTracker) Watch() <-chan MembershipChange {
+	return rnt.watchers.watch()
 }
 
 // expireNodes will expire nodes which have not updated recently enough. Thread safe,
@@ -115,53 +185,164 @@ func (rnt *redisNodeTracker) expireNodes() {
 	defer rnt.rw.Unlock()
 
 	// https://github.com/golang/go/wiki/SliceTricks#filtering-without-allocating
+	var removed []string
 	nodes := rnt.nodes[:0]
 	for _, node := range rnt.nodes {
 		if now.Before(node.expiry) {
 			// 	Keep it
 			nodes = append(nodes, node)
+		} else {
+			removed = append(removed, node.nodeid)
 		}
 	}
 	rnt.nodes = nodes
+	rnt.watchers.notify(MembershipChange{Removed: removed, Nodes: nodes.ids()})
 }
 
 // updateNode will attempt to update the expiry on an existing node, if it
 // doesn't exist, it will be added under the write lock.
 func (rnt *redisNodeTracker) updateNode(nodeid string) {
+	rnt.updateWeightedNode(nodeid, 1)
+}
+
+// updateWeightedNode is updateNode for a node with a weight.  If the weight of
+// an existing node has changed, it is updated under the write lock.
+func (rnt *redisNodeTracker) updateWeightedNode(nodeid string, weight float64) {
 	// Does not talk to Redis
-	if rnt.tryUpdateExistingNode(nodeid) {
+	node := newNode(nodeid, weight, time.Time{})
+	if rnt.tryUpdateExistingNode(nodeid, node.weight) {
 		return
 	}
 
-	node := &node{
-		nodeid: nodeid,
-		expiry: rnt.now().Add(5 * time.Second),
-	}
+	node.expiry = rnt.now().Add(rnt.expiryInterval)
 
 	rnt.rw.Lock()
 	defer rnt.rw.Unlock()
+	for _, existing := range rnt.nodes {
+		if existing.nodeid == nodeid {
+			// Added since tryUpdateExistingNode, or the weight changed
+			existing.expiry = node.expiry
+			existing.weight = node.weight
+			return
+		}
+	}
 	rnt.nodes = append(rnt.nodes, node)
 	sort.Sort(rnt.nodes)
+	rnt.watchers.notify(MembershipChange{Added: []string{nodeid}, Nodes: rnt.nodes.ids()})
 }
 
 // tryUpdateExistingNode will update a nodes expiry time in place if it exists
-// and returns true if it succeeds.  Prevents taking the write lock.
-func (rnt *redisNodeTracker) tryUpdateExistingNode(nodeid string) bool {
+// with the same weight, and returns true if it succeeds.  Prevents taking the
+// write lock.
+func (rnt *redisNodeTracker) tryUpdateExistingNode(nodeid string, weight float64) bool {
 	// Does not talk to redis
 	rnt.rw.RLock()
 	defer rnt.rw.RUnlock()
 	for _, node := range rnt.nodes {
-		if node.nodeid == nodeid {
-			node.expiry = rnt.now().Add(5 * time.Second)
+		if node.nodeid == nodeid && node.weight == weight {
+			node.expiry = rnt.now().Add(rnt.expiryInterval)
 			return true
 		}
 	}
 	return false
 }
 
-// emitPresence will announce the presence of this node to the PubSub endpoint
+// emitPresence will announce the presence of this node to the PubSub endpoint.  A tracker without a node id, such as
+// the one a forwarder uses to find aggregators, only watches the cluster and never announces itself.
 func (rnt *redisNodeTracker) emitPresence() error {
+	if rnt.nodeid == "" {
+		return nil
+	}
 	// Talks to redis
-	cmd := rnt.client.Publish(rnt.namespace, rnt.nodeid)
+	payload, err := rnt.presencePayload()
+	if err != nil {
+		return err
+	}
+	cmd := rnt.client.Publish(rnt.namespace, payload)
 	return cmd.Err()
 }
+
+// presencePayload returns the message announcing this node, signed if there is a signing key.
+func (rnt *redisNodeTracker) presencePayload() (string, error) {
+	p := presence{
+		Version:   presenceVersion,
+		NodeID:    rnt.nodeid,
+		Host:      rnt.host,
+		Weight:    rnt.weight,
+		Timestamp: rnt.now().UnixNano(),
+	}
+	if len(rnt.signingKey) > 0 {
+		signature, err := rnt.sign(&p)
+		if err != nil {
+			return "", err
+		}
+		p.Signature = signature
+	}
+	payload, err := json.Marshal(&p)
+	if err != nil {
+		return "", err
+	}
+	return string(payload), nil
+}
+
+// sign returns the signature of a presence message, which must not be signed yet.
+func (rnt *redisNodeTracker) sign(p *presence) (string, error) {
+	unsigned, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, rnt.signingKey)
+	_, _ = mac.Write(unsigned)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// handlePresence validates a presence message, and tracks the node it announces.  Messages which are unsigned when
+// there is a signing key, or which were sent more than the expiry interval ago or in the future, are rejected.  If
+// there is no signing key, a message which is only a node ID, as sent by older versions, is accepted.
+func (rnt *redisNodeTracker) handlePresence(payload string) error {
+	if !strings.HasPrefix(payload, "{") {
+		if len(rnt.signingKey) > 0 {
+			return errors.New("presence message is not signed")
+		}
+		if err := validateNodeID(payload); err != nil {
+			return err
+		}
+		rnt.updateNode(payload)
+		return nil
+	}
+
+	var p presence
+	if err := json.Unmarshal([]byte(payload), &p); err != nil {
+		return fmt.Errorf("malformed presence message: %v", err)
+	}
+	if p.Version != presenceVersion {
+		return fmt.Errorf("unsupported presence message version %d", p.Version)
+	}
+	if err := validateNodeID(p.NodeID); err != nil {
+		return err
+	}
+	if len(rnt.signingKey) > 0 {
+		signature := p.Signature
+		p.Signature = ""
+		expected, err := rnt.sign(&p)
+		if err != nil {
+			return err
+		}
+		if !hmac.Equal([]byte(signature), []byte(expected)) {
+			return fmt.Errorf("invalid signature on presence message from %q", p.NodeID)
+		}
+	}
+	if age := rnt.now().Sub(time.Unix(0, p.Timestamp)); age > rnt.expiryInterval || age < -rnt.expiryInterval {
+		return fmt.Errorf("presence message from %q is %v old", p.NodeID, age)
+	}
+	rnt.updateWeightedNode(p.NodeID, p.Weight)
+	return nil
+}
+
+// validateNodeID checks that a node ID is something which can be sent metrics.
+func validateNodeID(nodeid string) error {
+	if nodeid == "" || len(nodeid) > maxNodeIDLength || strings.IndexFunc(nodeid, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("invalid node ID %q", nodeid)
+	}
+	return nil
+}
@@ -3,11 +3,13 @@ package nodes
 import (
 	"context"
 	"fmt"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type fakeTime struct {
@@ -218,3 +220,142 @@ func BenchmarkParallelSelects(b *testing.B) {
 	cancel()
 	wg.Wait()
 }
+
+func TestRedisWatch(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+
+	rnt := &redisNodeTracker{
+		updateInterval: 1 * time.Second,
+		expiryInterval: 5 * time.Second,
+		now: (&fakeTime{
+			samples: []time.Time{
+				now,
+				now.Add(1000 * time.Millisecond),
+				now.Add(1500 * time.Millisecond),
+				now.Add(5500 * time.Millisecond),
+			},
+		}).Now,
+	}
+	changes := rnt.Watch()
+
+	rnt.updateNode("127.0.0.1:80") // time.sample[0] - will expire
+	rnt.updateNode("127.0.0.2:80") // time.sample[1] - will not expire
+	rnt.updateNode("127.0.0.2:80") // time.sample[2] - refresh, not a change
+	rnt.expireNodes()              // time.sample[3]
+
+	assert.Equal(t, MembershipChange{Added: []string{"127.0.0.1:80"}, Nodes: []string{"127.0.0.1:80"}}, <-changes)
+	assert.Equal(t, MembershipChange{Added: []string{"127.0.0.2:80"}, Nodes: []string{"127.0.0.1:80", "127.0.0.2:80"}}, <-changes)
+	assert.Equal(t, MembershipChange{Removed: []string{"127.0.0.1:80"}, Nodes: []string{"127.0.0.2:80"}}, <-changes)
+	assert.Len(t, changes, 0)
+}
+
+func newPresenceTracker(nodeid, signingKey string, now time.Time) *redisNodeTracker {
+	return &redisNodeTracker{
+		nodeid:         nodeid,
+		host:           "aggregator-1",
+		weight:         2,
+		signingKey:     []byte(signingKey),
+		expiryInterval: 10 * time.Second,
+		now:            func() time.Time { return now },
+	}
+}
+
+func TestWatchOnlyTrackerDoesNotAnnounce(t *testing.T) {
+	t.Parallel()
+	rnt := newPresenceTracker("", "", time.Now())
+	assert.NoError(t, rnt.emitPresence()) // Would use the nil client if it tried to publish
+}
+
+func TestPresenceRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	sender := newPresenceTracker("10.0.0.1:8080", "secret", now)
+	payload, err := sender.presencePayload()
+	require.NoError(t, err)
+
+	receiver := newPresenceTracker("", "secret", now.Add(time.Second))
+	require.NoError(t, receiver.handlePresence(payload))
+	require.Len(t, receiver.nodes, 1)
+	assert.Equal(t, "10.0.0.1:8080", receiver.nodes[0].nodeid)
+	assert.Equal(t, 2.0, receiver.nodes[0].weight)
+	assert.Equal(t, now.Add(11*time.Second), receiver.nodes[0].expiry, "the configured expiry must be used")
+
+	// A receiver without a key accepts signed messages
+	require.NoError(t, newPresenceTracker("", "", now).handlePresence(payload))
+}
+
+func TestPresenceValidation(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	signed, err := newPresenceTracker("10.0.0.1:8080", "secret", now).presencePayload()
+	require.NoError(t, err)
+	wrongKey, err := newPresenceTracker("10.0.0.1:8080", "guess", now).presencePayload()
+	require.NoError(t, err)
+	unsigned, err := newPresenceTracker("10.0.0.1:8080", "", now).presencePayload()
+	require.NoError(t, err)
+	stale, err := newPresenceTracker("10.0.0.1:8080", "secret", now.Add(-time.Minute)).presencePayload()
+	require.NoError(t, err)
+	future, err := newPresenceTracker("10.0.0.1:8080", "secret", now.Add(time.Minute)).presencePayload()
+	require.NoError(t, err)
+	tampered := strings.Replace(signed, "10.0.0.1", "10.6.6.6", 1)
+
+	for name, payload := range map[string]string{
+		"wrong key": wrongKey,
+		"unsigned":  unsigned,
+		"legacy":    "10.0.0.1:8080",
+		"stale":     stale,
+		"future":    future,
+		"tampered":  tampered,
+		"malformed": "{not json",
+		"version":   `{"v":2,"node":"10.0.0.1:8080"}`,
+	} {
+		receiver := newPresenceTracker("", "secret", now)
+		assert.Error(t, receiver.handlePresence(payload), name)
+		assert.Empty(t, receiver.nodes, name)
+	}
+
+	// Without a key, unsigned and legacy messages are accepted, but must still be valid
+	receiver := newPresenceTracker("", "", now)
+	assert.NoError(t, receiver.handlePresence(unsigned))
+	assert.NoError(t, receiver.handlePresence("10.0.0.2:8080"))
+	assert.Error(t, receiver.handlePresence(""))
+	assert.Error(t, receiver.handlePresence("10.0.0.3 8080"))
+	assert.Error(t, receiver.handlePresence(`{"v":1,"node":"","ts":1}`))
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080"}, receiver.List())
+}
+
+func TestConfiguredExpiry(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	rnt := &redisNodeTracker{
+		expiryInterval: 30 * time.Second,
+		now: (&fakeTime{
+			samples: []time.Time{
+				now,
+				now.Add(10 * time.Second),
+				now.Add(31 * time.Second),
+			},
+		}).Now,
+	}
+
+	rnt.updateNode("127.0.0.1:80") // time.sample[0]
+	rnt.expireNodes()              // time.sample[1] - would have expired with the old fixed 5s expiry
+	assert.Equal(t, []string{"127.0.0.1:80"}, rnt.List())
+	rnt.expireNodes() // time.sample[2]
+	assert.Empty(t, rnt.List())
+}
+
+func TestUpdateWeight(t *testing.T) {
+	t.Parallel()
+
+	rnt := newPresenceTracker("", "", time.Now())
+	rnt.updateWeightedNode("127.0.0.1:80", 1)
+	rnt.updateWeightedNode("127.0.0.1:80", 3)
+	require.Len(t, rnt.nodes, 1)
+	assert.Equal(t, 3.0, rnt.nodes[0].weight)
+}
@@ -0,0 +1,65 @@
+package nodes
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StaticNodeTracker is a NodeTracker for a list of nodes from configuration, which can be replaced while it is running.
+type StaticNodeTracker struct {
+	nodeSet
+}
+
+// NewStaticNodeTracker returns a NodeTracker for a list of nodes, in the format accepted by SetNodes.
+func NewStaticNodeTracker(nodes []string) (*StaticNodeTracker, error) {
+	snt := &StaticNodeTracker{}
+	if err := snt.SetNodes(nodes); err != nil {
+		return nil, err
+	}
+	return snt, nil
+}
+
+// Run does nothing until the context is closed, as the nodes only change when SetNodes is called.
+func (snt *StaticNodeTracker) Run(ctx context.Context) {
+	<-ctx.Done()
+}
+
+// SetNodes replaces the tracked nodes.  Each node is an address, optionally followed by = and its weight, such as
+// 10.0.0.1:8080=2.  Nothing is changed if any node is invalid.  Thread safe.
+func (snt *StaticNodeTracker) SetNodes(nodes []string) error {
+	nl := make(nodeList, 0, len(nodes))
+	seen := make(map[string]bool, len(nodes))
+	for _, s := range nodes {
+		n, err := parseStaticNode(s)
+		if err != nil {
+			return err
+		}
+		if seen[n.nodeid] {
+			return fmt.Errorf("duplicate node %q", n.nodeid)
+		}
+		seen[n.nodeid] = true
+		nl = append(nl, n)
+	}
+	snt.replace(nl)
+	return nil
+}
+
+// parseStaticNode parses a node in the format accepted by SetNodes.
+func parseStaticNode(s string) (*node, error) {
+	nodeid := strings.TrimSpace(s)
+	weight := 1.0
+	if idx := strings.LastIndexByte(nodeid, '='); idx >= 0 {
+		var err error
+		if weight, err = strconv.ParseFloat(nodeid[idx+1:], 64); err != nil || weight <= 0 {
+			return nil, fmt.Errorf("invalid weight for node %q", s)
+		}
+		nodeid = nodeid[:idx]
+	}
+	if nodeid == "" || strings.ContainsAny(nodeid, " \t") {
+		return nil, fmt.Errorf("invalid node %q", s)
+	}
+	return newNode(nodeid, weight, time.Time{}), nil
+}
@@ -0,0 +1,46 @@
+package nodes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticNodeTracker(t *testing.T) {
+	t.Parallel()
+
+	snt, err := NewStaticNodeTracker([]string{"10.0.0.2:8080=2", "10.0.0.1:8080"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080"}, snt.List())
+	assert.Equal(t, 2.0, snt.nodes[1].weight)
+	changes := snt.Watch()
+
+	require.NoError(t, snt.SetNodes([]string{"10.0.0.2:8080", "http://10.0.0.3:8080"}))
+	assert.Equal(t, MembershipChange{
+		Added:   []string{"http://10.0.0.3:8080"},
+		Removed: []string{"10.0.0.1:8080"},
+		Nodes:   []string{"10.0.0.2:8080", "http://10.0.0.3:8080"},
+	}, <-changes)
+
+	require.NoError(t, snt.SetNodes(nil))
+	_, err = snt.Select(0)
+	assert.Error(t, err)
+}
+
+func TestStaticNodeTrackerInvalid(t *testing.T) {
+	t.Parallel()
+
+	snt, err := NewStaticNodeTracker([]string{"10.0.0.1:8080"})
+	require.NoError(t, err)
+	for _, nodes := range [][]string{
+		{""},
+		{"10.0.0.1:8080=0"},
+		{"10.0.0.1:8080=heavy"},
+		{"10.0.0.1 8080"},
+		{"10.0.0.2:8080", "10.0.0.2:8080=2"},
+	} {
+		assert.Error(t, snt.SetNodes(nodes), "%v", nodes)
+	}
+	assert.Equal(t, []string{"10.0.0.1:8080"}, snt.List(), "nodes must not change if any are invalid")
+}
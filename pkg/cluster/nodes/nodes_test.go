@@ -0,0 +1,92 @@
+package nodes
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const selectKeys = 100000
+
+func newTestNodeList(weights ...float64) nodeList {
+	var nl nodeList
+	for idx, weight := range weights {
+		nl = append(nl, newNode(fmt.Sprintf("10.0.0.%d:8080", idx+1), weight, time.Time{}))
+	}
+	return nl
+}
+
+func countOwners(t *testing.T, nl nodeList) map[string]int {
+	owners := map[string]int{}
+	for key := uint64(0); key < selectKeys; key++ {
+		owner, err := nl.selectNode(key)
+		require.NoError(t, err)
+		owners[owner]++
+	}
+	return owners
+}
+
+func TestSelectNodeEmpty(t *testing.T) {
+	t.Parallel()
+	_, err := nodeList(nil).selectNode(0)
+	assert.Equal(t, errNoNodes, err)
+}
+
+func TestSelectNodeDistribution(t *testing.T) {
+	t.Parallel()
+	nl := newTestNodeList(1, 1, 1, 1)
+	for owner, count := range countOwners(t, nl) {
+		assert.InDelta(t, selectKeys/4, count, selectKeys/40, "%s owns %d keys", owner, count)
+	}
+}
+
+func TestSelectNodeWeighted(t *testing.T) {
+	t.Parallel()
+	nl := newTestNodeList(1, 2, 0)
+	owners := countOwners(t, nl)
+	// A weight of 0 is treated as 1, so the shares are 1:2:1
+	assert.InDelta(t, selectKeys/4, owners["10.0.0.1:8080"], selectKeys/40)
+	assert.InDelta(t, selectKeys/2, owners["10.0.0.2:8080"], selectKeys/40)
+	assert.InDelta(t, selectKeys/4, owners["10.0.0.3:8080"], selectKeys/40)
+}
+
+func TestSelectNodeMinimalMovement(t *testing.T) {
+	t.Parallel()
+	before := newTestNodeList(1, 1, 1, 1)
+	after := before[:3] // 10.0.0.4 leaves
+
+	moved := 0
+	for key := uint64(0); key < selectKeys; key++ {
+		ownerBefore, err := before.selectNode(key)
+		require.NoError(t, err)
+		ownerAfter, err := after.selectNode(key)
+		require.NoError(t, err)
+		if ownerBefore != ownerAfter {
+			require.Equal(t, "10.0.0.4:8080", ownerBefore, "only keys owned by the node which left should move")
+			moved++
+		}
+	}
+	assert.InDelta(t, selectKeys/4, moved, selectKeys/40)
+}
+
+func TestWatchers(t *testing.T) {
+	t.Parallel()
+	var w watchers
+	ch1 := w.watch()
+	ch2 := w.watch()
+
+	w.notify(MembershipChange{Nodes: []string{"a"}}) // Empty changes are not sent
+	change := MembershipChange{Added: []string{"b"}, Nodes: []string{"a", "b"}}
+	w.notify(change)
+	assert.Equal(t, change, <-ch1)
+	assert.Equal(t, change, <-ch2)
+
+	// A watcher which falls behind misses changes rather than blocking
+	for i := 0; i < watchBuffer+1; i++ {
+		w.notify(change)
+	}
+	assert.Len(t, ch1, watchBuffer)
+}
@@ -0,0 +1,164 @@
+package nodes
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/atlassian/gostatsd/internal/tlsconfig"
+)
+
+const (
+	defaultRedisAddr      = "127.0.0.1:6379"
+	defaultNamespace      = "gostatsd"
+	defaultUpdateInterval = time.Second
+	defaultExpiryInterval = 30 * time.Second
+	defaultDNSRecord      = "srv"
+	defaultDNSMinInterval = 5 * time.Second
+	defaultDNSMaxInterval = time.Minute
+	defaultGossipBind     = "0.0.0.0:7946" // For members which announce a node
+	defaultGossipWatch    = "0.0.0.0:7947" // For members which only watch, so a forwarder and aggregator can share a host
+	defaultGossipProbe    = time.Second
+	defaultGossipSuspect  = 5 * time.Second
+)
+
+// NewNodeTrackerFromViper returns the NodeTracker configured by the type setting, announcing nodeid to the cluster if
+// it is not empty.  Returns nil if no type is configured.
+func NewNodeTrackerFromViper(v *viper.Viper, nodeid string) (NodeTracker, error) {
+	v.SetDefault("type", "")
+	v.SetDefault("redis-addr", defaultRedisAddr)
+	v.SetDefault("redis-password", "")
+	v.SetDefault("redis-password-file", "")
+	v.SetDefault("redis-db", 0)
+	v.SetDefault("redis-tls", false)
+	v.SetDefault("redis-tls-ca-path", "")
+	v.SetDefault("redis-tls-cert-path", "")
+	v.SetDefault("redis-tls-key-path", "")
+	v.SetDefault("redis-sentinel-addrs", []string{})
+	v.SetDefault("redis-sentinel-master", "")
+	v.SetDefault("redis-weight", 1.0)
+	v.SetDefault("signing-key", "")
+	v.SetDefault("signing-key-file", "")
+	v.SetDefault("namespace", defaultNamespace)
+	v.SetDefault("update-interval", defaultUpdateInterval)
+	v.SetDefault("expiry-interval", defaultExpiryInterval)
+	v.SetDefault("nodes", []string{})
+	v.SetDefault("dns-name", "")
+	v.SetDefault("dns-record", defaultDNSRecord)
+	v.SetDefault("dns-port", 0)
+	v.SetDefault("dns-server", "")
+	v.SetDefault("dns-min-interval", defaultDNSMinInterval)
+	v.SetDefault("dns-max-interval", defaultDNSMaxInterval)
+	if nodeid != "" {
+		v.SetDefault("gossip-bind", defaultGossipBind)
+	} else {
+		v.SetDefault("gossip-bind", defaultGossipWatch)
+	}
+	v.SetDefault("gossip-advertise", "")
+	v.SetDefault("gossip-seeds", []string{})
+	v.SetDefault("gossip-zone", "")
+	v.SetDefault("gossip-weight", 1.0)
+	v.SetDefault("gossip-prefer-zone", false)
+	v.SetDefault("gossip-keys", []string{})
+	v.SetDefault("gossip-probe-interval", defaultGossipProbe)
+	v.SetDefault("gossip-suspect-timeout", defaultGossipSuspect)
+
+	switch trackerType := v.GetString("type"); trackerType {
+	case "":
+		return nil, nil
+	case "redis":
+		tlsConfig, err := tlsconfig.Client(
+			v.GetString("redis-tls-ca-path"),
+			v.GetString("redis-tls-cert-path"),
+			v.GetString("redis-tls-key-path"),
+			v.GetBool("redis-tls"),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Redis TLS configuration: %v", err)
+		}
+		sentinelAddrs := v.GetStringSlice("redis-sentinel-addrs")
+		if len(sentinelAddrs) > 0 && v.GetString("redis-sentinel-master") == "" {
+			return nil, errors.New("redis-sentinel-master is required with redis-sentinel-addrs")
+		}
+		if v.GetDuration("expiry-interval") <= 0 {
+			return nil, errors.New("expiry-interval must be positive")
+		}
+		password, err := secret(v, "redis-password")
+		if err != nil {
+			return nil, err
+		}
+		signingKey, err := secret(v, "signing-key")
+		if err != nil {
+			return nil, err
+		}
+		return NewRedisNodeTrackerFromConfig(RedisConfig{
+			Addr:           v.GetString("redis-addr"),
+			Password:       password,
+			DB:             v.GetInt("redis-db"),
+			TLSConfig:      tlsConfig,
+			SentinelAddrs:  sentinelAddrs,
+			SentinelMaster: v.GetString("redis-sentinel-master"),
+			Namespace:      v.GetString("namespace"),
+			NodeID:         nodeid,
+			Weight:         v.GetFloat64("redis-weight"),
+			SigningKey:     signingKey,
+			UpdateInterval: v.GetDuration("update-interval"),
+			ExpiryInterval: v.GetDuration("expiry-interval"),
+		}), nil
+	case "static":
+		snt, err := NewStaticNodeTracker(v.GetStringSlice("nodes"))
+		if err != nil {
+			return nil, err
+		}
+		return snt, nil
+	case "dns":
+		return NewDNSNodeTracker(
+			v.GetString("dns-name"),
+			v.GetString("dns-record"),
+			v.GetInt("dns-port"),
+			v.GetString("dns-server"),
+			v.GetDuration("dns-min-interval"),
+			v.GetDuration("dns-max-interval"),
+		)
+	case "gossip":
+		gnt, err := NewGossipNodeTracker(GossipConfig{
+			BindAddr:       v.GetString("gossip-bind"),
+			AdvertiseAddr:  v.GetString("gossip-advertise"),
+			NodeID:         nodeid,
+			Zone:           v.GetString("gossip-zone"),
+			Weight:         v.GetFloat64("gossip-weight"),
+			PreferZone:     v.GetBool("gossip-prefer-zone"),
+			Seeds:          v.GetStringSlice("gossip-seeds"),
+			Keys:           v.GetStringSlice("gossip-keys"),
+			ProbeInterval:  v.GetDuration("gossip-probe-interval"),
+			SuspectTimeout: v.GetDuration("gossip-suspect-timeout"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return gnt, nil
+	default:
+		return nil, fmt.Errorf("unknown node tracker type %q", trackerType)
+	}
+}
+
+// secret returns the value of the setting key, or the contents of the file named by the setting key-file, so a secret
+// can be kept out of the configuration file.  Trailing whitespace is trimmed from the file.
+func secret(v *viper.Viper, key string) (string, error) {
+	path := v.GetString(key + "-file")
+	if path == "" {
+		return v.GetString(key), nil
+	}
+	if v.GetString(key) != "" {
+		return "", fmt.Errorf("only one of %s and %s-file may be set", key, key)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s-file: %v", key, err)
+	}
+	return strings.TrimRight(string(data), " \t\r\n"), nil
+}
@@ -0,0 +1,98 @@
+package nodes
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewNodeTrackerFromViper(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "nodes_viper_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	v := viper.New()
+	tracker, err := NewNodeTrackerFromViper(v, "")
+	require.NoError(t, err)
+	assert.Nil(t, tracker)
+
+	v.Set("type", "redis")
+	v.Set("namespace", "aggregators")
+	tracker, err = NewNodeTrackerFromViper(v, "10.0.0.1:8080")
+	require.NoError(t, err)
+	rnt := tracker.(*redisNodeTracker)
+	assert.Equal(t, "aggregators", rnt.namespace)
+	assert.Equal(t, "10.0.0.1:8080", rnt.nodeid)
+	assert.Equal(t, defaultExpiryInterval, rnt.expiryInterval)
+
+	v.Set("redis-sentinel-addrs", []string{"10.0.0.10:26379"})
+	_, err = NewNodeTrackerFromViper(v, "")
+	assert.Error(t, err, "a master name is required with Sentinel")
+	v.Set("redis-sentinel-master", "statsd")
+	v.Set("redis-tls", true)
+	v.Set("signing-key", "secret")
+	tracker, err = NewNodeTrackerFromViper(v, "")
+	require.NoError(t, err)
+	rnt = tracker.(*redisNodeTracker)
+	assert.Equal(t, []byte("secret"), rnt.signingKey)
+
+	keyFile := filepath.Join(dir, "signing-key")
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("from-file\n"), 0600))
+	v.Set("signing-key-file", keyFile)
+	_, err = NewNodeTrackerFromViper(v, "")
+	assert.Error(t, err, "only one of signing-key and signing-key-file may be set")
+	v.Set("signing-key", "")
+	tracker, err = NewNodeTrackerFromViper(v, "")
+	require.NoError(t, err)
+	rnt = tracker.(*redisNodeTracker)
+	assert.Equal(t, []byte("from-file"), rnt.signingKey)
+	v.Set("signing-key-file", filepath.Join(dir, "missing"))
+	_, err = NewNodeTrackerFromViper(v, "")
+	assert.Error(t, err)
+	v.Set("signing-key-file", "")
+
+	v.Set("redis-tls-cert-path", "client.pem")
+	_, err = NewNodeTrackerFromViper(v, "")
+	assert.Error(t, err, "a key is required with a client certificate")
+
+	v.Set("type", "static")
+	v.Set("nodes", []string{"10.0.0.1:8080", "10.0.0.2:8080=2"})
+	tracker, err = NewNodeTrackerFromViper(v, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080"}, tracker.List())
+
+	v.Set("nodes", []string{"10.0.0.1:8080=0"})
+	tracker, err = NewNodeTrackerFromViper(v, "")
+	assert.Error(t, err)
+	assert.Nil(t, tracker)
+
+	v.Set("type", "dns")
+	v.Set("dns-name", "aggregators.local")
+	v.Set("dns-record", "a")
+	v.Set("dns-port", 8080)
+	v.Set("dns-server", "127.0.0.1:53")
+	tracker, err = NewNodeTrackerFromViper(v, "")
+	require.NoError(t, err)
+	dnt := tracker.(*dnsNodeTracker)
+	assert.Equal(t, "aggregators.local.", dnt.name)
+	assert.Equal(t, defaultDNSMinInterval, dnt.minInterval)
+
+	v.Set("type", "gossip")
+	v.Set("gossip-bind", "127.0.0.1:0")
+	v.Set("gossip-zone", "edge-1")
+	tracker, err = NewNodeTrackerFromViper(v, "10.0.0.1:8080")
+	require.NoError(t, err)
+	gnt := tracker.(*GossipNodeTracker)
+	defer gnt.conn.Close()
+	assert.Equal(t, []GossipMember{{Addr: gnt.Addr(), NodeID: "10.0.0.1:8080", Zone: "edge-1", Weight: 1, State: "alive"}}, gnt.Members())
+
+	v.Set("type", "zookeeper")
+	_, err = NewNodeTrackerFromViper(v, "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,197 @@
+package rules
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// sample is a single value of a series.
+type sample struct {
+	value    float64
+	hostname string
+	tags     gostatsd.Tags
+}
+
+// result is the result of evaluating a node, either a scalar, or a vector of samples keyed by tags and hostname.
+type result struct {
+	scalar   float64
+	vector   map[string]sample
+	isScalar bool
+}
+
+type node interface {
+	eval(mm *gostatsd.MetricMap) (result, error)
+}
+
+type numberNode float64
+
+func (n numberNode) eval(mm *gostatsd.MetricMap) (result, error) {
+	return result{scalar: float64(n), isScalar: true}, nil
+}
+
+// metricNode evaluates to the values of all counters and gauges with the name.  It is an error for a counter and a
+// gauge to have the same name, tags and hostname, as it is ambiguous which one is meant.
+type metricNode string
+
+func (n metricNode) eval(mm *gostatsd.MetricMap) (result, error) {
+	vector := map[string]sample{}
+	for tagsKey, c := range mm.Counters[string(n)] {
+		vector[tagsKey] = sample{c.Value, c.Hostname, c.Tags}
+	}
+	for tagsKey, g := range mm.Gauges[string(n)] {
+		if _, ok := vector[tagsKey]; ok {
+			return result{}, fmt.Errorf("%s is both a counter and a gauge with tags %q", string(n), tagsKey)
+		}
+		vector[tagsKey] = sample{g.Value, g.Hostname, g.Tags}
+	}
+	return result{vector: vector}, nil
+}
+
+// binaryNode applies an arithmetic operator.  Between two vectors, only samples with the same tags and hostname on
+// both sides produce a result.  A scalar is applied to every sample of a vector.  Division by zero produces nothing.
+type binaryNode struct {
+	op          byte
+	left, right node
+}
+
+func (n *binaryNode) apply(l, r float64) (float64, bool) {
+	switch n.op {
+	case '+':
+		return l + r, true
+	case '-':
+		return l - r, true
+	case '*':
+		return l * r, true
+	default:
+		if r == 0 {
+			return 0, false
+		}
+		return l / r, true
+	}
+}
+
+func (n *binaryNode) eval(mm *gostatsd.MetricMap) (result, error) {
+	l, err := n.left.eval(mm)
+	if err != nil {
+		return result{}, err
+	}
+	r, err := n.right.eval(mm)
+	if err != nil {
+		return result{}, err
+	}
+	if l.isScalar && r.isScalar {
+		if v, ok := n.apply(l.scalar, r.scalar); ok {
+			return result{scalar: v, isScalar: true}, nil
+		}
+		return result{vector: map[string]sample{}}, nil
+	}
+	vector := map[string]sample{}
+	switch {
+	case l.isScalar:
+		for key, s := range r.vector {
+			if v, ok := n.apply(l.scalar, s.value); ok {
+				vector[key] = sample{v, s.hostname, s.tags}
+			}
+		}
+	case r.isScalar:
+		for key, s := range l.vector {
+			if v, ok := n.apply(s.value, r.scalar); ok {
+				vector[key] = sample{v, s.hostname, s.tags}
+			}
+		}
+	default:
+		for key, ls := range l.vector {
+			if rs, ok := r.vector[key]; ok {
+				if v, ok := n.apply(ls.value, rs.value); ok {
+					vector[key] = sample{v, ls.hostname, ls.tags}
+				}
+			}
+		}
+	}
+	return result{vector: vector}, nil
+}
+
+type aggregation func(values []float64) float64
+
+var aggregations = map[string]aggregation{
+	"sum": func(values []float64) float64 {
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum
+	},
+	"avg": func(values []float64) float64 {
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values))
+	},
+	"min": func(values []float64) float64 {
+		min := math.Inf(1)
+		for _, v := range values {
+			min = math.Min(min, v)
+		}
+		return min
+	},
+	"max": func(values []float64) float64 {
+		max := math.Inf(-1)
+		for _, v := range values {
+			max = math.Max(max, v)
+		}
+		return max
+	},
+}
+
+// aggregateNode aggregates the samples of a vector into one sample per distinct value of the tag keys in by.  The
+// hostname and all other tags are dropped.  A scalar is returned unchanged.
+type aggregateNode struct {
+	fn   aggregation
+	expr node
+	by   []string
+}
+
+func (n *aggregateNode) eval(mm *gostatsd.MetricMap) (result, error) {
+	r, err := n.expr.eval(mm)
+	if err != nil || r.isScalar {
+		return r, err
+	}
+	type group struct {
+		tags   gostatsd.Tags
+		values []float64
+	}
+	groups := map[string]*group{}
+	for _, s := range r.vector {
+		tags := n.groupTags(s.tags)
+		key := gostatsd.FormatTagsKey("", tags)
+		g, ok := groups[key]
+		if !ok {
+			g = &group{tags: tags}
+			groups[key] = g
+		}
+		g.values = append(g.values, s.value)
+	}
+	vector := make(map[string]sample, len(groups))
+	for key, g := range groups {
+		vector[key] = sample{value: n.fn(g.values), tags: g.tags}
+	}
+	return result{vector: vector}, nil
+}
+
+// groupTags returns the tags with keys in n.by.  A tag without a value is treated as a key with an empty value.
+func (n *aggregateNode) groupTags(tags gostatsd.Tags) gostatsd.Tags {
+	var groupTags gostatsd.Tags
+	for _, key := range n.by {
+		for _, tag := range tags {
+			if tag == key || strings.HasPrefix(tag, key+":") {
+				groupTags = append(groupTags, tag)
+				break
+			}
+		}
+	}
+	return groupTags
+}
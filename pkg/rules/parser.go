@@ -0,0 +1,250 @@
+package rules
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expressions are parsed using the grammar:
+//
+//   expr    = term { ("+" | "-") term }
+//   term    = unary { ("*" | "/") unary }
+//   unary   = "-" unary | primary
+//   primary = number | name | "(" expr ")" | agg "(" expr ")" [ "by" "(" name { "," name } ")" ]
+//   agg     = "sum" | "avg" | "min" | "max"
+//
+// Names are metric names or tag keys.  They start with a letter or underscore, and contain letters, digits,
+// underscores and dots.  Any other name can be written in double quotes.
+
+type tokenType int
+
+const (
+	tokEOF tokenType = iota
+	tokNumber
+	tokName
+	tokString
+	tokLParen
+	tokRParen
+	tokComma
+	tokOperator
+)
+
+type token struct {
+	typ tokenType
+	val string
+	pos int
+}
+
+func (t token) String() string {
+	if t.typ == tokEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("%q at position %d", t.val, t.pos)
+}
+
+func isNameStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isNameChar(r rune) bool {
+	return r == '_' || r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func lex(expression string) ([]token, error) {
+	var tokens []token
+	input := []rune(expression)
+	for pos := 0; pos < len(input); {
+		r := input[pos]
+		switch {
+		case unicode.IsSpace(r):
+			pos++
+		case r == '(':
+			tokens = append(tokens, token{tokLParen, "(", pos})
+			pos++
+		case r == ')':
+			tokens = append(tokens, token{tokRParen, ")", pos})
+			pos++
+		case r == ',':
+			tokens = append(tokens, token{tokComma, ",", pos})
+			pos++
+		case strings.ContainsRune("+-*/", r):
+			tokens = append(tokens, token{tokOperator, string(r), pos})
+			pos++
+		case r == '"':
+			end := pos + 1
+			for end < len(input) && input[end] != '"' {
+				end++
+			}
+			if end == len(input) {
+				return nil, fmt.Errorf("unterminated string at position %d", pos)
+			}
+			tokens = append(tokens, token{tokString, string(input[pos+1 : end]), pos})
+			pos = end + 1
+		case unicode.IsDigit(r):
+			end := pos
+			for end < len(input) && (unicode.IsDigit(input[end]) || input[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, token{tokNumber, string(input[pos:end]), pos})
+			pos = end
+		case isNameStart(r):
+			end := pos
+			for end < len(input) && isNameChar(input[end]) {
+				end++
+			}
+			tokens = append(tokens, token{tokName, string(input[pos:end]), pos})
+			pos = end
+		default:
+			return nil, fmt.Errorf("unexpected %q at position %d", r, pos)
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(input)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// parse parses an expression, returning the root node of the expression.
+func parse(expression string) (node, error) {
+	tokens, err := lex(expression)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	n, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ != tokEOF {
+		return nil, fmt.Errorf("unexpected %s", t)
+	}
+	return n, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.typ != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(typ tokenType, val string) error {
+	if t := p.next(); t.typ != typ {
+		return fmt.Errorf("expected %q, got %s", val, t)
+	}
+	return nil
+}
+
+func (p *parser) parseExpr() (node, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t.typ == tokOperator && (t.val == "+" || t.val == "-"); t = p.peek() {
+		p.next()
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: t.val[0], left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseTerm() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t.typ == tokOperator && (t.val == "*" || t.val == "/"); t = p.peek() {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: t.val[0], left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if t := p.peek(); t.typ == tokOperator && t.val == "-" {
+		p.next()
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &binaryNode{op: '-', left: numberNode(0), right: n}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.typ {
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", t)
+		}
+		return numberNode(f), nil
+	case tokString:
+		return metricNode(t.val), nil
+	case tokLParen:
+		n, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokRParen, ")"); err != nil {
+			return nil, err
+		}
+		return n, nil
+	case tokName:
+		if fn, ok := aggregations[t.val]; ok && p.peek().typ == tokLParen {
+			return p.parseAggregation(fn)
+		}
+		return metricNode(t.val), nil
+	}
+	return nil, fmt.Errorf("unexpected %s", t)
+}
+
+func (p *parser) parseAggregation(fn aggregation) (node, error) {
+	p.next() // "("
+	n, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(tokRParen, ")"); err != nil {
+		return nil, err
+	}
+	agg := &aggregateNode{fn: fn, expr: n}
+	if t := p.peek(); t.typ != tokName || t.val != "by" {
+		return agg, nil
+	}
+	p.next()
+	if err := p.expect(tokLParen, "("); err != nil {
+		return nil, err
+	}
+	for {
+		t := p.next()
+		if t.typ != tokName && t.typ != tokString {
+			return nil, fmt.Errorf("expected tag key, got %s", t)
+		}
+		agg.by = append(agg.by, t.val)
+		if t := p.next(); t.typ == tokRParen {
+			break
+		} else if t.typ != tokComma {
+			return nil, fmt.Errorf("expected \",\" or \")\", got %s", t)
+		}
+	}
+	return agg, nil
+}
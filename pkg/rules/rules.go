@@ -0,0 +1,148 @@
+// Package rules evaluates recording rules, which derive new metrics from aggregated metrics at flush time.
+package rules
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/viper"
+)
+
+// Rule is a named expression over aggregated counters and gauges.  The result of the expression is emitted as gauges
+// named metric.
+type Rule struct {
+	metric string
+	root   node
+}
+
+// NewRule parses expression into a Rule emitting gauges named metric.
+func NewRule(metric, expression string) (*Rule, error) {
+	if metric == "" {
+		return nil, fmt.Errorf("metric name is required")
+	}
+	root, err := parse(expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", expression, err)
+	}
+	return &Rule{
+		metric: metric,
+		root:   root,
+	}, nil
+}
+
+// Engine collects the metrics referenced by its rules as they are flushed from each aggregator, and evaluates the
+// rules once all aggregators have flushed.
+type Engine struct {
+	rules   []*Rule
+	metrics map[string]struct{} // Names of all metrics referenced by rules
+
+	mu    sync.Mutex
+	input *gostatsd.MetricMap
+}
+
+// NewEngine creates an Engine evaluating rules.
+func NewEngine(rules []*Rule) *Engine {
+	metrics := map[string]struct{}{}
+	for _, rule := range rules {
+		collectMetrics(rule.root, metrics)
+	}
+	return &Engine{
+		rules:   rules,
+		metrics: metrics,
+		input:   gostatsd.NewMetricMap(),
+	}
+}
+
+// NewEngineFromViper creates an Engine from the rules named in the top level rules setting.  Each rule is configured
+// in a section named rule.<name>, with an expression, and optionally the name of the metric to emit, which defaults to
+// the name of the rule.  Returns nil if no rules are configured.
+func NewEngineFromViper(v *viper.Viper) (*Engine, error) {
+	ruleNames := v.GetStringSlice("rules")
+	if len(ruleNames) == 0 {
+		return nil, nil
+	}
+	rules := make([]*Rule, 0, len(ruleNames))
+	for _, ruleName := range ruleNames {
+		vSub := getSubViper(v, "rule."+ruleName)
+		vSub.SetDefault("metric", ruleName)
+		rule, err := NewRule(vSub.GetString("metric"), vSub.GetString("expression"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to make rule %s: %v", ruleName, err)
+		}
+		rules = append(rules, rule)
+	}
+	return NewEngine(rules), nil
+}
+
+func collectMetrics(n node, metrics map[string]struct{}) {
+	switch n := n.(type) {
+	case metricNode:
+		metrics[string(n)] = struct{}{}
+	case *binaryNode:
+		collectMetrics(n.left, metrics)
+		collectMetrics(n.right, metrics)
+	case *aggregateNode:
+		collectMetrics(n.expr, metrics)
+	}
+}
+
+// Collect copies the counters and gauges referenced by rules from a flushed MetricMap.  It is safe to call
+// concurrently.
+func (e *Engine) Collect(mm *gostatsd.MetricMap) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for name := range e.metrics {
+		for tagsKey, c := range mm.Counters[name] {
+			if _, ok := e.input.Counters[name]; !ok {
+				e.input.Counters[name] = map[string]gostatsd.Counter{}
+			}
+			e.input.Counters[name][tagsKey] = c
+		}
+		for tagsKey, g := range mm.Gauges[name] {
+			if _, ok := e.input.Gauges[name]; !ok {
+				e.input.Gauges[name] = map[string]gostatsd.Gauge{}
+			}
+			e.input.Gauges[name][tagsKey] = g
+		}
+	}
+}
+
+// Evaluate evaluates all rules over the collected metrics, returning the results as gauges timestamped now, and
+// clears the collected metrics.  Rules which evaluate to a scalar are skipped if nothing was collected.  Rules which
+// fail to evaluate are skipped, and an error is returned for each of them.
+func (e *Engine) Evaluate(now gostatsd.Nanotime) (*gostatsd.MetricMap, []error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	mm := gostatsd.NewMetricMap()
+	hasInput := !e.input.IsEmpty()
+	var errs []error
+	for _, rule := range e.rules {
+		r, err := rule.root.eval(e.input)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to evaluate rule for %s: %v", rule.metric, err))
+			continue
+		}
+		gauges := map[string]gostatsd.Gauge{}
+		if r.isScalar && hasInput {
+			gauges[""] = gostatsd.Gauge{Value: r.scalar, Timestamp: now}
+		}
+		for tagsKey, s := range r.vector {
+			gauges[tagsKey] = gostatsd.Gauge{Value: s.value, Timestamp: now, Hostname: s.hostname, Tags: s.tags}
+		}
+		if len(gauges) > 0 {
+			mm.Gauges[rule.metric] = gauges
+		}
+	}
+	e.input = gostatsd.NewMetricMap()
+	return mm, errs
+}
+
+func getSubViper(v *viper.Viper, key string) *viper.Viper {
+	n := v.Sub(key)
+	if n == nil {
+		n = viper.New()
+	}
+	return n
+}
@@ -0,0 +1,180 @@
+package rules
+
+import (
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testMetricMap() *gostatsd.MetricMap {
+	mm := gostatsd.NewMetricMap()
+	for _, m := range []*gostatsd.Metric{
+		{Name: "requests", Type: gostatsd.COUNTER, Value: 100, Rate: 1, Tags: gostatsd.Tags{"service:a", "path:/x"}, Hostname: "h1"},
+		{Name: "requests", Type: gostatsd.COUNTER, Value: 50, Rate: 1, Tags: gostatsd.Tags{"service:a", "path:/y"}, Hostname: "h1"},
+		{Name: "requests", Type: gostatsd.COUNTER, Value: 10, Rate: 1, Tags: gostatsd.Tags{"service:b", "path:/x"}, Hostname: "h2"},
+		{Name: "errors", Type: gostatsd.COUNTER, Value: 15, Rate: 1, Tags: gostatsd.Tags{"service:a", "path:/x"}, Hostname: "h1"},
+		{Name: "errors", Type: gostatsd.COUNTER, Value: 5, Rate: 1, Tags: gostatsd.Tags{"service:b", "path:/x"}, Hostname: "h2"},
+		{Name: "queue-depth", Type: gostatsd.GAUGE, Value: 7, Rate: 1, Hostname: "h1"},
+		{Name: "queue-depth", Type: gostatsd.GAUGE, Value: 3, Rate: 1, Hostname: "h2"},
+	} {
+		m.TagsKey = m.FormatTagsKey()
+		mm.Receive(m)
+	}
+	return mm
+}
+
+func evaluate(t *testing.T, expression string) map[string]gostatsd.Gauge {
+	rule, err := NewRule("result", expression)
+	require.NoError(t, err)
+	input, err := NewRule("input", "requests") // Collects some input, so scalars are emitted
+	require.NoError(t, err)
+	e := NewEngine([]*Rule{rule, input})
+	e.Collect(testMetricMap())
+	mm, errs := e.Evaluate(1)
+	require.Empty(t, errs)
+	return mm.Gauges["result"]
+}
+
+func TestEvaluate(t *testing.T) {
+	t.Parallel()
+	input := []struct {
+		expression string
+		expected   map[string]float64 // keyed by tags key
+	}{
+		{"1 + 2 * 3", map[string]float64{"": 7}},
+		{"(1 + 2) * -3", map[string]float64{"": -9}},
+		{"1 / 0", nil},
+		{"sum(requests)", map[string]float64{"": 160}},
+		{"sum(requests) by (service)", map[string]float64{"service:a": 150, "service:b": 10}},
+		{"avg(requests) by (path)", map[string]float64{"path:/x": 55, "path:/y": 50}},
+		{"max(requests) by (service, path)", map[string]float64{"path:/x,service:a": 100, "path:/y,service:a": 50, "path:/x,service:b": 10}},
+		{"min(\"queue-depth\")", map[string]float64{"": 3}},
+		{"sum(errors) by (service) / sum(requests) by (service)", map[string]float64{"service:a": 0.1, "service:b": 0.5}},
+		{"errors / requests * 100", map[string]float64{"path:/x,service:a,s:h1": 15, "path:/x,service:b,s:h2": 50}},
+		{"sum(missing)", map[string]float64{}},
+	}
+	for _, inp := range input {
+		inp := inp
+		t.Run(inp.expression, func(t *testing.T) {
+			t.Parallel()
+			actual := map[string]float64{}
+			for tagsKey, g := range evaluate(t, inp.expression) {
+				actual[tagsKey] = g.Value
+				assert.EqualValues(t, 1, g.Timestamp)
+			}
+			if len(inp.expected) == 0 {
+				assert.Empty(t, actual)
+			} else {
+				assert.Equal(t, inp.expected, actual)
+			}
+		})
+	}
+}
+
+func TestEvaluateKeepsTagsAndHostname(t *testing.T) {
+	t.Parallel()
+	gauges := evaluate(t, "errors / requests")
+	g := gauges["path:/x,service:b,s:h2"]
+	assert.Equal(t, "h2", g.Hostname)
+	assert.ElementsMatch(t, gostatsd.Tags{"service:b", "path:/x"}, g.Tags)
+
+	gauges = evaluate(t, "sum(requests) by (service)")
+	g = gauges["service:b"]
+	assert.Equal(t, "", g.Hostname)
+	assert.Equal(t, gostatsd.Tags{"service:b"}, g.Tags)
+}
+
+func TestEvaluateClearsInput(t *testing.T) {
+	t.Parallel()
+	rule, err := NewRule("result", "sum(requests)")
+	require.NoError(t, err)
+	e := NewEngine([]*Rule{rule})
+	e.Collect(testMetricMap())
+	mm, _ := e.Evaluate(1)
+	assert.Len(t, mm.Gauges, 1)
+	mm, _ = e.Evaluate(1)
+	assert.Empty(t, mm.Gauges)
+}
+
+func TestEvaluateScalarWithoutInput(t *testing.T) {
+	t.Parallel()
+	scalar, err := NewRule("scalar", "1 + 2")
+	require.NoError(t, err)
+	total, err := NewRule("total", "sum(requests)")
+	require.NoError(t, err)
+	e := NewEngine([]*Rule{scalar, total})
+	mm, _ := e.Evaluate(1)
+	assert.Empty(t, mm.Gauges, "a scalar should not be emitted without any input")
+	e.Collect(testMetricMap())
+	mm, _ = e.Evaluate(1)
+	assert.Len(t, mm.Gauges["scalar"], 1)
+}
+
+func TestEvaluateCounterAndGaugeWithSameName(t *testing.T) {
+	t.Parallel()
+	ambiguous, err := NewRule("ambiguous", "sum(requests)")
+	require.NoError(t, err)
+	other, err := NewRule("other", "sum(errors)")
+	require.NoError(t, err)
+	e := NewEngine([]*Rule{ambiguous, other})
+	mm := testMetricMap()
+	gauge := &gostatsd.Metric{Name: "requests", Type: gostatsd.GAUGE, Value: 1, Rate: 1, Tags: gostatsd.Tags{"service:b", "path:/x"}, Hostname: "h2"}
+	gauge.TagsKey = gauge.FormatTagsKey()
+	mm.Receive(gauge)
+	e.Collect(mm)
+	derived, errs := e.Evaluate(1)
+	require.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "requests is both a counter and a gauge")
+	assert.Empty(t, derived.Gauges["ambiguous"], "an ambiguous rule should not be emitted")
+	assert.Len(t, derived.Gauges["other"], 1, "other rules should still be emitted")
+}
+
+func TestNewRuleInvalid(t *testing.T) {
+	t.Parallel()
+	input := []string{
+		"",
+		"1 +",
+		"(1",
+		"sum(requests) by service",
+		"sum(requests) by (service",
+		"requests requests",
+		"\"requests",
+		"requests % 2",
+	}
+	for _, expression := range input {
+		expression := expression
+		t.Run(expression, func(t *testing.T) {
+			t.Parallel()
+			_, err := NewRule("result", expression)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestNewEngineFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("rules", "error_ratio total")
+	v.Set("rule.error_ratio.metric", "api.error_ratio")
+	v.Set("rule.error_ratio.expression", "sum(errors) by (service) / sum(requests) by (service)")
+	v.Set("rule.total.expression", "sum(requests)")
+	e, err := NewEngineFromViper(v)
+	require.NoError(t, err)
+	e.Collect(testMetricMap())
+	mm, errs := e.Evaluate(1)
+	require.Empty(t, errs)
+	assert.Len(t, mm.Gauges["api.error_ratio"], 2)
+	assert.Len(t, mm.Gauges["total"], 1)
+
+	v.Set("rule.total.expression", "sum(")
+	_, err = NewEngineFromViper(v)
+	assert.Error(t, err)
+
+	e, err = NewEngineFromViper(viper.New())
+	require.NoError(t, err)
+	assert.Nil(t, e)
+}
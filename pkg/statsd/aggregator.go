@@ -25,27 +25,53 @@ type percentStruct struct {
 type MetricAggregator struct {
 	metricsReceived    uint64
 	metricMapsReceived uint64
+	metricsLate        uint64
 	expiryInterval     time.Duration // How often to expire metrics
 	percentThresholds  map[float64]percentStruct
 	now                func() time.Time // Returns current time. Useful for testing.
 	statser            stats.Statser
 	disabledSubtypes   gostatsd.TimerSubtypes
+	integerCounters    bool // Truncate each counter sample, for backwards compatibility
 	metricMap          *gostatsd.MetricMap
+
+	flushInterval  time.Duration                 // Length of the interval late metrics are grouped by
+	lateGrace      time.Duration                 // How old a client timestamp may be before the current interval, 0 to disable
+	lateFlush      bool                          // Flush late metrics with their own timestamp, rather than dropping them
+	lateThreshold  gostatsd.Nanotime             // Metrics with an older client timestamp are late
+	lateMetricMaps map[int64]*gostatsd.MetricMap // Late metrics, keyed by the start of their interval in nsec
 }
 
-// NewMetricAggregator creates a new MetricAggregator object.
-func NewMetricAggregator(percentThresholds []float64, expiryInterval time.Duration, disabled gostatsd.TimerSubtypes) *MetricAggregator {
+// NewMetricAggregator creates a new MetricAggregator object.  Metrics with a client timestamp more than lateGrace
+// before the start of the current flush interval are late, and are dropped, or if lateFlush is true, flushed
+// separately for the earlier flushInterval they belong to.
+func NewMetricAggregator(percentThresholds []float64, expiryInterval time.Duration, disabled gostatsd.TimerSubtypes, integerCounters bool, flushInterval, lateGrace time.Duration, lateFlush bool) *MetricAggregator {
 	a := MetricAggregator{
 		expiryInterval:    expiryInterval,
-		percentThresholds: make(map[float64]percentStruct, len(percentThresholds)),
+		percentThresholds: newPercentThresholds(percentThresholds),
 		now:               time.Now,
 		statser:           stats.NewNullStatser(), // Will probably be replaced via RunMetrics
 		metricMap:         gostatsd.NewMetricMap(),
 		disabledSubtypes:  disabled,
+		integerCounters:   integerCounters,
+		flushInterval:     flushInterval,
+		lateGrace:         lateGrace,
+		lateFlush:         lateFlush,
+		lateMetricMaps:    map[int64]*gostatsd.MetricMap{},
 	}
+	a.resetLateThreshold()
+	return &a
+}
+
+// SetPercentThresholds replaces the percentiles calculated for timers.
+func (a *MetricAggregator) SetPercentThresholds(percentThresholds []float64) {
+	a.percentThresholds = newPercentThresholds(percentThresholds)
+}
+
+func newPercentThresholds(percentThresholds []float64) map[float64]percentStruct {
+	pcts := make(map[float64]percentStruct, len(percentThresholds))
 	for _, pct := range percentThresholds {
 		sPct := strconv.Itoa(int(pct))
-		a.percentThresholds[pct] = percentStruct{
+		pcts[pct] = percentStruct{
 			count:      "count_" + sPct,
 			mean:       "mean_" + sPct,
 			sum:        "sum_" + sPct,
@@ -54,7 +80,7 @@ func NewMetricAggregator(percentThresholds []float64, expiryInterval time.Durati
 			lower:      "lower_" + sPct,
 		}
 	}
-	return &a
+	return pcts
 }
 
 // round rounds a number to its nearest integer value.
@@ -67,15 +93,23 @@ func round(v float64) float64 {
 func (a *MetricAggregator) Flush(flushInterval time.Duration) {
 	a.statser.Gauge("aggregator.metrics_received", float64(a.metricsReceived), nil)
 	a.statser.Gauge("aggregator.metricmaps_received", float64(a.metricMapsReceived), nil)
+	a.statser.Gauge("aggregator.metrics_late", float64(a.metricsLate), nil)
 
+	a.flushMetricMap(a.metricMap, flushInterval)
+	for _, mm := range a.lateMetricMaps {
+		a.flushMetricMap(mm, a.flushInterval)
+	}
+}
+
+func (a *MetricAggregator) flushMetricMap(mm *gostatsd.MetricMap, flushInterval time.Duration) {
 	flushInSeconds := float64(flushInterval) / float64(time.Second)
 
-	a.metricMap.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
-		counter.PerSecond = float64(counter.Value) / flushInSeconds
-		a.metricMap.Counters[key][tagsKey] = counter
+	mm.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		counter.PerSecond = counter.Value / flushInSeconds
+		mm.Counters[key][tagsKey] = counter
 	})
 
-	a.metricMap.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+	mm.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
 		if count := len(timer.Values); count > 0 {
 			sort.Float64s(timer.Values)
 			timer.Min = timer.Values[0]
@@ -163,7 +197,7 @@ func (a *MetricAggregator) Flush(flushInterval time.Duration) {
 			timer.Count = int(round(timer.SampledCount))
 			timer.PerSecond = timer.SampledCount / flushInSeconds
 
-			a.metricMap.Timers[key][tagsKey] = timer
+			mm.Timers[key][tagsKey] = timer
 		} else {
 			timer.Count = 0
 			timer.SampledCount = 0
@@ -180,6 +214,12 @@ func (a *MetricAggregator) Process(f ProcessFunc) {
 	f(a.metricMap)
 }
 
+func (a *MetricAggregator) ProcessLate(f LateProcessFunc) {
+	for intervalStart, mm := range a.lateMetricMaps {
+		f(time.Unix(0, intervalStart), mm)
+	}
+}
+
 func (a *MetricAggregator) isExpired(now, ts gostatsd.Nanotime) bool {
 	return a.expiryInterval != 0 && time.Duration(now-ts) > a.expiryInterval
 }
@@ -194,6 +234,11 @@ func deleteMetric(key, tagsKey string, metrics gostatsd.AggregatedMetrics) {
 // Reset clears the contents of a MetricAggregator.
 func (a *MetricAggregator) Reset() {
 	a.metricsReceived = 0
+	a.metricsLate = 0
+	a.resetLateThreshold()
+	if len(a.lateMetricMaps) > 0 {
+		a.lateMetricMaps = map[int64]*gostatsd.MetricMap{}
+	}
 	nowNano := gostatsd.Nanotime(a.now().UnixNano())
 
 	a.metricMap.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
@@ -246,11 +291,53 @@ func (a *MetricAggregator) Reset() {
 func (a *MetricAggregator) Receive(ms ...*gostatsd.Metric) {
 	a.metricsReceived += uint64(len(ms))
 	for _, m := range ms {
+		if a.integerCounters && m.Type == gostatsd.COUNTER {
+			m = truncateCounter(m)
+		}
+		if m.ClientTimestamp && a.lateGrace != 0 && m.Timestamp < a.lateThreshold {
+			a.receiveLate(m)
+			continue
+		}
 		a.metricMap.Receive(m)
 	}
 }
 
+// truncateCounter returns a copy of a counter with its sampled value truncated to an integer, as counters were before
+// they kept float precision.
+func truncateCounter(m *gostatsd.Metric) *gostatsd.Metric {
+	truncated := *m
+	truncated.Value = math.Trunc(m.Value / m.Rate)
+	truncated.Rate = 1
+	return &truncated
+}
+
+// receiveLate aggregates a metric with a client timestamp from before the current flush interval.
+func (a *MetricAggregator) receiveLate(m *gostatsd.Metric) {
+	a.metricsLate++
+	if !a.lateFlush {
+		return
+	}
+	intervalStart := alignTime(time.Unix(0, int64(m.Timestamp)), a.flushInterval).UnixNano()
+	mm, ok := a.lateMetricMaps[intervalStart]
+	if !ok {
+		mm = gostatsd.NewMetricMap()
+		a.lateMetricMaps[intervalStart] = mm
+	}
+	mm.Receive(m)
+}
+
+func (a *MetricAggregator) resetLateThreshold() {
+	a.lateThreshold = gostatsd.Nanotime(a.now().Add(-a.lateGrace).UnixNano())
+}
+
 func (a *MetricAggregator) ReceiveMap(mm *gostatsd.MetricMap) {
 	a.metricMapsReceived++
+	if a.integerCounters {
+		// Forwarded counters are already summed, so the best we can do is truncate each forwarded value
+		mm.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+			counter.Value = math.Trunc(counter.Value)
+			mm.Counters[key][tagsKey] = counter
+		})
+	}
 	a.metricMap.Merge(mm)
 }
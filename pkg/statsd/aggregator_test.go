@@ -17,6 +17,10 @@ func newFakeAggregator() *MetricAggregator {
 		[]float64{90},
 		5*time.Minute,
 		gostatsd.TimerSubtypes{},
+		false,
+		0,
+		0,
+		false,
 	)
 }
 
@@ -299,6 +303,85 @@ func TestIsExpired(t *testing.T) {
 	assrt.Equal(false, ma.isExpired(now, ts))
 }
 
+func TestFlushIntegerCounters(t *testing.T) {
+	t.Parallel()
+	assrt := assert.New(t)
+
+	ma := newFakeAggregator()
+	ma.Receive(&gostatsd.Metric{Name: "x", Value: 1, Rate: 0.3, Type: gostatsd.COUNTER})
+	ma.Flush(1 * time.Second)
+	assrt.InDelta(3.333, ma.metricMap.Counters["x"][""].Value, 0.001)
+
+	ma = NewMetricAggregator(nil, 5*time.Minute, gostatsd.TimerSubtypes{}, true, 0, 0, false)
+	ma.Receive(&gostatsd.Metric{Name: "x", Value: 1, Rate: 0.3, Type: gostatsd.COUNTER})
+	ma.Flush(1 * time.Second)
+	assrt.Equal(3.0, ma.metricMap.Counters["x"][""].Value)
+	assrt.Equal(3.0, ma.metricMap.Counters["x"][""].PerSecond)
+}
+
+func TestIntegerCountersMatchOldOutput(t *testing.T) {
+	t.Parallel()
+	samples := []struct {
+		value float64
+		rate  float64
+	}{{0.5, 1}, {0.5, 1}, {0.5, 1}, {1, 0.3}, {2.7, 1}, {1, 0.3}}
+
+	// Counters used to truncate each sample to an int64 as it was received
+	var expected int64
+	ma := NewMetricAggregator(nil, 5*time.Minute, gostatsd.TimerSubtypes{}, true, 0, 0, false)
+	for _, sample := range samples {
+		expected += int64(sample.value / sample.rate)
+		ma.Receive(&gostatsd.Metric{Name: "x", Value: sample.value, Rate: sample.rate, Type: gostatsd.COUNTER})
+	}
+	ma.Flush(1 * time.Second)
+	assert.Equal(t, float64(expected), ma.metricMap.Counters["x"][""].Value)
+}
+
+func TestReceiveLate(t *testing.T) {
+	t.Parallel()
+	assrt := assert.New(t)
+	now := func() time.Time { return time.Unix(100, 0) }
+	metrics := func() []*gostatsd.Metric {
+		return []*gostatsd.Metric{
+			{Name: "x", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: 1},
+			{Name: "x", Value: 2, Rate: 1, Type: gostatsd.COUNTER, Timestamp: 96e9, ClientTimestamp: true},
+			{Name: "x", Value: 4, Rate: 1, Type: gostatsd.COUNTER, Timestamp: 84e9, ClientTimestamp: true},
+			{Name: "x", Value: 8, Rate: 1, Type: gostatsd.COUNTER, Timestamp: 86e9, ClientTimestamp: true},
+		}
+	}
+
+	for _, lateFlush := range []bool{false, true} {
+		ma := NewMetricAggregator(nil, 5*time.Minute, gostatsd.TimerSubtypes{}, false, 10*time.Second, 5*time.Second, lateFlush)
+		ma.now = now
+		ma.Reset()
+		ma.Receive(metrics()...)
+		ma.Flush(10 * time.Second)
+		assrt.EqualValues(3, ma.metricMap.Counters["x"][""].Value)
+		assrt.EqualValues(2, ma.metricsLate)
+
+		late := map[time.Time]float64{}
+		ma.ProcessLate(func(intervalStart time.Time, mm *gostatsd.MetricMap) {
+			late[intervalStart] = mm.Counters["x"][""].Value
+			assrt.EqualValues(1.2, mm.Counters["x"][""].PerSecond)
+		})
+		if lateFlush {
+			assrt.Equal(map[time.Time]float64{time.Unix(80, 0): 8 + 4}, late)
+		} else {
+			assrt.Empty(late)
+		}
+
+		ma.Reset()
+		ma.ProcessLate(func(intervalStart time.Time, mm *gostatsd.MetricMap) {
+			t.Errorf("late metrics not reset")
+		})
+	}
+
+	// Disabled
+	ma := newFakeAggregator()
+	ma.Receive(metrics()...)
+	assrt.EqualValues(15, ma.metricMap.Counters["x"][""].Value)
+}
+
 func TestDisabledCount(t *testing.T) {
 	t.Parallel()
 	ma := newFakeAggregator()
@@ -370,6 +453,10 @@ func TestDisabledLower(t *testing.T) {
 		[]float64{-90},
 		5*time.Minute,
 		gostatsd.TimerSubtypes{},
+		false,
+		0,
+		0,
+		false,
 	)
 	ma.disabledSubtypes.LowerPct = true
 	ma.Receive(&gostatsd.Metric{Name: "x", Value: 1, Type: gostatsd.TIMER})
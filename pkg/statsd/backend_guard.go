@@ -0,0 +1,201 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tilinna/clock"
+)
+
+// errBackendSkipped is the result of a send skipped because the breaker is open.
+var errBackendSkipped = errors.New("backend skipped as its circuit breaker is open")
+
+// backendGuard isolates the rest of the server from a misbehaving backend.  Every send has a deadline, after which
+// the flush is treated as failed even if the backend never calls back, and an optional circuit breaker stops sending
+// to the backend after too many consecutive failures.  Once the breaker has been open for the cooldown, a single send is
+// let through as a probe, which closes the breaker if it succeeds.
+type backendGuard struct {
+	backend  gostatsd.Backend
+	timeout  time.Duration
+	failures int // Consecutive failures which open the breaker, 0 to disable the breaker
+	cooldown time.Duration
+	tags     gostatsd.Tags
+
+	mu                  sync.Mutex
+	consecutiveFailures int
+	openUntil           time.Time // Zero if the breaker is closed
+	probing             bool      // A probe is in flight while the breaker is half-open
+}
+
+// runnerBackendGuard is a backendGuard for a backend which is a gostatsd.Runner.
+type runnerBackendGuard struct {
+	*backendGuard
+	runner gostatsd.Runner
+}
+
+func (rbg *runnerBackendGuard) Run(ctx context.Context) {
+	rbg.runner.Run(ctx)
+}
+
+// newBackendGuard wraps backend in a backendGuard, keeping it a gostatsd.Runner if it is one.
+func newBackendGuard(backend gostatsd.Backend, timeout time.Duration, failures int, cooldown time.Duration) gostatsd.Backend {
+	bg := &backendGuard{
+		backend:  backend,
+		timeout:  timeout,
+		failures: failures,
+		cooldown: cooldown,
+		tags:     gostatsd.Tags{"backend:" + backend.Name()},
+	}
+	if runner, ok := backend.(gostatsd.Runner); ok {
+		return &runnerBackendGuard{
+			backendGuard: bg,
+			runner:       runner,
+		}
+	}
+	return bg
+}
+
+// guardBackends wraps each backend in a backendGuard.  The deadline for each send defaults to the flush interval of the
+// backend, and the breaker settings to the top level settings, all of which may be overridden in the backend section.
+func guardBackends(v *viper.Viper, backends []gostatsd.Backend, flushInterval time.Duration, backendFlushIntervals map[string]time.Duration) []gostatsd.Backend {
+	guarded := make([]gostatsd.Backend, 0, len(backends))
+	for _, backend := range backends {
+		timeout := flushInterval
+		if interval := backendFlushIntervals[backend.Name()]; interval > timeout {
+			timeout = interval
+		}
+		vBackend := getSubViper(v, backend.Name())
+		vBackend.SetDefault("send-timeout", timeout)
+		vBackend.SetDefault("breaker-failures", v.GetInt(ParamBackendBreakerFailures))
+		vBackend.SetDefault("breaker-cooldown", v.GetDuration(ParamBackendBreakerCooldown))
+		guarded = append(guarded, newBackendGuard(
+			backend,
+			vBackend.GetDuration("send-timeout"),
+			vBackend.GetInt("breaker-failures"),
+			vBackend.GetDuration("breaker-cooldown"),
+		))
+	}
+	return guarded
+}
+
+// Name returns the name of the backend.
+func (bg *backendGuard) Name() string {
+	return bg.backend.Name()
+}
+
+// SendMetricsAsync sends the metrics to the backend, unless the breaker is open, in which case the callback is called
+// with errBackendSkipped.  The callback is called once the backend has finished, or once the deadline has passed,
+// whichever happens first.
+//
+// The backend's SendMetricsAsync is called synchronously, as it must finish reading m before returning, so the
+// deadline can't stop a backend which blocks before returning from stalling the flush.
+func (bg *backendGuard) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, intervalStart time.Time, cb gostatsd.SendCallback) {
+	statser := stats.FromContext(ctx).WithTags(bg.tags)
+	if !bg.allow(clock.Now(ctx)) {
+		statser.Increment("backend.flushes_skipped", nil)
+		cb([]error{errBackendSkipped})
+		return
+	}
+
+	start := clock.Now(ctx)
+	sendCtx, cancel := clock.TimeoutContext(ctx, bg.timeout)
+	var once sync.Once
+	finish := func(errs []error) {
+		once.Do(func() {
+			cancel()
+			statser.TimingDuration("backend.send_time", clock.Since(ctx, start), nil)
+			err := firstError(errs)
+			if err != nil {
+				statser.Increment("backend.send_errors", nil)
+			}
+			bg.record(clock.Now(ctx), err)
+			cb(errs)
+		})
+	}
+	timer := clock.AfterFunc(ctx, bg.timeout, func() {
+		finish([]error{fmt.Errorf("backend %s did not complete within %v", bg.backend.Name(), bg.timeout)})
+	})
+	bg.backend.SendMetricsAsync(sendCtx, m, intervalStart, func(errs []error) {
+		timer.Stop()
+		finish(errs)
+	})
+}
+
+// SendEvent sends the event to the backend with a deadline, unless the breaker is open.
+func (bg *backendGuard) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	if !bg.allow(clock.Now(ctx)) {
+		return fmt.Errorf("circuit breaker for backend %s is open", bg.backend.Name())
+	}
+	sendCtx, cancel := clock.TimeoutContext(ctx, bg.timeout)
+	defer cancel()
+	err := bg.backend.SendEvent(sendCtx, e)
+	bg.record(clock.Now(ctx), err)
+	return err
+}
+
+// Healthy returns an error if the breaker is open.
+func (bg *backendGuard) Healthy() error {
+	bg.mu.Lock()
+	defer bg.mu.Unlock()
+	if !bg.openUntil.IsZero() {
+		return fmt.Errorf("circuit breaker for backend %s is open after %d consecutive failures", bg.backend.Name(), bg.consecutiveFailures)
+	}
+	return nil
+}
+
+// allow returns true if a send may go ahead at now.
+func (bg *backendGuard) allow(now time.Time) bool {
+	bg.mu.Lock()
+	defer bg.mu.Unlock()
+	if bg.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(bg.openUntil) || bg.probing {
+		return false
+	}
+	bg.probing = true
+	return true
+}
+
+// record updates the breaker with the result of a send.
+func (bg *backendGuard) record(now time.Time, err error) {
+	bg.mu.Lock()
+	defer bg.mu.Unlock()
+	bg.probing = false
+	if err == nil {
+		if !bg.openUntil.IsZero() {
+			log.Infof("Circuit breaker for backend %s closed", bg.backend.Name())
+		}
+		bg.consecutiveFailures = 0
+		bg.openUntil = time.Time{}
+		return
+	}
+	bg.consecutiveFailures++
+	if bg.failures == 0 {
+		return
+	}
+	if !bg.openUntil.IsZero() || bg.consecutiveFailures >= bg.failures {
+		if bg.openUntil.IsZero() {
+			log.Warnf("Circuit breaker for backend %s opened after %d consecutive failures: %v", bg.backend.Name(), bg.consecutiveFailures, err)
+		}
+		bg.openUntil = now.Add(bg.cooldown)
+	}
+}
+
+// firstError returns the first non-nil error in errs.
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
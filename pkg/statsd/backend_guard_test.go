@@ -0,0 +1,184 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilinna/clock"
+)
+
+// scriptedBackend fails sends while fail is set, and never calls back while hang is set.
+type scriptedBackend struct {
+	mu    sync.Mutex
+	fail  bool
+	hang  bool
+	sends int
+}
+
+func (sb *scriptedBackend) Name() string {
+	return "scripted"
+}
+
+func (sb *scriptedBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, intervalStart time.Time, callback gostatsd.SendCallback) {
+	sb.mu.Lock()
+	sb.sends++
+	fail, hang := sb.fail, sb.hang
+	sb.mu.Unlock()
+	if hang {
+		return
+	}
+	if fail {
+		callback([]error{errors.New("boom")})
+	} else {
+		callback(nil)
+	}
+}
+
+func (sb *scriptedBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+type guardStatser struct {
+	stats.NullStatser
+	mu         sync.Mutex
+	increments []string
+	timings    int
+}
+
+func (gs *guardStatser) Increment(name string, tags gostatsd.Tags) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.increments = append(gs.increments, name)
+}
+
+func (gs *guardStatser) TimingDuration(name string, d time.Duration, tags gostatsd.Tags) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.timings++
+}
+
+func (gs *guardStatser) WithTags(tags gostatsd.Tags) stats.Statser {
+	return gs
+}
+
+func sendAndWait(ctx context.Context, backend gostatsd.Backend) []error {
+	var result []error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	backend.SendMetricsAsync(ctx, gostatsd.NewMetricMap(), time.Unix(0, 0), func(errs []error) {
+		result = errs
+		wg.Done()
+	})
+	wg.Wait()
+	return result
+}
+
+func TestBackendGuardTimeout(t *testing.T) {
+	t.Parallel()
+	mockClock := clock.NewMock(time.Unix(100, 0))
+	ctx := clock.Context(context.Background(), mockClock)
+	backend := &scriptedBackend{hang: true}
+	guard := newBackendGuard(backend, 10*time.Second, 0, time.Minute)
+
+	done := make(chan []error, 1)
+	guard.SendMetricsAsync(ctx, gostatsd.NewMetricMap(), time.Unix(0, 0), func(errs []error) {
+		done <- errs
+	})
+	select {
+	case <-done:
+		require.Fail(t, "callback called before the deadline")
+	default:
+	}
+	mockClock.Add(10 * time.Second)
+	select {
+	case errs := <-done:
+		require.Len(t, errs, 1)
+		assert.Contains(t, errs[0].Error(), "did not complete within 10s")
+	case <-time.After(time.Second):
+		require.Fail(t, "callback not called after the deadline")
+	}
+}
+
+func TestBackendGuardBreaker(t *testing.T) {
+	t.Parallel()
+	mockClock := clock.NewMock(time.Unix(100, 0))
+	statser := &guardStatser{}
+	ctx := stats.NewContext(clock.Context(context.Background(), mockClock), statser)
+	backend := &scriptedBackend{fail: true}
+	guard := newBackendGuard(backend, 10*time.Second, 2, time.Minute)
+	flusher := NewMetricFlusher(time.Second, false, nil, []gostatsd.Backend{guard}, nil, nil, nil, nil)
+
+	assert.Len(t, sendAndWait(ctx, guard), 1)
+	assert.Empty(t, flusher.HealthProblems())
+	assert.Len(t, sendAndWait(ctx, guard), 1)
+	require.Len(t, flusher.HealthProblems(), 1) // Breaker opened
+	assert.Contains(t, flusher.HealthProblems()[0], "circuit breaker for backend scripted is open")
+
+	assert.Equal(t, []error{errBackendSkipped}, sendAndWait(ctx, guard))
+	assert.Equal(t, 2, backend.sends)
+	assert.Error(t, guard.SendEvent(ctx, &gostatsd.Event{}))
+
+	// Half-open, the probe fails, so the breaker opens again
+	mockClock.Add(time.Minute)
+	assert.Len(t, sendAndWait(ctx, guard), 1)
+	assert.Equal(t, 3, backend.sends)
+	assert.Equal(t, []error{errBackendSkipped}, sendAndWait(ctx, guard))
+	assert.Equal(t, 3, backend.sends)
+
+	// Half-open, the probe succeeds, so the breaker closes
+	mockClock.Add(time.Minute)
+	backend.fail = false
+	assert.Empty(t, sendAndWait(ctx, guard))
+	assert.Empty(t, flusher.HealthProblems())
+	assert.Empty(t, sendAndWait(ctx, guard))
+	assert.Equal(t, 5, backend.sends)
+
+	assert.Equal(t, []string{
+		"backend.send_errors",
+		"backend.send_errors",
+		"backend.flushes_skipped",
+		"backend.send_errors",
+		"backend.flushes_skipped",
+	}, statser.increments)
+	assert.Equal(t, 5, statser.timings)
+}
+
+func TestGuardBackendsFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set(ParamBackendBreakerFailures, 3)
+	v.Set(ParamBackendBreakerCooldown, "1m")
+	v.Set("slow.send-timeout", "45s")
+	v.Set("slow.breaker-failures", 0)
+
+	guarded := guardBackends(v, []gostatsd.Backend{newRunnerBackend("fast"), newRunnerBackend("slow"), &scriptedBackend{}}, 10*time.Second, map[string]time.Duration{"scripted": time.Minute})
+	require.Len(t, guarded, 3)
+
+	fast := guarded[0].(*runnerBackendGuard)
+	assert.Equal(t, 10*time.Second, fast.timeout)
+	assert.Equal(t, 3, fast.failures)
+	assert.Equal(t, time.Minute, fast.cooldown)
+
+	slow := guarded[1].(*runnerBackendGuard)
+	assert.Equal(t, 45*time.Second, slow.timeout)
+	assert.Equal(t, 0, slow.failures)
+
+	scripted := guarded[2].(*backendGuard)
+	assert.Equal(t, time.Minute, scripted.timeout)
+	assert.Equal(t, "scripted", scripted.Name())
+
+	// The breaker is opt-in
+	v = viper.New()
+	v.SetDefault(ParamBackendBreakerFailures, DefaultBackendBreakerFailures)
+	guarded = guardBackends(v, []gostatsd.Backend{newRunnerBackend("default")}, 10*time.Second, nil)
+	assert.Equal(t, 0, guarded[0].(*runnerBackendGuard).failures)
+}
@@ -0,0 +1,261 @@
+package statsd
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tilinna/clock"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pb"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+// spoolRecordHeaderSize is the size of the interval start and interval length before the protobuf in a spool record.
+const spoolRecordHeaderSize = 16
+
+var unsafeSpoolNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// spoolBackend saves the metrics of failed sends to a backend in a diskSpool, and replays them in order once the
+// backend is accepting metrics again.  Replayed metrics are aggregated again, so rates and timer statistics are
+// calculated as they would have been originally.
+type spoolBackend struct {
+	backend  gostatsd.Backend
+	spool    *diskSpool
+	factory  AggregatorFactory
+	interval time.Duration
+	maxAge   time.Duration
+	tags     gostatsd.Tags
+	wake     chan struct{}
+
+	spooled  uint64
+	replayed uint64
+	expired  uint64
+}
+
+// newSpoolBackend wraps backend in a spoolBackend.
+func newSpoolBackend(backend gostatsd.Backend, spool *diskSpool, factory AggregatorFactory, interval, maxAge time.Duration) *spoolBackend {
+	return &spoolBackend{
+		backend:  backend,
+		spool:    spool,
+		factory:  factory,
+		interval: interval,
+		maxAge:   maxAge,
+		tags:     gostatsd.Tags{"backend:" + backend.Name()},
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// spoolBackends wraps each backend in a spoolBackend, with a spool in its own directory under the spool directory.
+// The backends are returned unchanged if there is no spool directory.  Spooling may be disabled for a backend by
+// setting spool to false in the backend section.
+func spoolBackends(v *viper.Viper, backends []gostatsd.Backend, flushInterval time.Duration, backendFlushIntervals map[string]time.Duration, factory AggregatorFactory) ([]gostatsd.Backend, error) {
+	dir := v.GetString(ParamSpoolDir)
+	if dir == "" {
+		return backends, nil
+	}
+	spooled := make([]gostatsd.Backend, 0, len(backends))
+	for _, backend := range backends {
+		vBackend := getSubViper(v, backend.Name())
+		vBackend.SetDefault("spool", true)
+		if !vBackend.GetBool("spool") {
+			spooled = append(spooled, backend)
+			continue
+		}
+		spool, err := openSpool(filepath.Join(dir, unsafeSpoolNameChars.ReplaceAllString(backend.Name(), "_")), v.GetInt64(ParamSpoolMaxSize), false)
+		if err != nil {
+			releaseSpools(spooled)
+			return nil, err
+		}
+		interval := flushInterval
+		if backendInterval, ok := backendFlushIntervals[backend.Name()]; ok {
+			interval = backendInterval
+		}
+		spooled = append(spooled, newSpoolBackend(backend, spool, factory, interval, v.GetDuration(ParamSpoolMaxAge)))
+	}
+	return spooled, nil
+}
+
+// releaseSpools releases the spools of the spoolBackends in backends which will never be run.
+func releaseSpools(backends []gostatsd.Backend) {
+	for _, backend := range backends {
+		if sb, ok := backend.(*spoolBackend); ok {
+			sb.spool.release()
+		}
+	}
+}
+
+// Name returns the name of the backend.
+func (sb *spoolBackend) Name() string {
+	return sb.backend.Name()
+}
+
+// SendMetricsAsync sends the metrics to the backend, and spools them if the send fails.  The metrics are marshalled
+// before they are sent, so m may be reset as soon as the backend has returned, as it can be with any other backend.
+func (sb *spoolBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, intervalStart time.Time, cb gostatsd.SendCallback) {
+	data, err := proto.Marshal(pb.FromMetricMap(m))
+	if err != nil {
+		log.Errorf("Failed to marshal metrics to spool for backend %s: %v", sb.backend.Name(), err)
+	}
+	sb.backend.SendMetricsAsync(ctx, m, intervalStart, func(errs []error) {
+		if firstError(errs) != nil && data != nil {
+			if err := sb.save(data, intervalStart); err != nil {
+				log.Errorf("Failed to spool metrics for backend %s: %v", sb.backend.Name(), err)
+			}
+		}
+		cb(errs)
+	})
+}
+
+// SendEvent sends the event to the backend.  Events are not spooled.
+func (sb *spoolBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return sb.backend.SendEvent(ctx, e)
+}
+
+// Healthy returns the health of the backend, if it reports it.
+func (sb *spoolBackend) Healthy() error {
+	if hc, ok := sb.backend.(interface{ Healthy() error }); ok {
+		return hc.Healthy()
+	}
+	return nil
+}
+
+// save appends the marshalled metrics to the spool.
+func (sb *spoolBackend) save(data []byte, intervalStart time.Time) error {
+	record := make([]byte, spoolRecordHeaderSize+len(data))
+	binary.BigEndian.PutUint64(record[0:8], uint64(intervalStart.UnixNano()))
+	binary.BigEndian.PutUint64(record[8:16], uint64(sb.interval))
+	copy(record[spoolRecordHeaderSize:], data)
+	if err := sb.spool.append(record); err != nil {
+		return err
+	}
+	atomic.AddUint64(&sb.spooled, 1)
+	select {
+	case sb.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run runs the backend if it is a gostatsd.Runner, and replays the spool until the context is done.
+func (sb *spoolBackend) Run(ctx context.Context) {
+	defer sb.spool.release()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	if runner, ok := sb.backend.(gostatsd.Runner); ok {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runner.Run(ctx)
+		}()
+	}
+
+	statser := stats.FromContext(ctx).WithTags(sb.tags)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = 0
+	var retry <-chan time.Time
+	var timer *clock.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		if retry == nil {
+			replayed, err := sb.replay(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Warnf("Failed to replay spooled metrics for backend %s: %v", sb.backend.Name(), err)
+			}
+			if replayed {
+				b.Reset()
+				continue
+			}
+			if err != nil {
+				timer = clock.NewTimer(ctx, b.NextBackOff())
+				retry = timer.C
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-sb.wake:
+		case <-retry:
+			retry = nil
+		case <-flushed:
+			records, bytes, dropped := sb.spool.depth()
+			statser.Gauge("backend.spool_records", float64(records), nil)
+			statser.Gauge("backend.spool_bytes", float64(bytes), nil)
+			statser.Gauge("backend.spool_dropped", float64(dropped), nil)
+			statser.Gauge("backend.spooled", float64(atomic.LoadUint64(&sb.spooled)), nil)
+			statser.Gauge("backend.spool_replayed", float64(atomic.LoadUint64(&sb.replayed)), nil)
+			statser.Gauge("backend.spool_expired", float64(atomic.LoadUint64(&sb.expired)), nil)
+		}
+	}
+}
+
+// replay sends the oldest record in the spool to the backend, and consumes it if the send succeeds.  Returns true if
+// a record was consumed, or discarded as it was expired or corrupt.
+func (sb *spoolBackend) replay(ctx context.Context) (bool, error) {
+	sb.spool.replayLock.Lock()
+	defer sb.spool.replayLock.Unlock()
+
+	data, ok, err := sb.spool.peek()
+	if err != nil {
+		return true, err // The rest of the segment was dropped, so move on to the next one
+	} else if !ok {
+		return false, nil
+	}
+	if len(data) < spoolRecordHeaderSize {
+		sb.spool.commit()
+		return true, errSpoolCorrupt
+	}
+	intervalStart := time.Unix(0, int64(binary.BigEndian.Uint64(data[0:8])))
+	interval := time.Duration(binary.BigEndian.Uint64(data[8:16]))
+	if sb.maxAge != 0 && clock.Since(ctx, intervalStart) > sb.maxAge {
+		atomic.AddUint64(&sb.expired, 1)
+		sb.spool.commit()
+		return true, nil
+	}
+	var msg pb.RawMessageV2
+	if err = proto.Unmarshal(data[spoolRecordHeaderSize:], &msg); err != nil {
+		sb.spool.commit()
+		return true, fmt.Errorf("%v: %v", errSpoolCorrupt, err)
+	}
+
+	aggr := sb.factory.Create()
+	aggr.ReceiveMap(pb.ToMetricMap(&msg, gostatsd.Nanotime(intervalStart.Add(interval).UnixNano())))
+	aggr.Flush(interval)
+	var errs []error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	aggr.Process(func(m *gostatsd.MetricMap) {
+		wg.Add(1)
+		sb.backend.SendMetricsAsync(ctx, m, intervalStart, func(sendErrs []error) {
+			defer wg.Done()
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, sendErrs...)
+		})
+	})
+	wg.Wait()
+	if err = firstError(errs); err != nil {
+		return false, err
+	}
+	atomic.AddUint64(&sb.replayed, 1)
+	sb.spool.commit()
+	return true, nil
+}
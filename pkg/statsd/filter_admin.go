@@ -0,0 +1,209 @@
+package statsd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/atlassian/gostatsd/pkg/web"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// filterKeys are the settings of a filter section in the configuration file.
+var filterKeys = map[string]bool{
+	"match-metrics":   true,
+	"exclude-metrics": true,
+	"match-tags":      true,
+	"drop-tags":       true,
+	"drop-metric":     true,
+	"drop-host":       true,
+	"add-tags":        true,
+	"rename-metric":   true,
+	"keep-only-tags":  true,
+	"sample-rate":     true,
+	"set-hostname":    true,
+}
+
+// filterAdmin manages the filters added to a TagHandler at runtime through the admin API, and optionally persists them
+// to a state file so they survive restarts.
+type filterAdmin struct {
+	tagHandler *TagHandler
+	stateFile  string // Empty to not persist filters
+
+	mu      sync.Mutex
+	configs map[string]map[string]interface{}
+	filters map[string]Filter
+}
+
+// newFilterAdmin creates a filterAdmin, and applies any filters already in the state file.
+func newFilterAdmin(tagHandler *TagHandler, stateFile string) (*filterAdmin, error) {
+	fa := &filterAdmin{
+		tagHandler: tagHandler,
+		stateFile:  stateFile,
+		configs:    map[string]map[string]interface{}{},
+		filters:    map[string]Filter{},
+	}
+	if stateFile == "" {
+		return fa, nil
+	}
+	data, err := ioutil.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return fa, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read filter state file: %v", err)
+	}
+	var configs map[string]map[string]interface{}
+	if err = json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse filter state file %s: %v", stateFile, err)
+	}
+	for name, config := range configs {
+		if tagHandler.isConfigFilter(name) {
+			return nil, fmt.Errorf("failed to load filter %v from state file: it is defined in the configuration", name)
+		}
+		filter, err := newFilterFromConfig(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load filter %v from state file: %v", name, err)
+		}
+		fa.configs[name] = config
+		fa.filters[name] = filter
+		logrus.Infof("Loaded filter %v from state file", name)
+	}
+	fa.apply()
+	return fa, nil
+}
+
+// newFilterFromConfig creates a Filter from a map with the same keys as a filter section in the configuration file.
+func newFilterFromConfig(config map[string]interface{}) (Filter, error) {
+	v := viper.New()
+	for key, value := range config {
+		if !filterKeys[key] {
+			return Filter{}, fmt.Errorf("unknown setting %s", key)
+		}
+		v.Set(key, value)
+	}
+	return NewFilterFromViper(v)
+}
+
+// Filters returns the filters from the configuration, followed by the filters added at runtime.
+func (fa *filterAdmin) Filters() []web.FilterStatus {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	th := fa.tagHandler
+	th.mu.RLock()
+	defer th.mu.RUnlock()
+	statuses := make([]web.FilterStatus, 0, len(th.filterNames))
+	for idx, name := range th.filterNames {
+		status := web.FilterStatus{
+			Name:    name,
+			Source:  "config",
+			Matches: atomic.LoadUint64(&th.filterMatches[idx]),
+		}
+		if idx >= len(th.configNames) {
+			status.Source = "admin"
+			status.Config = fa.configs[name]
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// SetFilter adds or replaces a filter added at runtime.
+func (fa *filterAdmin) SetFilter(name string, config map[string]interface{}) error {
+	filter, err := newFilterFromConfig(config)
+	if err != nil {
+		return &web.InvalidFilterError{Message: fmt.Sprintf("invalid filter %s: %v", name, err)}
+	}
+
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	if fa.tagHandler.isConfigFilter(name) {
+		return &web.InvalidFilterError{Message: fmt.Sprintf("filter %s is defined in the configuration", name)}
+	}
+	configs := make(map[string]map[string]interface{}, len(fa.configs)+1)
+	for n, c := range fa.configs {
+		configs[n] = c
+	}
+	configs[name] = config
+	if err = fa.save(configs); err != nil {
+		return err
+	}
+	fa.configs = configs
+	fa.filters[name] = filter
+	fa.apply()
+	return nil
+}
+
+// DeleteFilter removes a filter added at runtime, returning false if it does not exist.
+func (fa *filterAdmin) DeleteFilter(name string) (bool, error) {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	if fa.tagHandler.isConfigFilter(name) {
+		return false, &web.InvalidFilterError{Message: fmt.Sprintf("filter %s is defined in the configuration", name)}
+	}
+	if _, ok := fa.configs[name]; !ok {
+		return false, nil
+	}
+	configs := make(map[string]map[string]interface{}, len(fa.configs))
+	for n, c := range fa.configs {
+		if n != name {
+			configs[n] = c
+		}
+	}
+	if err := fa.save(configs); err != nil {
+		return false, err
+	}
+	fa.configs = configs
+	delete(fa.filters, name)
+	fa.apply()
+	return true, nil
+}
+
+// apply passes the filters to the TagHandler, sorted by name.  Must be called with fa.mu held.
+func (fa *filterAdmin) apply() {
+	names := make([]string, 0, len(fa.filters))
+	for name := range fa.filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	filters := make([]Filter, 0, len(names))
+	for _, name := range names {
+		filters = append(filters, fa.filters[name])
+	}
+	fa.tagHandler.SetAdminFilters(names, filters)
+}
+
+// save writes the filters to the state file, if there is one.  The file is replaced atomically, so a crash can't
+// leave it half written.
+func (fa *filterAdmin) save(configs map[string]map[string]interface{}) error {
+	if fa.stateFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(configs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fa.stateFile), filepath.Base(fa.stateFile)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write filter state file: %v", err)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fa.stateFile)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write filter state file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package statsd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/web"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterAdminSetAndDelete(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+	th := NewTagHandler(ch, nil, nil)
+	th.SetTagsAndFilters(nil, []string{"drop-a"}, []Filter{{MatchMetrics: stringMatchList("a.*"), DropMetric: true}})
+	fa, err := newFilterAdmin(th, "")
+	require.NoError(t, err)
+
+	require.NoError(t, fa.SetFilter("drop-b", map[string]interface{}{
+		"match-metrics": []interface{}{"b.*"},
+		"drop-metric":   true,
+	}))
+	th.DispatchMetrics(context.Background(), []*gostatsd.Metric{{Name: "a.x"}, {Name: "b.x"}, {Name: "b.y"}, {Name: "c.x"}})
+	require.Len(t, ch.m, 1)
+	assert.Equal(t, "c.x", ch.m[0].Name)
+
+	assert.Equal(t, []web.FilterStatus{
+		{Name: "drop-a", Source: "config", Matches: 1},
+		{Name: "drop-b", Source: "admin", Matches: 2, Config: map[string]interface{}{
+			"match-metrics": []interface{}{"b.*"},
+			"drop-metric":   true,
+		}},
+	}, fa.Filters())
+
+	// Match counts survive other filters changing
+	require.NoError(t, fa.SetFilter("rename-c", map[string]interface{}{"match-metrics": "c.*", "rename-metric": "d"}))
+	statuses := fa.Filters()
+	require.Len(t, statuses, 3)
+	assert.EqualValues(t, 2, statuses[1].Matches)
+	assert.Equal(t, "rename-c", statuses[2].Name)
+
+	found, err := fa.DeleteFilter("drop-b")
+	require.NoError(t, err)
+	assert.True(t, found)
+	found, err = fa.DeleteFilter("drop-b")
+	require.NoError(t, err)
+	assert.False(t, found)
+	require.Len(t, th.filters, 2)
+
+	// Filters from the configuration can't be changed, and reloading the configuration keeps runtime filters
+	_, err = fa.DeleteFilter("drop-a")
+	assert.IsType(t, &web.InvalidFilterError{}, err)
+	assert.IsType(t, &web.InvalidFilterError{}, fa.SetFilter("drop-a", map[string]interface{}{}))
+	th.SetTagsAndFilters(nil, nil, nil)
+	require.Len(t, th.filters, 1)
+	assert.Equal(t, "d", th.filters[0].RenameMetric)
+
+	// The configuration can't reuse the name of a runtime filter
+	assert.Error(t, th.checkConfigFilterNames([]string{"drop-a", "rename-c"}))
+	assert.NoError(t, th.checkConfigFilterNames([]string{"drop-a"}))
+}
+
+func TestFilterAdminInvalidFilter(t *testing.T) {
+	t.Parallel()
+	fa, err := newFilterAdmin(NewTagHandler(&nopHandler{}, nil, nil), "")
+	require.NoError(t, err)
+
+	for _, config := range []map[string]interface{}{
+		{"match-metrics": "~("},
+		{"sample-rate": 2},
+		{"unknown": true},
+	} {
+		assert.IsType(t, &web.InvalidFilterError{}, fa.SetFilter("bad", config), config)
+	}
+	assert.Empty(t, fa.Filters())
+}
+
+func TestFilterAdminStateFile(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "filter-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "filters.json")
+
+	fa, err := newFilterAdmin(NewTagHandler(&nopHandler{}, nil, nil), stateFile)
+	require.NoError(t, err)
+	require.NoError(t, fa.SetFilter("drop-a", map[string]interface{}{"match-metrics": []interface{}{"a.*"}, "drop-metric": true}))
+	require.NoError(t, fa.SetFilter("drop-b", map[string]interface{}{"match-metrics": []interface{}{"b.*"}, "drop-metric": true}))
+	_, err = fa.DeleteFilter("drop-a")
+	require.NoError(t, err)
+
+	th := NewTagHandler(&nopHandler{}, nil, nil)
+	_, err = newFilterAdmin(th, stateFile)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"drop-b"}, th.filterNames)
+	require.Len(t, th.filters, 1)
+	assert.Equal(t, stringMatchList("b.*"), th.filters[0].MatchMetrics)
+
+	// A filter in the state file can't have the name of a filter from the configuration
+	th = NewTagHandler(&nopHandler{}, nil, nil)
+	th.SetTagsAndFilters(nil, []string{"drop-b"}, []Filter{{DropMetric: true}})
+	_, err = newFilterAdmin(th, stateFile)
+	assert.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(stateFile, []byte(`{"bad": {"sample-rate": -1}}`), 0600))
+	_, err = newFilterAdmin(th, stateFile)
+	assert.Error(t, err)
+}
@@ -1,8 +1,11 @@
 package statsd
 
 import (
+	"fmt"
+
 	"github.com/atlassian/gostatsd"
 
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
@@ -13,31 +16,89 @@ type Filter struct {
 	DropTags       gostatsd.StringMatchList // Any tag matching anything will be dropped
 	DropMetric     bool                     // Drop the entire metric
 	DropHost       bool                     // Clears Hostname if present
+	AddTags        gostatsd.Tags            // Tags to add
+	RenameMetric   string                   // New name for the metric if not empty
+	KeepOnlyTags   gostatsd.StringMatchList // Any tag not matching anything will be dropped
+	SampleRate     float64                  // Fraction of metrics to keep, adjusting their rate, or 0 to keep all
+	SetHostname    string                   // New Hostname if not empty
 }
 
 // toStringMatch turns a []string in to a []gostatsd.StringMatch
-func toStringMatch(tests []string) []gostatsd.StringMatch {
+func toStringMatch(tests []string) ([]gostatsd.StringMatch, error) {
 	matches := make([]gostatsd.StringMatch, 0, len(tests))
 	for _, test := range tests {
-		matches = append(matches, gostatsd.NewStringMatch(test))
+		match, err := gostatsd.ParseStringMatch(test)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, match)
+	}
+	return matches, nil
+}
+
+// NewFiltersFromViper creates the filters named in the filters setting, given a *viper.Viper, and returns them with
+// their names.
+func NewFiltersFromViper(v *viper.Viper) ([]string, []Filter, error) {
+	filterNameList := v.GetStringSlice("filters")
+	var names []string
+	var filters []Filter
+	for _, filterName := range filterNameList {
+		vFilter := v.Sub("filter." + filterName)
+		if vFilter == nil {
+			logrus.Warnf("Filter doesn't exist: %v", filterName)
+			continue
+		}
+		filter, err := NewFilterFromViper(vFilter)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load filter %v: %v", filterName, err)
+		}
+		names = append(names, filterName)
+		filters = append(filters, filter)
+		logrus.Infof("Loaded filter %v", filterName)
 	}
-	return matches
+	return names, filters, nil
 }
 
 // NewFilterFromViper creates a new Filter given a *viper.Viper
-func NewFilterFromViper(v *viper.Viper) Filter {
+func NewFilterFromViper(v *viper.Viper) (Filter, error) {
 	v.SetDefault("match-metrics", []string{})
 	v.SetDefault("exclude-metrics", []string{})
 	v.SetDefault("match-tags", []string{})
 	v.SetDefault("drop-tags", []string{})
 	v.SetDefault("drop-host", false)
 	v.SetDefault("drop-metric", false)
-	return Filter{
-		MatchMetrics:   toStringMatch(v.GetStringSlice("match-metrics")),
-		ExcludeMetrics: toStringMatch(v.GetStringSlice("exclude-metrics")),
-		MatchTags:      toStringMatch(v.GetStringSlice("match-tags")),
-		DropTags:       toStringMatch(v.GetStringSlice("drop-tags")),
-		DropHost:       v.GetBool("drop-host"),
-		DropMetric:     v.GetBool("drop-metric"),
+	v.SetDefault("add-tags", []string{})
+	v.SetDefault("rename-metric", "")
+	v.SetDefault("keep-only-tags", []string{})
+	v.SetDefault("sample-rate", 0)
+	v.SetDefault("set-hostname", "")
+
+	f := Filter{
+		DropHost:     v.GetBool("drop-host"),
+		DropMetric:   v.GetBool("drop-metric"),
+		AddTags:      v.GetStringSlice("add-tags"),
+		RenameMetric: v.GetString("rename-metric"),
+		SampleRate:   v.GetFloat64("sample-rate"),
+		SetHostname:  v.GetString("set-hostname"),
+	}
+	for _, list := range []struct {
+		key   string
+		match *gostatsd.StringMatchList
+	}{
+		{"match-metrics", &f.MatchMetrics},
+		{"exclude-metrics", &f.ExcludeMetrics},
+		{"match-tags", &f.MatchTags},
+		{"drop-tags", &f.DropTags},
+		{"keep-only-tags", &f.KeepOnlyTags},
+	} {
+		match, err := toStringMatch(v.GetStringSlice(list.key))
+		if err != nil {
+			return Filter{}, fmt.Errorf("invalid %s: %v", list.key, err)
+		}
+		*list.match = match
+	}
+	if f.SampleRate < 0 || f.SampleRate > 1 {
+		return Filter{}, fmt.Errorf("invalid sample-rate %v, must be between 0 and 1", f.SampleRate)
 	}
+	return f, nil
 }
@@ -8,9 +8,11 @@ import (
 	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/rules"
 	"github.com/atlassian/gostatsd/pkg/stats"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/tilinna/clock"
 )
 
 // MetricFlusher periodically flushes metrics from all Aggregators to Senders.
@@ -22,27 +24,108 @@ type MetricFlusher struct {
 	lastFlushError int64 // Time of the last flush error. Unix timestamp in nsec.
 
 	flushInterval      time.Duration // How often to flush metrics to the sender
+	alignFlushes       bool          // Flush on multiples of flushInterval since the epoch rather than since startup
 	aggregateProcesser AggregateProcesser
-	backends           []gostatsd.Backend
+	ruleEngine         *rules.Engine // Derives metrics from the flushed metrics, may be nil
+
+	backendsLock sync.RWMutex       // Held for reading during a flush, and for writing while backends are replaced
+	backends     []gostatsd.Backend // Backends flushed every flushInterval
+	routes       []*BackendRoute    // Route of each backend in backends, nil to send everything
+	rollups      []*backendRollup   // Backends with a longer flush interval
 }
 
-// NewMetricFlusher creates a new MetricFlusher with provided configuration.
-func NewMetricFlusher(flushInterval time.Duration, aggregateProcesser AggregateProcesser, backends []gostatsd.Backend) *MetricFlusher {
-	return &MetricFlusher{
+// NewMetricFlusher creates a new MetricFlusher with provided configuration.  Backends with an entry in
+// backendFlushIntervals longer than flushInterval are sent rollups of successive flushes, accumulated by an
+// Aggregator from aggregatorFactory.  Backends with an entry in backendRoutes are only sent the series it selects.  If
+// ruleEngine is not nil, the metrics it derives are added to the metrics sent by every flush.
+func NewMetricFlusher(flushInterval time.Duration, alignFlushes bool, aggregateProcesser AggregateProcesser, backends []gostatsd.Backend, backendFlushIntervals map[string]time.Duration, backendRoutes map[string]*BackendRoute, aggregatorFactory AggregatorFactory, ruleEngine *rules.Engine) *MetricFlusher {
+	f := &MetricFlusher{
 		flushInterval:      flushInterval,
+		alignFlushes:       alignFlushes,
 		aggregateProcesser: aggregateProcesser,
-		backends:           backends,
+		ruleEngine:         ruleEngine,
+	}
+	f.setBackends(backends, backendFlushIntervals, backendRoutes, aggregatorFactory)
+	return f
+}
+
+func (f *MetricFlusher) setBackends(backends []gostatsd.Backend, backendFlushIntervals map[string]time.Duration, backendRoutes map[string]*BackendRoute, aggregatorFactory AggregatorFactory) {
+	f.backends = nil
+	f.routes = nil
+	f.rollups = nil
+	for _, backend := range backends {
+		route := backendRoutes[backend.Name()]
+		if interval := backendFlushIntervals[backend.Name()]; interval > f.flushInterval {
+			r := newBackendRollup(backend, interval, aggregatorFactory.Create())
+			r.route = route
+			f.rollups = append(f.rollups, r)
+		} else {
+			f.backends = append(f.backends, backend)
+			f.routes = append(f.routes, route)
+		}
 	}
 }
 
+// SetBackends replaces the backends metrics are flushed to.  It waits for any flush in progress to complete, and
+// flushes anything accumulated for the old backends with a longer flush interval early, so once it returns the old
+// backends are no longer in use.
+func (f *MetricFlusher) SetBackends(ctx context.Context, backends []gostatsd.Backend, backendFlushIntervals map[string]time.Duration, backendRoutes map[string]*BackendRoute, aggregatorFactory AggregatorFactory) {
+	f.backendsLock.Lock()
+	oldRollups := f.rollups
+	f.setBackends(backends, backendFlushIntervals, backendRoutes, aggregatorFactory)
+	f.backendsLock.Unlock()
+
+	// The old rollups are no longer reachable by a flush, so they are sent without holding the lock, and flushes to the
+	// new backends aren't held up by a slow old backend.
+	var sendWg sync.WaitGroup
+	now := clock.Now(ctx)
+	for _, r := range oldRollups {
+		r.flushPending(ctx, now, &sendWg, f.handleSendResult)
+	}
+	sendWg.Wait()
+}
+
+// SetPercentThresholds replaces the percentiles calculated for timers by backends with a longer flush interval.
+func (f *MetricFlusher) SetPercentThresholds(percentThresholds []float64) {
+	f.backendsLock.RLock()
+	defer f.backendsLock.RUnlock()
+	for _, r := range f.rollups {
+		r.setPercentThresholds(percentThresholds)
+	}
+}
+
+// HealthProblems returns a description of each backend which is unhealthy, because its circuit breaker is open.
+func (f *MetricFlusher) HealthProblems() []string {
+	f.backendsLock.RLock()
+	defer f.backendsLock.RUnlock()
+	var problems []string
+	backends := f.backends
+	for _, r := range f.rollups {
+		backends = append(backends[:len(backends):len(backends)], r.backend)
+	}
+	for _, backend := range backends {
+		if hc, ok := backend.(interface{ Healthy() error }); ok {
+			if err := hc.Healthy(); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+	return problems
+}
+
 // Run runs the MetricFlusher.
 func (f *MetricFlusher) Run(ctx context.Context) {
 	statser := stats.FromContext(ctx)
 
-	flushTicker := time.NewTicker(f.flushInterval)
+	if f.alignFlushes {
+		f.runAligned(ctx, statser)
+		return
+	}
+
+	flushTicker := clock.NewTicker(ctx, f.flushInterval)
 	defer flushTicker.Stop()
 
-	lastFlush := time.Now()
+	lastFlush := clock.Now(ctx)
 	for {
 		select {
 		case <-ctx.Done():
@@ -50,7 +133,7 @@ func (f *MetricFlusher) Run(ctx context.Context) {
 		case thisFlush := <-flushTicker.C: // Time to flush to the backends
 			flushDelta := thisFlush.Sub(lastFlush)
 			if f.aggregateProcesser != AggregateProcesser(nil) {
-				f.flushData(ctx, flushDelta, statser)
+				f.flushData(ctx, flushDelta, lastFlush, thisFlush, statser)
 			}
 			statser.NotifyFlush(flushDelta)
 			lastFlush = thisFlush
@@ -58,40 +141,114 @@ func (f *MetricFlusher) Run(ctx context.Context) {
 	}
 }
 
-func (f *MetricFlusher) flushData(ctx context.Context, flushInterval time.Duration, statser stats.Statser) {
+// runAligned flushes on multiples of the flush interval since the Unix epoch, so that every instance configured
+// with the same interval flushes the same buckets.  If a boundary is missed because a flush took too long, it is
+// skipped and the data is included in the next bucket.
+func (f *MetricFlusher) runAligned(ctx context.Context, statser stats.Statser) {
+	lastFlush := clock.Now(ctx)
+	for {
+		nextFlush := alignTime(clock.Now(ctx), f.flushInterval).Add(f.flushInterval)
+		timer := clock.NewTimer(ctx, clock.Until(ctx, nextFlush))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case thisFlush := <-timer.C: // Time to flush to the backends
+			flushDelta := thisFlush.Sub(lastFlush)
+			if f.aggregateProcesser != AggregateProcesser(nil) {
+				f.flushData(ctx, flushDelta, nextFlush.Add(-f.flushInterval), nextFlush, statser)
+			}
+			statser.NotifyFlush(flushDelta)
+			lastFlush = thisFlush
+		}
+	}
+}
+
+// alignTime returns t rounded down to a multiple of d since the Unix epoch.  Unlike time.Truncate, this is
+// independent of the zero time.
+func alignTime(t time.Time, d time.Duration) time.Time {
+	ns := t.UnixNano()
+	return time.Unix(0, ns-ns%int64(d))
+}
+
+func (f *MetricFlusher) flushData(ctx context.Context, flushInterval time.Duration, intervalStart, intervalEnd time.Time, statser stats.Statser) {
+	f.backendsLock.RLock()
+	defer f.backendsLock.RUnlock()
 	var sendWg sync.WaitGroup
 	timerTotal := statser.NewTimer("flusher.total_time", nil)
 	processWait := f.aggregateProcesser.Process(ctx, func(workerId int, aggr Aggregator) {
-		// This is in the flusher, but it's an aggregator action, so put it in that space.
-		tags := gostatsd.Tags{fmt.Sprintf("aggregator_id:%d", workerId)}
-
-		timerFlush := statser.NewTimer("aggregator.aggregation_time", tags)
-		aggr.Flush(flushInterval)
-		timerFlush.SendGauge()
-
-		timerProcess := statser.NewTimer("aggregator.process_time", tags)
-		aggr.Process(func(m *gostatsd.MetricMap) {
-			f.sendMetricsAsync(ctx, &sendWg, m)
-		})
-		timerProcess.SendGauge()
-
-		timerReset := statser.NewTimer("aggregator.reset_time", tags)
-		aggr.Reset()
-		timerReset.SendGauge()
+		flushAggregator(workerId, aggr, flushInterval, statser)
+		if f.ruleEngine != nil {
+			aggr.Process(f.ruleEngine.Collect)
+		}
+		f.sendAggregator(ctx, &sendWg, workerId, aggr, intervalStart, statser)
 	})
 	processWait() // Wait for all workers to execute function
+	if f.ruleEngine != nil {
+		// Rules can only be evaluated once every aggregator has been flushed.  They are evaluated over copies of the
+		// metrics they reference, so the aggregators are sent and reset without waiting, and the derived metrics are
+		// sent on their own.
+		derived, errs := f.ruleEngine.Evaluate(gostatsd.Nanotime(clock.Now(ctx).UnixNano()))
+		for _, err := range errs {
+			log.Errorf("Skipped a recording rule: %v", err)
+		}
+		if !derived.IsEmpty() {
+			f.sendMetricsAsync(ctx, &sendWg, derived, intervalStart)
+		}
+	}
+	for _, r := range f.rollups {
+		if r.due(intervalEnd, f.alignFlushes) {
+			r.flush(ctx, intervalEnd, &sendWg, f.handleSendResult)
+		}
+	}
 	sendWg.Wait() // Wait for all backends to finish sending
 	timerTotal.SendGauge()
 }
 
-func (f *MetricFlusher) sendMetricsAsync(ctx context.Context, wg *sync.WaitGroup, m *gostatsd.MetricMap) {
-	wg.Add(len(f.backends))
-	for _, backend := range f.backends {
-		backend.SendMetricsAsync(ctx, m, func(errs []error) {
+// flushAggregator prepares the metrics of an aggregator for sending.
+func flushAggregator(workerId int, aggr Aggregator, flushInterval time.Duration, statser stats.Statser) {
+	// This is in the flusher, but it's an aggregator action, so put it in that space.
+	tags := gostatsd.Tags{fmt.Sprintf("aggregator_id:%d", workerId)}
+
+	timerFlush := statser.NewTimer("aggregator.aggregation_time", tags)
+	aggr.Flush(flushInterval)
+	timerFlush.SendGauge()
+}
+
+// sendAggregator sends the flushed metrics of an aggregator to the backends, and resets the aggregator.
+func (f *MetricFlusher) sendAggregator(ctx context.Context, wg *sync.WaitGroup, workerId int, aggr Aggregator, intervalStart time.Time, statser stats.Statser) {
+	tags := gostatsd.Tags{fmt.Sprintf("aggregator_id:%d", workerId)}
+
+	timerProcess := statser.NewTimer("aggregator.process_time", tags)
+	aggr.Process(func(m *gostatsd.MetricMap) {
+		f.sendMetricsAsync(ctx, wg, m, intervalStart)
+	})
+	aggr.ProcessLate(func(lateIntervalStart time.Time, m *gostatsd.MetricMap) {
+		f.sendMetricsAsync(ctx, wg, m, lateIntervalStart)
+	})
+	timerProcess.SendGauge()
+
+	timerReset := statser.NewTimer("aggregator.reset_time", tags)
+	aggr.Reset()
+	timerReset.SendGauge()
+}
+
+// sendMetricsAsync sends m to the backends, and adds it to the rollups.
+func (f *MetricFlusher) sendMetricsAsync(ctx context.Context, wg *sync.WaitGroup, m *gostatsd.MetricMap, intervalStart time.Time) {
+	for idx, backend := range f.backends {
+		view := f.routes[idx].view(m)
+		if view != m && view.IsEmpty() {
+			continue
+		}
+		wg.Add(1)
+		backend.SendMetricsAsync(ctx, view, intervalStart, func(errs []error) {
 			defer wg.Done()
 			f.handleSendResult(errs)
 		})
 	}
+	for _, r := range f.rollups {
+		r.receive(r.route.view(m), intervalStart)
+	}
 }
 
 func (f *MetricFlusher) handleSendResult(flushResults []error) {
@@ -99,7 +256,7 @@ func (f *MetricFlusher) handleSendResult(flushResults []error) {
 	for _, err := range flushResults {
 		if err != nil {
 			timestampPointer = &f.lastFlushError
-			if err != context.DeadlineExceeded && err != context.Canceled {
+			if err != context.DeadlineExceeded && err != context.Canceled && err != errBackendSkipped {
 				log.Errorf("Sending metrics to backend failed: %v", err)
 			}
 		}
@@ -1,9 +1,19 @@
 package statsd
 
 import (
+	"context"
 	"errors"
 	"strconv"
 	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/rules"
+	"github.com/atlassian/gostatsd/pkg/stats"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilinna/clock"
 )
 
 func TestFlusherHandleSendResultNoErrors(t *testing.T) {
@@ -17,7 +27,7 @@ func TestFlusherHandleSendResultNoErrors(t *testing.T) {
 		errs := errs
 		t.Run(strconv.Itoa(pos), func(t *testing.T) {
 			t.Parallel()
-			fl := NewMetricFlusher(0, nil, nil)
+			fl := NewMetricFlusher(0, false, nil, nil, nil, nil, nil, nil)
 			fl.handleSendResult(errs)
 
 			if fl.lastFlush == 0 || fl.lastFlushError != 0 {
@@ -39,7 +49,7 @@ func TestFlusherHandleSendResultError(t *testing.T) {
 		errs := errs
 		t.Run(strconv.Itoa(pos), func(t *testing.T) {
 			t.Parallel()
-			fl := NewMetricFlusher(0, nil, nil)
+			fl := NewMetricFlusher(0, false, nil, nil, nil, nil, nil, nil)
 			fl.handleSendResult(errs)
 
 			if fl.lastFlushError == 0 || fl.lastFlush != 0 {
@@ -48,3 +58,156 @@ func TestFlusherHandleSendResultError(t *testing.T) {
 		})
 	}
 }
+
+func TestAlignTime(t *testing.T) {
+	t.Parallel()
+	input := []struct {
+		t        time.Time
+		d        time.Duration
+		expected time.Time
+	}{
+		{time.Unix(0, 0), 10 * time.Second, time.Unix(0, 0)},
+		{time.Unix(7, 500), 10 * time.Second, time.Unix(0, 0)},
+		{time.Unix(10, 0), 10 * time.Second, time.Unix(10, 0)},
+		{time.Unix(119, 0), time.Minute, time.Unix(60, 0)},
+	}
+	for pos, inp := range input {
+		inp := inp
+		t.Run(strconv.Itoa(pos), func(t *testing.T) {
+			t.Parallel()
+			assert.True(t, inp.expected.Equal(alignTime(inp.t, inp.d)), "got %v", alignTime(inp.t, inp.d))
+		})
+	}
+}
+
+func TestFlusherIntervalStart(t *testing.T) {
+	t.Parallel()
+	input := []struct {
+		aligned  bool
+		expected []time.Time
+	}{
+		{false, []time.Time{time.Unix(7, 0), time.Unix(17, 0)}},
+		{true, []time.Time{time.Unix(0, 0), time.Unix(10, 0)}},
+	}
+	for pos, inp := range input {
+		inp := inp
+		t.Run(strconv.Itoa(pos), func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			mockClock := clock.NewMock(time.Unix(7, 0))
+			ctx = clock.Context(ctx, mockClock)
+
+			backend := &intervalCapturingBackend{starts: make(chan time.Time, len(inp.expected))}
+			fl := NewMetricFlusher(10*time.Second, inp.aligned, &singleAggregateProcesser{
+				aggr: NewMetricAggregator(nil, 0, gostatsd.TimerSubtypes{}, false, 0, 0, false),
+			}, []gostatsd.Backend{backend}, nil, nil, nil, nil)
+			go fl.Run(ctx)
+
+			for _, expected := range inp.expected {
+				// Wait for the flusher to schedule its next flush, then fire it.
+				for _, d := mockClock.AddNext(); d == 0; _, d = mockClock.AddNext() {
+					time.Sleep(time.Millisecond)
+				}
+				select {
+				case start := <-backend.starts:
+					assert.True(t, expected.Equal(start), "expected %v, got %v", expected, start)
+				case <-time.After(time.Second):
+					require.Fail(t, "timed out waiting for flush")
+				}
+			}
+		})
+	}
+}
+
+func TestFlusherBackendFlushInterval(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mockClock := clock.NewMock(time.Unix(7, 0))
+	ctx = clock.Context(ctx, mockClock)
+
+	backend := &intervalCapturingBackend{starts: make(chan time.Time, 3)}
+	rollupBackend := &capturingBackend{}
+	factory := &agrFactory{}
+	fl := NewMetricFlusher(10*time.Second, true, &singleAggregateProcesser{
+		aggr: factory.Create(),
+	}, []gostatsd.Backend{backend, rollupBackend}, map[string]time.Duration{
+		rollupBackend.Name(): 30 * time.Second,
+	}, nil, factory, nil)
+	go fl.Run(ctx)
+
+	for i := 0; i < 3; i++ {
+		for _, d := mockClock.AddNext(); d == 0; _, d = mockClock.AddNext() {
+			time.Sleep(time.Millisecond)
+		}
+		select {
+		case <-backend.starts:
+		case <-time.After(time.Second):
+			require.Fail(t, "timed out waiting for flush")
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		rollupBackend.mu.Lock()
+		starts := rollupBackend.intervalStarts
+		rollupBackend.mu.Unlock()
+		if len(starts) > 0 {
+			assert.Equal(t, []time.Time{time.Unix(0, 0)}, starts)
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "timed out waiting for rollup flush")
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFlusherAddsDerivedMetrics(t *testing.T) {
+	t.Parallel()
+	rule, err := rules.NewRule("requests.total", "sum(requests)")
+	require.NoError(t, err)
+	aggr := NewMetricAggregator(nil, 0, gostatsd.TimerSubtypes{}, false, 0, 0, false)
+	backend := &capturingBackend{}
+	fl := NewMetricFlusher(10*time.Second, false, &singleAggregateProcesser{aggr: aggr}, []gostatsd.Backend{backend}, nil, nil, nil, rules.NewEngine([]*rules.Rule{rule}))
+
+	aggr.Receive(
+		&gostatsd.Metric{Name: "requests", Value: 2, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"a"}, TagsKey: "a"},
+		&gostatsd.Metric{Name: "requests", Value: 3, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"b"}, TagsKey: "b"},
+	)
+	fl.flushData(context.Background(), 10*time.Second, time.Unix(0, 0), time.Unix(10, 0), stats.NewNullStatser())
+
+	require.Len(t, backend.maps, 2, "derived metrics should be sent after the flushed metrics")
+	assert.Len(t, backend.maps[0].Counters["requests"], 2)
+	assert.Empty(t, backend.maps[0].Gauges)
+	assert.Empty(t, backend.maps[1].Counters)
+	assert.Equal(t, 5.0, backend.maps[1].Gauges["requests.total"][""].Value)
+	aggr.Process(func(m *gostatsd.MetricMap) {
+		assert.Empty(t, m.Gauges, "derived metrics should not be kept by the aggregator")
+	})
+}
+
+type singleAggregateProcesser struct {
+	aggr Aggregator
+}
+
+func (sap *singleAggregateProcesser) Process(ctx context.Context, fn DispatcherProcessFunc) gostatsd.Wait {
+	fn(0, sap.aggr)
+	return func() {}
+}
+
+type intervalCapturingBackend struct {
+	starts chan time.Time
+}
+
+func (icb *intervalCapturingBackend) Name() string {
+	return "intervalCapturingBackend"
+}
+
+func (icb *intervalCapturingBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, intervalStart time.Time, callback gostatsd.SendCallback) {
+	icb.starts <- intervalStart
+	callback(nil)
+}
+
+func (icb *intervalCapturingBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
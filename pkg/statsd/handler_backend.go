@@ -30,6 +30,7 @@ func (f AggregatorFactoryFunc) Create() Aggregator {
 // BackendEventHandler dispatches metrics and events to all configured backends (via Aggregators)
 type BackendHandler struct {
 	eventWg          sync.WaitGroup
+	backendsLock     sync.RWMutex
 	backends         []gostatsd.Backend
 	concurrentEvents chan struct{}
 
@@ -157,6 +158,27 @@ func (bh *BackendHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.Me
 	}
 }
 
+// QueueUtilisation returns how full the fullest worker queue is, between 0 and 1.
+func (bh *BackendHandler) QueueUtilisation() float64 {
+	var utilisation float64
+	for _, w := range bh.workers {
+		for _, u := range []float64{fraction(len(w.metricsQueue), cap(w.metricsQueue)), fraction(len(w.metricMapQueue), cap(w.metricMapQueue))} {
+			if u > utilisation {
+				utilisation = u
+			}
+		}
+	}
+	return utilisation
+}
+
+// fraction returns how full a queue of length queued and capacity size is, or 0 if it is unbuffered.
+func fraction(queued, size int) float64 {
+	if size == 0 {
+		return 0
+	}
+	return float64(queued) / float64(size)
+}
+
 // Process concurrently executes provided function in goroutines that own Aggregators.
 // DispatcherProcessFunc function may be executed zero or up to numWorkers times. It is executed
 // less than numWorkers times if the context signals "done".
@@ -182,14 +204,25 @@ loop:
 	return wg.Wait
 }
 
+// SetBackends replaces the backends events are sent to.  Events already being sent are not affected.
+func (bh *BackendHandler) SetBackends(backends []gostatsd.Backend) {
+	bh.backendsLock.Lock()
+	defer bh.backendsLock.Unlock()
+	bh.backends = backends
+}
+
 func (bh *BackendHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	bh.backendsLock.RLock()
+	backends := bh.backends
+	bh.backendsLock.RUnlock()
+
 	eventsDispatched := 0
-	bh.eventWg.Add(len(bh.backends))
-	for _, backend := range bh.backends {
+	bh.eventWg.Add(len(backends))
+	for _, backend := range backends {
 		select {
 		case <-ctx.Done():
 			// Not all backends got the event, should decrement the wg counter
-			bh.eventWg.Add(eventsDispatched - len(bh.backends))
+			bh.eventWg.Add(eventsDispatched - len(backends))
 			return
 		case bh.concurrentEvents <- struct{}{}:
 			go bh.dispatchEvent(ctx, backend, e)
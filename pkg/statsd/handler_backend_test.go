@@ -50,6 +50,12 @@ func (a *testAggregator) Process(f ProcessFunc) {
 	f(&a.MetricMap)
 }
 
+func (a *testAggregator) ProcessLate(f LateProcessFunc) {
+}
+
+func (a *testAggregator) SetPercentThresholds(percentThresholds []float64) {
+}
+
 func (a *testAggregator) Reset() {
 	a.af.Mutex.Lock()
 	defer a.af.Mutex.Unlock()
@@ -229,3 +235,17 @@ func BenchmarkBackendHandler(b *testing.B) {
 	cancelFunc()    // After all metrics have been dispatched, we signal dispatcher to shut down
 	wgFinish.Wait() // Wait for dispatcher to shutdown
 }
+
+func TestQueueUtilisation(t *testing.T) {
+	t.Parallel()
+	h := NewBackendHandler(nil, 0, 2, 4, newTestFactory())
+	assert.Zero(t, h.QueueUtilisation())
+
+	h.workers[0].metricsQueue <- nil
+	assert.Equal(t, 0.25, h.QueueUtilisation())
+
+	for i := 0; i < 3; i++ {
+		h.workers[1].metricMapQueue <- gostatsd.NewMetricMap()
+	}
+	assert.Equal(t, 0.75, h.QueueUtilisation(), "the fullest queue should be reported")
+}
@@ -0,0 +1,478 @@
+package statsd
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/internal/tlsconfig"
+	"github.com/atlassian/gostatsd/pb"
+	"github.com/atlassian/gostatsd/pkg/stats"
+
+	"github.com/ash2k/stager/wait"
+	"github.com/cenkalti/backoff"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tilinna/clock"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding/gzip"
+)
+
+const (
+	defaultGrpcAddress      = ""
+	defaultMaxSeriesPerSend = 10000
+	defaultMaxStreams       = 4
+	defaultMaxStreamAge     = 5 * time.Second
+)
+
+// GrpcForwarderHandlerV2 is a PipelineHandler which forwards metrics to another gostatsd instance over gRPC.
+type GrpcForwarderHandlerV2 struct {
+	streamId        uint64 // atomic - used for an id in logs
+	messagesCreated uint64 // atomic - messages which were created
+	messagesSent    uint64 // atomic - messages on streams which were successfully closed
+	messagesRetried uint64 // atomic - messages sent again (first send is not a retry, final failure is not a retry)
+	messagesDropped uint64 // atomic - final failure
+
+	logger                logrus.FieldLogger
+	address               string
+	clientTimeout         time.Duration
+	maxRequestElapsedTime time.Duration
+	maxStreamAge          time.Duration
+	maxSeries             int // Series in each message
+	maxStreams            int // Metric streams open at once
+	conn                  *grpc.ClientConn
+	client                pb.ForwarderV2Client
+	callOptions           []grpc.CallOption
+	consolidator          *gostatsd.MetricConsolidator
+	consolidatedMetrics   <-chan []*gostatsd.MetricMap
+	metricMessages        chan streamMessage
+	eventMessages         chan streamMessage
+	stopped               chan struct{} // Closed when Run has stopped sending
+	eventWg               sync.WaitGroup
+}
+
+// streamMessage is a message waiting to be sent on a stream.  If done is not nil, it is called once the message has
+// been sent or dropped.
+type streamMessage struct {
+	msg  interface{}
+	done func()
+}
+
+// streamOpener opens a client stream of a ForwarderV2 method.
+type streamOpener func(ctx context.Context) (grpc.ClientStream, error)
+
+// NewGrpcForwarderHandlerV2FromViper returns a new gRPC API client.
+func NewGrpcForwarderHandlerV2FromViper(logger logrus.FieldLogger, v *viper.Viper) (*GrpcForwarderHandlerV2, error) {
+	subViper := getSubViper(v, "grpc-transport")
+	subViper.SetDefault("address", defaultGrpcAddress)
+	subViper.SetDefault("client-timeout", defaultClientTimeout)
+	subViper.SetDefault("compress", defaultCompress)
+	subViper.SetDefault("max-streams", defaultMaxStreams)
+	subViper.SetDefault("max-stream-age", defaultMaxStreamAge)
+	subViper.SetDefault("max-request-elapsed-time", defaultMaxRequestElapsedTime)
+	subViper.SetDefault("max-series-per-send", defaultMaxSeriesPerSend)
+	subViper.SetDefault("consolidator-slots", v.GetInt(ParamMaxParsers))
+	subViper.SetDefault("flush-interval", defaultConsolidatorFlushInterval)
+	subViper.SetDefault("auth-token", "")
+	subViper.SetDefault("tls", false)
+	subViper.SetDefault("tls-ca-path", "")
+	subViper.SetDefault("tls-cert-path", "")
+	subViper.SetDefault("tls-key-path", "")
+
+	tlsConfig, err := tlsconfig.Client(
+		subViper.GetString("tls-ca-path"),
+		subViper.GetString("tls-cert-path"),
+		subViper.GetString("tls-key-path"),
+		subViper.GetBool("tls"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialOptions []grpc.DialOption
+	if token := subViper.GetString("auth-token"); token != "" {
+		dialOptions = append(dialOptions, grpc.WithPerRPCCredentials(bearerToken(token)))
+	}
+
+	return NewGrpcForwarderHandlerV2(
+		logger,
+		subViper.GetString("address"),
+		subViper.GetInt("consolidator-slots"),
+		subViper.GetInt("max-streams"),
+		subViper.GetInt("max-series-per-send"),
+		subViper.GetBool("compress"),
+		tlsConfig,
+		subViper.GetDuration("client-timeout"),
+		subViper.GetDuration("max-request-elapsed-time"),
+		subViper.GetDuration("max-stream-age"),
+		subViper.GetDuration("flush-interval"),
+		dialOptions...,
+	)
+}
+
+// bearerToken is a credentials.PerRPCCredentials which authenticates every stream to aggregators which require tenants.
+type bearerToken string
+
+func (bt bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(bt)}, nil
+}
+
+// RequireTransportSecurity allows the token to be sent without TLS, as the http forwarder does.
+func (bt bearerToken) RequireTransportSecurity() bool {
+	return false
+}
+
+// NewGrpcForwarderHandlerV2 returns a new handler which streams metrics over gRPC to another gostatsd server.  Metric
+// maps are split in to messages of at most maxSeries series, which are sent on up to maxStreams streams over a single
+// shared connection.  Each stream is closed once it has been open for maxStreamAge, and must be closed within
+// clientTimeout.  A stream which fails is sent again in full until maxRequestElapsedTime has passed.  If tlsConfig is
+// nil, TLS is not used.  Any dialOptions are added to those derived from the other arguments.
+func NewGrpcForwarderHandlerV2(
+	logger logrus.FieldLogger,
+	address string,
+	consolidatorSlots, maxStreams, maxSeries int,
+	compress bool,
+	tlsConfig *tls.Config,
+	clientTimeout, maxRequestElapsedTime, maxStreamAge, flushInterval time.Duration,
+	dialOptions ...grpc.DialOption,
+) (*GrpcForwarderHandlerV2, error) {
+	if address == "" {
+		return nil, fmt.Errorf("address is required")
+	}
+	if consolidatorSlots <= 0 {
+		return nil, fmt.Errorf("consolidator-slots must be positive")
+	}
+	if maxStreams <= 0 {
+		return nil, fmt.Errorf("max-streams must be positive")
+	}
+	if maxSeries <= 0 {
+		return nil, fmt.Errorf("max-series-per-send must be positive")
+	}
+	if clientTimeout <= 0 {
+		return nil, fmt.Errorf("client-timeout must be positive")
+	}
+	if maxRequestElapsedTime <= 0 {
+		return nil, fmt.Errorf("max-request-elapsed-time must be positive")
+	}
+	if maxStreamAge <= 0 || maxStreamAge >= clientTimeout {
+		return nil, fmt.Errorf("max-stream-age must be positive and less than client-timeout")
+	}
+	if flushInterval <= 0 {
+		return nil, fmt.Errorf("flush-interval must be positive")
+	}
+
+	logger.WithFields(logrus.Fields{
+		"address":                  address,
+		"client-timeout":           clientTimeout,
+		"compress":                 compress,
+		"max-request-elapsed-time": maxRequestElapsedTime,
+		"max-stream-age":           maxStreamAge,
+		"max-streams":              maxStreams,
+		"max-series-per-send":      maxSeries,
+		"consolidator-slots":       consolidatorSlots,
+		"flush-interval":           flushInterval,
+		"tls":                      tlsConfig != nil,
+	}).Info("created GrpcForwarderHandler")
+
+	opts := []grpc.DialOption{grpc.WithUserAgent("gostatsd (grpc forwarder)")}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	// The connection is established in the background, and re-established whenever it is lost.
+	conn, err := grpc.Dial(address, append(opts, dialOptions...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var callOptions []grpc.CallOption
+	if compress {
+		callOptions = append(callOptions, grpc.UseCompressor(gzip.Name))
+	}
+
+	ch := make(chan []*gostatsd.MetricMap)
+
+	return &GrpcForwarderHandlerV2{
+		logger:                logger.WithField("component", "grpc-forwarder-handler-v2"),
+		address:               address,
+		clientTimeout:         clientTimeout,
+		maxRequestElapsedTime: maxRequestElapsedTime,
+		maxStreamAge:          maxStreamAge,
+		maxSeries:             maxSeries,
+		maxStreams:            maxStreams,
+		conn:                  conn,
+		client:                pb.NewForwarderV2Client(conn),
+		callOptions:           callOptions,
+		consolidator:          gostatsd.NewMetricConsolidator(consolidatorSlots, flushInterval, ch),
+		consolidatedMetrics:   ch,
+		metricMessages:        make(chan streamMessage),
+		eventMessages:         make(chan streamMessage),
+		stopped:               make(chan struct{}),
+	}, nil
+}
+
+func (gfh *GrpcForwarderHandlerV2) EstimatedTags() int {
+	return 0
+}
+
+func (gfh *GrpcForwarderHandlerV2) DispatchMetrics(ctx context.Context, metrics []*gostatsd.Metric) {
+	gfh.consolidator.ReceiveMetrics(metrics)
+}
+
+// DispatchMetricMap re-dispatches a metric map through GrpcForwarderHandlerV2.DispatchMetrics
+func (gfh *GrpcForwarderHandlerV2) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	gfh.consolidator.ReceiveMetricMap(mm)
+}
+
+func (gfh *GrpcForwarderHandlerV2) RunMetrics(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+
+	notify, cancel := statser.RegisterFlush()
+	defer cancel()
+
+	for {
+		select {
+		case <-notify:
+			gfh.emitMetrics(statser)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (gfh *GrpcForwarderHandlerV2) emitMetrics(statser stats.Statser) {
+	messagesCreated := atomic.SwapUint64(&gfh.messagesCreated, 0)
+	messagesSent := atomic.SwapUint64(&gfh.messagesSent, 0)
+	messagesRetried := atomic.SwapUint64(&gfh.messagesRetried, 0)
+	messagesDropped := atomic.SwapUint64(&gfh.messagesDropped, 0)
+
+	statser.Count("grpc.forwarder.created", float64(messagesCreated), nil)
+	statser.Count("grpc.forwarder.sent", float64(messagesSent), nil)
+	statser.Count("grpc.forwarder.retried", float64(messagesRetried), nil)
+	statser.Count("grpc.forwarder.dropped", float64(messagesDropped), nil)
+}
+
+func (gfh *GrpcForwarderHandlerV2) Run(ctx context.Context) {
+	var wg wait.Group
+	defer func() {
+		wg.Wait()
+		close(gfh.stopped)
+		gfh.eventWg.Wait()
+		_ = gfh.conn.Close()
+	}()
+	wg.StartWithContext(ctx, gfh.consolidator.Run)
+	for i := 0; i < gfh.maxStreams; i++ {
+		wg.StartWithContext(ctx, func(ctx context.Context) {
+			gfh.runStreams(ctx, "metrics", gfh.metricMessages, gfh.openMetricsStream)
+		})
+	}
+	wg.StartWithContext(ctx, func(ctx context.Context) {
+		gfh.runStreams(ctx, "events", gfh.eventMessages, gfh.openEventsStream)
+	})
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case metricMaps := <-gfh.consolidatedMetrics:
+			maps := splitMetricMap(mergeMaps(metricMaps), gfh.maxSeries)
+			atomic.AddUint64(&gfh.messagesCreated, uint64(len(maps)))
+			for i, mm := range maps {
+				select {
+				case <-ctx.Done():
+					atomic.AddUint64(&gfh.messagesDropped, uint64(len(maps)-i))
+					return
+				case gfh.metricMessages <- streamMessage{msg: pb.FromMetricMap(mm)}:
+				}
+			}
+		}
+	}
+}
+
+func (gfh *GrpcForwarderHandlerV2) openMetricsStream(ctx context.Context) (grpc.ClientStream, error) {
+	return gfh.client.SendMetrics(ctx, gfh.callOptions...)
+}
+
+func (gfh *GrpcForwarderHandlerV2) openEventsStream(ctx context.Context) (grpc.ClientStream, error) {
+	return gfh.client.SendEvents(ctx, gfh.callOptions...)
+}
+
+// splitMetricMap splits mm in to MetricMaps of at most maxSeries series each.
+func splitMetricMap(mm *gostatsd.MetricMap, maxSeries int) []*gostatsd.MetricMap {
+	var maps []*gostatsd.MetricMap
+	var current *gostatsd.MetricMap
+	series := 0
+	next := func() *gostatsd.MetricMap {
+		if current == nil || series == maxSeries {
+			current = gostatsd.NewMetricMap()
+			maps = append(maps, current)
+			series = 0
+		}
+		series++
+		return current
+	}
+
+	mm.SplitByFunc(func(metricName, tagsKey *string, hostname string, tags *gostatsd.Tags) *gostatsd.MetricMap {
+		return next()
+	})
+
+	return maps
+}
+
+// runStreams opens a stream whenever there is a message to send, and sends messages on it until it is done with.
+func (gfh *GrpcForwarderHandlerV2) runStreams(ctx context.Context, streamType string, messages <-chan streamMessage, open streamOpener) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case first := <-messages:
+			id := atomic.AddUint64(&gfh.streamId, 1) - 1
+			gfh.runStream(ctx, id, streamType, first, messages, open)
+		}
+	}
+}
+
+// runStream sends first, and any other messages which arrive in the next max-stream-age, on a new stream.  Nothing on
+// a stream is dispatched by the aggregator until the stream is closed, so if it fails, every message on it is sent
+// again on another stream.
+func (gfh *GrpcForwarderHandlerV2) runStream(ctx context.Context, id uint64, streamType string, first streamMessage, messages <-chan streamMessage, open streamOpener) {
+	pending := []streamMessage{first}
+	defer func() {
+		for _, m := range pending {
+			if m.done != nil {
+				m.done()
+			}
+		}
+	}()
+
+	streamCtx, cancel := context.WithTimeout(ctx, gfh.clientTimeout)
+	defer cancel()
+	stream, err := open(streamCtx)
+	if err == nil {
+		err = stream.SendMsg(first.msg)
+	}
+
+	timer := clock.NewTimer(ctx, gfh.maxStreamAge)
+	defer timer.Stop()
+	for expired := false; err == nil && !expired; {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-timer.C:
+			expired = true
+		case m := <-messages:
+			pending = append(pending, m)
+			err = stream.SendMsg(m.msg)
+		}
+	}
+	if err == nil {
+		err = closeStream(stream)
+	}
+	if err == nil {
+		atomic.AddUint64(&gfh.messagesSent, uint64(len(pending)))
+		return
+	}
+	if ctx.Err() != nil {
+		atomic.AddUint64(&gfh.messagesDropped, uint64(len(pending)))
+		return
+	}
+
+	gfh.resend(ctx, id, streamType, pending, open, err)
+}
+
+// resend sends messages again on a new stream, with backoff, until it succeeds or max-request-elapsed-time has
+// passed.  err is why the stream they were first sent on failed.
+func (gfh *GrpcForwarderHandlerV2) resend(ctx context.Context, id uint64, streamType string, messages []streamMessage, open streamOpener, err error) {
+	logger := gfh.logger.WithFields(logrus.Fields{
+		"id":       id,
+		"type":     streamType,
+		"messages": len(messages),
+	})
+	count := uint64(len(messages))
+
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = gfh.maxRequestElapsedTime
+
+	for {
+		next := b.NextBackOff()
+		if next == backoff.Stop {
+			atomic.AddUint64(&gfh.messagesDropped, count)
+			logger.WithError(err).Info("failed to send, giving up")
+			return
+		}
+
+		atomic.AddUint64(&gfh.messagesRetried, count)
+
+		timer := clock.NewTimer(ctx, next)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			atomic.AddUint64(&gfh.messagesDropped, count)
+			return
+		case <-timer.C:
+		}
+
+		streamCtx, cancel := context.WithTimeout(ctx, gfh.clientTimeout)
+		err = sendStream(streamCtx, messages, open)
+		cancel()
+		if err == nil {
+			atomic.AddUint64(&gfh.messagesSent, count)
+			return
+		}
+	}
+}
+
+// sendStream sends messages on a new stream, and closes it.
+func sendStream(ctx context.Context, messages []streamMessage, open streamOpener) error {
+	stream, err := open(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range messages {
+		if err = stream.SendMsg(m.msg); err != nil {
+			return err
+		}
+	}
+	return closeStream(stream)
+}
+
+// closeStream closes stream for sending, and waits for the aggregator to reply.
+func closeStream(stream grpc.ClientStream) error {
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	return stream.RecvMsg(&pb.SendReplyV2{})
+}
+
+///////// Event processing
+
+// Events are sent on their own stream, which is open while there are events to send.  DispatchEvent doesn't wait
+// for the stream, for the same reasons as HttpForwarderHandlerV2.
+
+func (gfh *GrpcForwarderHandlerV2) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	gfh.eventWg.Add(1)
+	go gfh.dispatchEvent(ctx, e)
+}
+
+func (gfh *GrpcForwarderHandlerV2) dispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	atomic.AddUint64(&gfh.messagesCreated, 1)
+	select {
+	case gfh.eventMessages <- streamMessage{msg: translateEventToProtobufV2(e), done: gfh.eventWg.Done}:
+	case <-ctx.Done():
+		atomic.AddUint64(&gfh.messagesDropped, 1)
+		gfh.eventWg.Done()
+	case <-gfh.stopped:
+		atomic.AddUint64(&gfh.messagesDropped, 1)
+		gfh.eventWg.Done()
+	}
+}
+
+func (gfh *GrpcForwarderHandlerV2) WaitForEvents() {
+	gfh.eventWg.Wait()
+}
@@ -0,0 +1,196 @@
+package statsd
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pb"
+)
+
+// flakyForwarderServer fails the first failures streams it receives, and records the messages on the others.
+type flakyForwarderServer struct {
+	mu       sync.Mutex
+	failures int
+	block    bool // Block until the stream's deadline instead of replying
+	streams  int  // Streams which succeeded
+	messages []*pb.RawMessageV2
+}
+
+func (ffs *flakyForwarderServer) SendMetrics(stream pb.ForwarderV2_SendMetricsServer) error {
+	var messages []*pb.RawMessageV2
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		messages = append(messages, msg)
+	}
+	if ffs.block {
+		<-stream.Context().Done()
+		return stream.Context().Err()
+	}
+
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	if ffs.failures > 0 {
+		ffs.failures--
+		return status.Error(codes.Unavailable, "flaky")
+	}
+	ffs.streams++
+	ffs.messages = append(ffs.messages, messages...)
+	return stream.SendAndClose(&pb.SendReplyV2{Received: uint64(len(messages))})
+}
+
+func (ffs *flakyForwarderServer) SendEvents(stream pb.ForwarderV2_SendEventsServer) error {
+	return status.Error(codes.Unimplemented, "events are not supported")
+}
+
+func newFlakyGrpcForwarder(t *testing.T, server *flakyForwarderServer, clientTimeout, maxRequestElapsedTime, maxStreamAge time.Duration) (*GrpcForwarderHandlerV2, func()) {
+	listener := bufconn.Listen(1024 * 1024)
+	gs := grpc.NewServer()
+	pb.RegisterForwarderV2Server(gs, server)
+	go func() {
+		_ = gs.Serve(listener)
+	}()
+
+	gfh, err := NewGrpcForwarderHandlerV2(logrus.StandardLogger(), "bufconn", 1, 1, 2, false, nil, clientTimeout, maxRequestElapsedTime, maxStreamAge, time.Second,
+		grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+			return listener.Dial()
+		}),
+	)
+	require.NoError(t, err)
+	return gfh, func() {
+		_ = gfh.conn.Close()
+		gs.Stop()
+	}
+}
+
+// metricMessage returns a message with a counter called name.
+func metricMessage(name string) streamMessage {
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: name, Value: 1, Rate: 1, Type: gostatsd.COUNTER})
+	return streamMessage{msg: pb.FromMetricMap(mm)}
+}
+
+func TestSplitMetricMap(t *testing.T) {
+	t.Parallel()
+	mm := metricMapForSharding()
+
+	maps := splitMetricMap(mm, 5)
+	require.Len(t, maps, 10) // 48 series
+	merged := gostatsd.NewMetricMap()
+	for _, m := range maps {
+		series := 0
+		m.Counters.Each(func(string, string, gostatsd.Counter) { series++ })
+		m.Timers.Each(func(string, string, gostatsd.Timer) { series++ })
+		assert.True(t, series <= 5)
+		merged.Merge(m)
+	}
+	assert.Equal(t, mm, merged)
+
+	assert.Empty(t, splitMetricMap(gostatsd.NewMetricMap(), 5))
+}
+
+func TestGrpcForwarderV2StreamsMessages(t *testing.T) {
+	t.Parallel()
+	server := &flakyForwarderServer{}
+	gfh, stop := newFlakyGrpcForwarder(t, server, time.Second, 10*time.Second, 50*time.Millisecond)
+	defer stop()
+
+	messages := make(chan streamMessage, 2)
+	messages <- metricMessage("b")
+	messages <- metricMessage("c")
+	gfh.runStream(context.Background(), 0, "metrics", metricMessage("a"), messages, gfh.openMetricsStream)
+
+	assert.Equal(t, 1, server.streams, "messages arriving while the stream is open should be sent on it")
+	assert.Len(t, server.messages, 3)
+	assert.EqualValues(t, 3, gfh.messagesSent)
+	assert.EqualValues(t, 0, gfh.messagesRetried)
+}
+
+func TestGrpcForwarderV2ResendsStream(t *testing.T) {
+	t.Parallel()
+	server := &flakyForwarderServer{failures: 1}
+	gfh, stop := newFlakyGrpcForwarder(t, server, time.Second, 10*time.Second, 50*time.Millisecond)
+	defer stop()
+
+	messages := make(chan streamMessage, 1)
+	messages <- metricMessage("b")
+	done := 0
+	first := metricMessage("a")
+	first.done = func() { done++ }
+	gfh.runStream(context.Background(), 0, "metrics", first, messages, gfh.openMetricsStream)
+
+	require.Len(t, server.messages, 2, "every message on the failed stream should be sent again")
+	assert.Equal(t, 1, server.streams)
+	assert.Equal(t, 1, done)
+	assert.EqualValues(t, 2, gfh.messagesSent)
+	assert.EqualValues(t, 2, gfh.messagesRetried)
+	assert.EqualValues(t, 0, gfh.messagesDropped)
+}
+
+func TestGrpcForwarderV2Deadline(t *testing.T) {
+	t.Parallel()
+	server := &flakyForwarderServer{block: true}
+	gfh, stop := newFlakyGrpcForwarder(t, server, 50*time.Millisecond, time.Nanosecond, 10*time.Millisecond)
+	defer stop()
+
+	start := time.Now()
+	gfh.runStream(context.Background(), 0, "metrics", metricMessage("a"), nil, gfh.openMetricsStream)
+
+	assert.True(t, time.Since(start) < 5*time.Second, "the stream should be abandoned at its deadline")
+	assert.EqualValues(t, 0, gfh.messagesSent)
+	assert.EqualValues(t, 1, gfh.messagesDropped)
+}
+
+func TestNewGrpcForwarderHandlerV2FromViper(t *testing.T) {
+	t.Parallel()
+
+	v := viper.New()
+	_, err := NewGrpcForwarderHandlerV2FromViper(logrus.StandardLogger(), v)
+	assert.Error(t, err, "an address is required")
+
+	v.Set("grpc-transport.address", "aggregator:8081")
+	v.Set(ParamMaxParsers, 2)
+	gfh, err := NewGrpcForwarderHandlerV2FromViper(logrus.StandardLogger(), v)
+	require.NoError(t, err)
+	defer gfh.conn.Close()
+	assert.Equal(t, defaultMaxSeriesPerSend, gfh.maxSeries)
+	assert.Equal(t, defaultMaxStreams, gfh.maxStreams)
+	assert.Equal(t, defaultMaxStreamAge, gfh.maxStreamAge)
+	assert.Len(t, gfh.callOptions, 1, "streams should be compressed by default")
+
+	v.Set("grpc-transport.max-stream-age", "20s")
+	_, err = NewGrpcForwarderHandlerV2FromViper(logrus.StandardLogger(), v)
+	assert.Error(t, err, "a stream can't stay open past its deadline")
+	v.Set("grpc-transport.max-stream-age", "1s")
+
+	v.Set("grpc-transport.tls", true)
+	v.Set("grpc-transport.tls-cert-path", "cert.pem")
+	_, err = NewGrpcForwarderHandlerV2FromViper(logrus.StandardLogger(), v)
+	assert.Error(t, err, "a key is required with a certificate")
+}
+
+func TestBearerToken(t *testing.T) {
+	t.Parallel()
+	md, err := bearerToken("secret").GetRequestMetadata(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"authorization": "Bearer secret"}, md)
+}
@@ -10,16 +10,20 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/internal/tlsconfig"
 	"github.com/atlassian/gostatsd/pb"
+	"github.com/atlassian/gostatsd/pkg/cluster/nodes"
 	"github.com/atlassian/gostatsd/pkg/stats"
 
 	"github.com/ash2k/stager/wait"
 	"github.com/cenkalti/backoff"
+	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -28,6 +32,7 @@ import (
 
 const (
 	defaultConsolidatorFlushInterval = 1 * time.Second
+	defaultMaxFlushIntervalFactor    = 10
 	defaultClientTimeout             = 10 * time.Second
 	defaultCompress                  = true
 	defaultEnableHttp2               = false
@@ -35,16 +40,31 @@ const (
 	defaultMaxRequestElapsedTime     = 30 * time.Second
 	defaultMaxRequests               = 1000
 	defaultNetwork                   = "tcp"
+	defaultQueueMaxSize              = 1024 * 1024 * 1024
+	defaultQueuePrefer               = "newest"
+	defaultFormat                    = "protobuf"
+)
+
+// Content-Type of the formats a forwarder can send messages in.
+const (
+	contentTypeProtobuf = "application/x-protobuf"
+	contentTypeJSON     = "application/json"
 )
 
 // HttpForwarderHandlerV2 is a PipelineHandler which sends metrics to another gostatsd instance
 type HttpForwarderHandlerV2 struct {
-	postId          uint64 // atomic - used for an id in logs
-	messagesInvalid uint64 // atomic - messages which failed to be created
-	messagesCreated uint64 // atomic - messages which were created
-	messagesSent    uint64 // atomic - messages successfully sent
-	messagesRetried uint64 // atomic - retries (first send is not a retry, final failure is not a retry)
-	messagesDropped uint64 // atomic - final failure
+	postId              uint64 // atomic - used for an id in logs
+	messagesInvalid     uint64 // atomic - messages which failed to be created
+	messagesCreated     uint64 // atomic - messages which were created
+	messagesSent        uint64 // atomic - messages successfully sent
+	messagesRetried     uint64 // atomic - retries (first send is not a retry, final failure is not a retry)
+	messagesDropped     uint64 // atomic - final failure
+	messagesThrottled   uint64 // atomic - responses asking the forwarder to slow down
+	throttledInInterval uint64 // atomic - throttled responses since the consolidator was last flushed
+	flushStretch        int64  // atomic - how many flush intervals the consolidator is currently flushed after
+	messagesQueued      uint64 // atomic - final failure, written to the queue
+	messagesDrained     uint64 // atomic - sent from the queue
+	clusterMembership   uint64 // atomic - aggregators joining or leaving the cluster
 
 	logger                logrus.FieldLogger
 	apiEndpoint           string
@@ -53,8 +73,16 @@ type HttpForwarderHandlerV2 struct {
 	client                http.Client
 	consolidator          *gostatsd.MetricConsolidator
 	consolidatedMetrics   <-chan []*gostatsd.MetricMap
+	flushInterval         time.Duration
+	maxFlushStretch       int // The most flush intervals the consolidator can be flushed after while throttled
 	eventWg               sync.WaitGroup
 	compress              bool
+	queue                 *diskSpool        // Messages which failed to send, nil if disabled
+	queueWake             chan struct{}     // Signals the queue may be drained
+	nodes                 nodes.NodeTracker // Aggregators metrics are sharded across, nil to send to apiEndpoint
+	shardByTags           bool
+	authToken             string // Bearer token sent to aggregators, "" for none
+	json                  bool   // Send messages using the protobuf JSON mapping rather than binary protobuf
 }
 
 // NewHttpForwarderHandlerV2FromViper returns a new http API client.
@@ -69,8 +97,28 @@ func NewHttpForwarderHandlerV2FromViper(logger logrus.FieldLogger, v *viper.Vipe
 	subViper.SetDefault("consolidator-slots", v.GetInt(ParamMaxParsers))
 	subViper.SetDefault("flush-interval", defaultConsolidatorFlushInterval)
 	subViper.SetDefault("network", defaultNetwork)
+	subViper.SetDefault("queue-dir", "")
+	subViper.SetDefault("queue-max-size", defaultQueueMaxSize)
+	subViper.SetDefault("queue-prefer", defaultQueuePrefer)
+	subViper.SetDefault("shard-by-tags", false)
+	subViper.SetDefault("auth-token", "")
+	subViper.SetDefault("format", defaultFormat)
+	subViper.SetDefault("tls", false)
+	subViper.SetDefault("tls-ca-path", "")
+	subViper.SetDefault("tls-cert-path", "")
+	subViper.SetDefault("tls-key-path", "")
+	subViper.SetDefault("max-flush-interval", defaultMaxFlushIntervalFactor*subViper.GetDuration("flush-interval"))
+
+	tracker, err := nodes.NewNodeTrackerFromViper(getSubViper(v, "cluster"), "")
+	if err != nil {
+		return nil, err
+	}
+	newHandler := NewHttpForwarderHandlerV2
+	if tracker != nil {
+		newHandler = newHttpForwarderHandlerV2 // api-endpoint isn't required
+	}
 
-	return NewHttpForwarderHandlerV2(
+	hfh, err := newHandler(
 		logger,
 		subViper.GetString("api-endpoint"),
 		subViper.GetString("network"),
@@ -82,6 +130,41 @@ func NewHttpForwarderHandlerV2FromViper(logger logrus.FieldLogger, v *viper.Vipe
 		subViper.GetDuration("max-request-elapsed-time"),
 		subViper.GetDuration("flush-interval"),
 	)
+	if err != nil {
+		return nil, err
+	}
+	if tracker != nil {
+		hfh.SetNodeTracker(tracker, subViper.GetBool("shard-by-tags"))
+	}
+	caPath, certPath, keyPath := subViper.GetString("tls-ca-path"), subViper.GetString("tls-cert-path"), subViper.GetString("tls-key-path")
+	if !subViper.GetBool("tls") && (caPath != "" || certPath != "" || keyPath != "") {
+		return nil, fmt.Errorf("tls-ca-path, tls-cert-path and tls-key-path require tls")
+	}
+	tlsConfig, err := tlsconfig.Client(caPath, certPath, keyPath, subViper.GetBool("tls"))
+	if err != nil {
+		return nil, err
+	}
+	hfh.SetCredentials(subViper.GetString("auth-token"), tlsConfig)
+	if err = hfh.SetMaxFlushInterval(subViper.GetDuration("max-flush-interval")); err != nil {
+		return nil, err
+	}
+	if err = hfh.SetFormat(subViper.GetString("format")); err != nil {
+		return nil, err
+	}
+	if queueDir := subViper.GetString("queue-dir"); queueDir != "" {
+		var keepOldest bool
+		switch prefer := subViper.GetString("queue-prefer"); prefer {
+		case "newest":
+		case "oldest":
+			keepOldest = true
+		default:
+			return nil, fmt.Errorf("queue-prefer must be newest or oldest, not %q", prefer)
+		}
+		if err = hfh.EnableQueue(queueDir, subViper.GetInt64("queue-max-size"), keepOldest); err != nil {
+			return nil, err
+		}
+	}
+	return hfh, nil
 }
 
 // NewHttpForwarderHandlerV2 returns a new handler which dispatches metrics over http to another gostatsd server.
@@ -89,6 +172,10 @@ func NewHttpForwarderHandlerV2(logger logrus.FieldLogger, apiEndpoint, network s
 	if apiEndpoint == "" {
 		return nil, fmt.Errorf("api-endpoint is required")
 	}
+	return newHttpForwarderHandlerV2(logger, apiEndpoint, network, consolidatorSlots, maxRequests, compress, enableHttp2, clientTimeout, maxRequestElapsedTime, flushInterval)
+}
+
+func newHttpForwarderHandlerV2(logger logrus.FieldLogger, apiEndpoint, network string, consolidatorSlots, maxRequests int, compress, enableHttp2 bool, clientTimeout, maxRequestElapsedTime time.Duration, flushInterval time.Duration) (*HttpForwarderHandlerV2, error) {
 	if consolidatorSlots <= 0 {
 		return nil, fmt.Errorf("consolidator-slots must be positive")
 	}
@@ -158,6 +245,9 @@ func NewHttpForwarderHandlerV2(logger logrus.FieldLogger, apiEndpoint, network s
 		compress:              compress,
 		consolidator:          gostatsd.NewMetricConsolidator(consolidatorSlots, flushInterval, ch),
 		consolidatedMetrics:   ch,
+		flushInterval:         flushInterval,
+		flushStretch:          1,
+		maxFlushStretch:       defaultMaxFlushIntervalFactor,
 		client: http.Client{
 			Transport: transport,
 			Timeout:   clientTimeout,
@@ -165,6 +255,39 @@ func NewHttpForwarderHandlerV2(logger logrus.FieldLogger, apiEndpoint, network s
 	}, nil
 }
 
+// SetCredentials makes the forwarder authenticate to aggregators with a bearer token, unless token is empty, and with
+// the CA and client certificate in tlsConfig, unless it is nil.
+func (hfh *HttpForwarderHandlerV2) SetCredentials(token string, tlsConfig *tls.Config) {
+	hfh.authToken = token
+	if tlsConfig != nil {
+		hfh.client.Transport.(*http.Transport).TLSClientConfig = tlsConfig
+	}
+}
+
+// SetFormat sets the format messages are sent in, either protobuf or json.  JSON uses the protobuf JSON mapping, and
+// is intended for debugging.
+func (hfh *HttpForwarderHandlerV2) SetFormat(format string) error {
+	switch format {
+	case "protobuf":
+		hfh.json = false
+	case "json":
+		hfh.json = true
+	default:
+		return fmt.Errorf("format must be protobuf or json, not %q", format)
+	}
+	return nil
+}
+
+// SetMaxFlushInterval sets how far the flush interval can be stretched while aggregators are asking the forwarder to
+// slow down.  It is rounded down to a multiple of the flush interval.
+func (hfh *HttpForwarderHandlerV2) SetMaxFlushInterval(maxFlushInterval time.Duration) error {
+	if maxFlushInterval < hfh.flushInterval {
+		return fmt.Errorf("max-flush-interval must be at least flush-interval")
+	}
+	hfh.maxFlushStretch = int(maxFlushInterval / hfh.flushInterval)
+	return nil
+}
+
 func (hfh *HttpForwarderHandlerV2) EstimatedTags() int {
 	return 0
 }
@@ -200,18 +323,46 @@ func (hfh *HttpForwarderHandlerV2) emitMetrics(statser stats.Statser) {
 	messagesSent := atomic.SwapUint64(&hfh.messagesSent, 0)
 	messagesRetried := atomic.SwapUint64(&hfh.messagesRetried, 0)
 	messagesDropped := atomic.SwapUint64(&hfh.messagesDropped, 0)
+	messagesThrottled := atomic.SwapUint64(&hfh.messagesThrottled, 0)
+	flushStretch := atomic.LoadInt64(&hfh.flushStretch)
 
 	statser.Count("http.forwarder.invalid", float64(messagesInvalid), nil)
 	statser.Count("http.forwarder.created", float64(messagesCreated), nil)
 	statser.Count("http.forwarder.sent", float64(messagesSent), nil)
 	statser.Count("http.forwarder.retried", float64(messagesRetried), nil)
 	statser.Count("http.forwarder.dropped", float64(messagesDropped), nil)
+	statser.Count("http.forwarder.throttled", float64(messagesThrottled), nil)
+	statser.Gauge("http.forwarder.flush_interval", (time.Duration(flushStretch) * hfh.flushInterval).Seconds(), nil)
+
+	if hfh.nodes != nil {
+		clusterMembership := atomic.SwapUint64(&hfh.clusterMembership, 0)
+		statser.Count("http.forwarder.cluster_membership_changes", float64(clusterMembership), nil)
+		statser.Gauge("http.forwarder.cluster_nodes", float64(len(hfh.nodes.List())), nil)
+	}
+
+	if hfh.queue != nil {
+		messagesQueued := atomic.SwapUint64(&hfh.messagesQueued, 0)
+		messagesDrained := atomic.SwapUint64(&hfh.messagesDrained, 0)
+		records, bytes, dropped := hfh.queue.depth()
+		statser.Count("http.forwarder.queued", float64(messagesQueued), nil)
+		statser.Count("http.forwarder.drained", float64(messagesDrained), nil)
+		statser.Gauge("http.forwarder.queue_records", float64(records), nil)
+		statser.Gauge("http.forwarder.queue_bytes", float64(bytes), nil)
+		statser.Gauge("http.forwarder.queue_dropped", float64(dropped), nil)
+	}
 }
 
 func (hfh *HttpForwarderHandlerV2) Run(ctx context.Context) {
 	var wg wait.Group
 	defer wg.Wait()
-	wg.StartWithContext(ctx, hfh.consolidator.Run)
+	wg.StartWithContext(ctx, hfh.runConsolidator)
+	if hfh.nodes != nil {
+		wg.StartWithContext(ctx, hfh.nodes.Run)
+		wg.StartWithContext(ctx, hfh.watchNodes)
+	}
+	if hfh.queue != nil {
+		wg.StartWithContext(ctx, hfh.drainQueue)
+	}
 
 	for {
 		select {
@@ -231,6 +382,47 @@ func (hfh *HttpForwarderHandlerV2) Run(ctx context.Context) {
 	}
 }
 
+// runConsolidator flushes the consolidator every flush interval, stretching the interval while aggregators are
+// asking the forwarder to slow down, so that fewer, larger, requests are sent.
+func (hfh *HttpForwarderHandlerV2) runConsolidator(ctx context.Context) {
+	t := clock.NewTicker(ctx, hfh.flushInterval)
+	defer t.Stop()
+
+	stretch, ticks := 1, 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if ticks++; ticks < stretch {
+				continue
+			}
+			ticks = 0
+			hfh.consolidator.Flush(ctx)
+			throttled := atomic.SwapUint64(&hfh.throttledInInterval, 0) > 0
+			if newStretch := nextFlushStretch(stretch, hfh.maxFlushStretch, throttled); newStretch != stretch {
+				hfh.logger.WithField("flush-interval", time.Duration(newStretch)*hfh.flushInterval).Info("changed flush interval")
+				stretch = newStretch
+				atomic.StoreInt64(&hfh.flushStretch, int64(stretch))
+			}
+		}
+	}
+}
+
+// nextFlushStretch doubles the stretch of the flush interval after an interval in which a request was throttled, and
+// halves it after one in which none were.  Pushback must be sustained for the interval to keep growing.
+func nextFlushStretch(stretch, maxStretch int, throttled bool) int {
+	if throttled {
+		stretch *= 2
+		if stretch > maxStretch {
+			stretch = maxStretch
+		}
+	} else if stretch > 1 {
+		stretch /= 2
+	}
+	return stretch
+}
+
 func mergeMaps(maps []*gostatsd.MetricMap) *gostatsd.MetricMap {
 	mm := gostatsd.NewMetricMap()
 	for _, m := range maps {
@@ -252,77 +444,22 @@ func (hfh *HttpForwarderHandlerV2) releaseSem() {
 	hfh.metricsSem <- struct{}{} // will never block
 }
 
-func translateToProtobufV2(metricMap *gostatsd.MetricMap) *pb.RawMessageV2 {
-	var pbMetricMap pb.RawMessageV2
-
-	pbMetricMap.Gauges = map[string]*pb.GaugeTagV2{}
-	for metricName, m := range metricMap.Gauges {
-		pbMetricMap.Gauges[metricName] = &pb.GaugeTagV2{TagMap: map[string]*pb.RawGaugeV2{}}
-		for tagsKey, metric := range m {
-			pbMetricMap.Gauges[metricName].TagMap[tagsKey] = &pb.RawGaugeV2{
-				Tags:     metric.Tags,
-				Hostname: metric.Hostname,
-				Value:    metric.Value,
-			}
-		}
-	}
-
-	pbMetricMap.Counters = map[string]*pb.CounterTagV2{}
-	for metricName, m := range metricMap.Counters {
-		pbMetricMap.Counters[metricName] = &pb.CounterTagV2{TagMap: map[string]*pb.RawCounterV2{}}
-		for tagsKey, metric := range m {
-			pbMetricMap.Counters[metricName].TagMap[tagsKey] = &pb.RawCounterV2{
-				Tags:     metric.Tags,
-				Hostname: metric.Hostname,
-				Value:    metric.Value,
-			}
-		}
-	}
-
-	pbMetricMap.Sets = map[string]*pb.SetTagV2{}
-	for metricName, m := range metricMap.Sets {
-		pbMetricMap.Sets[metricName] = &pb.SetTagV2{TagMap: map[string]*pb.RawSetV2{}}
-		for tagsKey, metric := range m {
-			var values []string
-			for key := range metric.Values {
-				values = append(values, key)
-			}
-			pbMetricMap.Sets[metricName].TagMap[tagsKey] = &pb.RawSetV2{
-				Tags:     metric.Tags,
-				Hostname: metric.Hostname,
-				Values:   values,
-			}
-		}
-	}
-
-	pbMetricMap.Timers = map[string]*pb.TimerTagV2{}
-	for metricName, m := range metricMap.Timers {
-		pbMetricMap.Timers[metricName] = &pb.TimerTagV2{TagMap: map[string]*pb.RawTimerV2{}}
-		for tagsKey, metric := range m {
-			pbMetricMap.Timers[metricName].TagMap[tagsKey] = &pb.RawTimerV2{
-				Tags:        metric.Tags,
-				Hostname:    metric.Hostname,
-				SampleCount: metric.SampledCount,
-				Values:      metric.Values,
-			}
-		}
-	}
-
-	return &pbMetricMap
-}
-
 func (hfh *HttpForwarderHandlerV2) postMetrics(ctx context.Context, metricMap *gostatsd.MetricMap, batchId uint64) {
-	message := translateToProtobufV2(metricMap)
-	hfh.post(ctx, message, batchId, "metrics", "/v2/raw")
+	if hfh.nodes != nil {
+		hfh.postShards(ctx, metricMap, batchId)
+		return
+	}
+	message := pb.FromMetricMap(metricMap)
+	hfh.post(ctx, message, batchId, "metrics", hfh.apiEndpoint+"/v2/raw")
 }
 
-func (hfh *HttpForwarderHandlerV2) post(ctx context.Context, message proto.Message, id uint64, endpointType, endpoint string) {
+func (hfh *HttpForwarderHandlerV2) post(ctx context.Context, message proto.Message, id uint64, endpointType, url string) {
 	logger := hfh.logger.WithFields(logrus.Fields{
 		"id":   id,
 		"type": endpointType,
 	})
 
-	post, err := hfh.constructPost(ctx, logger, hfh.apiEndpoint+endpoint, message)
+	body, encoding, contentType, err := hfh.encode(message)
 	if err != nil {
 		atomic.AddUint64(&hfh.messagesInvalid, 1)
 		logger.WithError(err).Error("failed to create request")
@@ -330,6 +467,10 @@ func (hfh *HttpForwarderHandlerV2) post(ctx context.Context, message proto.Messa
 	} else {
 		atomic.AddUint64(&hfh.messagesCreated, 1)
 	}
+	post := hfh.newPost(ctx, logger, url, body, encoding, contentType)
+
+	// Only metrics are queued, as events are sent with the context they were received with.
+	queue := endpointType == "metrics" && hfh.queue != nil
 
 	b := backoff.NewExponentialBackOff()
 	b.MaxElapsedTime = hfh.maxRequestElapsedTime
@@ -337,11 +478,22 @@ func (hfh *HttpForwarderHandlerV2) post(ctx context.Context, message proto.Messa
 	for {
 		if err = post(); err == nil {
 			atomic.AddUint64(&hfh.messagesSent, 1)
+			if queue {
+				hfh.wakeQueue()
+			}
 			return
 		}
 
 		next := b.NextBackOff()
 		if next == backoff.Stop {
+			if queue {
+				if queueErr := hfh.enqueue(logger, body, encoding, contentType); queueErr == nil {
+					logger.WithError(err).Info("failed to send, queued")
+					return
+				} else if queueErr == errSpoolFull {
+					return // Counted as dropped by the queue
+				}
+			}
 			atomic.AddUint64(&hfh.messagesDropped, 1)
 			logger.WithError(err).Info("failed to send, giving up")
 			return
@@ -349,10 +501,13 @@ func (hfh *HttpForwarderHandlerV2) post(ctx context.Context, message proto.Messa
 
 		atomic.AddUint64(&hfh.messagesRetried, 1)
 
-		timer := clock.NewTimer(ctx, next)
+		timer := clock.NewTimer(ctx, hfh.retryDelay(err, next))
 		select {
 		case <-ctx.Done():
 			timer.Stop()
+			if queue {
+				_ = hfh.enqueue(logger, body, encoding, contentType)
+			}
 			return
 		case <-timer.C:
 		}
@@ -360,6 +515,14 @@ func (hfh *HttpForwarderHandlerV2) post(ctx context.Context, message proto.Messa
 }
 
 func (hfh *HttpForwarderHandlerV2) serialize(message proto.Message) ([]byte, error) {
+	if hfh.json {
+		buf := &bytes.Buffer{}
+		if err := (&jsonpb.Marshaler{}).Marshal(buf, message); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
 	buf, err := proto.Marshal(message)
 	if err != nil {
 		return nil, err
@@ -401,29 +564,30 @@ func (hfh *HttpForwarderHandlerV2) serializeAndCompress(message proto.Message) (
 	return buf.Bytes(), nil
 }
 
-func (hfh *HttpForwarderHandlerV2) constructPost(ctx context.Context, logger logrus.FieldLogger, path string, message proto.Message) (func() error /*doPost*/, error) {
-	var body []byte
-	var err error
-	var encoding string
-
-	if hfh.compress {
-		body, err = hfh.serializeAndCompress(message)
-		encoding = "deflate"
-	} else {
-		body, err = hfh.serialize(message)
-		encoding = "identity"
+// encode returns the body of a request for the message, and its Content-Encoding and Content-Type.
+func (hfh *HttpForwarderHandlerV2) encode(message proto.Message) ([]byte, string, string, error) {
+	contentType := contentTypeProtobuf
+	if hfh.json {
+		contentType = contentTypeJSON
 	}
-
-	if err != nil {
-		return nil, err
+	if hfh.compress {
+		body, err := hfh.serializeAndCompress(message)
+		return body, "deflate", contentType, err
 	}
+	body, err := hfh.serialize(message)
+	return body, "identity", contentType, err
+}
 
+func (hfh *HttpForwarderHandlerV2) newPost(ctx context.Context, logger logrus.FieldLogger, path string, body []byte, encoding, contentType string) func() error /*doPost*/ {
 	return func() error {
 		headers := map[string]string{
-			"Content-Type":     "application/x-protobuf",
+			"Content-Type":     contentType,
 			"Content-Encoding": encoding,
 			"User-Agent":       "gostatsd (http forwarder)",
 		}
+		if hfh.authToken != "" {
+			headers["Authorization"] = "Bearer " + hfh.authToken
+		}
 		req, err := http.NewRequest("POST", path, bytes.NewReader(body))
 		if err != nil {
 			return fmt.Errorf("unable to create http.Request: %v", err)
@@ -446,10 +610,59 @@ func (hfh *HttpForwarderHandlerV2) constructPost(ctx context.Context, logger log
 				"status": resp.StatusCode,
 				"body":   string(bodyStart),
 			}).Info("failed request")
+			if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+				return &throttledError{
+					statusCode: resp.StatusCode,
+					retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), clock.Now(ctx)),
+				}
+			}
 			return fmt.Errorf("received bad status code %d", resp.StatusCode)
 		}
 		return nil
-	}, nil
+	}
+}
+
+// throttledError is returned when an aggregator asks the forwarder to slow down.
+type throttledError struct {
+	statusCode int
+	retryAfter time.Duration // 0 if the aggregator didn't say when to retry
+}
+
+func (te *throttledError) Error() string {
+	return fmt.Sprintf("throttled with status code %d, retry after %v", te.statusCode, te.retryAfter)
+}
+
+// retryDelay returns how long to wait before retrying a request which failed with err, given the next backoff.  If
+// the aggregator asked the forwarder to slow down, the throttling is recorded and its Retry-After is honoured.
+func (hfh *HttpForwarderHandlerV2) retryDelay(err error, next time.Duration) time.Duration {
+	te, ok := err.(*throttledError)
+	if !ok {
+		return next
+	}
+	atomic.AddUint64(&hfh.messagesThrottled, 1)
+	atomic.AddUint64(&hfh.throttledInInterval, 1)
+	if te.retryAfter > next {
+		return te.retryAfter
+	}
+	return next
+}
+
+// parseRetryAfter returns the delay requested by a Retry-After header, which is either a number of seconds or an
+// http date, or 0 if there is none.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
 }
 
 ///////// Event processing
@@ -466,6 +679,27 @@ func (hfh *HttpForwarderHandlerV2) DispatchEvent(ctx context.Context, e *gostats
 func (hfh *HttpForwarderHandlerV2) dispatchEvent(ctx context.Context, e *gostatsd.Event) {
 	postId := atomic.AddUint64(&hfh.postId, 1) - 1
 
+	message := translateEventToProtobufV2(e)
+
+	baseURL := hfh.apiEndpoint
+	if hfh.nodes != nil {
+		node, err := hfh.nodes.Select(shardKey(e.Title, ""))
+		if err != nil {
+			atomic.AddUint64(&hfh.messagesDropped, 1)
+			hfh.logger.WithError(err).WithField("id", postId).Info("failed to select aggregator for event, giving up")
+			hfh.eventWg.Done()
+			return
+		}
+		baseURL = nodeURL(node)
+	}
+
+	hfh.post(ctx, message, postId, "event", baseURL+"/v2/event")
+
+	defer hfh.eventWg.Done()
+}
+
+// translateEventToProtobufV2 converts an Event to an EventV2.
+func translateEventToProtobufV2(e *gostatsd.Event) *pb.EventV2 {
 	message := &pb.EventV2{
 		Title:          e.Title,
 		Text:           e.Text,
@@ -495,9 +729,7 @@ func (hfh *HttpForwarderHandlerV2) dispatchEvent(ctx context.Context, e *gostats
 		message.Type = pb.EventV2_Success
 	}
 
-	hfh.post(ctx, message, postId, "event", "/v2/event")
-
-	defer hfh.eventWg.Done()
+	return message
 }
 
 func (hfh *HttpForwarderHandlerV2) WaitForEvents() {
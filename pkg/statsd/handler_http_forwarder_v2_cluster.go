@@ -0,0 +1,189 @@
+package statsd
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"hash/fnv"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pb"
+	"github.com/atlassian/gostatsd/pkg/cluster/nodes"
+)
+
+// SetNodeTracker makes the forwarder shard metrics across the aggregators tracked by tracker, instead of sending them
+// all to the api-endpoint.  Metrics are sharded by name, so every series of a metric is aggregated by the same node,
+// or by name and tags if shardByTags is set.  Must be called before Run, which also runs the tracker.
+func (hfh *HttpForwarderHandlerV2) SetNodeTracker(tracker nodes.NodeTracker, shardByTags bool) {
+	hfh.nodes = tracker
+	hfh.shardByTags = shardByTags
+}
+
+// watchNodes logs and counts the membership changes of the cluster until the context is done.  A change is counted
+// once however many keys it moves, which with rendezvous hashing are only those of the nodes which joined or left.
+func (hfh *HttpForwarderHandlerV2) watchNodes(ctx context.Context) {
+	changes := hfh.nodes.Watch()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case change := <-changes:
+			atomic.AddUint64(&hfh.clusterMembership, 1)
+			hfh.logger.WithFields(logrus.Fields{
+				"added":   change.Added,
+				"removed": change.Removed,
+				"nodes":   len(change.Nodes),
+			}).Info("aggregator cluster changed")
+		}
+	}
+}
+
+// shardKey returns the key a series is sharded by.
+func shardKey(metricName, tagsKey string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(metricName))
+	if tagsKey != "" {
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(tagsKey))
+	}
+	return h.Sum64()
+}
+
+// nodeURL returns the base URL of a node, which is tracked as either a URL or a host:port.
+func nodeURL(node string) string {
+	if strings.Contains(node, "://") {
+		return strings.TrimSuffix(node, "/")
+	}
+	return "http://" + node
+}
+
+// shard splits mm in to a MetricMap for each node which owns some of its series.
+func (hfh *HttpForwarderHandlerV2) shard(mm *gostatsd.MetricMap) (map[string]*gostatsd.MetricMap, error) {
+	shards := map[string]*gostatsd.MetricMap{}
+	var err error
+	mm.SplitByFunc(func(metricName, tagsKey *string, hostname string, tags *gostatsd.Tags) *gostatsd.MetricMap {
+		key := *tagsKey
+		if !hfh.shardByTags {
+			key = ""
+		}
+		node, selectErr := hfh.nodes.Select(shardKey(*metricName, key))
+		if selectErr != nil {
+			err = selectErr
+			return nil
+		}
+		shard, ok := shards[node]
+		if !ok {
+			shard = gostatsd.NewMetricMap()
+			shards[node] = shard
+		}
+		return shard
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return shards, nil
+}
+
+// postShards sends each shard of the metrics to the node which owns it.  If no node is available, the metrics are
+// queued if there is a queue, otherwise they are dropped.
+func (hfh *HttpForwarderHandlerV2) postShards(ctx context.Context, metricMap *gostatsd.MetricMap, batchId uint64) {
+	shards, err := hfh.shard(metricMap)
+	if err != nil {
+		logger := hfh.logger.WithFields(logrus.Fields{
+			"id":   batchId,
+			"type": "metrics",
+		})
+		if hfh.queue != nil {
+			if body, encoding, contentType, encodeErr := hfh.encode(pb.FromMetricMap(metricMap)); encodeErr == nil {
+				if queueErr := hfh.enqueue(logger, body, encoding, contentType); queueErr == nil {
+					logger.WithError(err).Info("failed to select aggregator, queued")
+					return
+				} else if queueErr == errSpoolFull {
+					return // Counted as dropped by the queue
+				}
+			}
+		}
+		atomic.AddUint64(&hfh.messagesDropped, 1)
+		logger.WithError(err).Info("failed to select aggregator, giving up")
+		return
+	}
+
+	var wg sync.WaitGroup
+	for node, shard := range shards {
+		wg.Add(1)
+		go func(node string, shard *gostatsd.MetricMap) {
+			defer wg.Done()
+			hfh.post(ctx, pb.FromMetricMap(shard), batchId, "metrics", nodeURL(node)+"/v2/raw")
+		}(node, shard)
+	}
+	wg.Wait()
+}
+
+// drainShards sends a queued message to the nodes which currently own its metrics, as ownership may have changed
+// since it was queued.  Returns true if the message may be removed from the queue, which is the case unless every
+// shard failed to send.  Shards which failed to send are queued again.
+func (hfh *HttpForwarderHandlerV2) drainShards(ctx context.Context, logger logrus.FieldLogger, body []byte, encoding, contentType string) (bool, error) {
+	msg, err := decodeBody(body, encoding, contentType)
+	if err != nil {
+		return true, err
+	}
+	shards, err := hfh.shard(pb.ToMetricMap(msg, gostatsd.Nanotime(time.Now().UnixNano())))
+	if err != nil {
+		return false, err
+	}
+
+	var failed []*gostatsd.MetricMap
+	for node, shard := range shards {
+		shardBody, shardEncoding, shardContentType, encodeErr := hfh.encode(pb.FromMetricMap(shard))
+		if encodeErr != nil {
+			return true, encodeErr
+		}
+		if postErr := hfh.newPost(ctx, logger, nodeURL(node)+"/v2/raw", shardBody, shardEncoding, shardContentType)(); postErr != nil {
+			err = postErr
+			failed = append(failed, shard)
+		}
+	}
+	if len(failed) == len(shards) && err != nil {
+		return false, err
+	}
+	for _, shard := range failed {
+		if shardBody, shardEncoding, shardContentType, encodeErr := hfh.encode(pb.FromMetricMap(shard)); encodeErr == nil {
+			_ = hfh.enqueue(logger, shardBody, shardEncoding, shardContentType)
+		}
+	}
+	return true, err
+}
+
+// decodeBody decodes the body of a request sent to /v2/raw.
+func decodeBody(body []byte, encoding, contentType string) (*pb.RawMessageV2, error) {
+	if encoding == "deflate" {
+		decompressor, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body, err = ioutil.ReadAll(decompressor); err != nil {
+			return nil, err
+		}
+	}
+	var msg pb.RawMessageV2
+	if contentType == contentTypeJSON {
+		if err := jsonpb.Unmarshal(bytes.NewReader(body), &msg); err != nil {
+			return nil, err
+		}
+		return &msg, nil
+	}
+	if err := proto.Unmarshal(body, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
@@ -0,0 +1,178 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/cluster/nodes"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fixedNodeTracker selects from a fixed list of nodes.
+type fixedNodeTracker struct {
+	mu    sync.Mutex
+	nodes []string
+}
+
+func (fnt *fixedNodeTracker) Run(ctx context.Context) {
+	<-ctx.Done()
+}
+
+func (fnt *fixedNodeTracker) List() []string {
+	fnt.mu.Lock()
+	defer fnt.mu.Unlock()
+	return append([]string(nil), fnt.nodes...)
+}
+
+func (fnt *fixedNodeTracker) Select(key uint64) (string, error) {
+	fnt.mu.Lock()
+	defer fnt.mu.Unlock()
+	if len(fnt.nodes) == 0 {
+		return "", errors.New("no nodes available")
+	}
+	return fnt.nodes[key%uint64(len(fnt.nodes))], nil
+}
+
+func (fnt *fixedNodeTracker) Watch() <-chan nodes.MembershipChange {
+	return nil
+}
+
+func newShardingForwarder(t *testing.T, tracker *fixedNodeTracker, shardByTags bool) *HttpForwarderHandlerV2 {
+	hfh, err := newHttpForwarderHandlerV2(logrus.StandardLogger(), "", "tcp", 1, 1, false, false, time.Second, time.Nanosecond, time.Second)
+	require.NoError(t, err)
+	hfh.SetNodeTracker(tracker, shardByTags)
+	return hfh
+}
+
+func metricMapForSharding() *gostatsd.MetricMap {
+	mm := gostatsd.NewMetricMap()
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		for _, tag := range []string{"x:1", "x:2", "x:3"} {
+			mm.Receive(&gostatsd.Metric{Name: name, Value: 1, Rate: 1, Tags: gostatsd.Tags{tag}, TagsKey: tag, Type: gostatsd.COUNTER})
+			mm.Receive(&gostatsd.Metric{Name: name, Value: 1, Rate: 1, Tags: gostatsd.Tags{tag}, TagsKey: tag, Type: gostatsd.TIMER})
+		}
+	}
+	return mm
+}
+
+func TestHttpForwarderV2ShardByName(t *testing.T) {
+	t.Parallel()
+	hfh := newShardingForwarder(t, &fixedNodeTracker{nodes: []string{"n1", "n2", "n3"}}, false)
+	mm := metricMapForSharding()
+
+	shards, err := hfh.shard(mm)
+	require.NoError(t, err)
+	assert.True(t, len(shards) > 1, "metrics should be spread across nodes")
+
+	merged := gostatsd.NewMetricMap()
+	for _, shard := range shards {
+		for name, series := range shard.Counters {
+			assert.Len(t, series, 3, "every series of %s must be on the same node", name)
+		}
+		for name, series := range shard.Timers {
+			assert.Len(t, series, 3, "every series of %s must be on the same node", name)
+			assert.Contains(t, shard.Counters, name, "timers and counters named %s must be on the same node", name)
+		}
+		merged.Merge(shard)
+	}
+	assert.Equal(t, mm, merged)
+}
+
+func TestHttpForwarderV2ShardByTags(t *testing.T) {
+	t.Parallel()
+	hfh := newShardingForwarder(t, &fixedNodeTracker{nodes: []string{"n1", "n2", "n3"}}, true)
+	mm := metricMapForSharding()
+
+	shards, err := hfh.shard(mm)
+	require.NoError(t, err)
+	split := false
+	merged := gostatsd.NewMetricMap()
+	for _, shard := range shards {
+		for _, series := range shard.Counters {
+			split = split || len(series) < 3
+		}
+		merged.Merge(shard)
+	}
+	assert.True(t, split, "series of a metric should be spread across nodes")
+	assert.Equal(t, mm, merged)
+}
+
+func TestHttpForwarderV2PostShards(t *testing.T) {
+	t.Parallel()
+	aggregators := []*flakyAggregator{{}, {}}
+	tracker := &fixedNodeTracker{}
+	for _, aggregator := range aggregators {
+		server := httptest.NewServer(aggregator)
+		defer server.Close()
+		tracker.nodes = append(tracker.nodes, server.URL)
+	}
+	hfh := newShardingForwarder(t, tracker, false)
+
+	hfh.postMetrics(context.Background(), metricMapForSharding(), 0)
+	total := 0
+	for _, aggregator := range aggregators {
+		require.Len(t, aggregator.messages, 1)
+		total += len(aggregator.messages[0].Counters)
+	}
+	assert.Equal(t, 8, total)
+	assert.EqualValues(t, 2, hfh.messagesSent)
+}
+
+func TestHttpForwarderV2QueueReshards(t *testing.T) {
+	t.Parallel()
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	tracker := &fixedNodeTracker{}
+	hfh := newShardingForwarder(t, tracker, false)
+	require.NoError(t, hfh.EnableQueue(dir, 1024*1024, false))
+
+	// No nodes, so the metrics are queued
+	hfh.postMetrics(ctx, metricMapForSharding(), 0)
+	assert.EqualValues(t, 1, hfh.messagesQueued)
+	sent, err := hfh.drainOne(ctx, logrus.StandardLogger())
+	assert.Error(t, err)
+	assert.False(t, sent)
+
+	// The queued metrics are sharded across the nodes available once they are drained
+	aggregators := []*flakyAggregator{{}, {fail: true}}
+	var nodes []string
+	for _, aggregator := range aggregators {
+		server := httptest.NewServer(aggregator)
+		defer server.Close()
+		nodes = append(nodes, server.URL)
+	}
+	tracker.mu.Lock()
+	tracker.nodes = nodes
+	tracker.mu.Unlock()
+
+	sent, err = hfh.drainOne(ctx, logrus.StandardLogger())
+	assert.Error(t, err)
+	assert.True(t, sent)
+	require.Len(t, aggregators[0].messages, 1)
+	records, _, _ := hfh.queue.depth()
+	assert.Equal(t, 1, records, "the shard which failed should be queued again")
+
+	aggregators[1].setFail(false)
+	sent, err = hfh.drainOne(ctx, logrus.StandardLogger())
+	require.NoError(t, err)
+	assert.True(t, sent)
+	require.Len(t, aggregators[1].messages, 1)
+	assert.Equal(t, 8, len(aggregators[0].messages[0].Counters)+len(aggregators[1].messages[0].Counters))
+}
+
+func TestNodeURL(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "http://10.0.0.1:8080", nodeURL("10.0.0.1:8080"))
+	assert.Equal(t, "https://aggregator-1", nodeURL("https://aggregator-1/"))
+}
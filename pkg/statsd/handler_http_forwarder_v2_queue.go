@@ -0,0 +1,148 @@
+package statsd
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/sirupsen/logrus"
+	"github.com/tilinna/clock"
+)
+
+// Content-Encoding of a queued message, stored in the first byte of the record, combined with queueFormatJSON if its
+// Content-Type is JSON rather than protobuf.
+const (
+	queueEncodingIdentity = byte(0)
+	queueEncodingDeflate  = byte(1)
+	queueFormatJSON       = byte(2)
+)
+
+// EnableQueue makes the forwarder write metrics it fails to send to a queue on disk in dir, and send them once the
+// aggregator can be reached again.  Once the queue is larger than maxSize bytes the oldest messages are dropped, or
+// if keepOldest is set, new messages are dropped instead.  Queued messages are sent in order, but new messages are
+// sent as they are flushed, so they may reach the aggregator before older queued messages.  Must be called before Run.
+func (hfh *HttpForwarderHandlerV2) EnableQueue(dir string, maxSize int64, keepOldest bool) error {
+	queue, err := openSpool(dir, maxSize, keepOldest)
+	if err != nil {
+		return err
+	}
+	hfh.queue = queue
+	hfh.queueWake = make(chan struct{}, 1)
+	hfh.logger.WithFields(logrus.Fields{
+		"queue-dir":      dir,
+		"queue-max-size": maxSize,
+		"keep-oldest":    keepOldest,
+	}).Info("enabled queue")
+	return nil
+}
+
+// enqueue writes the body of a metrics request to the queue.  Returns errSpoolFull if the queue is full and keeps its
+// oldest messages, in which case the message is counted as dropped by the queue.
+func (hfh *HttpForwarderHandlerV2) enqueue(logger logrus.FieldLogger, body []byte, encoding, contentType string) error {
+	record := make([]byte, 1+len(body))
+	if encoding == "deflate" {
+		record[0] = queueEncodingDeflate
+	}
+	if contentType == contentTypeJSON {
+		record[0] |= queueFormatJSON
+	}
+	copy(record[1:], body)
+	if err := hfh.queue.append(record); err != nil {
+		if err == errSpoolFull {
+			logger.Info("queue is full, dropping")
+		} else {
+			logger.WithError(err).Error("failed to queue")
+		}
+		return err
+	}
+	atomic.AddUint64(&hfh.messagesQueued, 1)
+	hfh.wakeQueue()
+	return nil
+}
+
+func (hfh *HttpForwarderHandlerV2) wakeQueue() {
+	select {
+	case hfh.queueWake <- struct{}{}:
+	default:
+	}
+}
+
+// drainQueue sends queued messages in the order they were queued, backing off while they fail to send.
+func (hfh *HttpForwarderHandlerV2) drainQueue(ctx context.Context) {
+	logger := hfh.logger.WithField("type", "queue")
+
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = 0
+	var retry <-chan time.Time
+	var timer *clock.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		if retry == nil {
+			sent, err := hfh.drainOne(ctx, logger)
+			if err != nil && ctx.Err() == nil {
+				logger.WithError(err).Info("failed to send queued message")
+			}
+			if sent {
+				b.Reset()
+				continue
+			}
+			if err != nil {
+				timer = clock.NewTimer(ctx, hfh.retryDelay(err, b.NextBackOff()))
+				retry = timer.C
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-hfh.queueWake:
+		case <-retry:
+			retry = nil
+		}
+	}
+}
+
+// drainOne sends the oldest queued message.  Returns true if a message was removed from the queue.
+func (hfh *HttpForwarderHandlerV2) drainOne(ctx context.Context, logger logrus.FieldLogger) (bool, error) {
+	hfh.queue.replayLock.Lock()
+	defer hfh.queue.replayLock.Unlock()
+
+	record, ok, err := hfh.queue.peek()
+	if err != nil {
+		return true, err // The rest of the segment was dropped, so move on to the next one
+	} else if !ok {
+		return false, nil
+	}
+	if len(record) == 0 {
+		hfh.queue.commit()
+		return true, errSpoolCorrupt
+	}
+	encoding, contentType := "identity", contentTypeProtobuf
+	if record[0]&queueEncodingDeflate != 0 {
+		encoding = "deflate"
+	}
+	if record[0]&queueFormatJSON != 0 {
+		contentType = contentTypeJSON
+	}
+	if hfh.nodes != nil {
+		sent, err := hfh.drainShards(ctx, logger, record[1:], encoding, contentType)
+		if sent {
+			if err == nil {
+				atomic.AddUint64(&hfh.messagesDrained, 1)
+			}
+			hfh.queue.commit()
+		}
+		return sent, err
+	}
+	if err = hfh.newPost(ctx, logger, hfh.apiEndpoint+"/v2/raw", record[1:], encoding, contentType)(); err != nil {
+		return false, err
+	}
+	atomic.AddUint64(&hfh.messagesDrained, 1)
+	hfh.queue.commit()
+	return true, nil
+}
@@ -0,0 +1,179 @@
+package statsd
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pb"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyAggregator fails requests while fail is set, and records the messages it receives.
+type flakyAggregator struct {
+	mu           sync.Mutex
+	fail         bool
+	messages     []*pb.RawMessageV2
+	contentTypes []string
+}
+
+func (fa *flakyAggregator) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	if fa.fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	msg, err := decodeBody(body, req.Header.Get("Content-Encoding"), req.Header.Get("Content-Type"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	fa.messages = append(fa.messages, msg)
+	fa.contentTypes = append(fa.contentTypes, req.Header.Get("Content-Type"))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (fa *flakyAggregator) setFail(fail bool) {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	fa.fail = fail
+}
+
+func TestHttpForwarderV2Queue(t *testing.T) {
+	t.Parallel()
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aggregator := &flakyAggregator{fail: true}
+	server := httptest.NewServer(aggregator)
+	defer server.Close()
+
+	hfh, err := NewHttpForwarderHandlerV2(logrus.StandardLogger(), server.URL, "tcp", 1, 1, false, false, time.Second, time.Nanosecond, time.Second)
+	require.NoError(t, err)
+	require.NoError(t, hfh.EnableQueue(dir, 1024*1024, false))
+
+	for _, name := range []string{"first", "second"} {
+		mm := gostatsd.NewMetricMap()
+		mm.Receive(&gostatsd.Metric{Name: name, Value: 1, Rate: 1, Type: gostatsd.COUNTER})
+		hfh.postMetrics(ctx, mm, 0)
+	}
+	assert.EqualValues(t, 2, hfh.messagesQueued)
+	assert.Zero(t, hfh.messagesDropped)
+	records, _, _ := hfh.queue.depth()
+	assert.Equal(t, 2, records)
+
+	sent, err := hfh.drainOne(ctx, logrus.StandardLogger())
+	assert.Error(t, err)
+	assert.False(t, sent)
+
+	aggregator.setFail(false)
+	for i := 0; i < 2; i++ {
+		sent, err = hfh.drainOne(ctx, logrus.StandardLogger())
+		require.NoError(t, err)
+		assert.True(t, sent)
+	}
+	sent, err = hfh.drainOne(ctx, logrus.StandardLogger())
+	require.NoError(t, err)
+	assert.False(t, sent)
+
+	require.Len(t, aggregator.messages, 2)
+	assert.Contains(t, aggregator.messages[0].Counters, "first")
+	assert.Contains(t, aggregator.messages[1].Counters, "second")
+	assert.EqualValues(t, 2, hfh.messagesDrained)
+}
+
+func TestHttpForwarderV2QueueFullCountedOnce(t *testing.T) {
+	t.Parallel()
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aggregator := &flakyAggregator{fail: true}
+	server := httptest.NewServer(aggregator)
+	defer server.Close()
+
+	hfh, err := NewHttpForwarderHandlerV2(logrus.StandardLogger(), server.URL, "tcp", 1, 1, false, false, time.Second, time.Nanosecond, time.Second)
+	require.NoError(t, err)
+	require.NoError(t, hfh.EnableQueue(dir, 1, true)) // Too small for any message, so every message is dropped
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "first", Value: 1, Rate: 1, Type: gostatsd.COUNTER})
+	hfh.postMetrics(ctx, mm, 0)
+
+	_, _, dropped := hfh.queue.depth()
+	assert.EqualValues(t, 1, dropped)
+	assert.Zero(t, hfh.messagesDropped)
+	assert.Zero(t, hfh.messagesQueued)
+}
+
+func TestHttpForwarderV2QueueJSON(t *testing.T) {
+	t.Parallel()
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aggregator := &flakyAggregator{fail: true}
+	server := httptest.NewServer(aggregator)
+	defer server.Close()
+
+	hfh, err := NewHttpForwarderHandlerV2(logrus.StandardLogger(), server.URL, "tcp", 1, 1, true, false, time.Second, time.Nanosecond, time.Second)
+	require.NoError(t, err)
+	require.NoError(t, hfh.EnableQueue(dir, 1024*1024, false))
+	require.NoError(t, hfh.SetFormat("json"))
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "first", Value: 1, Rate: 1, Type: gostatsd.COUNTER})
+	hfh.postMetrics(ctx, mm, 0)
+	assert.EqualValues(t, 1, hfh.messagesQueued)
+
+	// A queued message is sent in the format it was queued in.
+	require.NoError(t, hfh.SetFormat("protobuf"))
+	aggregator.setFail(false)
+	sent, err := hfh.drainOne(ctx, logrus.StandardLogger())
+	require.NoError(t, err)
+	assert.True(t, sent)
+
+	require.Len(t, aggregator.messages, 1)
+	assert.Contains(t, aggregator.messages[0].Counters, "first")
+	assert.Equal(t, []string{"application/json"}, aggregator.contentTypes)
+}
+
+func TestHttpForwarderV2QueueFromViper(t *testing.T) {
+	t.Parallel()
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	v := viper.New()
+	v.Set("http-transport.api-endpoint", "http://aggregator")
+	v.Set("http-transport.consolidator-slots", 1)
+	hfh, err := NewHttpForwarderHandlerV2FromViper(logrus.StandardLogger(), v)
+	require.NoError(t, err)
+	assert.Nil(t, hfh.queue)
+
+	v.Set("http-transport.queue-dir", dir)
+	v.Set("http-transport.queue-prefer", "oldest")
+	hfh, err = NewHttpForwarderHandlerV2FromViper(logrus.StandardLogger(), v)
+	require.NoError(t, err)
+	require.NotNil(t, hfh.queue)
+	assert.True(t, hfh.queue.keepOldest)
+
+	v.Set("http-transport.queue-prefer", "random")
+	_, err = NewHttpForwarderHandlerV2FromViper(logrus.StandardLogger(), v)
+	assert.Error(t, err)
+}
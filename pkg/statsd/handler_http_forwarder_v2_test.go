@@ -1,10 +1,18 @@
 package statsd
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pb"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -83,7 +91,7 @@ func TestHttpForwarderV2Translation(t *testing.T) {
 		mm.Receive(metric)
 	}
 
-	pbMetrics := translateToProtobufV2(mm)
+	pbMetrics := pb.FromMetricMap(mm)
 
 	expected := &pb.RawMessageV2{
 		Gauges: map[string]*pb.GaugeTagV2{
@@ -110,18 +118,20 @@ func TestHttpForwarderV2Translation(t *testing.T) {
 			"TestHttpForwarderTranslation.counter": {
 				TagMap: map[string]*pb.RawCounterV2{
 					"TestHttpForwarderTranslation.counter.tag1,TestHttpForwarderTranslation.counter.tag2,s:TestHttpForwarderTranslation.counter.host": {
-						Tags:     []string{"TestHttpForwarderTranslation.counter.tag1", "TestHttpForwarderTranslation.counter.tag2"},
-						Hostname: "TestHttpForwarderTranslation.counter.host",
-						Value:    12347,
+						Tags:       []string{"TestHttpForwarderTranslation.counter.tag1", "TestHttpForwarderTranslation.counter.tag2"},
+						Hostname:   "TestHttpForwarderTranslation.counter.host",
+						Value:      12347,
+						FloatValue: 12347,
 					},
 				},
 			},
 			"TestHttpForwarderTranslation.counterrate": {
 				TagMap: map[string]*pb.RawCounterV2{
 					"TestHttpForwarderTranslation.counterrate.tag1,TestHttpForwarderTranslation.counterrate.tag2,s:TestHttpForwarderTranslation.counterrate.host": {
-						Tags:     []string{"TestHttpForwarderTranslation.counterrate.tag1", "TestHttpForwarderTranslation.counterrate.tag2"},
-						Hostname: "TestHttpForwarderTranslation.counterrate.host",
-						Value:    123480, // rate is multipled out
+						Tags:       []string{"TestHttpForwarderTranslation.counterrate.tag1", "TestHttpForwarderTranslation.counterrate.tag2"},
+						Hostname:   "TestHttpForwarderTranslation.counterrate.host",
+						Value:      123480, // rate is multipled out
+						FloatValue: 123480,
 					},
 				},
 			},
@@ -176,6 +186,132 @@ func TestHttpForwarderV2Translation(t *testing.T) {
 	require.EqualValues(t, expected.Sets, pbMetrics.Sets)
 }
 
+func TestHttpForwarderV2SendsAuthToken(t *testing.T) {
+	t.Parallel()
+	var authorization []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authorization = append(authorization, req.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	hfh, err := NewHttpForwarderHandlerV2(logrus.StandardLogger(), server.URL, "tcp", 1, 1, false, false, time.Second, time.Second, time.Second)
+	require.NoError(t, err)
+	hfh.postMetrics(context.Background(), gostatsd.NewMetricMap(), 0)
+	hfh.SetCredentials("secret", nil)
+	hfh.postMetrics(context.Background(), gostatsd.NewMetricMap(), 1)
+
+	assert.Equal(t, []string{"", "Bearer secret"}, authorization)
+}
+
+func TestHttpForwarderV2SendsJSON(t *testing.T) {
+	t.Parallel()
+	aggregator := &flakyAggregator{}
+	server := httptest.NewServer(aggregator)
+	defer server.Close()
+
+	hfh, err := NewHttpForwarderHandlerV2(logrus.StandardLogger(), server.URL, "tcp", 1, 1, true, false, time.Second, time.Second, time.Second)
+	require.NoError(t, err)
+	assert.Error(t, hfh.SetFormat("xml"))
+	require.NoError(t, hfh.SetFormat("json"))
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "counter", Value: 1.5, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"a:b"}})
+	hfh.postMetrics(context.Background(), mm, 0)
+
+	require.Len(t, aggregator.messages, 1)
+	assert.Equal(t, []string{"application/json"}, aggregator.contentTypes)
+	assert.Equal(t, pb.FromMetricMap(mm).Counters, aggregator.messages[0].Counters)
+}
+
+func TestHttpForwarderV2HonoursRetryAfter(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var requests []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, time.Now())
+		if len(requests) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	hfh, err := NewHttpForwarderHandlerV2(logrus.StandardLogger(), server.URL, "tcp", 1, 1, false, false, time.Second, 10*time.Second, time.Second)
+	require.NoError(t, err)
+	hfh.postMetrics(context.Background(), gostatsd.NewMetricMap(), 0)
+
+	require.Len(t, requests, 2)
+	assert.True(t, requests[1].Sub(requests[0]) >= time.Second, "the retry should wait for Retry-After")
+	assert.EqualValues(t, 1, hfh.messagesSent)
+	assert.EqualValues(t, 1, hfh.messagesThrottled)
+	assert.EqualValues(t, 1, hfh.throttledInInterval)
+}
+
+func TestNextFlushStretch(t *testing.T) {
+	t.Parallel()
+	stretch := 1
+	var stretches []int
+	for _, throttled := range []bool{true, true, true, true, true, false, true, false, false, false, false} {
+		stretch = nextFlushStretch(stretch, 10, throttled)
+		stretches = append(stretches, stretch)
+	}
+	assert.Equal(t, []int{2, 4, 8, 10, 10, 5, 10, 5, 2, 1, 1}, stretches)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, 3*time.Second, parseRetryAfter("3", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("-3", now))
+	assert.Equal(t, time.Minute, parseRetryAfter(now.Add(time.Minute).Format(http.TimeFormat), now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(now.Add(-time.Minute).Format(http.TimeFormat), now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+}
+
+func TestHttpForwarderV2MaxFlushInterval(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("http-transport.api-endpoint", "http://aggregator")
+	v.Set("http-transport.flush-interval", "2s")
+	v.Set(ParamMaxParsers, 1)
+	hfh, err := NewHttpForwarderHandlerV2FromViper(logrus.StandardLogger(), v)
+	require.NoError(t, err)
+	assert.Equal(t, defaultMaxFlushIntervalFactor, hfh.maxFlushStretch)
+
+	v.Set("http-transport.max-flush-interval", "5s")
+	hfh, err = NewHttpForwarderHandlerV2FromViper(logrus.StandardLogger(), v)
+	require.NoError(t, err)
+	assert.Equal(t, 2, hfh.maxFlushStretch)
+
+	v.Set("http-transport.max-flush-interval", "1s")
+	_, err = NewHttpForwarderHandlerV2FromViper(logrus.StandardLogger(), v)
+	assert.Error(t, err)
+}
+
+func TestHttpForwarderV2TLS(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("http-transport.api-endpoint", "https://aggregator")
+	v.Set(ParamMaxParsers, 1)
+	hfh, err := NewHttpForwarderHandlerV2FromViper(logrus.StandardLogger(), v)
+	require.NoError(t, err)
+	assert.NotNil(t, hfh.client.Transport.(*http.Transport).TLSClientConfig, "https should still use the default configuration")
+
+	v.Set("http-transport.tls-ca-path", "ca.pem")
+	_, err = NewHttpForwarderHandlerV2FromViper(logrus.StandardLogger(), v)
+	assert.Error(t, err, "a CA should require tls")
+
+	v.Set("http-transport.tls", true)
+	_, err = NewHttpForwarderHandlerV2FromViper(logrus.StandardLogger(), v)
+	assert.Error(t, err, "the CA doesn't exist")
+}
+
 func BenchmarkHttpForwarderV2TranslateAll(b *testing.B) {
 	metrics := []*gostatsd.Metric{}
 
@@ -199,6 +335,6 @@ func BenchmarkHttpForwarderV2TranslateAll(b *testing.B) {
 	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		translateToProtobufV2(mm)
+		pb.FromMetricMap(mm)
 	}
 }
@@ -0,0 +1,226 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// MappingHandler rewrites metric names and extracts tags from them, based on the first Mapping matching the name of
+// each metric.  The result for each name is cached.
+type MappingHandler struct {
+	handler   gostatsd.PipelineHandler
+	mappings  []*Mapping
+	cacheSize int
+
+	cacheLock sync.RWMutex
+	cache     map[string]*mappingResult // nil result if nothing matched
+}
+
+// NewMappingHandlerFromViper creates a MappingHandler from the mappings named in the mappings setting, or returns
+// handler if there are none.
+func NewMappingHandlerFromViper(v *viper.Viper, handler gostatsd.PipelineHandler) (gostatsd.PipelineHandler, error) {
+	mappingNameList := v.GetStringSlice("mappings")
+	if len(mappingNameList) == 0 {
+		return handler, nil
+	}
+	var mappings []*Mapping
+	for _, mappingName := range mappingNameList {
+		vMapping := v.Sub("mapping." + mappingName)
+		if vMapping == nil {
+			return nil, fmt.Errorf("mapping doesn't exist: %v", mappingName)
+		}
+		mapping, err := NewMappingFromViper(vMapping)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load mapping %v: %v", mappingName, err)
+		}
+		mappings = append(mappings, mapping)
+		logrus.Infof("Loaded mapping %v", mappingName)
+	}
+	v.SetDefault("mapping-cache-size", DefaultMappingCacheSize)
+	cacheSize := v.GetInt("mapping-cache-size")
+	if cacheSize < 0 {
+		return nil, fmt.Errorf("mapping-cache-size must not be negative")
+	}
+	return NewMappingHandler(handler, mappings, cacheSize), nil
+}
+
+// NewMappingHandler initialises a new handler which applies mappings to metrics before passing them to the next
+// handler.  Up to cacheSize results are cached, after which the cache is cleared.
+func NewMappingHandler(handler gostatsd.PipelineHandler, mappings []*Mapping, cacheSize int) *MappingHandler {
+	return &MappingHandler{
+		handler:   handler,
+		mappings:  mappings,
+		cacheSize: cacheSize,
+		cache:     make(map[string]*mappingResult),
+	}
+}
+
+// EstimatedTags returns a guess for how many tags to pre-allocate
+func (mh *MappingHandler) EstimatedTags() int {
+	return mh.handler.EstimatedTags()
+}
+
+// lookup returns the result of the first Mapping matching name, or nil if none match.
+func (mh *MappingHandler) lookup(name string) *mappingResult {
+	mh.cacheLock.RLock()
+	result, ok := mh.cache[name]
+	mh.cacheLock.RUnlock()
+	if ok {
+		return result
+	}
+
+	for _, mapping := range mh.mappings {
+		if result = mapping.apply(name); result != nil {
+			break
+		}
+	}
+
+	if mh.cacheSize <= 0 {
+		return result
+	}
+	mh.cacheLock.Lock()
+	if len(mh.cache) >= mh.cacheSize {
+		mh.cache = make(map[string]*mappingResult, mh.cacheSize)
+	}
+	mh.cache[name] = result
+	mh.cacheLock.Unlock()
+	return result
+}
+
+// DispatchMetrics applies the mappings to each metric and passes them to the next stage in the pipeline
+func (mh *MappingHandler) DispatchMetrics(ctx context.Context, metrics []*gostatsd.Metric) {
+	toDispatch := metrics[:0]
+	for _, m := range metrics {
+		result := mh.lookup(m.Name)
+		if result == nil {
+			toDispatch = append(toDispatch, m)
+			continue
+		}
+		if result.drop {
+			m.Done()
+			continue
+		}
+		m.Name = result.name
+		m.Tags = uniqueTags(m.Tags, result.tags)
+		m.TagsKey = ""
+		toDispatch = append(toDispatch, m)
+	}
+	if len(toDispatch) > 0 {
+		mh.handler.DispatchMetrics(ctx, toDispatch)
+	}
+}
+
+// DispatchMetricMap applies the mappings to each consolidated metric in the map and passes it to the next stage in
+// the pipeline.  Metrics mapped to the same name and tags are merged.  The map is passed on unchanged if no mapping
+// matches any of its metrics.
+func (mh *MappingHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	results := mh.lookupAll(mm)
+	if len(results) == 0 {
+		mh.handler.DispatchMetricMap(ctx, mm)
+		return
+	}
+
+	// Metrics which aren't mapped are moved as they are, then mapped metrics are merged in to them
+	mmNew := gostatsd.NewMetricMap()
+	for metricName, series := range mm.Counters {
+		if _, ok := results[metricName]; !ok {
+			mmNew.Counters[metricName] = series
+		}
+	}
+	for metricName, series := range mm.Gauges {
+		if _, ok := results[metricName]; !ok {
+			mmNew.Gauges[metricName] = series
+		}
+	}
+	for metricName, series := range mm.Timers {
+		if _, ok := results[metricName]; !ok {
+			mmNew.Timers[metricName] = series
+		}
+	}
+	for metricName, series := range mm.Sets {
+		if _, ok := results[metricName]; !ok {
+			mmNew.Sets[metricName] = series
+		}
+	}
+
+	for metricName, result := range results {
+		for _, c := range mm.Counters[metricName] {
+			if name, key, ok := result.mapSeries(c.Hostname, &c.Tags); ok {
+				mmNew.Merge(&gostatsd.MetricMap{Counters: gostatsd.Counters{name: {key: c}}})
+			}
+		}
+		for _, g := range mm.Gauges[metricName] {
+			if name, key, ok := result.mapSeries(g.Hostname, &g.Tags); ok {
+				mmNew.Merge(&gostatsd.MetricMap{Gauges: gostatsd.Gauges{name: {key: g}}})
+			}
+		}
+		for _, t := range mm.Timers[metricName] {
+			if name, key, ok := result.mapSeries(t.Hostname, &t.Tags); ok {
+				mmNew.Merge(&gostatsd.MetricMap{Timers: gostatsd.Timers{name: {key: t}}})
+			}
+		}
+		for _, s := range mm.Sets[metricName] {
+			if name, key, ok := result.mapSeries(s.Hostname, &s.Tags); ok {
+				mmNew.Merge(&gostatsd.MetricMap{Sets: gostatsd.Sets{name: {key: s}}})
+			}
+		}
+	}
+
+	if !mmNew.IsEmpty() {
+		mh.handler.DispatchMetricMap(ctx, mmNew)
+	}
+}
+
+// lookupAll returns the result of each metric name in mm matched by a mapping.
+func (mh *MappingHandler) lookupAll(mm *gostatsd.MetricMap) map[string]*mappingResult {
+	var results map[string]*mappingResult
+	add := func(metricName string) {
+		if _, ok := results[metricName]; ok {
+			return
+		}
+		if result := mh.lookup(metricName); result != nil {
+			if results == nil {
+				results = map[string]*mappingResult{}
+			}
+			results[metricName] = result
+		}
+	}
+	for metricName := range mm.Counters {
+		add(metricName)
+	}
+	for metricName := range mm.Gauges {
+		add(metricName)
+	}
+	for metricName := range mm.Timers {
+		add(metricName)
+	}
+	for metricName := range mm.Sets {
+		add(metricName)
+	}
+	return results
+}
+
+// mapSeries returns the new name and tags key of a consolidated metric, updating its tags, or false to drop it.
+func (result *mappingResult) mapSeries(hostname string, tags *gostatsd.Tags) (string, string, bool) {
+	if result.drop {
+		return "", "", false
+	}
+	*tags = uniqueTags(tags.Copy(), result.tags)
+	return result.name, gostatsd.FormatTagsKey(hostname, *tags), true
+}
+
+// DispatchEvent passes the event to the next stage in the pipeline
+func (mh *MappingHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	mh.handler.DispatchEvent(ctx, e)
+}
+
+// WaitForEvents waits for all event-dispatching goroutines to finish.
+func (mh *MappingHandler) WaitForEvents() {
+	mh.handler.WaitForEvents()
+}
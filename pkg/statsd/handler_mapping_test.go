@@ -0,0 +1,227 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMapping(t *testing.T, match, matchType, name string, tags []string, action string) *Mapping {
+	mapping, err := NewMapping(match, matchType, name, tags, action)
+	require.NoError(t, err)
+	return mapping
+}
+
+func TestMappingApply(t *testing.T) {
+	t.Parallel()
+	input := []struct {
+		name     string
+		mapping  *Mapping
+		metric   string
+		expected *mappingResult
+	}{
+		{
+			name:     "glob",
+			mapping:  newTestMapping(t, "envoy.cluster.*.upstream_rq_*", "glob", "envoy.cluster.upstream_rq", []string{"cluster:$1", "code:$2"}, "map"),
+			metric:   "envoy.cluster.backend.upstream_rq_200",
+			expected: &mappingResult{name: "envoy.cluster.upstream_rq", tags: gostatsd.Tags{"cluster:backend", "code:200"}},
+		},
+		{
+			name:     "glob does not match dots",
+			mapping:  newTestMapping(t, "envoy.cluster.*.upstream_rq", "glob", "envoy.upstream_rq", []string{"cluster:$1"}, "map"),
+			metric:   "envoy.cluster.a.b.upstream_rq",
+			expected: nil,
+		},
+		{
+			name:     "double star matches dots",
+			mapping:  newTestMapping(t, "envoy.cluster.**.upstream_rq", "glob", "envoy.upstream_rq", []string{"cluster:$1"}, "map"),
+			metric:   "envoy.cluster.a.b.upstream_rq",
+			expected: &mappingResult{name: "envoy.upstream_rq", tags: gostatsd.Tags{"cluster:a.b"}},
+		},
+		{
+			name:     "regex with named groups",
+			mapping:  newTestMapping(t, `http\.(?P<method>[a-z]+)\.(?P<status>\d+)`, "regex", "http.requests", []string{"method:${method}", "status:${status}"}, "map"),
+			metric:   "http.get.404",
+			expected: &mappingResult{name: "http.requests", tags: gostatsd.Tags{"method:get", "status:404"}},
+		},
+		{
+			name:     "regex must match the whole name",
+			mapping:  newTestMapping(t, `http\.[a-z]+`, "regex", "http", nil, "map"),
+			metric:   "http.get.404",
+			expected: nil,
+		},
+		{
+			name:     "keep name",
+			mapping:  newTestMapping(t, "db.*.query", "glob", "", []string{"db:$1"}, "map"),
+			metric:   "db.users.query",
+			expected: &mappingResult{name: "db.users.query", tags: gostatsd.Tags{"db:users"}},
+		},
+		{
+			name:     "empty capture skips tag",
+			mapping:  newTestMapping(t, `queue\.(\w*)\.?depth`, "regex", "queue.depth", []string{"queue:$1"}, "map"),
+			metric:   "queue.depth",
+			expected: &mappingResult{name: "queue.depth"},
+		},
+		{
+			name:     "drop",
+			mapping:  newTestMapping(t, "debug.*", "glob", "", nil, "drop"),
+			metric:   "debug.anything",
+			expected: &mappingResult{drop: true},
+		},
+	}
+	for _, inp := range input {
+		inp := inp
+		t.Run(inp.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, inp.expected, inp.mapping.apply(inp.metric))
+		})
+	}
+}
+
+func TestNewMappingInvalid(t *testing.T) {
+	t.Parallel()
+	_, err := NewMapping("a.*", "wildcard", "", nil, "map")
+	assert.Error(t, err)
+	_, err = NewMapping("(a", "regex", "", nil, "map")
+	assert.Error(t, err)
+	_, err = NewMapping("a.*", "glob", "", nil, "keep")
+	assert.Error(t, err)
+	_, err = NewMapping("a.*", "glob", "", []string{"$1"}, "map")
+	assert.Error(t, err)
+}
+
+func TestMappingHandlerDispatchMetrics(t *testing.T) {
+	t.Parallel()
+	tch := &capturingHandler{}
+	mh := NewMappingHandler(tch, []*Mapping{
+		newTestMapping(t, "debug.*", "glob", "", nil, "drop"),
+		newTestMapping(t, "api.*.*", "glob", "api.requests", []string{"service:$1", "endpoint:$2"}, "map"),
+		newTestMapping(t, "api.*.*", "glob", "api.ignored", nil, "map"),
+	}, 10)
+
+	mh.DispatchMetrics(context.Background(), []*gostatsd.Metric{
+		{Name: "debug.x", Type: gostatsd.COUNTER, Value: 1},
+		{Name: "api.users.login", Type: gostatsd.COUNTER, Value: 2, Tags: gostatsd.Tags{"env:prod"}, TagsKey: "env:prod"},
+		{Name: "other", Type: gostatsd.COUNTER, Value: 3, Tags: gostatsd.Tags{"env:prod"}},
+	})
+
+	require.Len(t, tch.m, 2)
+	assert.Equal(t, "api.requests", tch.m[0].Name)
+	assert.Equal(t, gostatsd.Tags{"env:prod", "service:users", "endpoint:login"}, tch.m[0].Tags)
+	assert.Equal(t, "", tch.m[0].TagsKey)
+	assert.Equal(t, "other", tch.m[1].Name)
+	assert.Equal(t, gostatsd.Tags{"env:prod"}, tch.m[1].Tags)
+}
+
+func TestMappingHandlerDispatchMetricMapMerges(t *testing.T) {
+	t.Parallel()
+	tch := &capturingHandler{}
+	mh := NewMappingHandler(tch, []*Mapping{
+		newTestMapping(t, "debug.*", "glob", "", nil, "drop"),
+		newTestMapping(t, "api.*.requests", "glob", "api.requests", []string{"service:$1"}, "map"),
+	}, 10)
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "api.users.requests", Timestamp: 10, Value: 1, Rate: 1})
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "api.users.requests", Timestamp: 20, Tags: gostatsd.Tags{"service:users"}, Value: 2, Rate: 1})
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "debug.x", Timestamp: 10, Value: 3, Rate: 1})
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.GAUGE, Name: "other", Timestamp: 10, Tags: gostatsd.Tags{"a:b"}, Value: 4})
+	mh.DispatchMetricMap(context.Background(), mm)
+
+	require.Len(t, tch.mm, 1)
+	expected := gostatsd.NewMetricMap()
+	expected.Counters["api.requests"] = map[string]gostatsd.Counter{
+		"service:users": {Timestamp: 20, Value: 3, Tags: gostatsd.Tags{"service:users"}},
+	}
+	expected.Gauges["other"] = map[string]gostatsd.Gauge{
+		"a:b": {Timestamp: 10, Value: 4, Tags: gostatsd.Tags{"a:b"}},
+	}
+	require.EqualValues(t, expected, tch.mm[0])
+}
+
+func TestMappingHandlerDispatchMetricMapUnmapped(t *testing.T) {
+	t.Parallel()
+	tch := &capturingHandler{}
+	mh := NewMappingHandler(tch, []*Mapping{
+		newTestMapping(t, "debug.*", "glob", "", nil, "drop"),
+	}, 10)
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "api.requests", Timestamp: 10, Value: 1, Rate: 1})
+	mh.DispatchMetricMap(context.Background(), mm)
+
+	require.Len(t, tch.mm, 1)
+	assert.True(t, mm == tch.mm[0], "a map without mapped metrics should be passed on as it is")
+}
+
+func TestMappingHandlerCache(t *testing.T) {
+	t.Parallel()
+	mh := NewMappingHandler(&nopHandler{}, []*Mapping{
+		newTestMapping(t, "a.*", "glob", "a", []string{"x:$1"}, "map"),
+	}, 2)
+
+	assert.Equal(t, &mappingResult{name: "a", tags: gostatsd.Tags{"x:1"}}, mh.lookup("a.1"))
+	assert.Nil(t, mh.lookup("b"))
+	assert.Len(t, mh.cache, 2)
+	assert.Contains(t, mh.cache, "b")
+
+	// A cached result is reused
+	assert.True(t, mh.lookup("a.1") == mh.lookup("a.1"))
+
+	// The cache is cleared when full
+	mh.lookup("a.2")
+	assert.Len(t, mh.cache, 1)
+
+	// A cache size of 0 disables the cache
+	mh = NewMappingHandler(&nopHandler{}, mh.mappings, 0)
+	assert.Equal(t, &mappingResult{name: "a", tags: gostatsd.Tags{"x:1"}}, mh.lookup("a.1"))
+	assert.Empty(t, mh.cache)
+}
+
+func TestNewMappingHandlerFromViper(t *testing.T) {
+	t.Parallel()
+	var data = []byte(`
+mappings='envoy-upstream drop-debug'
+mapping-cache-size=5
+
+[mapping.envoy-upstream]
+match='envoy.cluster.*.upstream_rq_*'
+name='envoy.cluster.upstream_rq'
+tags='cluster:$1 code:$2'
+
+[mapping.drop-debug]
+match='debug\..*'
+match-type='regex'
+action='drop'
+`)
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(bytes.NewBuffer(data)))
+
+	handler, err := NewMappingHandlerFromViper(v, &nopHandler{})
+	require.NoError(t, err)
+	mh := handler.(*MappingHandler)
+	assert.Len(t, mh.mappings, 2)
+	assert.Equal(t, 5, mh.cacheSize)
+	assert.Equal(t, &mappingResult{name: "envoy.cluster.upstream_rq", tags: gostatsd.Tags{"cluster:a", "code:503"}}, mh.lookup("envoy.cluster.a.upstream_rq_503"))
+	assert.Equal(t, &mappingResult{drop: true}, mh.lookup("debug.x"))
+
+	nh := &nopHandler{}
+	handler, err = NewMappingHandlerFromViper(viper.New(), nh)
+	require.NoError(t, err)
+	assert.Equal(t, nh, handler)
+
+	v.Set("mapping-cache-size", -1)
+	_, err = NewMappingHandlerFromViper(v, nh)
+	assert.Error(t, err)
+
+	v.Set("mappings", "missing")
+	_, err = NewMappingHandlerFromViper(v, nh)
+	assert.Error(t, err)
+}
@@ -2,51 +2,127 @@ package statsd
 
 import (
 	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
 
 	"github.com/atlassian/gostatsd"
 
-	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
 type TagHandler struct {
-	handler       gostatsd.PipelineHandler
+	handler gostatsd.PipelineHandler
+	random  func() float64 // Source of randomness for sampling, returns [0,1)
+
+	mu            sync.RWMutex  // Protects fields below, which may be replaced when the configuration is reloaded
 	tags          gostatsd.Tags // Tags to add to all metrics
-	filters       []Filter
+	filters       []Filter      // Filters from the configuration, followed by filters added at runtime
+	filterNames   []string      // Name of each filter in filters
+	filterMatches []uint64      // Number of metrics matched by each filter in filters, only accessed atomically
 	estimatedTags int
+
+	configNames   []string
+	configFilters []Filter
+	adminNames    []string
+	adminFilters  []Filter
 }
 
 var present = struct{}{}
 
-func NewTagHandlerFromViper(v *viper.Viper, handler gostatsd.PipelineHandler, tags gostatsd.Tags) *TagHandler {
-	filterNameList := v.GetStringSlice("filters")
-	var filters []Filter
-	for _, filterName := range filterNameList {
-		vFilter := v.Sub("filter." + filterName)
-		if vFilter == nil {
-			logrus.Warnf("Filter doesn't exist: %v", filterName)
-			continue
-		}
-		filters = append(filters, NewFilterFromViper(vFilter))
-		logrus.Infof("Loaded filter %v", filterName)
+func NewTagHandlerFromViper(v *viper.Viper, handler gostatsd.PipelineHandler, tags gostatsd.Tags) (*TagHandler, error) {
+	names, filters, err := NewFiltersFromViper(v)
+	if err != nil {
+		return nil, err
 	}
-	return NewTagHandler(handler, tags, filters)
+	th := NewTagHandler(handler, nil, nil)
+	th.SetTagsAndFilters(tags, names, filters)
+	return th, nil
 }
 
 // NewTagHandler initialises a new handler which adds unique tags, and sends metrics/events to the next handler based
 // on filter rules.
 func NewTagHandler(handler gostatsd.PipelineHandler, tags gostatsd.Tags, filters []Filter) *TagHandler {
+	th := &TagHandler{
+		handler: handler,
+		random:  rand.Float64,
+	}
+	th.SetTagsAndFilters(tags, nil, filters)
+	return th
+}
+
+// SetTagsAndFilters replaces the tags added to all metrics and events, and the filter rules from the configuration.
+// Filters added at runtime are kept.  names holds the name of each filter, or may be nil if they are unnamed.
+func (th *TagHandler) SetTagsAndFilters(tags gostatsd.Tags, names []string, filters []Filter) {
 	tags = uniqueTags(tags, gostatsd.Tags{}) // de-dupe tags
-	return &TagHandler{
-		handler:       handler,
-		tags:          tags,
-		filters:       filters,
-		estimatedTags: len(tags) + handler.EstimatedTags(),
+	if names == nil {
+		names = make([]string, len(filters))
+	}
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	th.tags = tags
+	th.configNames = names
+	th.configFilters = filters
+	th.combineFilters()
+	th.estimatedTags = len(tags) + th.handler.EstimatedTags()
+}
+
+// SetAdminFilters replaces the filter rules added at runtime, which are applied after the filters from the
+// configuration.  names holds the name of each filter.
+func (th *TagHandler) SetAdminFilters(names []string, filters []Filter) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	th.adminNames = names
+	th.adminFilters = filters
+	th.combineFilters()
+}
+
+// isConfigFilter returns true if name is the name of a filter from the configuration.
+func (th *TagHandler) isConfigFilter(name string) bool {
+	th.mu.RLock()
+	defer th.mu.RUnlock()
+	for _, configName := range th.configNames {
+		if configName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkConfigFilterNames returns an error if any of names is already used by a filter added at runtime.
+func (th *TagHandler) checkConfigFilterNames(names []string) error {
+	th.mu.RLock()
+	defer th.mu.RUnlock()
+	for _, name := range names {
+		for _, adminName := range th.adminNames {
+			if name == adminName {
+				return fmt.Errorf("filter %s is already defined at runtime", name)
+			}
+		}
+	}
+	return nil
+}
+
+// combineFilters rebuilds the list of filters to apply, keeping the match count of filters with the same name.  Must
+// be called with th.mu held.
+func (th *TagHandler) combineFilters() {
+	matches := make(map[string]uint64, len(th.filterNames))
+	for idx, name := range th.filterNames {
+		matches[name] = atomic.LoadUint64(&th.filterMatches[idx])
+	}
+	th.filters = append(append([]Filter(nil), th.configFilters...), th.adminFilters...)
+	th.filterNames = append(append([]string(nil), th.configNames...), th.adminNames...)
+	th.filterMatches = make([]uint64, len(th.filters))
+	for idx, name := range th.filterNames {
+		th.filterMatches[idx] = matches[name]
 	}
 }
 
 // EstimatedTags returns a guess for how many tags to pre-allocate
 func (th *TagHandler) EstimatedTags() int {
+	th.mu.RLock()
+	defer th.mu.RUnlock()
 	return th.estimatedTags
 }
 
@@ -54,14 +130,17 @@ func (th *TagHandler) EstimatedTags() int {
 func (th *TagHandler) DispatchMetrics(ctx context.Context, metrics []*gostatsd.Metric) {
 	var toDispatch []*gostatsd.Metric
 
+	th.mu.RLock()
 	for _, m := range metrics {
 		if m.Hostname == "" {
 			m.Hostname = string(m.SourceIP)
 		}
-		if th.uniqueFilterMetricAndAddTags(m) {
+		if rate, ok := th.uniqueFilterAndAddTags(&m.Name, &m.Hostname, &m.Tags); ok {
+			m.Rate *= rate
 			toDispatch = append(toDispatch, m)
 		}
 	}
+	th.mu.RUnlock()
 	if len(toDispatch) > 0 {
 		th.handler.DispatchMetrics(ctx, toDispatch)
 	}
@@ -75,8 +154,10 @@ func (th *TagHandler) DispatchMetrics(ctx context.Context, metrics []*gostatsd.M
 func (th *TagHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
 	mmNew := gostatsd.NewMetricMap()
 
-	mm.Counters.Each(func(metricName, x string, cOriginal gostatsd.Counter) {
-		if th.uniqueFilterAndAddTags(metricName, &cOriginal.Hostname, &cOriginal.Tags) {
+	th.mu.RLock()
+	mm.Counters.Each(func(metricName, _ string, cOriginal gostatsd.Counter) {
+		if rate, ok := th.uniqueFilterAndAddTags(&metricName, &cOriginal.Hostname, &cOriginal.Tags); ok {
+			cOriginal.Value /= rate
 			newTagsKey := gostatsd.FormatTagsKey(cOriginal.Hostname, cOriginal.Tags)
 			if cs, ok := mmNew.Counters[metricName]; ok {
 				if cNew, ok := cs[newTagsKey]; ok {
@@ -93,7 +174,7 @@ func (th *TagHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.Metric
 	})
 
 	mm.Gauges.Each(func(metricName, _ string, gOriginal gostatsd.Gauge) {
-		if th.uniqueFilterAndAddTags(metricName, &gOriginal.Hostname, &gOriginal.Tags) {
+		if _, ok := th.uniqueFilterAndAddTags(&metricName, &gOriginal.Hostname, &gOriginal.Tags); ok {
 			newTagsKey := gostatsd.FormatTagsKey(gOriginal.Hostname, gOriginal.Tags)
 			if gs, ok := mmNew.Gauges[metricName]; ok {
 				if gNew, ok := gs[newTagsKey]; ok {
@@ -112,7 +193,8 @@ func (th *TagHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.Metric
 	})
 
 	mm.Timers.Each(func(metricName, _ string, tOriginal gostatsd.Timer) {
-		if th.uniqueFilterAndAddTags(metricName, &tOriginal.Hostname, &tOriginal.Tags) {
+		if rate, ok := th.uniqueFilterAndAddTags(&metricName, &tOriginal.Hostname, &tOriginal.Tags); ok {
+			tOriginal.SampledCount /= rate
 			newTagsKey := gostatsd.FormatTagsKey(tOriginal.Hostname, tOriginal.Tags)
 			if ts, ok := mmNew.Timers[metricName]; ok {
 				if tNew, ok := ts[newTagsKey]; ok {
@@ -130,7 +212,7 @@ func (th *TagHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.Metric
 	})
 
 	mm.Sets.Each(func(metricName, _ string, sOriginal gostatsd.Set) {
-		if th.uniqueFilterAndAddTags(metricName, &sOriginal.Hostname, &sOriginal.Tags) {
+		if _, ok := th.uniqueFilterAndAddTags(&metricName, &sOriginal.Hostname, &sOriginal.Tags); ok {
 			newTagsKey := gostatsd.FormatTagsKey(sOriginal.Hostname, sOriginal.Tags)
 			if ss, ok := mmNew.Sets[metricName]; ok {
 				if sNew, ok := ss[newTagsKey]; ok {
@@ -147,6 +229,7 @@ func (th *TagHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.Metric
 			}
 		}
 	})
+	th.mu.RUnlock()
 
 	if !mmNew.IsEmpty() {
 		th.handler.DispatchMetricMap(ctx, mmNew)
@@ -156,28 +239,33 @@ func (th *TagHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.Metric
 // uniqueFilterAndAddTags will perform 3 tasks:
 // - Add static tags configured to the metric
 // - De-duplicate tags
-// - Perform rule based filtering
+// - Perform rule based filtering, which may also rename the metric, change its hostname, or sample it
 //
 // Everything is done in one function for efficiency, as the steps listed above are interrelated, and this is on the
 // hot code path.
 //
-// Returns true if the metric should be processed further, or false to drop it.
-func (th *TagHandler) uniqueFilterAndAddTags(mName string, mHostname *string, mTags *gostatsd.Tags) bool {
+// Must be called with th.mu held for reading.
+//
+// Returns the rate the metric was sampled at, and true if the metric should be processed further, or false to drop it.
+func (th *TagHandler) uniqueFilterAndAddTags(mName *string, mHostname *string, mTags *gostatsd.Tags) (float64, bool) {
 	if len(th.filters) == 0 {
 		*mTags = uniqueTags(*mTags, th.tags)
-		return true
+		return 1, true
 	}
 
 	dropTags := map[string]struct{}{}
+	addTags := th.tags
+	var keepOnly []gostatsd.StringMatchList
+	rate := 1.0
 
-	for _, filter := range th.filters {
-		if len(filter.MatchMetrics) > 0 && !filter.MatchMetrics.MatchAny(mName) { // returns false if nothing present
+	for idx, filter := range th.filters {
+		if len(filter.MatchMetrics) > 0 && !filter.MatchMetrics.MatchAny(*mName) { // returns false if nothing present
 			// name doesn't match an include, stop
 			continue
 		}
 
 		// this list may be empty, and therefore return false
-		if filter.ExcludeMetrics.MatchAny(mName) { // returns false if nothing present
+		if filter.ExcludeMetrics.MatchAny(*mName) { // returns false if nothing present
 			// name matches an exclude, stop
 			continue
 		}
@@ -187,8 +275,17 @@ func (th *TagHandler) uniqueFilterAndAddTags(mName string, mHostname *string, mT
 			continue
 		}
 
+		atomic.AddUint64(&th.filterMatches[idx], 1)
+
 		if filter.DropMetric {
-			return false
+			return 0, false
+		}
+
+		if filter.SampleRate > 0 {
+			if th.random() >= filter.SampleRate {
+				return 0, false
+			}
+			rate *= filter.SampleRate
 		}
 
 		for _, dropFilter := range filter.DropTags {
@@ -199,17 +296,51 @@ func (th *TagHandler) uniqueFilterAndAddTags(mName string, mHostname *string, mT
 			}
 		}
 
+		if len(filter.KeepOnlyTags) > 0 {
+			keepOnly = append(keepOnly, filter.KeepOnlyTags)
+		}
+
+		if len(filter.AddTags) > 0 {
+			addTags = append(addTags[:len(addTags):len(addTags)], filter.AddTags...)
+		}
+
+		if filter.RenameMetric != "" {
+			*mName = filter.RenameMetric
+		}
+
 		if filter.DropHost {
 			*mHostname = ""
 		}
+
+		if filter.SetHostname != "" {
+			*mHostname = filter.SetHostname
+		}
 	}
 
-	*mTags = uniqueTagsWithSeen(dropTags, *mTags, th.tags)
-	return true
+	*mTags = uniqueTagsWithSeen(dropTags, *mTags, addTags)
+	if len(keepOnly) > 0 {
+		// Applied last so that default tags and tags added by filters are also removed
+		*mTags = keepOnlyTags(*mTags, keepOnly)
+	}
+	return rate, true
 }
 
-func (th *TagHandler) uniqueFilterMetricAndAddTags(m *gostatsd.Metric) bool {
-	return th.uniqueFilterAndAddTags(m.Name, &m.Hostname, &m.Tags)
+// keepOnlyTags removes the tags which are not matched by every list in keepOnly.  It modifies the contents of tags.
+func keepOnlyTags(tags gostatsd.Tags, keepOnly []gostatsd.StringMatchList) gostatsd.Tags {
+	kept := tags[:0]
+	for _, tag := range tags {
+		keep := true
+		for _, sml := range keepOnly {
+			if !sml.MatchAny(tag) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			kept = append(kept, tag)
+		}
+	}
+	return kept
 }
 
 // DispatchEvent adds the unique tags from the TagHandler to the event and passes it to the next stage in the pipeline
@@ -217,7 +348,9 @@ func (th *TagHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
 	if e.Hostname == "" {
 		e.Hostname = string(e.SourceIP)
 	}
+	th.mu.RLock()
 	e.Tags = uniqueTags(e.Tags, th.tags)
+	th.mu.RUnlock()
 	th.handler.DispatchEvent(ctx, e)
 }
 
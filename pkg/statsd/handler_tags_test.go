@@ -113,7 +113,7 @@ func TestFilterPassesNoFilters(t *testing.T) {
 func TestFilterPassesEmptyFilters(t *testing.T) {
 	tch := &capturingHandler{}
 	th := NewTagHandler(tch, gostatsd.Tags{}, nil)
-	th.filters = []Filter{}
+	th.SetTagsAndFilters(gostatsd.Tags{}, nil, []Filter{})
 	m := &gostatsd.Metric{
 		Name: "name",
 		Tags: gostatsd.Tags{
@@ -139,12 +139,12 @@ func TestFilterPassesEmptyFilters(t *testing.T) {
 func TestFilterKeepNonMatch(t *testing.T) {
 	tch := &capturingHandler{}
 	th := NewTagHandler(tch, gostatsd.Tags{}, nil)
-	th.filters = []Filter{
+	th.SetTagsAndFilters(gostatsd.Tags{}, nil, []Filter{
 		{
 			MatchMetrics: gostatsd.StringMatchList{gostatsd.NewStringMatch("bad.name")},
 			DropMetric:   true,
 		},
-	}
+	})
 	m := &gostatsd.Metric{
 		Name: "good.name",
 		Tags: gostatsd.Tags{
@@ -170,12 +170,12 @@ func TestFilterKeepNonMatch(t *testing.T) {
 func TestFilterDropsBadName(t *testing.T) {
 	tch := &capturingHandler{}
 	th := NewTagHandler(tch, gostatsd.Tags{}, nil)
-	th.filters = []Filter{
+	th.SetTagsAndFilters(gostatsd.Tags{}, nil, []Filter{
 		{
 			MatchMetrics: gostatsd.StringMatchList{gostatsd.NewStringMatch("bad.name")},
 			DropMetric:   true,
 		},
-	}
+	})
 	m := &gostatsd.Metric{
 		Name: "bad.name",
 		Tags: gostatsd.Tags{
@@ -191,12 +191,12 @@ func TestFilterDropsBadName(t *testing.T) {
 func TestFilterDropsBadPrefix(t *testing.T) {
 	tch := &capturingHandler{}
 	th := NewTagHandler(tch, gostatsd.Tags{}, nil)
-	th.filters = []Filter{
+	th.SetTagsAndFilters(gostatsd.Tags{}, nil, []Filter{
 		{
 			MatchMetrics: gostatsd.StringMatchList{gostatsd.NewStringMatch("bad.*")},
 			DropMetric:   true,
 		},
-	}
+	})
 	m := &gostatsd.Metric{
 		Name: "bad.name",
 		Tags: gostatsd.Tags{
@@ -212,13 +212,13 @@ func TestFilterDropsBadPrefix(t *testing.T) {
 func TestFilterKeepsWhitelist(t *testing.T) {
 	tch := &capturingHandler{}
 	th := NewTagHandler(tch, gostatsd.Tags{}, nil)
-	th.filters = []Filter{
+	th.SetTagsAndFilters(gostatsd.Tags{}, nil, []Filter{
 		{
 			MatchMetrics:   gostatsd.StringMatchList{gostatsd.NewStringMatch("bad.*")},
 			ExcludeMetrics: gostatsd.StringMatchList{gostatsd.NewStringMatch("bad.good")},
 			DropMetric:     true,
 		},
-	}
+	})
 
 	m := &gostatsd.Metric{
 		Name: "bad.name",
@@ -256,12 +256,12 @@ func TestFilterKeepsWhitelist(t *testing.T) {
 func TestFilterDropsTag(t *testing.T) {
 	tch := &capturingHandler{}
 	th := NewTagHandler(tch, gostatsd.Tags{}, nil)
-	th.filters = []Filter{
+	th.SetTagsAndFilters(gostatsd.Tags{}, nil, []Filter{
 		{
 			MatchMetrics: gostatsd.StringMatchList{gostatsd.NewStringMatch("bad.name")},
 			DropTags:     gostatsd.StringMatchList{gostatsd.NewStringMatch("foo:*")},
 		},
-	}
+	})
 
 	m := &gostatsd.Metric{
 		Name: "bad.name",
@@ -288,12 +288,12 @@ func TestFilterDropsTag(t *testing.T) {
 func TestFilterDropsHost(t *testing.T) {
 	tch := &capturingHandler{}
 	th := NewTagHandler(tch, gostatsd.Tags{}, nil)
-	th.filters = []Filter{
+	th.SetTagsAndFilters(gostatsd.Tags{}, nil, []Filter{
 		{
 			MatchMetrics: gostatsd.StringMatchList{gostatsd.NewStringMatch("bad.name")},
 			DropHost:     true,
 		},
-	}
+	})
 
 	m := &gostatsd.Metric{
 		Name: "bad.name",
@@ -355,20 +355,165 @@ drop-tags='host:*'
 	}
 
 	nh := &nopHandler{}
-	th := NewTagHandlerFromViper(v, nh, nil)
+	th, err := NewTagHandlerFromViper(v, nh, nil)
+	require.NoError(t, err)
 
 	empty := gostatsd.StringMatchList{}
 
 	expected := []Filter{
-		{MatchMetrics: toStringMatch([]string{"noisy.*"}), ExcludeMetrics: empty, MatchTags: empty, DropTags: empty, DropMetric: true, DropHost: false},
-		{MatchMetrics: toStringMatch([]string{"noisy.*"}), ExcludeMetrics: empty, MatchTags: toStringMatch([]string{"noisy-tag:*"}), DropTags: empty, DropMetric: true, DropHost: false},
-		{MatchMetrics: toStringMatch([]string{"noisy.*"}), ExcludeMetrics: empty, MatchTags: empty, DropTags: toStringMatch([]string{"noisy-tag:*"}), DropMetric: false, DropHost: false},
-		{MatchMetrics: toStringMatch([]string{"noisy.*"}), ExcludeMetrics: toStringMatch([]string{"noisy.quiet.*", "noisy.ok.*"}), DropTags: empty, MatchTags: empty, DropMetric: true, DropHost: false},
-		{MatchMetrics: toStringMatch([]string{"global.*"}), ExcludeMetrics: empty, MatchTags: empty, DropTags: toStringMatch([]string{"host:*"}), DropMetric: false, DropHost: true},
+		{MatchMetrics: stringMatchList("noisy.*"), ExcludeMetrics: empty, MatchTags: empty, DropTags: empty, DropMetric: true, DropHost: false, AddTags: gostatsd.Tags{}, KeepOnlyTags: empty},
+		{MatchMetrics: stringMatchList("noisy.*"), ExcludeMetrics: empty, MatchTags: stringMatchList("noisy-tag:*"), DropTags: empty, DropMetric: true, DropHost: false, AddTags: gostatsd.Tags{}, KeepOnlyTags: empty},
+		{MatchMetrics: stringMatchList("noisy.*"), ExcludeMetrics: empty, MatchTags: empty, DropTags: stringMatchList("noisy-tag:*"), DropMetric: false, DropHost: false, AddTags: gostatsd.Tags{}, KeepOnlyTags: empty},
+		{MatchMetrics: stringMatchList("noisy.*"), ExcludeMetrics: stringMatchList("noisy.quiet.*", "noisy.ok.*"), DropTags: empty, MatchTags: empty, DropMetric: true, DropHost: false, AddTags: gostatsd.Tags{}, KeepOnlyTags: empty},
+		{MatchMetrics: stringMatchList("global.*"), ExcludeMetrics: empty, MatchTags: empty, DropTags: stringMatchList("host:*"), DropMetric: false, DropHost: true, AddTags: gostatsd.Tags{}, KeepOnlyTags: empty},
 	}
 	assert.Equal(t, expected, th.filters)
 }
 
+func stringMatchList(tests ...string) gostatsd.StringMatchList {
+	sml := gostatsd.StringMatchList{}
+	for _, test := range tests {
+		sml = append(sml, gostatsd.NewStringMatch(test))
+	}
+	return sml
+}
+
+func TestNewTagHandlerFromViperNewActions(t *testing.T) {
+	var data = []byte(`
+filters='envoy'
+
+[filter.envoy]
+match-metrics='~^envoy\.cluster\.'
+add-tags='source:envoy'
+rename-metric='envoy.cluster'
+keep-only-tags='cluster:* code:?xx'
+sample-rate=0.25
+set-hostname='mesh'
+`)
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(bytes.NewBuffer(data)))
+
+	th, err := NewTagHandlerFromViper(v, &nopHandler{}, nil)
+	require.NoError(t, err)
+	require.Len(t, th.filters, 1)
+	f := th.filters[0]
+	assert.True(t, f.MatchMetrics.MatchAny("envoy.cluster.upstream_rq"))
+	assert.False(t, f.MatchMetrics.MatchAny("xenvoy.cluster.upstream_rq"))
+	assert.Equal(t, gostatsd.Tags{"source:envoy"}, f.AddTags)
+	assert.Equal(t, "envoy.cluster", f.RenameMetric)
+	assert.Equal(t, stringMatchList("cluster:*", "code:?xx"), f.KeepOnlyTags)
+	assert.Equal(t, 0.25, f.SampleRate)
+	assert.Equal(t, "mesh", f.SetHostname)
+
+	v.Set("filter.envoy.match-tags", "~(")
+	_, err = NewTagHandlerFromViper(v, &nopHandler{}, nil)
+	assert.Error(t, err)
+
+	v.Set("filter.envoy.match-tags", "")
+	v.Set("filter.envoy.sample-rate", 2)
+	_, err = NewTagHandlerFromViper(v, &nopHandler{}, nil)
+	assert.Error(t, err)
+}
+
+func TestFilterMatchesGlobAndRegex(t *testing.T) {
+	tch := &capturingHandler{}
+	th := NewTagHandler(tch, nil, []Filter{
+		{MatchMetrics: stringMatchList("glob:api.*.errors"), MatchTags: stringMatchList("~^code:5\\d\\d$"), DropMetric: true},
+	})
+	th.DispatchMetrics(context.Background(), []*gostatsd.Metric{
+		{Name: "api.users.errors", Tags: gostatsd.Tags{"code:503"}},
+		{Name: "api.users.errors", Tags: gostatsd.Tags{"code:404"}},
+		{Name: "api.users.requests", Tags: gostatsd.Tags{"code:503"}},
+	})
+	require.Len(t, tch.m, 2)
+	assert.Equal(t, gostatsd.Tags{"code:404"}, tch.m[0].Tags)
+	assert.Equal(t, "api.users.requests", tch.m[1].Name)
+}
+
+func TestFilterActions(t *testing.T) {
+	tch := &capturingHandler{}
+	th := NewTagHandler(tch, gostatsd.Tags{"env:prod"}, []Filter{
+		{
+			MatchMetrics: stringMatchList("envoy.cluster.*"),
+			KeepOnlyTags: stringMatchList("cluster:*", "source:*", "renamed:*"),
+			AddTags:      gostatsd.Tags{"source:envoy"},
+			RenameMetric: "envoy.cluster",
+			SetHostname:  "mesh",
+		},
+		{
+			MatchMetrics: stringMatchList("envoy.cluster"), // sees the new name
+			AddTags:      gostatsd.Tags{"renamed:true"},
+		},
+	})
+	th.DispatchMetrics(context.Background(), []*gostatsd.Metric{
+		{Name: "envoy.cluster.rq", Hostname: "pod-1", Tags: gostatsd.Tags{"cluster:a", "pod:1"}},
+		{Name: "other", Hostname: "pod-1", Tags: gostatsd.Tags{"pod:1"}},
+	})
+	require.Len(t, tch.m, 2)
+	assert.Equal(t, "envoy.cluster", tch.m[0].Name)
+	assert.Equal(t, "mesh", tch.m[0].Hostname)
+	// keep-only-tags also applies to the default tags and the tags added by filters
+	assert.ElementsMatch(t, gostatsd.Tags{"cluster:a", "source:envoy", "renamed:true"}, tch.m[0].Tags)
+	assert.Equal(t, "other", tch.m[1].Name)
+	assert.Equal(t, "pod-1", tch.m[1].Hostname)
+	assertHasAllTags(t, tch.m[1].Tags, "pod:1", "env:prod")
+}
+
+func TestFilterActionsMergeMetricMap(t *testing.T) {
+	tch := &capturingHandler{}
+	th := NewTagHandler(tch, nil, []Filter{
+		{
+			MatchMetrics: stringMatchList("glob:envoy.cluster.*.rq"),
+			KeepOnlyTags: stringMatchList("code:*"),
+			RenameMetric: "envoy.rq",
+			DropHost:     true,
+		},
+	})
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "envoy.cluster.a.rq", Hostname: "h1", Timestamp: 10, Tags: gostatsd.Tags{"code:200", "pod:1"}, Value: 1, Rate: 1})
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "envoy.cluster.b.rq", Hostname: "h2", Timestamp: 20, Tags: gostatsd.Tags{"code:200", "pod:2"}, Value: 2, Rate: 1})
+	th.DispatchMetricMap(context.Background(), mm)
+
+	expected := gostatsd.NewMetricMap()
+	expected.Counters["envoy.rq"] = map[string]gostatsd.Counter{
+		"code:200": {Timestamp: 20, Value: 3, Tags: gostatsd.Tags{"code:200"}},
+	}
+	require.EqualValues(t, expected, tch.mm[0])
+}
+
+func TestFilterSampleRate(t *testing.T) {
+	tch := &capturingHandler{}
+	th := NewTagHandler(tch, nil, []Filter{
+		{MatchMetrics: stringMatchList("kept.*"), SampleRate: 0.5},
+		{MatchMetrics: stringMatchList("dropped.*"), SampleRate: 0.2},
+	})
+	th.random = func() float64 { return 0.3 }
+
+	th.DispatchMetrics(context.Background(), []*gostatsd.Metric{
+		{Name: "kept.counter", Type: gostatsd.COUNTER, Value: 1, Rate: 0.5},
+		{Name: "dropped.counter", Type: gostatsd.COUNTER, Value: 1, Rate: 1},
+		{Name: "other", Type: gostatsd.COUNTER, Value: 1, Rate: 1},
+	})
+	require.Len(t, tch.m, 2)
+	assert.Equal(t, "kept.counter", tch.m[0].Name)
+	assert.Equal(t, 0.25, tch.m[0].Rate)
+	assert.Equal(t, 1.0, tch.m[1].Rate)
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "kept.counter", Timestamp: 10, Value: 3, Rate: 1})
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.TIMER, Name: "kept.timer", Timestamp: 10, Value: 3, Rate: 1})
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.GAUGE, Name: "kept.gauge", Timestamp: 10, Value: 3, Rate: 1})
+	mm.Receive(&gostatsd.Metric{Type: gostatsd.COUNTER, Name: "dropped.counter", Timestamp: 10, Value: 3, Rate: 1})
+	th.DispatchMetricMap(context.Background(), mm)
+
+	require.Len(t, tch.mm, 1)
+	assert.Equal(t, 6.0, tch.mm[0].Counters["kept.counter"][""].Value)
+	assert.Equal(t, 2.0, tch.mm[0].Timers["kept.timer"][""].SampledCount)
+	assert.Equal(t, 3.0, tch.mm[0].Gauges["kept.gauge"][""].Value)
+	assert.NotContains(t, tch.mm[0].Counters, "dropped.counter")
+}
+
 func assertHasAllTags(t *testing.T, actual gostatsd.Tags, expected ...string) {
 	assert.Equal(t, len(expected), len(actual))
 	seenActual := map[string]struct{}{}
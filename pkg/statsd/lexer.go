@@ -5,6 +5,7 @@ import (
 	"errors"
 	"math"
 	"strconv"
+	"time"
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/pool"
@@ -396,47 +397,80 @@ func lexTypeSep(l *lexer) stateFn {
 		return nil
 	case '|':
 		l.start = l.pos
-		return lexSampleRateOrTags
+		return lexMetricField
 	}
 	l.err = errInvalidType
 	return nil
 }
 
-// lex the sample rate or the tags.
-func lexSampleRateOrTags(l *lexer) stateFn {
+// lex the possible separator between metric fields.
+func lexMetricFieldSep(l *lexer) stateFn {
+	switch b := l.next(); b {
+	case eof:
+		return nil
+	case '|':
+		return lexMetricField
+	}
+	l.err = errInvalidSamplingOrTags
+	return nil
+}
+
+// lex the sample rate, the tags, or the timestamp, in any order.  Other fields, such as the container id (c:) and
+// external data (e:) sent by DogStatsD clients, are skipped.
+func lexMetricField(l *lexer) stateFn {
 	b := l.next()
 	switch b {
 	case '@':
-		l.start = l.pos
-		for {
-			switch b := l.next(); b {
-			case '|':
-				return lexSampleRate
-			case eof:
-				l.pos++
-				return lexSampleRate
-			}
-		}
+		return lexUntil('|', lexSampleRate)
 	case '#':
-		return lexTags
-	default:
+		return lexUntil('|', lexMetricTags)
+	case 'T':
+		return lexUint(func(l *lexer, value uint64) stateFn {
+			if value > math.MaxInt64/uint64(time.Second) {
+				l.err = errOverflow
+				return nil
+			}
+			l.m.Timestamp = gostatsd.Nanotime(value * uint64(time.Second))
+			l.m.ClientTimestamp = true
+			return lexMetricFieldSep
+		})
+	case eof, '|':
 		l.err = errInvalidSamplingOrTags
 		return nil
+	default:
+		return lexUntil('|', func(l *lexer, data []byte) stateFn {
+			return lexMetricFieldSep
+		})
 	}
 }
 
 // lex the sample rate.
-func lexSampleRate(l *lexer) stateFn {
-	v, err := strconv.ParseFloat(string(l.input[l.start:l.pos-1]), 64)
+func lexSampleRate(l *lexer, data []byte) stateFn {
+	v, err := strconv.ParseFloat(string(data), 64)
 	if err != nil {
 		l.err = err
 		return nil
 	}
 	l.sampling = v
-	if l.pos >= l.len {
-		return nil
+	return lexMetricFieldSep
+}
+
+// lex the tags of a metric, which end at the next field.
+func lexMetricTags(l *lexer, data []byte) stateFn {
+	for len(data) > 0 {
+		idx := bytes.IndexByte(data, ',')
+		if idx == -1 {
+			idx = len(data)
+		}
+		if idx > 0 {
+			l.tags = append(l.tags, string(data[:idx]))
+		}
+		if idx == len(data) {
+			break
+		}
+		data = data[idx+1:]
 	}
-	return lexAssert('#', lexTags)
+	return lexMetricFieldSep
 }
 
 // lex the tags.
@@ -39,6 +39,13 @@ func TestMetricsLexer(t *testing.T) {
 		"a:1|g|#":                       {Name: "a", Value: 1, Type: gostatsd.GAUGE, Rate: 1.0},
 		"a:1|g|#,":                      {Name: "a", Value: 1, Type: gostatsd.GAUGE, Rate: 1.0},
 		"a:1|g|#,,":                     {Name: "a", Value: 1, Type: gostatsd.GAUGE, Rate: 1.0},
+		"a:1|c|T1656581400":             {Name: "a", Value: 1, Type: gostatsd.COUNTER, Rate: 1.0, Timestamp: 1656581400e9, ClientTimestamp: true},
+		"a:1|c|@0.5|#f|T1656581400":     {Name: "a", Value: 1, Type: gostatsd.COUNTER, Rate: 0.5, Tags: gostatsd.Tags{"f"}, Timestamp: 1656581400e9, ClientTimestamp: true},
+		"a:1|c|T1656581400|#f,z|@0.5":   {Name: "a", Value: 1, Type: gostatsd.COUNTER, Rate: 0.5, Tags: gostatsd.Tags{"f", "z"}, Timestamp: 1656581400e9, ClientTimestamp: true},
+		"a:1|c|#f|@0.5":                 {Name: "a", Value: 1, Type: gostatsd.COUNTER, Rate: 0.5, Tags: gostatsd.Tags{"f"}},
+		"a:1|c|#f:b|c:83c1b6d2e4":       {Name: "a", Value: 1, Type: gostatsd.COUNTER, Rate: 1.0, Tags: gostatsd.Tags{"f:b"}},
+		"a:1|c|c:83c1b6d2e4|@0.5":       {Name: "a", Value: 1, Type: gostatsd.COUNTER, Rate: 0.5},
+		"a:1|g|e:it-false,cn-nginx|#f":  {Name: "a", Value: 1, Type: gostatsd.GAUGE, Rate: 1.0, Tags: gostatsd.Tags{"f"}},
 	}
 
 	compareMetric(t, tests, "")
@@ -46,7 +53,7 @@ func TestMetricsLexer(t *testing.T) {
 
 func TestInvalidMetricsLexer(t *testing.T) {
 	t.Parallel()
-	failing := []string{"fOO|bar:bazkk", "foo.bar.baz:1|q", "NaN.should.be:NaN|g"}
+	failing := []string{"fOO|bar:bazkk", "foo.bar.baz:1|q", "NaN.should.be:NaN|g", "a:1|c|T", "a:1|c|Tabc", "a:1|c|T99999999999999999999", "a:1|c|@0.5|", "a:1|c||#f"}
 	for _, tc := range failing {
 		tc := tc
 		t.Run(tc, func(t *testing.T) {
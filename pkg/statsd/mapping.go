@@ -0,0 +1,125 @@
+package statsd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/viper"
+)
+
+// Mapping rewrites the names of metrics matching a glob or regular expression, and turns captured parts of the name
+// in to tags.
+type Mapping struct {
+	match *regexp.Regexp
+	name  string   // Template for the new name, empty to keep the name
+	tags  []string // Templates for tags to add, as key:value
+	drop  bool     // Drop matching metrics
+}
+
+// NewMapping creates a new Mapping.  If matchType is "glob", each * in match matches one or more characters other
+// than a dot, and each ** matches one or more of any characters, as in a filter's glob.  If matchType is "regex", match is a regular expression, which must match the whole name.  The name and
+// tags are templates, which may refer to the captures of the match as $1 or ${1}, or the named groups of a regular
+// expression as ${name}.  If action is "drop", matching metrics are dropped, otherwise it must be "map".
+func NewMapping(match, matchType, name string, tags []string, action string) (*Mapping, error) {
+	var pattern string
+	switch matchType {
+	case "glob":
+		pattern = globToCapturingRegex(match)
+	case "regex":
+		pattern = "^(?:" + match + ")$"
+	default:
+		return nil, fmt.Errorf("invalid match-type %q, must be glob or regex", matchType)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid match %q: %v", match, err)
+	}
+
+	if action != "map" && action != "drop" {
+		return nil, fmt.Errorf("invalid action %q, must be map or drop", action)
+	}
+	for _, tag := range tags {
+		if !strings.Contains(tag, ":") {
+			return nil, fmt.Errorf("invalid tag %q, must be key:value", tag)
+		}
+	}
+
+	return &Mapping{
+		match: re,
+		name:  name,
+		tags:  tags,
+		drop:  action == "drop",
+	}, nil
+}
+
+// globToCapturingRegex returns an anchored regular expression matching the glob, which captures the part of the name
+// matched by each * or **.
+func globToCapturingRegex(glob string) string {
+	var sb strings.Builder
+	sb.WriteByte('^')
+	for len(glob) > 0 {
+		idx := strings.IndexByte(glob, '*')
+		if idx == -1 {
+			sb.WriteString(regexp.QuoteMeta(glob))
+			break
+		}
+		sb.WriteString(regexp.QuoteMeta(glob[:idx]))
+		if strings.HasPrefix(glob[idx:], "**") {
+			sb.WriteString("(.+)")
+			glob = glob[idx+2:]
+		} else {
+			sb.WriteString("([^.]+)")
+			glob = glob[idx+1:]
+		}
+	}
+	sb.WriteByte('$')
+	return sb.String()
+}
+
+// NewMappingFromViper creates a new Mapping given a *viper.Viper
+func NewMappingFromViper(v *viper.Viper) (*Mapping, error) {
+	v.SetDefault("match-type", "glob")
+	v.SetDefault("name", "")
+	v.SetDefault("tags", []string{})
+	v.SetDefault("action", "map")
+	return NewMapping(
+		v.GetString("match"),
+		v.GetString("match-type"),
+		v.GetString("name"),
+		v.GetStringSlice("tags"),
+		v.GetString("action"),
+	)
+}
+
+// mappingResult is the result of applying the mappings to a name.
+type mappingResult struct {
+	drop bool
+	name string
+	tags gostatsd.Tags
+}
+
+// apply returns the result of the Mapping for name, or nil if it does not match.
+func (mp *Mapping) apply(name string) *mappingResult {
+	captures := mp.match.FindStringSubmatchIndex(name)
+	if captures == nil {
+		return nil
+	}
+	if mp.drop {
+		return &mappingResult{drop: true}
+	}
+
+	result := &mappingResult{name: name}
+	if mp.name != "" {
+		result.name = string(mp.match.ExpandString(nil, mp.name, name, captures))
+	}
+	for _, tag := range mp.tags {
+		tag = string(mp.match.ExpandString(nil, tag, name, captures))
+		if !strings.HasSuffix(tag, ":") { // Skip tags with an empty value
+			result.tags = append(result.tags, tag)
+		}
+	}
+	return result
+}
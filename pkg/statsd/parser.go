@@ -107,7 +107,23 @@ func (dp *DatagramParser) logBadLineRateLimited(line []byte, ip gostatsd.IP, err
 // handleDatagram handles the contents of a datagram and parsers it in to Metrics (which are returned), or
 // Events (which are sent to the pipeline via DispatchEvent).
 func (dp *DatagramParser) handleDatagram(ctx context.Context, now gostatsd.Nanotime, ip gostatsd.IP, msg []byte) (metrics []*gostatsd.Metric, eventCount uint64, badLineCount uint64) {
-	var numEvents, numBad uint64
+	metrics, events, badLineCount := dp.parseDatagram(now, ip, msg)
+	for _, event := range events {
+		dp.handler.DispatchEvent(ctx, event)
+	}
+	return metrics, uint64(len(events)), badLineCount
+}
+
+// ParseLines parses newline separated lines received from ip other than in a datagram, such as over http.  It
+// returns the Metrics and Events, and the number of lines which failed to parse.  Nothing is dispatched, and the
+// parser's counters of datagram lines are left alone, so the caller counts the lines itself.
+func (dp *DatagramParser) ParseLines(ip gostatsd.IP, msg []byte) ([]*gostatsd.Metric, []*gostatsd.Event, uint64) {
+	return dp.parseDatagram(gostatsd.Nanotime(time.Now().UnixNano()), ip, msg)
+}
+
+// parseDatagram parses the lines of msg in to Metrics and Events, and counts the lines which failed to parse.
+func (dp *DatagramParser) parseDatagram(now gostatsd.Nanotime, ip gostatsd.IP, msg []byte) (metrics []*gostatsd.Metric, events []*gostatsd.Event, badLineCount uint64) {
+	var numBad uint64
 	for {
 		idx := bytes.IndexByte(msg, '\n')
 		var line []byte
@@ -146,21 +162,22 @@ func (dp *DatagramParser) handleDatagram(ctx context.Context, now gostatsd.Nanot
 			} else {
 				metric.SourceIP = ip
 			}
-			metric.Timestamp = now
+			if !metric.ClientTimestamp {
+				metric.Timestamp = now
+			}
 			metrics = append(metrics, metric)
 		} else if event != nil {
-			numEvents++
 			event.SourceIP = ip // Always keep the source ip for events
 			if event.DateHappened == 0 {
 				event.DateHappened = time.Now().Unix()
 			}
-			dp.handler.DispatchEvent(ctx, event)
+			events = append(events, event)
 		} else {
 			// Should never happen.
 			log.Panic("Both event and metric are nil")
 		}
 	}
-	return metrics, numEvents, numBad
+	return metrics, events, numBad
 }
 
 // parseLine with lexer.
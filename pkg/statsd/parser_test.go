@@ -42,6 +42,19 @@ func TestParseEmptyDatagram(t *testing.T) {
 	}
 }
 
+func TestParseLinesLeavesDatagramCounters(t *testing.T) {
+	t.Parallel()
+	mr, ch := newTestParser(false)
+	metrics, events, bad := mr.ParseLines(fakeIP, []byte("a:1|c\n_e{1,1}:a|b\nnot a metric"))
+	assert.Len(t, metrics, 1)
+	assert.Len(t, events, 1)
+	assert.EqualValues(t, 1, bad)
+	assert.Zero(t, mr.metricsReceived)
+	assert.Zero(t, mr.eventsReceived)
+	assert.Zero(t, mr.badLines)
+	assert.Empty(t, ch.metrics, "nothing should be dispatched")
+}
+
 func TestParseDatagram(t *testing.T) {
 	t.Parallel()
 	input := map[string]metricAndEvent{
@@ -55,6 +68,11 @@ func TestParseDatagram(t *testing.T) {
 				{Name: "f", Value: 2, SourceIP: "127.0.0.1", Type: gostatsd.COUNTER, Rate: 1},
 			},
 		},
+		"f:2|c|T100": {
+			metrics: []gostatsd.Metric{
+				{Name: "f", Value: 2, SourceIP: "127.0.0.1", Type: gostatsd.COUNTER, Rate: 1, Timestamp: 100e9, ClientTimestamp: true},
+			},
+		},
 		"f:2|c|#t": {
 			metrics: []gostatsd.Metric{
 				{Name: "f", Value: 2, SourceIP: "127.0.0.1", Type: gostatsd.COUNTER, Rate: 1, Tags: gostatsd.Tags{"t"}},
@@ -96,7 +114,7 @@ func TestParseDatagram(t *testing.T) {
 			ch.DispatchMetrics(context.Background(), metrics)
 			for i, e := range ch.events {
 				if e.DateHappened <= 0 {
-					t.Errorf("%q: DateHappened should be positive", e)
+					t.Errorf("%v: DateHappened should be positive", e)
 				}
 				ch.events[i].DateHappened = 0
 			}
@@ -164,7 +182,7 @@ func TestParseDatagramIgnoreHost(t *testing.T) {
 			metrics, _, _ := mr.handleDatagram(context.Background(), 0, fakeIP, []byte(datagram))
 			for i, e := range ch.events {
 				if e.DateHappened <= 0 {
-					t.Errorf("%q: DateHappened should be positive", e)
+					t.Errorf("%v: DateHappened should be positive", e)
 				}
 				ch.events[i].DateHappened = 0
 			}
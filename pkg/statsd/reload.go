@@ -0,0 +1,294 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/cluster/nodes"
+	"github.com/atlassian/gostatsd/pkg/stats"
+
+	"github.com/ash2k/stager/wait"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tilinna/clock"
+)
+
+// BackendsFactory creates the backends from the configuration, and returns them with any per backend flush intervals,
+// keyed by backend name.  It is used to recreate the backends when the configuration is reloaded.
+type BackendsFactory func(v *viper.Viper) ([]gostatsd.Backend, map[string]time.Duration, error)
+
+// reloader reloads the configuration file when it changes, or when SIGHUP is received, and applies changes to the
+// filters, default tags, percentiles, backends and a static list of cluster nodes to the running server.  Nothing is
+// changed unless the whole configuration is valid.
+type reloader struct {
+	viper         *viper.Viper        // Replaced by a new instance each time the configuration is reloaded
+	interval      time.Duration       // How often to check the configuration file for changes, 0 to only reload on SIGHUP
+	newViper      func() *viper.Viper // Creates the viper the configuration file is read in to, may be nil
+	newBackends   BackendsFactory
+	flushInterval time.Duration
+
+	tagHandler *TagHandler
+	handler    gostatsd.PipelineHandler // Events about reloads are sent here
+	hostname   string
+	ip         gostatsd.IP
+
+	// Only set in forwarder mode, when the cluster is a static list of nodes
+	nodes *nodes.StaticNodeTracker
+
+	// Only set in standalone mode
+	backendHandler *BackendHandler
+	flusher        *MetricFlusher
+	factory        *agrFactory
+	running        *runningBackends
+	backendConfig  map[string]interface{} // Settings the running backends were created from
+}
+
+// Run watches for changes to the configuration until the context is closed.
+func (r *reloader) Run(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	configFile := r.viper.ConfigFileUsed()
+	var tick <-chan time.Time
+	if configFile != "" && r.interval > 0 {
+		ticker := clock.NewTicker(ctx, r.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	modTime := fileModTime(configFile)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			modTime = fileModTime(configFile)
+			r.reloadAndReport(ctx, statser)
+		case <-tick:
+			if m := fileModTime(configFile); !m.Equal(modTime) {
+				modTime = m
+				r.reloadAndReport(ctx, statser)
+			}
+		}
+	}
+}
+
+// fileModTime returns the modification time of a file, or the zero time if it can't be read.
+func fileModTime(path string) time.Time {
+	if path == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reloadAndReport reloads the configuration, and reports the result via a log line, an internal counter and an event.
+func (r *reloader) reloadAndReport(ctx context.Context, statser stats.Statser) {
+	e := &gostatsd.Event{
+		DateHappened: clock.Now(ctx).Unix(),
+		Hostname:     r.hostname,
+		SourceIP:     r.ip,
+		Priority:     gostatsd.PriLow,
+	}
+	if err := r.reload(ctx); err != nil {
+		log.Errorf("Failed to reload configuration: %v", err)
+		statser.Increment("config.reload", gostatsd.Tags{"result:failure"})
+		e.Title = "Gostatsd configuration reload failed"
+		e.Text = err.Error()
+		e.AlertType = gostatsd.AlertError
+	} else {
+		log.Info("Reloaded configuration")
+		statser.Increment("config.reload", gostatsd.Tags{"result:success"})
+		e.Title = "Gostatsd configuration reloaded"
+		e.Text = "Gostatsd configuration reloaded"
+	}
+	r.handler.DispatchEvent(ctx, e)
+}
+
+// readConfig reads the configuration file in to a new viper instance from newViper, so current is left untouched if
+// the file is invalid.  newViper should bind the flags and environment, so they still take precedence over the file.
+// Settings which don't come from the configuration file are also copied from current, as defaults.
+func readConfig(current *viper.Viper, newViper func() *viper.Viper) (*viper.Viper, error) {
+	configFile := current.ConfigFileUsed()
+	if configFile == "" {
+		return current, nil
+	}
+	v := viper.New()
+	if newViper != nil {
+		v = newViper()
+	}
+	for _, key := range current.AllKeys() {
+		if !current.InConfig(key) {
+			v.SetDefault(key, current.Get(key))
+		}
+	}
+	v.SetConfigFile(configFile)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("failed to read configuration: %v", err)
+	}
+	return v, nil
+}
+
+// reload re-reads the configuration file, and applies it if it is valid.
+func (r *reloader) reload(ctx context.Context) error {
+	v, err := readConfig(r.viper, r.newViper)
+	if err != nil {
+		return err
+	}
+
+	if flushInterval := v.GetDuration(ParamFlushInterval); v.IsSet(ParamFlushInterval) && flushInterval != r.flushInterval {
+		log.Warnf("Ignoring the change of %s to %v, which requires a restart", ParamFlushInterval, flushInterval)
+	}
+
+	tags := v.GetStringSlice(ParamDefaultTags)
+	filterNames, filters, err := NewFiltersFromViper(v)
+	if err != nil {
+		return err
+	}
+	if err = r.tagHandler.checkConfigFilterNames(filterNames); err != nil {
+		return err
+	}
+
+	var percentThresholds []float64
+	var backends []gostatsd.Backend
+	var backendFlushIntervals map[string]time.Duration
+	var backendRoutes map[string]*BackendRoute
+	var backendConfig map[string]interface{}
+	reloadBackends := false
+	if r.backendHandler != nil {
+		percentThresholds, err = ParsePercentThresholds(v.GetStringSlice(ParamPercentThreshold))
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", ParamPercentThreshold, err)
+		}
+		backendConfig = backendSettings(v)
+		if r.newBackends != nil && !reflect.DeepEqual(backendConfig, r.backendConfig) {
+			backends, backendFlushIntervals, err = r.newBackends(v)
+			if err != nil {
+				return err
+			}
+			if err = validateBackendFlushIntervals(r.flushInterval, backendFlushIntervals); err != nil {
+				return err
+			}
+			if backendRoutes, err = NewBackendRoutesFromViper(v, backends); err != nil {
+				return err
+			}
+			backends = guardBackends(v, backends, r.flushInterval, backendFlushIntervals)
+			if backends, err = spoolBackends(v, backends, r.flushInterval, backendFlushIntervals, r.factory); err != nil {
+				return err
+			}
+			reloadBackends = true
+		}
+	}
+
+	// Everything else is valid, so apply it.  SetNodes changes nothing if the nodes are invalid, so it goes first.
+	if r.nodes != nil {
+		if err = r.nodes.SetNodes(getSubViper(v, "cluster").GetStringSlice("nodes")); err != nil {
+			return fmt.Errorf("invalid cluster.nodes: %v", err)
+		}
+	}
+	r.viper = v
+	r.tagHandler.SetTagsAndFilters(tags, filterNames, filters)
+	if r.backendHandler == nil {
+		return nil
+	}
+
+	r.factory.setPercentThresholds(percentThresholds)
+	r.backendHandler.Process(ctx, func(aggrId int, aggr Aggregator) {
+		aggr.SetPercentThresholds(percentThresholds)
+	})()
+	r.flusher.SetPercentThresholds(percentThresholds)
+
+	if reloadBackends {
+		stopOld := r.running.replace(backends)
+		r.backendHandler.SetBackends(backends)
+		r.flusher.SetBackends(ctx, backends, backendFlushIntervals, backendRoutes, r.factory)
+		r.backendHandler.WaitForEvents()
+		stopOld()
+		r.backendConfig = backendConfig
+		log.Infof("Reloaded backends %v", v.GetStringSlice(ParamBackends))
+	}
+	return nil
+}
+
+// backendSettings returns the settings the backends are created from, including the settings of their guards and
+// spools, so changes can be detected.
+func backendSettings(v *viper.Viper) map[string]interface{} {
+	backendNames := v.GetStringSlice(ParamBackends)
+	settings := map[string]interface{}{
+		ParamBackends: backendNames,
+	}
+	for _, key := range []string{ParamBackendBreakerFailures, ParamBackendBreakerCooldown, ParamSpoolDir, ParamSpoolMaxSize, ParamSpoolMaxAge} {
+		settings[key] = v.Get(key)
+	}
+	for _, backendName := range backendNames {
+		settings[backendName] = v.Get(backendName)
+	}
+	return settings
+}
+
+// runningBackends runs the backends which are Runners, and stops them once they have been replaced.
+type runningBackends struct {
+	wg wait.Group
+
+	mu       sync.Mutex
+	ctx      context.Context
+	backends []gostatsd.Backend
+	cancels  []context.CancelFunc
+}
+
+func newRunningBackends(backends []gostatsd.Backend) *runningBackends {
+	return &runningBackends{
+		backends: backends,
+	}
+}
+
+// Run runs the backends until the context is closed.
+func (rb *runningBackends) Run(ctx context.Context) {
+	rb.mu.Lock()
+	rb.ctx = ctx
+	rb.cancels = rb.start(rb.backends)
+	rb.mu.Unlock()
+
+	<-ctx.Done()
+	rb.wg.Wait()
+}
+
+// start must be called with rb.mu held.
+func (rb *runningBackends) start(backends []gostatsd.Backend) []context.CancelFunc {
+	var cancels []context.CancelFunc
+	for _, backend := range backends {
+		if r, ok := backend.(gostatsd.Runner); ok {
+			ctx, cancel := context.WithCancel(rb.ctx)
+			cancels = append(cancels, cancel)
+			rb.wg.StartWithContext(ctx, r.Run)
+		}
+	}
+	return cancels
+}
+
+// replace starts the new backends, and returns a function which stops the backends they replace.
+func (rb *runningBackends) replace(backends []gostatsd.Backend) func() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	oldCancels := rb.cancels
+	rb.backends = backends
+	rb.cancels = rb.start(backends)
+	return func() {
+		for _, cancel := range oldCancels {
+			cancel()
+		}
+	}
+}
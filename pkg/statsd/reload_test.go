@@ -0,0 +1,369 @@
+package statsd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/cluster/nodes"
+	"github.com/atlassian/gostatsd/pkg/stats"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilinna/clock"
+)
+
+type runnerBackend struct {
+	name    string
+	started chan struct{}
+	stopped chan struct{}
+
+	mu   sync.Mutex
+	maps int
+}
+
+func newRunnerBackend(name string) *runnerBackend {
+	return &runnerBackend{
+		name:    name,
+		started: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+func (rb *runnerBackend) Run(ctx context.Context) {
+	close(rb.started)
+	<-ctx.Done()
+	close(rb.stopped)
+}
+
+func (rb *runnerBackend) Name() string {
+	return rb.name
+}
+
+func (rb *runnerBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, intervalStart time.Time, callback gostatsd.SendCallback) {
+	rb.mu.Lock()
+	rb.maps++
+	rb.mu.Unlock()
+	callback(nil)
+}
+
+func (rb *runnerBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+type incrementCapturingStatser struct {
+	stats.NullStatser
+	increments []string
+	tags       []gostatsd.Tags
+}
+
+func (ics *incrementCapturingStatser) Increment(name string, tags gostatsd.Tags) {
+	ics.increments = append(ics.increments, name)
+	ics.tags = append(ics.tags, tags)
+}
+
+// unguarded returns the backends wrapped by backendGuards.
+func unguarded(backends []gostatsd.Backend) []gostatsd.Backend {
+	var result []gostatsd.Backend
+	for _, backend := range backends {
+		switch bg := backend.(type) {
+		case *backendGuard:
+			result = append(result, bg.backend)
+		case *runnerBackendGuard:
+			result = append(result, bg.backend)
+		default:
+			result = append(result, backend)
+		}
+	}
+	return result
+}
+
+func writeConfig(t *testing.T, path, config string) {
+	require.NoError(t, ioutil.WriteFile(path, []byte(config), 0600))
+}
+
+func newTestReloader(t *testing.T, config string) (*reloader, func()) {
+	dir, err := ioutil.TempDir("", "reload")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "config.toml")
+	writeConfig(t, path, config)
+
+	v := viper.New()
+	v.SetConfigFile(path)
+	require.NoError(t, v.ReadInConfig())
+	th, err := NewTagHandlerFromViper(v, &nopHandler{}, v.GetStringSlice(ParamDefaultTags))
+	require.NoError(t, err)
+
+	return &reloader{
+		viper:      v,
+		tagHandler: th,
+		handler:    &countingHandler{},
+	}, func() { os.RemoveAll(dir) }
+}
+
+func TestReloadFiltersAndTags(t *testing.T) {
+	t.Parallel()
+	r, cleanup := newTestReloader(t, `
+default-tags='env:dev'
+filters='drop-a'
+
+[filter.drop-a]
+match-metrics='a.*'
+drop-metric=true
+`)
+	defer cleanup()
+	require.Len(t, r.tagHandler.filters, 1)
+
+	writeConfig(t, r.viper.ConfigFileUsed(), `
+default-tags='env:prod team:x'
+filters='drop-b keep-c'
+
+[filter.drop-b]
+match-metrics='b.*'
+drop-metric=true
+
+[filter.keep-c]
+match-metrics='c.*'
+keep-only-tags='team:*'
+`)
+	require.NoError(t, r.reload(context.Background()))
+	assert.Equal(t, gostatsd.Tags{"env:prod", "team:x"}, r.tagHandler.tags)
+	require.Len(t, r.tagHandler.filters, 2)
+	assert.Equal(t, stringMatchList("b.*"), r.tagHandler.filters[0].MatchMetrics)
+
+	writeConfig(t, r.viper.ConfigFileUsed(), `
+default-tags='env:broken'
+filters='bad'
+
+[filter.bad]
+match-metrics='~('
+`)
+	v := r.viper
+	assert.Error(t, r.reload(context.Background()))
+	assert.Equal(t, gostatsd.Tags{"env:prod", "team:x"}, r.tagHandler.tags)
+	assert.Len(t, r.tagHandler.filters, 2)
+	assert.True(t, v == r.viper)
+	assert.Equal(t, []string{"env:prod", "team:x"}, r.viper.GetStringSlice(ParamDefaultTags), "invalid configuration is not read in")
+}
+
+func TestReloadKeepsSettingsNotFromFile(t *testing.T) {
+	t.Parallel()
+	r, cleanup := newTestReloader(t, `default-tags='env:dev'`)
+	defer cleanup()
+	r.viper.SetDefault(ParamPercentThreshold, "90")
+	r.viper.Set(ParamMaxWorkers, 4)
+
+	writeConfig(t, r.viper.ConfigFileUsed(), `default-tags='env:prod'`)
+	require.NoError(t, r.reload(context.Background()))
+	assert.Equal(t, []string{"env:prod"}, r.viper.GetStringSlice(ParamDefaultTags))
+	assert.Equal(t, "90", r.viper.GetString(ParamPercentThreshold))
+	assert.Equal(t, 4, r.viper.GetInt(ParamMaxWorkers))
+}
+
+func TestReloadKeepsFlagPrecedence(t *testing.T) {
+	t.Parallel()
+	r, cleanup := newTestReloader(t, `max-workers=2`)
+	defer cleanup()
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	fs.Int(ParamMaxWorkers, 1, "")
+	require.NoError(t, fs.Parse([]string{"--" + ParamMaxWorkers + "=8"}))
+	r.newViper = func() *viper.Viper {
+		v := viper.New()
+		require.NoError(t, v.BindPFlags(fs))
+		return v
+	}
+
+	writeConfig(t, r.viper.ConfigFileUsed(), `max-workers=3`)
+	require.NoError(t, r.reload(context.Background()))
+	assert.Equal(t, 8, r.viper.GetInt(ParamMaxWorkers), "a flag should take precedence over the reloaded file")
+}
+
+func TestReloadClusterNodes(t *testing.T) {
+	t.Parallel()
+	r, cleanup := newTestReloader(t, `
+[cluster]
+type='static'
+nodes=['10.0.0.1:8080']
+`)
+	defer cleanup()
+	snt, err := nodes.NewStaticNodeTracker(getSubViper(r.viper, "cluster").GetStringSlice("nodes"))
+	require.NoError(t, err)
+	r.nodes = snt
+
+	writeConfig(t, r.viper.ConfigFileUsed(), `
+default-tags='env:prod'
+[cluster]
+type='static'
+nodes=['10.0.0.1:8080', '10.0.0.2:8080=2']
+`)
+	require.NoError(t, r.reload(context.Background()))
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080"}, snt.List())
+
+	writeConfig(t, r.viper.ConfigFileUsed(), `
+default-tags='env:broken'
+[cluster]
+type='static'
+nodes=['10.0.0.3:8080=-1']
+`)
+	assert.Error(t, r.reload(context.Background()))
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080"}, snt.List())
+	assert.Equal(t, gostatsd.Tags{"env:prod"}, r.tagHandler.tags)
+}
+
+func TestReloadReports(t *testing.T) {
+	t.Parallel()
+	r, cleanup := newTestReloader(t, `filters=''`)
+	defer cleanup()
+	statser := &incrementCapturingStatser{}
+	handler := r.handler.(*countingHandler)
+
+	r.reloadAndReport(context.Background(), statser)
+
+	writeConfig(t, r.viper.ConfigFileUsed(), `filters='missing`)
+	r.reloadAndReport(context.Background(), statser)
+
+	assert.Equal(t, []string{"config.reload", "config.reload"}, statser.increments)
+	assert.Equal(t, []gostatsd.Tags{{"result:success"}, {"result:failure"}}, statser.tags)
+	require.Len(t, handler.events, 2)
+	assert.Equal(t, "Gostatsd configuration reloaded", handler.events[0].Title)
+	assert.Equal(t, gostatsd.AlertInfo, handler.events[0].AlertType)
+	assert.Equal(t, "Gostatsd configuration reload failed", handler.events[1].Title)
+	assert.Equal(t, gostatsd.AlertError, handler.events[1].AlertType)
+	assert.Contains(t, handler.events[1].Text, "failed to read configuration")
+}
+
+func TestReloadBackendsAndPercentiles(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	oldBackend := newRunnerBackend("old")
+	newBackend := newRunnerBackend("new")
+	factory := &agrFactory{percentThresholds: []float64{90}, flushInterval: time.Second}
+	bh := NewBackendHandler([]gostatsd.Backend{oldBackend}, 1, 2, 1, factory)
+	go bh.Run(ctx)
+	flusher := NewMetricFlusher(time.Second, false, bh, []gostatsd.Backend{oldBackend}, map[string]time.Duration{"old": 10 * time.Second}, nil, factory, nil)
+	running := newRunningBackends([]gostatsd.Backend{oldBackend})
+	go running.Run(ctx)
+	<-oldBackend.started
+
+	// Something waiting to be rolled up for the old backend
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "c", Type: gostatsd.COUNTER, Value: 1, Rate: 1})
+	flusher.rollups[0].receive(mm, time.Unix(1, 0))
+
+	v := viper.New()
+	v.Set(ParamBackends, "old")
+	factoryCalls := 0
+	r := &reloader{
+		viper: v,
+		newBackends: func(v *viper.Viper) ([]gostatsd.Backend, map[string]time.Duration, error) {
+			factoryCalls++
+			return []gostatsd.Backend{newBackend}, nil, nil
+		},
+		flushInterval:  time.Second,
+		tagHandler:     NewTagHandler(&nopHandler{}, nil, nil),
+		handler:        &nopHandler{},
+		backendHandler: bh,
+		flusher:        flusher,
+		factory:        factory,
+		running:        running,
+		backendConfig:  backendSettings(v),
+	}
+
+	// Percentiles change, backends don't
+	v.Set(ParamPercentThreshold, "50 99")
+	require.NoError(t, r.reload(ctx))
+	assert.Zero(t, factoryCalls)
+	assert.Equal(t, []float64{50, 99}, factory.percentThresholds)
+	bh.Process(ctx, func(aggrId int, aggr Aggregator) {
+		pcts := aggr.(*MetricAggregator).percentThresholds
+		assert.Len(t, pcts, 2)
+		assert.Contains(t, pcts, 50.0)
+		assert.Contains(t, pcts, 99.0)
+	})()
+
+	// Backends change
+	v.Set(ParamBackends, "new")
+	require.NoError(t, r.reload(ctx))
+	assert.Equal(t, 1, factoryCalls)
+	assert.Equal(t, []gostatsd.Backend{newBackend}, unguarded(bh.backends))
+	assert.Equal(t, []gostatsd.Backend{newBackend}, unguarded(flusher.backends))
+	assert.Empty(t, flusher.rollups)
+	assert.Equal(t, 1, oldBackend.maps) // Rollup was flushed early
+	<-newBackend.started
+	<-oldBackend.stopped
+
+	// Nothing changes
+	require.NoError(t, r.reload(ctx))
+	assert.Equal(t, 1, factoryCalls)
+
+	// A guard setting changes, so the backends are recreated with it
+	guardedBackend := newRunnerBackend("new")
+	r.newBackends = func(v *viper.Viper) ([]gostatsd.Backend, map[string]time.Duration, error) {
+		factoryCalls++
+		return []gostatsd.Backend{guardedBackend}, nil, nil
+	}
+	v.Set(ParamBackendBreakerFailures, 3)
+	require.NoError(t, r.reload(ctx))
+	assert.Equal(t, 2, factoryCalls)
+	assert.Equal(t, []gostatsd.Backend{guardedBackend}, unguarded(bh.backends))
+	<-guardedBackend.started
+	<-newBackend.stopped
+
+	// Invalid flush interval
+	r.newBackends = func(v *viper.Viper) ([]gostatsd.Backend, map[string]time.Duration, error) {
+		return []gostatsd.Backend{oldBackend}, map[string]time.Duration{"old": 1500 * time.Millisecond}, nil
+	}
+	v.Set(ParamBackends, "old")
+	assert.Error(t, r.reload(ctx))
+	assert.Equal(t, []gostatsd.Backend{guardedBackend}, unguarded(bh.backends))
+}
+
+func TestReloaderWatchesConfigFile(t *testing.T) {
+	t.Parallel()
+	r, cleanup := newTestReloader(t, `filters=''`)
+	defer cleanup()
+	r.interval = time.Second
+	handler := r.handler.(*countingHandler)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mockClock := clock.NewMock(time.Unix(1, 0))
+	ctx = clock.Context(ctx, mockClock)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.Run(ctx)
+	}()
+
+	path := r.viper.ConfigFileUsed()
+	writeConfig(t, path, `default-tags='reloaded:true'`)
+
+	for i := 0; i < 1000; i++ {
+		// Keep changing the modification time, as Run may not have seen the original one yet
+		later := time.Now().Add(time.Duration(i+1) * time.Minute)
+		require.NoError(t, os.Chtimes(path, later, later))
+		mockClock.Add(time.Second)
+		handler.mu.Lock()
+		n := len(handler.events)
+		handler.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	require.NotEmpty(t, handler.events)
+	assert.Equal(t, "Gostatsd configuration reloaded", handler.events[0].Title)
+	assert.Equal(t, gostatsd.Tags{"reloaded:true"}, r.tagHandler.tags)
+}
@@ -0,0 +1,372 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/ash2k/stager/wait"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tilinna/clock"
+	"golang.org/x/time/rate"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+const (
+	defaultRepeaterNetwork       = "udp"
+	defaultRepeaterQueueSize     = 1000
+	defaultRepeaterMaxPacketSize = 1432
+	defaultRepeaterSampleRate    = 1.0
+	repeaterDialTimeout          = 1 * time.Second
+	repeaterWriteTimeout         = 1 * time.Second
+	repeaterRedialInterval       = 1 * time.Second
+)
+
+// DatagramRepeater passes datagrams from the receiver to the parser, sending a copy of their lines to other statsd
+// servers on the way.  Repeating never blocks the pipeline, lines which don't fit in a destination's queue are
+// dropped.  Lines received by the http servers are parsed without passing through it, so they aren't repeated.
+type DatagramRepeater struct {
+	destinations []*RepeaterDestination
+	workers      int
+
+	in  <-chan []*Datagram // Input chan of datagram batches from the receiver
+	out chan<- []*Datagram // Output chan of datagram batches to the parser
+}
+
+// RepeaterDestination is a statsd server which raw lines are repeated to.
+type RepeaterDestination struct {
+	linesSent     uint64 // atomic - lines written to the destination
+	linesOverflow uint64 // atomic - lines dropped because the queue was full
+	linesFailed   uint64 // atomic - lines dropped because they couldn't be written
+
+	name          string
+	network       string
+	address       string
+	route         *BackendRoute // Selects the lines which are repeated, nil to repeat every line
+	sampleRate    float64
+	maxPacketSize int
+	random        func() float64
+	queue         chan repeatedLines
+	logger        logrus.FieldLogger
+	errorLimiter  *rate.Limiter
+}
+
+// repeatedLines is a copy of the newline terminated lines of a datagram which are repeated to a destination.
+type repeatedLines struct {
+	buf   []byte
+	lines uint64
+}
+
+// NewDatagramRepeaterFromViper creates a DatagramRepeater for the repeaters named in the repeaters setting, each
+// configured by its repeater.<name> section.  Returns nil if there are no repeaters.
+func NewDatagramRepeaterFromViper(v *viper.Viper, logger logrus.FieldLogger, in <-chan []*Datagram, out chan<- []*Datagram, workers int) (*DatagramRepeater, error) {
+	names := v.GetStringSlice("repeaters")
+	if len(names) == 0 {
+		return nil, nil
+	}
+	destinations := make([]*RepeaterDestination, 0, len(names))
+	for _, name := range names {
+		destination, err := NewRepeaterDestinationFromViper(getSubViper(v, "repeater."+name), logger, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to make repeater %s: %v", name, err)
+		}
+		destinations = append(destinations, destination)
+	}
+	return NewDatagramRepeater(in, out, workers, destinations), nil
+}
+
+// NewDatagramRepeater creates a DatagramRepeater which passes datagrams from in to out on workers goroutines,
+// repeating their lines to destinations.
+func NewDatagramRepeater(in <-chan []*Datagram, out chan<- []*Datagram, workers int, destinations []*RepeaterDestination) *DatagramRepeater {
+	if workers < 1 {
+		workers = 1
+	}
+	return &DatagramRepeater{
+		destinations: destinations,
+		workers:      workers,
+		in:           in,
+		out:          out,
+	}
+}
+
+// NewRepeaterDestinationFromViper creates a RepeaterDestination given the *viper.Viper for its section.
+func NewRepeaterDestinationFromViper(v *viper.Viper, logger logrus.FieldLogger, name string) (*RepeaterDestination, error) {
+	v.SetDefault("network", defaultRepeaterNetwork)
+	v.SetDefault("queue-size", defaultRepeaterQueueSize)
+	v.SetDefault("max-packet-size", defaultRepeaterMaxPacketSize)
+	v.SetDefault("sample-rate", defaultRepeaterSampleRate)
+
+	var route *BackendRoute
+	matchMetrics, err := toStringMatch(v.GetStringSlice("match-metrics"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid match-metrics: %v", err)
+	}
+	excludeMetrics, err := toStringMatch(v.GetStringSlice("exclude-metrics"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid exclude-metrics: %v", err)
+	}
+	if len(matchMetrics) > 0 || len(excludeMetrics) > 0 {
+		route = &BackendRoute{MatchMetrics: matchMetrics, ExcludeMetrics: excludeMetrics}
+	}
+
+	return NewRepeaterDestination(
+		logger,
+		name,
+		v.GetString("network"),
+		v.GetString("address"),
+		route,
+		v.GetFloat64("sample-rate"),
+		v.GetInt("queue-size"),
+		v.GetInt("max-packet-size"),
+	)
+}
+
+// NewRepeaterDestination creates a RepeaterDestination which writes lines selected by route to address over network,
+// which is udp or tcp.  Only a sampleRate fraction of lines are repeated, and up to queueSize datagrams are queued.
+// Lines sent over udp are packed in to packets of up to maxPacketSize bytes.
+func NewRepeaterDestination(logger logrus.FieldLogger, name, network, address string, route *BackendRoute, sampleRate float64, queueSize, maxPacketSize int) (*RepeaterDestination, error) {
+	switch network {
+	case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("network must be udp or tcp, not %q", network)
+	}
+	if address == "" {
+		return nil, fmt.Errorf("address is required")
+	}
+	if sampleRate <= 0 || sampleRate > 1 {
+		return nil, fmt.Errorf("sample-rate must be greater than 0 and at most 1")
+	}
+	if queueSize <= 0 {
+		return nil, fmt.Errorf("queue-size must be positive")
+	}
+	if maxPacketSize <= 0 {
+		return nil, fmt.Errorf("max-packet-size must be positive")
+	}
+
+	logger = logger.WithField("repeater", name)
+	logger.WithFields(logrus.Fields{
+		"network":         network,
+		"address":         address,
+		"filtered":        route != nil,
+		"sample-rate":     sampleRate,
+		"queue-size":      queueSize,
+		"max-packet-size": maxPacketSize,
+	}).Info("created repeater")
+
+	return &RepeaterDestination{
+		name:          name,
+		network:       network,
+		address:       address,
+		route:         route,
+		sampleRate:    sampleRate,
+		maxPacketSize: maxPacketSize,
+		random:        rand.Float64,
+		queue:         make(chan repeatedLines, queueSize),
+		logger:        logger,
+		errorLimiter:  rate.NewLimiter(rate.Every(10*time.Second), 1),
+	}, nil
+}
+
+// Run passes datagrams to the parser and writes repeated lines to each destination until the Context is closed.
+func (dr *DatagramRepeater) Run(ctx context.Context) {
+	var wg wait.Group
+	defer wg.Wait()
+	for _, destination := range dr.destinations {
+		wg.StartWithContext(ctx, destination.run)
+	}
+	for i := 0; i < dr.workers; i++ {
+		wg.StartWithContext(ctx, dr.pass)
+	}
+}
+
+// RunMetrics emits the number of lines sent and dropped by each destination every flush.
+func (dr *DatagramRepeater) RunMetrics(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			for _, destination := range dr.destinations {
+				destination.emitMetrics(statser)
+			}
+		}
+	}
+}
+
+func (rd *RepeaterDestination) emitMetrics(statser stats.Statser) {
+	linesSent := atomic.SwapUint64(&rd.linesSent, 0)
+	linesOverflow := atomic.SwapUint64(&rd.linesOverflow, 0)
+	linesFailed := atomic.SwapUint64(&rd.linesFailed, 0)
+
+	tags := gostatsd.Tags{"repeater:" + rd.name}
+	statser.Count("repeater.lines", float64(linesSent), append(tags, "result:success"))
+	statser.Count("repeater.lines", float64(linesOverflow), append(tags, "result:failure", "failure:overflow"))
+	statser.Count("repeater.lines", float64(linesFailed), append(tags, "result:failure", "failure:send"))
+	statser.Gauge("repeater.queued", float64(len(rd.queue)), tags)
+}
+
+// pass offers the lines of each datagram to every destination before passing it on to the parser, which may free
+// its buffer.
+func (dr *DatagramRepeater) pass(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case dgs := <-dr.in:
+			for _, dg := range dgs {
+				for _, destination := range dr.destinations {
+					destination.offer(dg.Msg)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				for _, dg := range dgs {
+					dg.DoneFunc()
+				}
+				return
+			case dr.out <- dgs:
+			}
+		}
+	}
+}
+
+// offer queues a copy of the lines of msg selected by the destination, dropping them if the queue is full.
+func (rd *RepeaterDestination) offer(msg []byte) {
+	var buf []byte
+	var lines uint64
+	for len(msg) > 0 {
+		line := msg
+		if idx := bytes.IndexByte(msg, '\n'); idx >= 0 {
+			line, msg = msg[:idx], msg[idx+1:]
+		} else {
+			msg = nil
+		}
+		if len(line) == 0 || !rd.accepts(line) || (rd.sampleRate < 1 && rd.random() >= rd.sampleRate) {
+			continue
+		}
+		if buf == nil {
+			buf = make([]byte, 0, len(line)+1+len(msg))
+		}
+		buf = append(append(buf, line...), '\n')
+		lines++
+	}
+	if lines == 0 {
+		return
+	}
+
+	select {
+	case rd.queue <- repeatedLines{buf: buf, lines: lines}:
+	default:
+		atomic.AddUint64(&rd.linesOverflow, lines)
+	}
+}
+
+// accepts returns true if a line is selected by the destination's route.  Metrics are selected by name, and events
+// and service checks are only repeated if the route doesn't require a name to match.
+func (rd *RepeaterDestination) accepts(line []byte) bool {
+	if rd.route == nil {
+		return true
+	}
+	if bytes.HasPrefix(line, []byte("_e{")) || bytes.HasPrefix(line, []byte("_sc|")) {
+		return len(rd.route.MatchMetrics) == 0
+	}
+	name := line
+	if idx := bytes.IndexByte(line, ':'); idx >= 0 {
+		name = line[:idx]
+	}
+	return rd.route.acceptsName(string(name))
+}
+
+// run writes queued lines to the destination, reconnecting after a failure.  Lines which can't be written, including
+// those dequeued while waiting to reconnect after a failed connection, are dropped and counted as failed.
+func (rd *RepeaterDestination) run(ctx context.Context) {
+	var conn net.Conn
+	var redialAt time.Time
+	defer func() {
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case rl := <-rd.queue:
+			if conn == nil {
+				if clock.Now(ctx).Before(redialAt) {
+					// Dropped without trying to connect until the redial interval has passed
+					atomic.AddUint64(&rd.linesFailed, rl.lines)
+					continue
+				}
+				var err error
+				if conn, err = net.DialTimeout(rd.network, rd.address, repeaterDialTimeout); err != nil {
+					conn = nil
+					redialAt = clock.Now(ctx).Add(repeaterRedialInterval)
+					atomic.AddUint64(&rd.linesFailed, rl.lines)
+					rd.logError(err, "failed to connect")
+					continue
+				}
+			}
+			if err := rd.write(conn, rl.buf); err != nil {
+				_ = conn.Close()
+				conn = nil
+				atomic.AddUint64(&rd.linesFailed, rl.lines)
+				rd.logError(err, "failed to write")
+				continue
+			}
+			atomic.AddUint64(&rd.linesSent, rl.lines)
+		}
+	}
+}
+
+func (rd *RepeaterDestination) write(conn net.Conn, buf []byte) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(repeaterWriteTimeout)); err != nil {
+		return err
+	}
+	if _, ok := conn.(*net.UDPConn); !ok {
+		_, err := conn.Write(buf)
+		return err
+	}
+	for _, packet := range splitPackets(buf, rd.maxPacketSize) {
+		if _, err := conn.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rd *RepeaterDestination) logError(err error, msg string) {
+	if rd.errorLimiter.Allow() {
+		rd.logger.WithError(err).Warn(msg)
+	}
+}
+
+// splitPackets splits newline terminated lines in to packets of at most maxSize bytes, without splitting a line.  A
+// line longer than maxSize is sent in a packet of its own.
+func splitPackets(buf []byte, maxSize int) [][]byte {
+	var packets [][]byte
+	for len(buf) > 0 {
+		end := len(buf)
+		if end > maxSize+1 { // The newline after the last line in a packet isn't sent
+			end = bytes.LastIndexByte(buf[:maxSize+1], '\n') + 1
+			if end == 0 {
+				end = bytes.IndexByte(buf, '\n') + 1
+			}
+		}
+		packets = append(packets, buf[:end-1])
+		buf = buf[end:]
+	}
+	return packets
+}
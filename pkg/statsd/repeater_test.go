@@ -0,0 +1,221 @@
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilinna/clock"
+)
+
+func newTestRepeaterDestination(t *testing.T, network, address string, route *BackendRoute, queueSize int) *RepeaterDestination {
+	rd, err := NewRepeaterDestination(logrus.StandardLogger(), t.Name(), network, address, route, 1, queueSize, defaultRepeaterMaxPacketSize)
+	require.NoError(t, err)
+	return rd
+}
+
+func TestSplitPackets(t *testing.T) {
+	t.Parallel()
+	assert.Nil(t, splitPackets(nil, 10))
+	assert.Equal(t, [][]byte{[]byte("a:1|c")}, splitPackets([]byte("a:1|c\n"), 10))
+	assert.Equal(t, [][]byte{[]byte("a:1|c\nb:1|c")}, splitPackets([]byte("a:1|c\nb:1|c\n"), 11))
+	assert.Equal(t, [][]byte{[]byte("a:1|c"), []byte("b:1|c")}, splitPackets([]byte("a:1|c\nb:1|c\n"), 10))
+	assert.Equal(t,
+		[][]byte{[]byte("a"), []byte("long.metric:1|c"), []byte("b")},
+		splitPackets([]byte("a\nlong.metric:1|c\nb\n"), 5),
+		"a line longer than the maximum should be sent alone")
+}
+
+func TestRepeaterDestinationFilter(t *testing.T) {
+	t.Parallel()
+	match, err := toStringMatch([]string{"web.*"})
+	require.NoError(t, err)
+	exclude, err := toStringMatch([]string{"web.debug*"})
+	require.NoError(t, err)
+
+	rd := newTestRepeaterDestination(t, "udp", "127.0.0.1:8125", &BackendRoute{MatchMetrics: match, ExcludeMetrics: exclude}, 10)
+	rd.offer([]byte("web.requests:1|c\ndb.queries:1|c\nweb.debug.x:1|c\n\n_e{1,1}:a|b\nweb.latency:10|ms|#x:y"))
+	require.Len(t, rd.queue, 1)
+	rl := <-rd.queue
+	assert.Equal(t, "web.requests:1|c\nweb.latency:10|ms|#x:y\n", string(rl.buf))
+	assert.EqualValues(t, 2, rl.lines)
+
+	rd = newTestRepeaterDestination(t, "udp", "127.0.0.1:8125", &BackendRoute{ExcludeMetrics: exclude}, 10)
+	rd.offer([]byte("_e{1,1}:a|b\n_sc|check|0\nweb.debug.x:1|c"))
+	rl = <-rd.queue
+	assert.Equal(t, "_e{1,1}:a|b\n_sc|check|0\n", string(rl.buf), "events and service checks are only dropped by match-metrics")
+}
+
+func TestRepeaterDestinationSampling(t *testing.T) {
+	t.Parallel()
+	rd, err := NewRepeaterDestination(logrus.StandardLogger(), t.Name(), "udp", "127.0.0.1:8125", nil, 0.5, 10, defaultRepeaterMaxPacketSize)
+	require.NoError(t, err)
+	samples := []float64{0.1, 0.7, 0.4, 0.5}
+	rd.random = func() float64 {
+		sample := samples[0]
+		samples = samples[1:]
+		return sample
+	}
+	rd.offer([]byte("a:1|c\nb:1|c\nc:1|c\nd:1|c"))
+	rl := <-rd.queue
+	assert.Equal(t, "a:1|c\nc:1|c\n", string(rl.buf))
+}
+
+func TestRepeaterDestinationOverflow(t *testing.T) {
+	t.Parallel()
+	rd := newTestRepeaterDestination(t, "udp", "127.0.0.1:8125", nil, 1)
+	rd.offer([]byte("a:1|c\nb:1|c"))
+	rd.offer([]byte("c:1|c\nd:1|c\ne:1|c"))
+	assert.Len(t, rd.queue, 1)
+	assert.EqualValues(t, 3, atomic.LoadUint64(&rd.linesOverflow))
+}
+
+func TestDatagramRepeaterUDP(t *testing.T) {
+	t.Parallel()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	in := make(chan []*Datagram)
+	out := make(chan []*Datagram)
+	rd := newTestRepeaterDestination(t, "udp", conn.LocalAddr().String(), nil, 10)
+	dr := NewDatagramRepeater(in, out, 1, []*RepeaterDestination{rd})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dr.Run(ctx)
+
+	var done uint32
+	msg := []byte("a:1|c\nb:2|g")
+	in <- []*Datagram{{Msg: msg, DoneFunc: func() { atomic.StoreUint32(&done, 1) }}}
+	dgs := <-out
+	require.Len(t, dgs, 1)
+	assert.Equal(t, msg, dgs[0].Msg, "datagrams should be passed to the parser unchanged")
+	assert.Zero(t, atomic.LoadUint32(&done), "the parser frees datagrams")
+
+	buf := make([]byte, 1024)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "a:1|c\nb:2|g", string(buf[:n]))
+	for atomic.LoadUint64(&rd.linesSent) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.EqualValues(t, 2, atomic.LoadUint64(&rd.linesSent))
+}
+
+func TestDatagramRepeaterTCP(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	in := make(chan []*Datagram)
+	out := make(chan []*Datagram, 2)
+	rd := newTestRepeaterDestination(t, "tcp", l.Addr().String(), nil, 10)
+	dr := NewDatagramRepeater(in, out, 1, []*RepeaterDestination{rd})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dr.Run(ctx)
+
+	in <- []*Datagram{{Msg: []byte("a:1|c")}, {Msg: []byte("b:2|g\n")}}
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	reader := bufio.NewReader(conn)
+	for _, expected := range []string{"a:1|c\n", "b:2|g\n"} {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, expected, line)
+	}
+}
+
+func TestRepeaterDestinationRedial(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := l.Addr().String()
+	require.NoError(t, l.Close()) // Nothing is listening, so connecting fails
+
+	rd := newTestRepeaterDestination(t, "tcp", address, nil, 10)
+	mockClock := clock.NewMock(time.Unix(0, 0))
+	ctx, cancel := context.WithCancel(clock.Context(context.Background(), mockClock))
+	defer cancel()
+	go rd.run(ctx)
+
+	waitForFailed := func(expected uint64) {
+		for i := 0; i < 5000 && atomic.LoadUint64(&rd.linesFailed) < expected; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		require.EqualValues(t, expected, atomic.LoadUint64(&rd.linesFailed))
+	}
+
+	rd.offer([]byte("a:1|c\nb:1|c"))
+	waitForFailed(2)
+	rd.offer([]byte("c:1|c"))
+	waitForFailed(3) // Within the redial interval, so dropped without connecting
+
+	l, err = net.Listen("tcp", address)
+	if err != nil {
+		t.Skipf("can't listen on %s again: %v", address, err)
+	}
+	defer l.Close()
+	mockClock.Add(repeaterRedialInterval)
+	rd.offer([]byte("d:1|c"))
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "d:1|c\n", line, "lines should be sent once the redial interval has passed")
+	assert.EqualValues(t, 3, atomic.LoadUint64(&rd.linesFailed))
+}
+
+func TestNewDatagramRepeaterFromViper(t *testing.T) {
+	t.Parallel()
+	dr, err := NewDatagramRepeaterFromViper(viper.New(), logrus.StandardLogger(), nil, nil, 1)
+	require.NoError(t, err)
+	assert.Nil(t, dr, "no repeaters are configured")
+
+	v := viper.New()
+	v.Set("repeaters", []string{"canary"})
+	v.Set("repeater.canary.address", "127.0.0.1:8125")
+	v.Set("repeater.canary.match-metrics", []string{"web.*"})
+	dr, err = NewDatagramRepeaterFromViper(v, logrus.StandardLogger(), nil, nil, 1)
+	require.NoError(t, err)
+	require.Len(t, dr.destinations, 1)
+	rd := dr.destinations[0]
+	assert.Equal(t, "udp", rd.network)
+	assert.Equal(t, 1.0, rd.sampleRate)
+	assert.Equal(t, defaultRepeaterQueueSize, cap(rd.queue))
+	require.NotNil(t, rd.route)
+	assert.True(t, rd.route.acceptsName("web.requests"))
+	assert.False(t, rd.route.acceptsName("db.queries"))
+
+	for name, config := range map[string]map[string]interface{}{
+		"no address":          {},
+		"invalid network":     {"repeater.canary.address": "127.0.0.1:8125", "repeater.canary.network": "unix"},
+		"invalid sample rate": {"repeater.canary.address": "127.0.0.1:8125", "repeater.canary.sample-rate": 1.5},
+		"invalid queue size":  {"repeater.canary.address": "127.0.0.1:8125", "repeater.canary.queue-size": 0},
+		"invalid match":       {"repeater.canary.address": "127.0.0.1:8125", "repeater.canary.match-metrics": []string{"~("}},
+	} {
+		v := viper.New()
+		v.Set("repeaters", []string{"canary"})
+		for key, value := range config {
+			v.Set(key, value)
+		}
+		_, err := NewDatagramRepeaterFromViper(v, logrus.StandardLogger(), nil, nil, 1)
+		assert.Error(t, err, name)
+	}
+}
@@ -0,0 +1,140 @@
+package statsd
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// backendRollup accumulates successive flushes for a backend with a longer flush interval than the server, and
+// flushes the accumulated metrics to the backend once its own interval has elapsed.
+type backendRollup struct {
+	backend  gostatsd.Backend
+	interval time.Duration
+	route    *BackendRoute // Selects the series accumulated, nil for everything
+
+	mu            sync.Mutex // Protects fields below, as aggregator workers feed the rollup concurrently
+	aggr          Aggregator
+	intervalStart time.Time // Start of the interval being accumulated, zero if nothing has been accumulated yet
+}
+
+func newBackendRollup(backend gostatsd.Backend, interval time.Duration, aggr Aggregator) *backendRollup {
+	return &backendRollup{
+		backend:  backend,
+		interval: interval,
+		aggr:     aggr,
+	}
+}
+
+// receive merges a flushed MetricMap into the rollup.  Counters are summed, gauges are last-wins, and timer samples
+// and set values are merged.  The MetricMap is copied, as it is owned by an aggregator which will reset it.
+func (r *backendRollup) receive(m *gostatsd.MetricMap, intervalStart time.Time) {
+	mm := copyForRollup(m)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.intervalStart.IsZero() {
+		r.intervalStart = intervalStart
+	}
+	r.aggr.ReceiveMap(mm)
+}
+
+// due returns true if the rollup should be flushed at the end of a server flush interval ending at intervalEnd.
+func (r *backendRollup) due(intervalEnd time.Time, aligned bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.intervalStart.IsZero() {
+		return false
+	}
+	if aligned {
+		return alignTime(intervalEnd, r.interval).Equal(intervalEnd)
+	}
+	// Ticks are not exact, so allow for some jitter.
+	return intervalEnd.Sub(r.intervalStart) > r.interval-r.interval/10
+}
+
+// flush flushes the accumulated metrics to the backend, and resets the rollup.
+func (r *backendRollup) flush(ctx context.Context, intervalEnd time.Time, wg *sync.WaitGroup, cb gostatsd.SendCallback) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	intervalStart := r.intervalStart
+	r.aggr.Flush(intervalEnd.Sub(intervalStart))
+	r.aggr.Process(func(m *gostatsd.MetricMap) {
+		wg.Add(1)
+		r.backend.SendMetricsAsync(ctx, m, intervalStart, func(errs []error) {
+			defer wg.Done()
+			cb(errs)
+		})
+	})
+	r.aggr.Reset()
+	r.intervalStart = time.Time{}
+}
+
+// flushPending flushes any accumulated metrics to the backend early.
+func (r *backendRollup) flushPending(ctx context.Context, intervalEnd time.Time, wg *sync.WaitGroup, cb gostatsd.SendCallback) {
+	r.mu.Lock()
+	pending := !r.intervalStart.IsZero()
+	r.mu.Unlock()
+	if pending {
+		r.flush(ctx, intervalEnd, wg, cb)
+	}
+}
+
+// setPercentThresholds replaces the percentiles calculated for timers in the rollup.
+func (r *backendRollup) setPercentThresholds(percentThresholds []float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.aggr.SetPercentThresholds(percentThresholds)
+}
+
+// copyForRollup returns a copy of the raw values in mm, without any of the values calculated when it was flushed.
+// Timer samples and set values are copied, as the aggregator owning mm reuses them.
+func copyForRollup(mm *gostatsd.MetricMap) *gostatsd.MetricMap {
+	mmCopy := gostatsd.NewMetricMap()
+	mm.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		if _, ok := mmCopy.Counters[key]; !ok {
+			mmCopy.Counters[key] = map[string]gostatsd.Counter{}
+		}
+		mmCopy.Counters[key][tagsKey] = gostatsd.Counter{
+			Value:     counter.Value,
+			Timestamp: counter.Timestamp,
+			Hostname:  counter.Hostname,
+			Tags:      counter.Tags,
+		}
+	})
+	mm.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		if _, ok := mmCopy.Gauges[key]; !ok {
+			mmCopy.Gauges[key] = map[string]gostatsd.Gauge{}
+		}
+		mmCopy.Gauges[key][tagsKey] = gauge
+	})
+	mm.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		if _, ok := mmCopy.Timers[key]; !ok {
+			mmCopy.Timers[key] = map[string]gostatsd.Timer{}
+		}
+		mmCopy.Timers[key][tagsKey] = gostatsd.Timer{
+			SampledCount: timer.SampledCount,
+			Values:       append([]float64(nil), timer.Values...),
+			Timestamp:    timer.Timestamp,
+			Hostname:     timer.Hostname,
+			Tags:         timer.Tags,
+		}
+	})
+	mm.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+		if _, ok := mmCopy.Sets[key]; !ok {
+			mmCopy.Sets[key] = map[string]gostatsd.Set{}
+		}
+		values := make(map[string]struct{}, len(set.Values))
+		for v := range set.Values {
+			values[v] = struct{}{}
+		}
+		mmCopy.Sets[key][tagsKey] = gostatsd.Set{
+			Values:    values,
+			Timestamp: set.Timestamp,
+			Hostname:  set.Hostname,
+			Tags:      set.Tags,
+		}
+	})
+	return mmCopy
+}
@@ -0,0 +1,108 @@
+package statsd
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type capturingBackend struct {
+	mu             sync.Mutex
+	maps           []*gostatsd.MetricMap
+	intervalStarts []time.Time
+}
+
+func (cb *capturingBackend) Name() string {
+	return "capturingBackend"
+}
+
+func (cb *capturingBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, intervalStart time.Time, callback gostatsd.SendCallback) {
+	mm := gostatsd.NewMetricMap()
+	mm.Merge(m) // Keeps calculated values, but shares timer and set values, which are not reused until the next flush
+	cb.mu.Lock()
+	cb.maps = append(cb.maps, mm)
+	cb.intervalStarts = append(cb.intervalStarts, intervalStart)
+	cb.mu.Unlock()
+	callback(nil)
+}
+
+func (cb *capturingBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func TestRollupMerges(t *testing.T) {
+	t.Parallel()
+	backend := &capturingBackend{}
+	r := newBackendRollup(backend, 20*time.Second, NewMetricAggregator(nil, 0, gostatsd.TimerSubtypes{}, false, 0, 0, false))
+
+	aggr := NewMetricAggregator(nil, 0, gostatsd.TimerSubtypes{}, false, 0, 0, false)
+	aggr.Receive(
+		&gostatsd.Metric{Name: "c", Type: gostatsd.COUNTER, Value: 5, Rate: 1, Timestamp: 1},
+		&gostatsd.Metric{Name: "g", Type: gostatsd.GAUGE, Value: 1, Rate: 1, Timestamp: 1},
+		&gostatsd.Metric{Name: "t", Type: gostatsd.TIMER, Value: 10, Rate: 1, Timestamp: 1},
+		&gostatsd.Metric{Name: "s", Type: gostatsd.SET, StringValue: "a", Rate: 1, Timestamp: 1},
+	)
+	aggr.Flush(10 * time.Second)
+	aggr.Process(func(m *gostatsd.MetricMap) {
+		r.receive(m, time.Unix(100, 0))
+	})
+	aggr.Reset()
+	require.False(t, r.due(time.Unix(110, 0), false))
+
+	aggr.Receive(
+		&gostatsd.Metric{Name: "c", Type: gostatsd.COUNTER, Value: 3, Rate: 1, Timestamp: 2},
+		&gostatsd.Metric{Name: "g", Type: gostatsd.GAUGE, Value: 2, Rate: 1, Timestamp: 2},
+		&gostatsd.Metric{Name: "t", Type: gostatsd.TIMER, Value: 20, Rate: 1, Timestamp: 2},
+		&gostatsd.Metric{Name: "s", Type: gostatsd.SET, StringValue: "b", Rate: 1, Timestamp: 2},
+	)
+	aggr.Flush(10 * time.Second)
+	aggr.Process(func(m *gostatsd.MetricMap) {
+		r.receive(m, time.Unix(110, 0))
+	})
+	aggr.Reset()
+	require.True(t, r.due(time.Unix(120, 0), false))
+
+	var wg sync.WaitGroup
+	r.flush(context.Background(), time.Unix(120, 0), &wg, func(errs []error) {})
+	wg.Wait()
+
+	require.Len(t, backend.maps, 1)
+	assert.Equal(t, time.Unix(100, 0), backend.intervalStarts[0])
+	mm := backend.maps[0]
+	assert.EqualValues(t, 8, mm.Counters["c"][""].Value)
+	assert.EqualValues(t, 0.4, mm.Counters["c"][""].PerSecond)
+	assert.EqualValues(t, 2, mm.Gauges["g"][""].Value)
+	assert.Equal(t, []float64{10, 20}, mm.Timers["t"][""].Values)
+	assert.Equal(t, map[string]struct{}{"a": {}, "b": {}}, mm.Sets["s"][""].Values)
+
+	// Nothing is due until the rollup receives more data.
+	assert.False(t, r.due(time.Unix(140, 0), false))
+}
+
+func TestRollupDueAligned(t *testing.T) {
+	t.Parallel()
+	r := newBackendRollup(&capturingBackend{}, time.Minute, NewMetricAggregator(nil, 0, gostatsd.TimerSubtypes{}, false, 0, 0, false))
+	r.receive(gostatsd.NewMetricMap(), time.Unix(110, 0))
+	assert.False(t, r.due(time.Unix(170, 0), true))
+	assert.True(t, r.due(time.Unix(180, 0), true))
+}
+
+func TestCopyForRollupDoesNotAlias(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "t", Type: gostatsd.TIMER, Value: 10, Rate: 1})
+	mm.Receive(&gostatsd.Metric{Name: "s", Type: gostatsd.SET, StringValue: "a", Rate: 1})
+
+	mmCopy := copyForRollup(mm)
+	mm.Timers["t"][""].Values[0] = 20
+	mm.Sets["s"][""].Values["b"] = struct{}{}
+
+	assert.Equal(t, []float64{10}, mmCopy.Timers["t"][""].Values)
+	assert.Equal(t, map[string]struct{}{"a": {}}, mmCopy.Sets["s"][""].Values)
+}
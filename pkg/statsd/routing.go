@@ -0,0 +1,107 @@
+package statsd
+
+import (
+	"fmt"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/viper"
+)
+
+// BackendRoute selects which series are sent to a backend.  A series is sent if its name matches MatchMetrics (or
+// MatchMetrics is empty) and doesn't match ExcludeMetrics, and any of its tags match MatchTags (or MatchTags is empty)
+// and none match ExcludeTags.
+type BackendRoute struct {
+	MatchMetrics   gostatsd.StringMatchList
+	ExcludeMetrics gostatsd.StringMatchList
+	MatchTags      gostatsd.StringMatchList
+	ExcludeTags    gostatsd.StringMatchList
+}
+
+// NewBackendRoutesFromViper creates the routes configured in the section of each backend, keyed by backend name.  The
+// section of a backend is named after it, like its flush interval.  Backends without any routing rules are not
+// included.
+func NewBackendRoutesFromViper(v *viper.Viper, backends []gostatsd.Backend) (map[string]*BackendRoute, error) {
+	routes := map[string]*BackendRoute{}
+	for _, backend := range backends {
+		backendName := backend.Name()
+		vBackend := v.Sub(backendName)
+		if vBackend == nil {
+			continue
+		}
+		route, err := NewBackendRouteFromViper(vBackend)
+		if err != nil {
+			return nil, fmt.Errorf("invalid routing for backend %s: %v", backendName, err)
+		}
+		if route != nil {
+			routes[backendName] = route
+		}
+	}
+	return routes, nil
+}
+
+// NewBackendRouteFromViper creates a BackendRoute given the *viper.Viper for a backend section, or returns nil if it
+// has no routing rules.
+func NewBackendRouteFromViper(v *viper.Viper) (*BackendRoute, error) {
+	r := &BackendRoute{}
+	empty := true
+	for _, list := range []struct {
+		key   string
+		match *gostatsd.StringMatchList
+	}{
+		{"match-metrics", &r.MatchMetrics},
+		{"exclude-metrics", &r.ExcludeMetrics},
+		{"match-tags", &r.MatchTags},
+		{"exclude-tags", &r.ExcludeTags},
+	} {
+		match, err := toStringMatch(v.GetStringSlice(list.key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", list.key, err)
+		}
+		if len(match) > 0 {
+			*list.match = match
+			empty = false
+		}
+	}
+	if empty {
+		return nil, nil
+	}
+	return r, nil
+}
+
+func (r *BackendRoute) acceptsName(name string) bool {
+	if len(r.MatchMetrics) > 0 && !r.MatchMetrics.MatchAny(name) {
+		return false
+	}
+	return !r.ExcludeMetrics.MatchAny(name)
+}
+
+func (r *BackendRoute) acceptsTags(tags gostatsd.Tags) bool {
+	if len(r.MatchTags) > 0 && !r.MatchTags.MatchAnyMultiple(tags) {
+		return false
+	}
+	return !r.ExcludeTags.MatchAnyMultiple(tags)
+}
+
+// view returns the part of mm routed to the backend, or mm itself if the route is nil.  The route is evaluated once
+// per series, and the name of each metric is only matched once.  The result shares its values with mm, so must be
+// treated as read only, like mm.
+func (r *BackendRoute) view(mm *gostatsd.MetricMap) *gostatsd.MetricMap {
+	if r == nil {
+		return mm
+	}
+	view := gostatsd.NewMetricMap()
+	var lastName string
+	checked, lastAccepted := false, false
+	mm.SplitByFunc(func(metricName, tagsKey *string, hostname string, tags *gostatsd.Tags) *gostatsd.MetricMap {
+		// Series are visited one metric at a time
+		if !checked || *metricName != lastName {
+			checked, lastName, lastAccepted = true, *metricName, r.acceptsName(*metricName)
+		}
+		if lastAccepted && r.acceptsTags(*tags) {
+			return view
+		}
+		return nil
+	})
+	return view
+}
@@ -0,0 +1,110 @@
+package statsd
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewBackendRoutesFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set(ParamBackends, "graphite sepagent datadog")
+	v.Set("graphite.address", "127.0.0.1:2003")
+	v.Set("sepagent.match-metrics", "sep*")
+	v.Set("datadog.match-tags", []string{"team:*"})
+	v.Set("datadog.exclude-metrics", []string{"debug.*"})
+	v.Set("datadog:team.match-tags", []string{"team:x"})
+	backends := []gostatsd.Backend{
+		newRunnerBackend("graphite"),
+		newRunnerBackend("sepagent"),
+		newRunnerBackend("datadog"),
+		newRunnerBackend("datadog:team"),
+	}
+
+	// Routes are keyed by the name of each backend, which is also the name of its section
+	routes, err := NewBackendRoutesFromViper(v, backends)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]*BackendRoute{
+		"sepagent":     {MatchMetrics: stringMatchList("sep*")},
+		"datadog":      {MatchTags: stringMatchList("team:*"), ExcludeMetrics: stringMatchList("debug.*")},
+		"datadog:team": {MatchTags: stringMatchList("team:x")},
+	}, routes)
+
+	v.Set("graphite.exclude-tags", "~(")
+	_, err = NewBackendRoutesFromViper(v, backends)
+	assert.Error(t, err)
+}
+
+func TestBackendRouteView(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	for _, m := range []*gostatsd.Metric{
+		{Name: "sep.a", Type: gostatsd.COUNTER, Value: 1, Rate: 1, Tags: gostatsd.Tags{"team:x"}},
+		{Name: "sep.a", Type: gostatsd.COUNTER, Value: 1, Rate: 1, Tags: gostatsd.Tags{"team:y"}},
+		{Name: "sep.b", Type: gostatsd.GAUGE, Value: 1, Rate: 1, Tags: gostatsd.Tags{"team:x"}},
+		{Name: "other", Type: gostatsd.TIMER, Value: 1, Rate: 1, Tags: gostatsd.Tags{"team:x"}},
+		{Name: "other", Type: gostatsd.SET, StringValue: "v", Rate: 1},
+	} {
+		mm.Receive(m)
+	}
+
+	var nilRoute *BackendRoute
+	assert.True(t, mm == nilRoute.view(mm))
+
+	byName := &BackendRoute{MatchMetrics: stringMatchList("sep.*")}
+	view := byName.view(mm)
+	assert.Len(t, view.Counters["sep.a"], 2)
+	assert.Len(t, view.Gauges["sep.b"], 1)
+	assert.Empty(t, view.Timers)
+	assert.Empty(t, view.Sets)
+	// The view is a new map
+	view.Counters["sep.a"]["new"] = gostatsd.Counter{}
+	assert.NotContains(t, mm.Counters["sep.a"], "new")
+
+	byTag := &BackendRoute{ExcludeMetrics: stringMatchList("sep.b"), ExcludeTags: stringMatchList("team:y")}
+	view = byTag.view(mm)
+	require.Len(t, view.Counters["sep.a"], 1)
+	for _, c := range view.Counters["sep.a"] {
+		assert.Equal(t, gostatsd.Tags{"team:x"}, c.Tags)
+	}
+	assert.Len(t, mm.Counters["sep.a"], 2)
+	assert.Empty(t, view.Gauges)
+	assert.Len(t, view.Timers["other"], 1)
+	assert.Len(t, view.Sets["other"], 1)
+
+	byMatchTag := &BackendRoute{MatchTags: stringMatchList("team:y")}
+	view = byMatchTag.view(mm)
+	assert.Len(t, view.Counters["sep.a"], 1)
+	assert.Empty(t, view.Gauges)
+	assert.Empty(t, view.Timers)
+	assert.Empty(t, view.Sets)
+}
+
+func TestFlusherRoutesMetrics(t *testing.T) {
+	t.Parallel()
+	routed := &capturingBackend{}
+	unrouted := newRunnerBackend("unrouted")
+	fl := NewMetricFlusher(time.Second, false, nil, []gostatsd.Backend{routed, unrouted}, nil, map[string]*BackendRoute{
+		routed.Name(): {MatchMetrics: stringMatchList("sep.*")},
+	}, nil, nil)
+
+	for _, name := range []string{"sep.a", "other"} {
+		mm := gostatsd.NewMetricMap()
+		mm.Receive(&gostatsd.Metric{Name: name, Type: gostatsd.COUNTER, Value: 1, Rate: 1})
+		var wg sync.WaitGroup
+		fl.sendMetricsAsync(context.Background(), &wg, mm, time.Unix(1, 0))
+		wg.Wait()
+	}
+
+	require.Len(t, routed.maps, 1) // Nothing is sent to a backend if nothing is routed to it
+	assert.Contains(t, routed.maps[0].Counters, "sep.a")
+	assert.Equal(t, 2, unrouted.maps)
+}
@@ -0,0 +1,399 @@
+package statsd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	spoolSegmentSuffix  = ".spool"
+	spoolOffsetFile     = "offset"
+	spoolHeaderSize     = 8 // uint32 length and uint32 CRC32 of each record
+	maxSpoolSegmentSize = 16 * 1024 * 1024
+)
+
+var (
+	errSpoolCorrupt = errors.New("corrupt spool record")
+	errSpoolFull    = errors.New("spool is full")
+)
+
+// spoolSegment is a file in a diskSpool holding records in the order they were appended.
+type spoolSegment struct {
+	seq     uint64
+	size    int64
+	records int // Records not yet consumed
+}
+
+// diskSpool is a size capped log of records on disk, split in to segments.  Records are consumed in the order they
+// were appended, and the position of the next record is persisted so records are not replayed again after a restart.
+// When the spool is over its maximum size the oldest segments are dropped, or if keepOldest is set, new records are
+// dropped instead.
+type diskSpool struct {
+	dir         string
+	segmentSize int64
+	maxSize     int64
+	keepOldest  bool
+
+	replayLock sync.Mutex // Held while a record is replayed, so a backend and its replacement don't both replay it
+
+	mu         sync.Mutex
+	segments   []*spoolSegment // Oldest first, the last one is appended to
+	readOffset int64           // Offset of the next record in segments[0]
+	headSize   int64           // Size of the record returned by peek
+	writer     *os.File        // Open for appending to the last segment, nil if it hasn't been opened
+	records    int
+	bytes      int64
+	dropped    uint64 // Records dropped because the spool was full
+
+	refs int // Users of the spool, protected by openSpoolsLock
+}
+
+var (
+	openSpoolsLock sync.Mutex
+	openSpools     = map[string]*diskSpool{}
+)
+
+// openSpool opens the spool in dir, creating it if needed.  The same diskSpool is returned for the same directory, as
+// a backend and its replacement may both use it while the configuration is reloaded.  Each call must be matched by a
+// call to release once the spool is no longer used.
+func openSpool(dir string, maxSize int64, keepOldest bool) (*diskSpool, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("invalid spool max size %d: must be positive", maxSize)
+	}
+	openSpoolsLock.Lock()
+	defer openSpoolsLock.Unlock()
+	if ds, ok := openSpools[dir]; ok {
+		ds.mu.Lock()
+		ds.maxSize = maxSize
+		ds.keepOldest = keepOldest
+		ds.mu.Unlock()
+		ds.refs++
+		return ds, nil
+	}
+	ds := &diskSpool{
+		dir:         dir,
+		segmentSize: maxSpoolSegmentSize,
+		maxSize:     maxSize,
+		keepOldest:  keepOldest,
+	}
+	if ds.segmentSize > maxSize/4 {
+		ds.segmentSize = maxSize / 4
+	}
+	if err := ds.load(); err != nil {
+		return nil, fmt.Errorf("failed to open spool %s: %v", dir, err)
+	}
+	ds.refs = 1
+	openSpools[dir] = ds
+	return ds, nil
+}
+
+// release stops using the spool.  Once it has no users it is closed, and forgotten so it is read again from disk if
+// it is opened again.
+func (ds *diskSpool) release() {
+	openSpoolsLock.Lock()
+	defer openSpoolsLock.Unlock()
+	ds.refs--
+	if ds.refs > 0 {
+		return
+	}
+	if openSpools[ds.dir] == ds {
+		delete(openSpools, ds.dir)
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if ds.writer != nil {
+		_ = ds.writer.Close()
+		ds.writer = nil
+	}
+}
+
+// load reads the state of the spool from disk.
+func (ds *diskSpool) load() error {
+	if err := os.MkdirAll(ds.dir, 0700); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(ds.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), spoolSegmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), spoolSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		ds.segments = append(ds.segments, &spoolSegment{seq: seq})
+	}
+	sort.Slice(ds.segments, func(i, j int) bool {
+		return ds.segments[i].seq < ds.segments[j].seq
+	})
+
+	var offsetSeq uint64
+	var offset int64
+	if data, err := ioutil.ReadFile(filepath.Join(ds.dir, spoolOffsetFile)); err == nil {
+		_, _ = fmt.Sscanf(string(data), "%d %d", &offsetSeq, &offset)
+	}
+
+	segments := ds.segments[:0]
+	for _, segment := range ds.segments {
+		if segment.seq < offsetSeq {
+			_ = os.Remove(ds.segmentPath(segment.seq)) // Already consumed
+			continue
+		}
+		start := int64(0)
+		if segment.seq == offsetSeq {
+			start = offset
+		}
+		if err := ds.scan(segment, start); err != nil {
+			return err
+		}
+		if len(segments) == 0 {
+			ds.readOffset = start
+		}
+		segments = append(segments, segment)
+		ds.records += segment.records
+		ds.bytes += segment.size
+	}
+	ds.segments = segments
+	return nil
+}
+
+// scan counts the records in a segment from start, and truncates a partially written record at the end.
+func (ds *diskSpool) scan(segment *spoolSegment, start int64) error {
+	f, err := os.OpenFile(ds.segmentPath(segment.seq), os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	var header [spoolHeaderSize]byte
+	offset := int64(0)
+	for offset < info.Size() {
+		if _, err = f.ReadAt(header[:], offset); err != nil {
+			break
+		}
+		next := offset + spoolHeaderSize + int64(binary.BigEndian.Uint32(header[0:4]))
+		if next > info.Size() {
+			break
+		}
+		if offset >= start {
+			segment.records++
+		}
+		offset = next
+	}
+	if offset < info.Size() {
+		if err = f.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	segment.size = offset
+	return nil
+}
+
+func (ds *diskSpool) segmentPath(seq uint64) string {
+	return filepath.Join(ds.dir, fmt.Sprintf("%020d%s", seq, spoolSegmentSuffix))
+}
+
+// append adds a record to the end of the spool, dropping the oldest segments if the spool is over its maximum size.
+// If keepOldest is set, the record is dropped and errSpoolFull returned instead.
+func (ds *diskSpool) append(data []byte) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	size := int64(spoolHeaderSize + len(data))
+	if ds.keepOldest && ds.bytes+size > ds.maxSize {
+		ds.dropped++
+		return errSpoolFull
+	}
+	if len(ds.segments) > 0 && ds.last().size > 0 && ds.last().size+size > ds.segmentSize {
+		if err := ds.roll(true); err != nil {
+			return err
+		}
+	} else if ds.writer == nil {
+		if err := ds.roll(len(ds.segments) == 0); err != nil {
+			return err
+		}
+	}
+
+	record := make([]byte, size)
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[spoolHeaderSize:], data)
+	if _, err := ds.writer.Write(record); err != nil {
+		return err
+	}
+	if err := ds.writer.Sync(); err != nil {
+		return err
+	}
+	last := ds.last()
+	last.size += size
+	last.records++
+	ds.records++
+	ds.bytes += size
+
+	for ds.bytes > ds.maxSize && len(ds.segments) > 1 {
+		oldest := ds.segments[0]
+		ds.dropped += uint64(oldest.records)
+		ds.removeOldest()
+	}
+	return nil
+}
+
+func (ds *diskSpool) last() *spoolSegment {
+	return ds.segments[len(ds.segments)-1]
+}
+
+// roll starts appending to a new segment if next is true, otherwise re-opens the last segment, such as after a
+// restart.  Must be called with ds.mu held.
+func (ds *diskSpool) roll(next bool) error {
+	if ds.writer != nil {
+		if err := ds.writer.Close(); err != nil {
+			return err
+		}
+		ds.writer = nil
+	}
+	if next {
+		seq := uint64(0)
+		if len(ds.segments) > 0 {
+			seq = ds.last().seq + 1
+		} else if data, err := ioutil.ReadFile(filepath.Join(ds.dir, spoolOffsetFile)); err == nil {
+			_, _ = fmt.Sscanf(string(data), "%d", &seq) // Never reuse a consumed sequence number
+		}
+		ds.segments = append(ds.segments, &spoolSegment{seq: seq})
+	}
+	f, err := os.OpenFile(ds.segmentPath(ds.last().seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	ds.writer = f
+	return nil
+}
+
+// removeOldest removes the oldest segment.  Must be called with ds.mu held.
+func (ds *diskSpool) removeOldest() {
+	oldest := ds.segments[0]
+	if len(ds.segments) == 1 && ds.writer != nil {
+		_ = ds.writer.Close()
+		ds.writer = nil
+	}
+	_ = os.Remove(ds.segmentPath(oldest.seq))
+	ds.records -= oldest.records
+	ds.bytes -= oldest.size
+	ds.segments = ds.segments[1:]
+	ds.readOffset = 0
+	ds.headSize = 0
+	ds.saveOffset(oldest.seq + 1)
+}
+
+// peek returns the oldest record without consuming it, or false if the spool is empty.  A corrupt record is
+// discarded along with the rest of its segment, and returns errSpoolCorrupt.
+func (ds *diskSpool) peek() ([]byte, bool, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if ds.records == 0 {
+		return nil, false, nil
+	}
+	for ds.segments[0].records == 0 {
+		ds.removeOldest()
+	}
+
+	data, err := ds.read(ds.segments[0], ds.readOffset)
+	if err != nil {
+		oldest := ds.segments[0]
+		ds.dropped += uint64(oldest.records)
+		ds.removeOldest()
+		return nil, false, err
+	}
+	ds.headSize = int64(spoolHeaderSize + len(data))
+	return data, true, nil
+}
+
+// read reads the record at offset in a segment.  The length in the header is checked against the size of the segment
+// before anything is allocated, as the header may be corrupt.
+func (ds *diskSpool) read(segment *spoolSegment, offset int64) ([]byte, error) {
+	f, err := os.Open(ds.segmentPath(segment.seq))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var header [spoolHeaderSize]byte
+	if _, err = f.ReadAt(header[:], offset); err != nil {
+		return nil, errSpoolCorrupt
+	}
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if length > segment.size-offset-spoolHeaderSize {
+		return nil, errSpoolCorrupt
+	}
+	data := make([]byte, length)
+	if _, err = f.ReadAt(data, offset+spoolHeaderSize); err != nil && err != io.EOF {
+		return nil, errSpoolCorrupt
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errSpoolCorrupt
+	}
+	return data, nil
+}
+
+// commit consumes the record returned by the last call to peek.
+func (ds *diskSpool) commit() {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if ds.headSize == 0 {
+		return // Removed while it was being replayed
+	}
+	oldest := ds.segments[0]
+	ds.readOffset += ds.headSize
+	ds.headSize = 0
+	oldest.records--
+	ds.records--
+	if oldest.records == 0 && (len(ds.segments) > 1 || ds.readOffset >= oldest.size) {
+		ds.removeOldest()
+		return
+	}
+	ds.saveOffset(oldest.seq)
+}
+
+// saveOffset persists the position of the next record.  The file is replaced atomically, so a crash leaves either
+// the old or the new position.  Must be called with ds.mu held.
+func (ds *diskSpool) saveOffset(seq uint64) {
+	path := filepath.Join(ds.dir, spoolOffsetFile)
+	tmp, err := ioutil.TempFile(ds.dir, spoolOffsetFile+".tmp")
+	if err != nil {
+		return
+	}
+	_, err = fmt.Fprintf(tmp, "%d %d", seq, ds.readOffset)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+}
+
+// depth returns the number of records and bytes in the spool, and the number of records dropped.
+func (ds *diskSpool) depth() (int, int64, uint64) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.records, ds.bytes, ds.dropped
+}
@@ -0,0 +1,372 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pb"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilinna/clock"
+)
+
+// reopenSpool forgets the open spool in dir, and opens it again from disk.
+func reopenSpool(t *testing.T, dir string, maxSize int64) *diskSpool {
+	openSpoolsLock.Lock()
+	if ds, ok := openSpools[dir]; ok && ds.writer != nil {
+		_ = ds.writer.Close()
+	}
+	delete(openSpools, dir)
+	openSpoolsLock.Unlock()
+	ds, err := openSpool(dir, maxSize, false)
+	require.NoError(t, err)
+	return ds
+}
+
+func tempSpoolDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "spool")
+	require.NoError(t, err)
+	return dir
+}
+
+func TestDiskSpoolOrderAndRestart(t *testing.T) {
+	t.Parallel()
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	ds := reopenSpool(t, dir, 1024)
+	for _, record := range []string{"a", "b", "c"} {
+		require.NoError(t, ds.append([]byte(record)))
+	}
+	data, ok, err := ds.peek()
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "a", string(data))
+	ds.commit()
+
+	ds = reopenSpool(t, dir, 1024)
+	records, _, _ := ds.depth()
+	assert.Equal(t, 2, records)
+	for _, expected := range []string{"b", "c"} {
+		data, ok, err = ds.peek()
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Equal(t, expected, string(data))
+		ds.commit()
+	}
+	_, ok, err = ds.peek()
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// Appending after the spool has been emptied starts a new segment
+	require.NoError(t, ds.append([]byte("d")))
+	ds = reopenSpool(t, dir, 1024)
+	data, ok, err = ds.peek()
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "d", string(data))
+}
+
+func TestDiskSpoolTruncatesPartialRecord(t *testing.T) {
+	t.Parallel()
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	ds := reopenSpool(t, dir, 1024)
+	require.NoError(t, ds.append([]byte("a")))
+	f, err := os.OpenFile(ds.segmentPath(ds.last().seq), os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 9, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	ds = reopenSpool(t, dir, 1024)
+	records, bytes, _ := ds.depth()
+	assert.Equal(t, 1, records)
+	assert.EqualValues(t, spoolHeaderSize+1, bytes)
+	require.NoError(t, ds.append([]byte("b")))
+	for _, expected := range []string{"a", "b"} {
+		data, ok, err := ds.peek()
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Equal(t, expected, string(data))
+		ds.commit()
+	}
+}
+
+func TestDiskSpoolRejectsCorruptLength(t *testing.T) {
+	t.Parallel()
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	ds := reopenSpool(t, dir, 1024)
+	require.NoError(t, ds.append([]byte("a")))
+	f, err := os.OpenFile(ds.segmentPath(ds.last().seq), os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 0) // A length far beyond the end of the segment
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, ok, err := ds.peek()
+	assert.Equal(t, errSpoolCorrupt, err)
+	assert.False(t, ok)
+	_, _, dropped := ds.depth()
+	assert.EqualValues(t, 1, dropped)
+}
+
+func TestDiskSpoolSavesOffsetAtomically(t *testing.T) {
+	t.Parallel()
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	ds := reopenSpool(t, dir, 1024)
+	require.NoError(t, ds.append([]byte("a")))
+	require.NoError(t, ds.append([]byte("b")))
+	_, _, err := ds.peek()
+	require.NoError(t, err)
+	ds.commit()
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	assert.ElementsMatch(t, []string{filepath.Base(ds.segmentPath(ds.last().seq)), spoolOffsetFile}, names, "no temporary files should be left behind")
+	data, err := ioutil.ReadFile(filepath.Join(dir, spoolOffsetFile))
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%d %d", ds.last().seq, spoolHeaderSize+1), string(data))
+}
+
+func TestDiskSpoolDropsOldestWhenFull(t *testing.T) {
+	t.Parallel()
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	ds := reopenSpool(t, dir, 80) // Segments of 20 bytes, so each holds a single 18 byte record
+	for _, record := range []string{"0123456789", "1123456789", "2123456789", "3123456789", "4123456789"} {
+		require.NoError(t, ds.append([]byte(record)))
+	}
+	records, bytes, dropped := ds.depth()
+	assert.Equal(t, 4, records)
+	assert.EqualValues(t, 72, bytes)
+	assert.EqualValues(t, 1, dropped)
+	data, ok, err := ds.peek()
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "1123456789", string(data))
+}
+
+func TestDiskSpoolKeepsOldestWhenFull(t *testing.T) {
+	t.Parallel()
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	ds, err := openSpool(dir, 40, true)
+	require.NoError(t, err)
+	require.NoError(t, ds.append([]byte("0123456789")))
+	require.NoError(t, ds.append([]byte("1123456789")))
+	assert.Equal(t, errSpoolFull, ds.append([]byte("2123456789")))
+	records, _, dropped := ds.depth()
+	assert.Equal(t, 2, records)
+	assert.EqualValues(t, 1, dropped)
+	data, ok, err := ds.peek()
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "0123456789", string(data))
+}
+
+// replayBackend fails sends while fail is set, and captures the counters of successful sends.
+type replayBackend struct {
+	mu       sync.Mutex
+	fail     bool
+	counters []gostatsd.Counter
+	starts   []time.Time
+}
+
+func (cb *replayBackend) Name() string {
+	return "capturing:a"
+}
+
+func (cb *replayBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, intervalStart time.Time, callback gostatsd.SendCallback) {
+	cb.mu.Lock()
+	if cb.fail {
+		cb.mu.Unlock()
+		callback([]error{errors.New("boom")})
+		return
+	}
+	m.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		cb.counters = append(cb.counters, counter)
+	})
+	cb.starts = append(cb.starts, intervalStart)
+	cb.mu.Unlock()
+	callback(nil)
+}
+
+func (cb *replayBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func TestSpoolBackendReplay(t *testing.T) {
+	t.Parallel()
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	mockClock := clock.NewMock(time.Unix(1000, 0))
+	ctx := clock.Context(context.Background(), mockClock)
+
+	v := viper.New()
+	v.Set(ParamSpoolDir, dir)
+	v.Set(ParamSpoolMaxSize, 1024*1024)
+	v.Set(ParamSpoolMaxAge, time.Minute)
+	backend := &replayBackend{fail: true}
+	spooled, err := spoolBackends(v, []gostatsd.Backend{backend}, 10*time.Second, nil, &agrFactory{flushInterval: 10 * time.Second})
+	require.NoError(t, err)
+	sb := spooled[0].(*spoolBackend)
+	assert.Equal(t, filepath.Join(dir, "capturing_a"), sb.spool.dir)
+
+	for _, intervalStart := range []time.Time{time.Unix(0, 0), time.Unix(990, 0)} {
+		mm := gostatsd.NewMetricMap()
+		mm.Receive(&gostatsd.Metric{Name: "c", Value: 20, Type: gostatsd.COUNTER, Rate: 1, Hostname: "h"})
+		errs := sendMapAndWait(ctx, sb, mm, intervalStart)
+		assert.Len(t, errs, 1)
+	}
+	records, _, _ := sb.spool.depth()
+	assert.Equal(t, 2, records)
+
+	// The first record is older than the max age, so it is dropped
+	replayed, err := sb.replay(ctx)
+	require.NoError(t, err)
+	assert.True(t, replayed)
+	assert.EqualValues(t, 1, sb.expired)
+
+	// The backend is still failing, so the second record stays in the spool
+	replayed, err = sb.replay(ctx)
+	assert.Error(t, err)
+	assert.False(t, replayed)
+
+	backend.fail = false
+	replayed, err = sb.replay(ctx)
+	require.NoError(t, err)
+	assert.True(t, replayed)
+	require.Len(t, backend.counters, 1)
+	assert.EqualValues(t, 20, backend.counters[0].Value)
+	assert.EqualValues(t, 2, backend.counters[0].PerSecond)
+	assert.Equal(t, time.Unix(1000, 0).UnixNano(), int64(backend.counters[0].Timestamp))
+	assert.Equal(t, []time.Time{time.Unix(990, 0)}, backend.starts)
+
+	replayed, err = sb.replay(ctx)
+	require.NoError(t, err)
+	assert.False(t, replayed)
+	records, _, _ = sb.spool.depth()
+	assert.Zero(t, records)
+}
+
+func TestSpoolBackendsDisabled(t *testing.T) {
+	t.Parallel()
+	backends := []gostatsd.Backend{&replayBackend{}}
+	v := viper.New()
+	spooled, err := spoolBackends(v, backends, time.Second, nil, &agrFactory{})
+	require.NoError(t, err)
+	assert.Equal(t, backends, spooled)
+
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	v.Set(ParamSpoolDir, dir)
+	v.Set("capturing:a.spool", false)
+	spooled, err = spoolBackends(v, backends, time.Second, nil, &agrFactory{})
+	require.NoError(t, err)
+	assert.Equal(t, backends, spooled)
+}
+
+func sendMapAndWait(ctx context.Context, backend gostatsd.Backend, mm *gostatsd.MetricMap, intervalStart time.Time) []error {
+	result := make(chan []error, 1)
+	backend.SendMetricsAsync(ctx, mm, intervalStart, func(errs []error) {
+		result <- errs
+	})
+	return <-result
+}
+
+func TestOpenSpoolRelease(t *testing.T) {
+	t.Parallel()
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	_, err := openSpool(dir, 0, false)
+	assert.Error(t, err)
+
+	ds, err := openSpool(dir, 1024, false)
+	require.NoError(t, err)
+	same, err := openSpool(dir, 1024, false)
+	require.NoError(t, err)
+	assert.True(t, ds == same)
+
+	ds.release()
+	openSpoolsLock.Lock()
+	assert.Contains(t, openSpools, dir) // Still used by the second opener
+	openSpoolsLock.Unlock()
+	same.release()
+	openSpoolsLock.Lock()
+	assert.NotContains(t, openSpools, dir)
+	openSpoolsLock.Unlock()
+}
+
+// delayedBackend fails every send, but only calls back once release is closed.
+type delayedBackend struct {
+	release chan struct{}
+}
+
+func (db *delayedBackend) Name() string {
+	return "delayed"
+}
+
+func (db *delayedBackend) SendMetricsAsync(ctx context.Context, m *gostatsd.MetricMap, intervalStart time.Time, callback gostatsd.SendCallback) {
+	go func() {
+		<-db.release
+		callback([]error{errors.New("boom")})
+	}()
+}
+
+func (db *delayedBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func TestSpoolBackendCopiesMap(t *testing.T) {
+	t.Parallel()
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	ds, err := openSpool(dir, 1024*1024, false)
+	require.NoError(t, err)
+	defer ds.release()
+	backend := &delayedBackend{release: make(chan struct{})}
+	sb := newSpoolBackend(backend, ds, &agrFactory{}, time.Second, 0)
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "c", Value: 1, Type: gostatsd.COUNTER, Rate: 1})
+	done := make(chan struct{})
+	sb.SendMetricsAsync(context.Background(), mm, time.Unix(1, 0), func(errs []error) {
+		close(done)
+	})
+
+	// The map is reset as soon as the send has returned, as the flusher does, before the backend fails
+	delete(mm.Counters, "c")
+	close(backend.release)
+	<-done
+
+	data, ok, err := ds.peek()
+	require.NoError(t, err)
+	require.True(t, ok)
+	var msg pb.RawMessageV2
+	require.NoError(t, proto.Unmarshal(data[spoolRecordHeaderSize:], &msg))
+	assert.Contains(t, msg.Counters, "c", "the metrics should be spooled as they were sent")
+}
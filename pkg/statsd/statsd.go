@@ -7,9 +7,12 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/cluster/nodes"
+	"github.com/atlassian/gostatsd/pkg/rules"
 	"github.com/atlassian/gostatsd/pkg/stats"
 	"github.com/atlassian/gostatsd/pkg/web"
 
@@ -24,6 +27,7 @@ import (
 // the statsd server. These can either be set via command line or directly.
 type Server struct {
 	Backends                  []gostatsd.Backend
+	BackendFlushIntervals     map[string]time.Duration // Per backend flush interval, keyed by backend name
 	CloudProvider             gostatsd.CloudProvider
 	Limiter                   *rate.Limiter
 	InternalTags              gostatsd.Tags
@@ -31,6 +35,7 @@ type Server struct {
 	DefaultTags               gostatsd.Tags
 	ExpiryInterval            time.Duration
 	FlushInterval             time.Duration
+	FlushAligned              bool
 	MaxReaders                int
 	MaxParsers                int
 	MaxWorkers                int
@@ -48,11 +53,19 @@ type Server struct {
 	HeartbeatTags             gostatsd.Tags
 	ReceiveBatchSize          int
 	DisabledSubTypes          gostatsd.TimerSubtypes
+	IntegerCounters           bool
+	LateGracePeriod           time.Duration
+	LateFlush                 bool
+	ConfigReloadInterval      time.Duration // How often to check the configuration file for changes, 0 to disable
+	NewBackends               BackendsFactory
 	BadLineRateLimitPerSecond rate.Limit
 	ServerMode                string
 	Hostname                  string
 	CacheOptions
 	Viper *viper.Viper
+	// NewViper creates an empty viper with the same flags and environment bound as Viper, so they keep their
+	// precedence over the configuration file when it is reloaded.  Optional.
+	NewViper func() *viper.Viper
 }
 
 // Run runs the server until context signals done.
@@ -83,13 +96,21 @@ func socketFactory(metricsAddr string, connPerReader bool) SocketFactory {
 	}
 }
 
-func (s *Server) createStandaloneSink() (gostatsd.PipelineHandler, []gostatsd.Runnable, error) {
+// validateBackendFlushIntervals checks that every per backend flush interval is a multiple of the flush interval.
+func validateBackendFlushIntervals(flushInterval time.Duration, backendFlushIntervals map[string]time.Duration) error {
+	for name, interval := range backendFlushIntervals {
+		if interval < flushInterval || interval%flushInterval != 0 {
+			return fmt.Errorf("flush interval %v of backend %q must be a multiple of the flush interval %v", interval, name, flushInterval)
+		}
+	}
+	return nil
+}
+
+func (s *Server) createStandaloneSink(reloader *reloader) (gostatsd.PipelineHandler, []gostatsd.Runnable, error) {
 	var runnables []gostatsd.Runnable
 
-	for _, backend := range s.Backends {
-		if r, ok := backend.(gostatsd.Runner); ok {
-			runnables = append(runnables, r.Run)
-		}
+	if err := validateBackendFlushIntervals(s.FlushInterval, s.BackendFlushIntervals); err != nil {
+		return nil, nil, err
 	}
 
 	// Create the backend handler
@@ -97,19 +118,68 @@ func (s *Server) createStandaloneSink() (gostatsd.PipelineHandler, []gostatsd.Ru
 		percentThresholds: s.PercentThreshold,
 		expiryInterval:    s.ExpiryInterval,
 		disabledSubtypes:  s.DisabledSubTypes,
+		integerCounters:   s.IntegerCounters,
+		flushInterval:     s.FlushInterval,
+		lateGracePeriod:   s.LateGracePeriod,
+		lateFlush:         s.LateFlush,
+	}
+
+	backends := guardBackends(s.Viper, s.Backends, s.FlushInterval, s.BackendFlushIntervals)
+	backends, err := spoolBackends(s.Viper, backends, s.FlushInterval, s.BackendFlushIntervals, &factory)
+	if err != nil {
+		return nil, nil, err
 	}
+	runningBackends := newRunningBackends(backends)
+	runnables = append(runnables, runningBackends.Run)
 
-	backendHandler := NewBackendHandler(s.Backends, uint(s.MaxConcurrentEvents), s.MaxWorkers, s.MaxQueueSize, &factory)
+	backendHandler := NewBackendHandler(backends, uint(s.MaxConcurrentEvents), s.MaxWorkers, s.MaxQueueSize, &factory)
 	runnables = append(runnables, backendHandler.Run, backendHandler.RunMetricsContext)
 
 	// Create the Flusher
-	flusher := NewMetricFlusher(s.FlushInterval, backendHandler, s.Backends)
+	ruleEngine, err := rules.NewEngineFromViper(s.Viper)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	backendRoutes, err := NewBackendRoutesFromViper(s.Viper, s.Backends)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	flusher := NewMetricFlusher(s.FlushInterval, s.FlushAligned, backendHandler, backends, s.BackendFlushIntervals, backendRoutes, &factory, ruleEngine)
 	runnables = append(runnables, flusher.Run)
 
+	// Announce this server to forwarders sharding metrics across a cluster of aggregators
+	vCluster := getSubViper(s.Viper, "cluster")
+	if advertise := vCluster.GetString("advertise"); advertise != "" {
+		tracker, err := nodes.NewNodeTrackerFromViper(vCluster, advertise)
+		if err != nil {
+			return nil, nil, err
+		}
+		if tracker == nil {
+			return nil, nil, errors.New("cluster.advertise requires a cluster.type")
+		}
+		runnables = append(runnables, tracker.Run)
+	}
+
+	reloader.backendHandler = backendHandler
+	reloader.flusher = flusher
+	reloader.factory = &factory
+	reloader.running = runningBackends
+	reloader.backendConfig = backendSettings(s.Viper)
+
 	return backendHandler, runnables, nil
 }
 
-func (s *Server) createForwarderSink() (gostatsd.PipelineHandler, []gostatsd.Runnable, error) {
+func (s *Server) createForwarderSink(reloader *reloader) (gostatsd.PipelineHandler, []gostatsd.Runnable, error) {
+	switch transport := s.Viper.GetString(ParamForwarderTransport); transport {
+	case "", "http":
+	case "grpc":
+		return s.createGrpcForwarderSink()
+	default:
+		return nil, nil, fmt.Errorf("invalid %s %q, must be http or grpc", ParamForwarderTransport, transport)
+	}
+
 	forwarderHandler, err := NewHttpForwarderHandlerV2FromViper(
 		log.StandardLogger(),
 		s.Viper,
@@ -117,18 +187,36 @@ func (s *Server) createForwarderSink() (gostatsd.PipelineHandler, []gostatsd.Run
 	if err != nil {
 		return nil, nil, err
 	}
+	if snt, ok := forwarderHandler.nodes.(*nodes.StaticNodeTracker); ok {
+		reloader.nodes = snt
+	}
 
 	// Create a Flusher, this is primarily for all the periodic metrics which are emitted.
-	flusher := NewMetricFlusher(s.FlushInterval, nil, s.Backends)
+	flusher := NewMetricFlusher(s.FlushInterval, s.FlushAligned, nil, s.Backends, nil, nil, nil, nil)
 
 	return forwarderHandler, []gostatsd.Runnable{forwarderHandler.Run, forwarderHandler.RunMetrics, flusher.Run}, nil
 }
 
-func (s *Server) createFinalSink() (gostatsd.PipelineHandler, []gostatsd.Runnable, error) {
+func (s *Server) createGrpcForwarderSink() (gostatsd.PipelineHandler, []gostatsd.Runnable, error) {
+	forwarderHandler, err := NewGrpcForwarderHandlerV2FromViper(
+		log.StandardLogger(),
+		s.Viper,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Create a Flusher, this is primarily for all the periodic metrics which are emitted.
+	flusher := NewMetricFlusher(s.FlushInterval, s.FlushAligned, nil, s.Backends, nil, nil, nil, nil)
+
+	return forwarderHandler, []gostatsd.Runnable{forwarderHandler.Run, forwarderHandler.RunMetrics, flusher.Run}, nil
+}
+
+func (s *Server) createFinalSink(reloader *reloader) (gostatsd.PipelineHandler, []gostatsd.Runnable, error) {
 	if s.ServerMode == "standalone" {
-		return s.createStandaloneSink()
+		return s.createStandaloneSink(reloader)
 	} else if s.ServerMode == "forwarder" {
-		return s.createForwarderSink()
+		return s.createForwarderSink(reloader)
 	}
 	return nil, nil, errors.New("invalid server-mode, must be standalone, or forwarder")
 }
@@ -136,13 +224,36 @@ func (s *Server) createFinalSink() (gostatsd.PipelineHandler, []gostatsd.Runnabl
 // RunWithCustomSocket runs the server until context signals done.
 // Listening socket is created using sf.
 func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) error {
-	handler, runnables, err := s.createFinalSink()
+	reloader := &reloader{
+		viper:         s.Viper,
+		interval:      s.ConfigReloadInterval,
+		newViper:      s.NewViper,
+		newBackends:   s.NewBackends,
+		flushInterval: s.FlushInterval,
+	}
+
+	handler, runnables, err := s.createFinalSink(reloader)
 	if err != nil {
 		return err
 	}
 
 	// Create the tag processor
-	handler = NewTagHandlerFromViper(s.Viper, handler, s.DefaultTags)
+	tagHandler, err := NewTagHandlerFromViper(s.Viper, handler, s.DefaultTags)
+	if err != nil {
+		return err
+	}
+	handler = tagHandler
+	reloader.tagHandler = tagHandler
+	filterAdmin, err := newFilterAdmin(tagHandler, s.Viper.GetString(ParamFilterStateFile))
+	if err != nil {
+		return err
+	}
+
+	// Create the mapping processor, which runs before the tag processor so filters see the mapped names and tags
+	handler, err = NewMappingHandlerFromViper(s.Viper, handler)
+	if err != nil {
+		return err
+	}
 
 	// Create the cloud handler
 	ip := gostatsd.UnknownIP
@@ -174,8 +285,20 @@ func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) erro
 		runnables = append(runnables, parser.Run)
 	}
 
+	// Create the Repeater, which sits between the receiver and the parser if any repeaters are configured
+	received := make(chan []*Datagram)
+	repeater, err := NewDatagramRepeaterFromViper(s.Viper, log.StandardLogger(), received, datagrams, s.MaxParsers)
+	if err != nil {
+		return err
+	}
+	if repeater != nil {
+		runnables = append(runnables, repeater.RunMetrics, repeater.Run)
+	} else {
+		received = datagrams
+	}
+
 	// Create the Receiver
-	receiver := NewDatagramReceiver(datagrams, sf, s.MaxReaders, s.ReceiveBatchSize)
+	receiver := NewDatagramReceiver(received, sf, s.MaxReaders, s.ReceiveBatchSize)
 	runnables = append(runnables, receiver.RunMetrics)
 	runnables = append(runnables, receiver.Run) // loop is contained in Run to keep additional logic contained
 
@@ -187,13 +310,34 @@ func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) erro
 	}
 
 	// Create any http servers
-	httpServers, err := web.NewHttpServersFromViper(s.Viper, log.StandardLogger(), handler)
+	var health web.HealthReporter
+	if reloader.flusher != nil {
+		health = reloader.flusher
+	}
+	var load web.LoadReporter
+	if reloader.backendHandler != nil {
+		load = reloader.backendHandler
+	}
+	httpServers, err := web.NewHttpServersFromViper(s.Viper, log.StandardLogger(), handler, parser, filterAdmin, health, load)
 	if err != nil {
 		return err
 	}
 	for _, server := range httpServers {
 		runnables = append(runnables, server.Run)
 	}
+	grpcServers, err := web.NewGrpcServersFromViper(s.Viper, log.StandardLogger(), handler)
+	if err != nil {
+		return err
+	}
+	for _, server := range grpcServers {
+		runnables = append(runnables, server.Run)
+	}
+
+	// Create the configuration reloader
+	reloader.handler = handler
+	reloader.hostname = hostname
+	reloader.ip = ip
+	runnables = append(runnables, reloader.Run)
 
 	// Start the world!
 	runCtx := stats.NewContext(context.Background(), statser)
@@ -267,13 +411,41 @@ func getHost() string {
 }
 
 type agrFactory struct {
-	percentThresholds []float64
+	mu                sync.Mutex
+	percentThresholds []float64 // Replaced when the configuration is reloaded, so protected by mu
 	expiryInterval    time.Duration
 	disabledSubtypes  gostatsd.TimerSubtypes
+	integerCounters   bool
+	flushInterval     time.Duration
+	lateGracePeriod   time.Duration
+	lateFlush         bool
 }
 
 func (af *agrFactory) Create() Aggregator {
-	return NewMetricAggregator(af.percentThresholds, af.expiryInterval, af.disabledSubtypes)
+	af.mu.Lock()
+	percentThresholds := af.percentThresholds
+	af.mu.Unlock()
+	return NewMetricAggregator(percentThresholds, af.expiryInterval, af.disabledSubtypes, af.integerCounters, af.flushInterval, af.lateGracePeriod, af.lateFlush)
+}
+
+// setPercentThresholds replaces the percentiles calculated by the aggregators created from now on.
+func (af *agrFactory) setPercentThresholds(percentThresholds []float64) {
+	af.mu.Lock()
+	defer af.mu.Unlock()
+	af.percentThresholds = percentThresholds
+}
+
+// ParsePercentThresholds parses a list of percentiles.
+func ParsePercentThresholds(s []string) ([]float64, error) {
+	percentThresholds := make([]float64, len(s))
+	for i, sPercentThreshold := range s {
+		pt, err := strconv.ParseFloat(sPercentThreshold, 64)
+		if err != nil {
+			return nil, err
+		}
+		percentThresholds[i] = pt
+	}
+	return percentThresholds, nil
 }
 
 func toStringSlice(fs []float64) []string {
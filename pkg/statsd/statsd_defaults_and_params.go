@@ -84,6 +84,29 @@ const (
 	DefaultBadLinesPerMinute = 0
 	// DefaultServerMode is the default mode to run as, standalone|forwarder
 	DefaultServerMode = "standalone"
+	// DefaultForwarderTransport is the default transport a forwarder sends metrics with, http|grpc
+	DefaultForwarderTransport = "http"
+	// DefaultIntegerCounters is the default for whether counter values are truncated to integers
+	DefaultIntegerCounters = false
+	// DefaultFlushAligned is the default for whether flushes are aligned to the wall clock
+	DefaultFlushAligned = false
+	// DefaultLateGracePeriod is the default for how old a client timestamp may be before the current flush interval
+	DefaultLateGracePeriod = 10 * time.Second
+	// DefaultLateFlush is the default for whether late metrics are flushed with their own timestamp
+	DefaultLateFlush = false
+	// DefaultMappingCacheSize is the default number of metric names with cached mapping results
+	DefaultMappingCacheSize = 10000
+	// DefaultConfigReloadInterval is the default for how often the configuration file is checked for changes
+	DefaultConfigReloadInterval = 10 * time.Second
+	// DefaultBackendBreakerFailures is the default number of consecutive failed sends which stop sending to a backend,
+	// 0 as the breaker is opt-in
+	DefaultBackendBreakerFailures = 0
+	// DefaultBackendBreakerCooldown is the default for how long to stop sending to a backend before trying again
+	DefaultBackendBreakerCooldown = 30 * time.Second
+	// DefaultSpoolMaxAge is the default for how old spooled metrics may be before they are dropped instead of replayed
+	DefaultSpoolMaxAge = 6 * time.Hour
+	// DefaultSpoolMaxSize is the default maximum size in bytes of the spool for each backend
+	DefaultSpoolMaxSize = 1024 * 1024 * 1024
 )
 
 const (
@@ -145,8 +168,32 @@ const (
 	ParamBadLinesPerMinute = "bad-lines-per-minute"
 	// ParamServerMode is the name of the parameter used to configure the server mode.
 	ParamServerMode = "server-mode"
+	// ParamForwarderTransport is the name of the parameter with the transport a forwarder sends metrics with.
+	ParamForwarderTransport = "forwarder-transport"
 	// ParamHostname allows hostname overrides
 	ParamHostname = "hostname"
+	// ParamIntegerCounters is the name of the parameter indicating whether counter values are truncated to integers
+	ParamIntegerCounters = "integer-counters"
+	// ParamFlushAligned is the name of the parameter indicating whether flushes are aligned to the wall clock
+	ParamFlushAligned = "flush-aligned"
+	// ParamLateGracePeriod is the name of the parameter with how old a client timestamp may be before the current flush interval
+	ParamLateGracePeriod = "late-grace-period"
+	// ParamLateFlush is the name of the parameter indicating whether late metrics are flushed with their own timestamp
+	ParamLateFlush = "late-flush"
+	// ParamConfigReloadInterval is the name of the parameter with how often the configuration file is checked for changes
+	ParamConfigReloadInterval = "config-reload-interval"
+	// ParamFilterStateFile is the name of the parameter with the file filters added through the admin API are saved to
+	ParamFilterStateFile = "filter-state-file"
+	// ParamBackendBreakerFailures is the name of the parameter with the number of consecutive failed sends which stop sending to a backend
+	ParamBackendBreakerFailures = "backend-breaker-failures"
+	// ParamBackendBreakerCooldown is the name of the parameter with how long to stop sending to a backend before trying again
+	ParamBackendBreakerCooldown = "backend-breaker-cooldown"
+	// ParamSpoolDir is the name of the parameter with the directory metrics which failed to send are spooled to
+	ParamSpoolDir = "spool-dir"
+	// ParamSpoolMaxAge is the name of the parameter with how old spooled metrics may be before they are dropped
+	ParamSpoolMaxAge = "spool-max-age"
+	// ParamSpoolMaxSize is the name of the parameter with the maximum size in bytes of the spool for each backend
+	ParamSpoolMaxSize = "spool-max-size"
 )
 
 // AddFlags adds flags to the specified FlagSet.
@@ -154,6 +201,7 @@ func AddFlags(fs *pflag.FlagSet) {
 	fs.String(ParamCloudProvider, "", "If set, use the cloud provider to retrieve metadata about the sender")
 	fs.Duration(ParamExpiryInterval, DefaultExpiryInterval, "After how long do we expire metrics (0 to disable)")
 	fs.Duration(ParamFlushInterval, DefaultFlushInterval, "How often to flush metrics to the backends")
+	fs.Bool(ParamFlushAligned, DefaultFlushAligned, "Flush on multiples of the flush interval since the epoch, rather than since startup")
 	fs.Bool(ParamIgnoreHost, DefaultIgnoreHost, "Ignore the source for populating the hostname field of metrics")
 	fs.Int(ParamMaxReaders, DefaultMaxReaders, "Maximum number of socket readers")
 	fs.Int(ParamMaxParsers, DefaultMaxParsers, "Maximum number of workers to parse datagrams into metrics")
@@ -179,7 +227,18 @@ func AddFlags(fs *pflag.FlagSet) {
 	fs.Int(ParamReceiveBatchSize, DefaultReceiveBatchSize, "The number of datagrams to read in each receive batch")
 	fs.Bool(ParamConnPerReader, DefaultConnPerReader, "Create a separate connection per reader (requires system support for reusing addresses)")
 	fs.String(ParamServerMode, DefaultServerMode, "The server mode to run in")
+	fs.String(ParamForwarderTransport, DefaultForwarderTransport, "The transport a forwarder sends metrics with [http, grpc]")
 	fs.String(ParamHostname, getHost(), "overrides the hostname of the server")
+	fs.Bool(ParamIntegerCounters, DefaultIntegerCounters, "Truncate each counter sample to an integer, as older versions did")
+	fs.Duration(ParamLateGracePeriod, DefaultLateGracePeriod, "How long before the current flush interval a client timestamp may be before the metric is late (0 to disable)")
+	fs.Bool(ParamLateFlush, DefaultLateFlush, "Flush late metrics with the timestamp of their own flush interval, rather than dropping them")
+	fs.Duration(ParamConfigReloadInterval, DefaultConfigReloadInterval, "How often to check the configuration file for changes to reload (0 to only reload on SIGHUP)")
+	fs.String(ParamFilterStateFile, "", "File to save filters added through the admin API to, so they survive restarts")
+	fs.Int(ParamBackendBreakerFailures, DefaultBackendBreakerFailures, "Number of consecutive failed sends after which a backend is skipped until the cooldown has passed, 0 to disable the circuit breaker")
+	fs.Duration(ParamBackendBreakerCooldown, DefaultBackendBreakerCooldown, "How long to skip a backend for after too many failed sends, before trying it again")
+	fs.String(ParamSpoolDir, "", "Directory to spool metrics which failed to send to a backend to, so they are sent once it recovers (empty to disable)")
+	fs.Duration(ParamSpoolMaxAge, DefaultSpoolMaxAge, "How old spooled metrics may be before they are dropped instead of sent (0 to never drop)")
+	fs.Int64(ParamSpoolMaxSize, DefaultSpoolMaxSize, "Maximum size in bytes of the spool for each backend, after which the oldest metrics are dropped")
 }
 
 func minInt(a, b int) int {
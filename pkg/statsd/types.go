@@ -20,6 +20,10 @@ type AggregateProcesser interface {
 // ProcessFunc is a function that gets executed by Aggregator with its state passed into the function.
 type ProcessFunc func(*gostatsd.MetricMap)
 
+// LateProcessFunc is a function that gets executed by Aggregator with the late metrics of an earlier interval, and
+// the start of that interval.
+type LateProcessFunc func(time.Time, *gostatsd.MetricMap)
+
 // Aggregator is an object that aggregates statsd metrics.
 // The function NewAggregator should be used to create the objects.
 //
@@ -29,7 +33,9 @@ type Aggregator interface {
 	ReceiveMap(mm *gostatsd.MetricMap)
 	Flush(interval time.Duration)
 	Process(ProcessFunc)
+	ProcessLate(LateProcessFunc)
 	Reset()
+	SetPercentThresholds([]float64)
 }
 
 // Datagram is a received UDP datagram that has not been parsed into Metric/Event(s)
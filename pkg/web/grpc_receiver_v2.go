@@ -0,0 +1,145 @@
+package web
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pb"
+	"github.com/atlassian/gostatsd/pkg/stats"
+
+	"github.com/sirupsen/logrus"
+)
+
+// grpcReceiverV2 implements pb.ForwarderV2Server, dispatching what it receives to a PipelineHandler.
+type grpcReceiverV2 struct {
+	requests                uint64 // atomic
+	requestFailureAuth      uint64 // atomic
+	requestFailureThrottled uint64 // atomic
+	requestFailureReceive   uint64 // atomic - streams which failed before they were closed
+	metricsProcessed        uint64 // atomic - metric messages dispatched
+	eventsProcessed         uint64 // atomic
+
+	logger     logrus.FieldLogger
+	handler    gostatsd.PipelineHandler
+	serverName string
+	tenants    *Tenants // nil if calls aren't authenticated
+}
+
+func newGrpcReceiverV2(logger logrus.FieldLogger, serverName string, handler gostatsd.PipelineHandler, tenants *Tenants) *grpcReceiverV2 {
+	return &grpcReceiverV2{
+		logger:     logger,
+		handler:    handler,
+		serverName: serverName,
+		tenants:    tenants,
+	}
+}
+
+func (grv *grpcReceiverV2) RunMetrics(ctx context.Context) {
+	statser := stats.FromContext(ctx).WithTags([]string{"server-name:" + grv.serverName})
+
+	notify, cancel := statser.RegisterFlush()
+	defer cancel()
+
+	for {
+		select {
+		case <-notify:
+			grv.emitMetrics(statser)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (grv *grpcReceiverV2) emitMetrics(statser stats.Statser) {
+	requests := atomic.SwapUint64(&grv.requests, 0)
+	metricsProcessed := atomic.SwapUint64(&grv.metricsProcessed, 0)
+	eventsProcessed := atomic.SwapUint64(&grv.eventsProcessed, 0)
+
+	statser.Count("grpc.incoming", float64(requests), []string{"result:success"})
+	statser.Count("grpc.incoming", float64(atomic.SwapUint64(&grv.requestFailureReceive, 0)), []string{"result:failure", "failure:receive"})
+	statser.Count("grpc.incoming.metrics", float64(metricsProcessed), nil)
+	statser.Count("grpc.incoming.events", float64(eventsProcessed), nil)
+
+	if grv.tenants != nil {
+		statser.Count("grpc.incoming", float64(atomic.SwapUint64(&grv.requestFailureAuth, 0)), []string{"result:failure", "failure:unauthorized"})
+		statser.Count("grpc.incoming", float64(atomic.SwapUint64(&grv.requestFailureThrottled, 0)), []string{"result:failure", "failure:throttled"})
+		grv.tenants.emitMetrics(statser, "grpc")
+	}
+}
+
+// SendMetrics receives every message on the stream before dispatching any of them, so a stream which fails part way
+// can be sent again by the forwarder without the metrics received before the failure being counted twice.  A tenant is
+// charged one request for the whole stream, with every series on it.
+func (grv *grpcReceiverV2) SendMetrics(stream pb.ForwarderV2_SendMetricsServer) error {
+	var mms []*gostatsd.MetricMap
+	series := 0
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			atomic.AddUint64(&grv.requestFailureReceive, 1)
+			grv.logger.WithError(err).Info("failed receiving metrics")
+			return err
+		}
+		mm := pb.ToMetricMap(msg, gostatsd.Nanotime(time.Now().UnixNano()))
+		series += countSeries(mm)
+		mms = append(mms, mm)
+	}
+
+	ctx := stream.Context()
+	if t := tenantFromContext(ctx); t != nil {
+		if err := grv.admit(t, series); err != nil {
+			return err
+		}
+		for i, mm := range mms {
+			mms[i] = t.tagMetricMap(mm)
+		}
+	}
+	for _, mm := range mms {
+		grv.handler.DispatchMetricMap(ctx, mm)
+	}
+
+	atomic.AddUint64(&grv.metricsProcessed, uint64(len(mms)))
+	atomic.AddUint64(&grv.requests, 1)
+	return stream.SendAndClose(&pb.SendReplyV2{Received: uint64(len(mms))})
+}
+
+// SendEvents receives every event on the stream before dispatching any of them, for the same reason as SendMetrics.
+func (grv *grpcReceiverV2) SendEvents(stream pb.ForwarderV2_SendEventsServer) error {
+	var events []*gostatsd.Event
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			atomic.AddUint64(&grv.requestFailureReceive, 1)
+			grv.logger.WithError(err).Info("failed receiving events")
+			return err
+		}
+		events = append(events, translateEventFromProtobufV2(msg))
+	}
+
+	ctx := stream.Context()
+	if t := tenantFromContext(ctx); t != nil {
+		if err := grv.admit(t, 0); err != nil {
+			return err
+		}
+		for _, event := range events {
+			event.Tags = t.tagTags(event.Tags)
+		}
+		atomic.AddUint64(&t.eventsAccepted, uint64(len(events)))
+	}
+	for _, event := range events {
+		grv.handler.DispatchEvent(ctx, event)
+	}
+
+	atomic.AddUint64(&grv.eventsProcessed, uint64(len(events)))
+	atomic.AddUint64(&grv.requests, 1)
+	return stream.SendAndClose(&pb.SendReplyV2{Received: uint64(len(events))})
+}
@@ -0,0 +1,257 @@
+package web_test
+
+import (
+	"context"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ash2k/stager/wait"
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pb"
+	"github.com/atlassian/gostatsd/pkg/statsd"
+	"github.com/atlassian/gostatsd/pkg/web"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tilinna/clock"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func (ch *capturingHandler) GetEvents() []*gostatsd.Event {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	e := make([]*gostatsd.Event, len(ch.e))
+	copy(e, ch.e)
+	return e
+}
+
+// newBufconnServer starts a gRPC server on an in-memory listener until ctx is done.
+func newBufconnServer(t *testing.T, ctx context.Context, ch *capturingHandler, tenants *web.Tenants) *bufconn.Listener {
+	gs, err := web.NewGrpcServer(logrus.StandardLogger(), ch, t.Name(), "", tenants, nil)
+	require.NoError(t, err)
+
+	listener := bufconn.Listen(1024 * 1024)
+	go gs.Serve(ctx, listener)
+	return listener
+}
+
+// newBufconnForwarder starts a gRPC server on an in-memory listener, and returns a forwarder connected to it.
+func newBufconnForwarder(t *testing.T, ctx context.Context, ch *capturingHandler, maxSeries int, compress bool) *statsd.GrpcForwarderHandlerV2 {
+	listener := newBufconnServer(t, ctx, ch, nil)
+
+	gfh, err := statsd.NewGrpcForwarderHandlerV2(
+		logrus.StandardLogger(),
+		"bufconn",
+		5,
+		10,
+		maxSeries,
+		compress,
+		nil,
+		10*time.Second,
+		10*time.Second,
+		10*time.Millisecond,
+		10*time.Millisecond,
+		grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+			return listener.Dial()
+		}),
+	)
+	require.NoError(t, err)
+	return gfh
+}
+
+func TestGrpcForwardingEndToEndV2(t *testing.T) {
+	t.Parallel()
+
+	for _, compress := range []bool{false, true} {
+		compress := compress
+		name := "identity"
+		if compress {
+			name = "gzip"
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			ctxTest, testDone := testContext(t)
+			mockClock := clock.NewMock(time.Unix(0, 0))
+			ctxTest = clock.Context(ctxTest, mockClock)
+
+			ch := &capturingHandler{}
+			// Every series is sent in its own message, so each batch is several messages on a stream.
+			gfh := newBufconnForwarder(t, ctxTest, ch, 1, compress)
+
+			var wg wait.Group
+			wg.StartWithContext(ctxTest, gfh.Run)
+			defer wg.Wait()
+
+			for i := 0; i < 10; i++ {
+				gfh.DispatchMetrics(ctxTest, []*gostatsd.Metric{
+					{Name: "counter", Type: gostatsd.COUNTER, Value: 10, Rate: 1},
+					{Name: "counter", Type: gostatsd.COUNTER, Value: 10, Rate: 0.1, Tags: gostatsd.Tags{"a:b"}, TagsKey: "a:b"},
+					{Name: "gauge", Type: gostatsd.GAUGE, Value: 10, Rate: 1},
+					{Name: "set", Type: gostatsd.SET, StringValue: "abc", Rate: 1},
+				})
+			}
+			gfh.DispatchMetrics(ctxTest, []*gostatsd.Metric{{Name: "timer", Type: gostatsd.TIMER, Value: 10, Rate: 1}})
+
+			// There's no good way to tell when the Ticker has been created, so we use a hard loop
+			for _, d := mockClock.AddNext(); d == 0 && ctxTest.Err() == nil; _, d = mockClock.AddNext() {
+				time.Sleep(time.Millisecond) // Allows the system to actually idle, runtime.Gosched() does not.
+			}
+			mockClock.Add(1 * time.Second) // Make sure everything gets scheduled
+			for len(ch.GetMetrics()) < 5 && ctxTest.Err() == nil {
+				mockClock.Add(10 * time.Millisecond) // Close the stream once it has been open for max-stream-age
+				time.Sleep(time.Millisecond)         // Give the stream time to actually complete
+			}
+
+			expected := []*gostatsd.Metric{
+				{Name: "counter", Type: gostatsd.COUNTER, Value: 10 * 10, Rate: 1},
+				{Name: "counter", Type: gostatsd.COUNTER, Value: 10 * 10 / 0.1, Rate: 1, Tags: gostatsd.Tags{"a:b"}, TagsKey: "a:b"},
+				{Name: "gauge", Type: gostatsd.GAUGE, Value: 10, Rate: 1},
+				{Name: "set", Type: gostatsd.SET, StringValue: "abc", Rate: 1},
+				{Name: "timer", Type: gostatsd.TIMER, Value: 10, Rate: 1},
+			}
+
+			actual := ch.GetMetrics()
+			for _, metric := range actual {
+				metric.Timestamp = 0 // This isn't propagated through v2, and is set to the time of receive
+			}
+			cmpSort := func(slice []*gostatsd.Metric) func(i, j int) bool {
+				return func(i, j int) bool {
+					if slice[i].Name == slice[j].Name {
+						return len(slice[i].Tags) < len(slice[j].Tags)
+					}
+					return slice[i].Name < slice[j].Name
+				}
+			}
+			sort.Slice(actual, cmpSort(actual))
+			sort.Slice(expected, cmpSort(expected))
+
+			require.EqualValues(t, expected, actual)
+			testDone()
+		})
+	}
+}
+
+func TestGrpcForwardingEventV2(t *testing.T) {
+	t.Parallel()
+
+	ctxTest, testDone := testContext(t)
+	ch := &capturingHandler{}
+	gfh := newBufconnForwarder(t, ctxTest, ch, 1, true)
+
+	var wg wait.Group
+	wg.StartWithContext(ctxTest, gfh.Run)
+	defer wg.Wait()
+
+	event := &gostatsd.Event{
+		Title:          "title",
+		Text:           "text",
+		DateHappened:   10,
+		Hostname:       "host",
+		AggregationKey: "key",
+		SourceTypeName: "source",
+		Tags:           gostatsd.Tags{"a:b"},
+		SourceIP:       "127.0.0.1",
+		Priority:       gostatsd.PriLow,
+		AlertType:      gostatsd.AlertWarning,
+	}
+	gfh.DispatchEvent(ctxTest, event)
+	gfh.WaitForEvents()
+
+	events := ch.GetEvents()
+	require.Len(t, events, 1)
+	assert.Equal(t, event, events[0])
+	testDone()
+}
+
+func TestGrpcTenants(t *testing.T) {
+	t.Parallel()
+
+	ctxTest, testDone := testContext(t)
+	defer testDone()
+	v := viper.New()
+	v.Set("tenant.a.tokens", []string{"secret-a"})
+	v.Set("tenant.a.namespace", "team-a")
+	v.Set("tenant.a.max-series-per-second", 2)
+	v.Set("tenant.a.quota-burst", "1s")
+	tenants, err := web.NewTenantsFromViper(v, []string{"a"})
+	require.NoError(t, err)
+
+	ch := &capturingHandler{}
+	listener := newBufconnServer(t, ctxTest, ch, tenants)
+	conn, err := grpc.DialContext(ctxTest, "bufconn", grpc.WithInsecure(), grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+		return listener.Dial()
+	}))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := pb.NewForwarderV2Client(conn)
+
+	msg := &pb.RawMessageV2{Counters: map[string]*pb.CounterTagV2{
+		"requests": {TagMap: map[string]*pb.RawCounterV2{"tenant:b": {Tags: []string{"tenant:b"}, FloatValue: 1}}},
+	}}
+	_, err = sendMetricsStream(ctxTest, client, msg)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	ctxWrong := metadata.AppendToOutgoingContext(ctxTest, "authorization", "Bearer wrong")
+	_, err = sendMetricsStream(ctxWrong, client, msg)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = sendEventsStream(ctxWrong, client, &pb.EventV2{Title: "deploy"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.Empty(t, ch.GetMetrics())
+
+	ctxA := metadata.AppendToOutgoingContext(ctxTest, "authorization", "Bearer secret-a")
+	reply, err := sendMetricsStream(ctxA, client, msg)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, reply.Received)
+	metrics := ch.GetMetrics()
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "team-a.requests", metrics[0].Name)
+	assert.Equal(t, gostatsd.Tags{"tenant:a"}, metrics[0].Tags, "the tenant tag should replace a spoofed one")
+
+	_, err = sendMetricsStream(ctxA, client, msg, msg)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "the series quota should be charged for the whole stream")
+	assert.Len(t, ch.GetMetrics(), 1, "nothing on a rejected stream should be dispatched")
+
+	reply, err = sendEventsStream(ctxA, client, &pb.EventV2{Title: "deploy", Tags: []string{"tenant:b"}}, &pb.EventV2{Title: "rollback"})
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, reply.Received)
+	events := ch.GetEvents()
+	require.Len(t, events, 2)
+	assert.Equal(t, gostatsd.Tags{"tenant:a"}, events[0].Tags)
+	assert.Equal(t, gostatsd.Tags{"tenant:a"}, events[1].Tags)
+}
+
+// sendMetricsStream sends msgs on a single stream, and closes it.
+func sendMetricsStream(ctx context.Context, client pb.ForwarderV2Client, msgs ...*pb.RawMessageV2) (*pb.SendReplyV2, error) {
+	stream, err := client.SendMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		if err = stream.Send(msg); err != nil {
+			break
+		}
+	}
+	// Send returns io.EOF if the stream was aborted, and the reason is returned by CloseAndRecv.
+	return stream.CloseAndRecv()
+}
+
+// sendEventsStream sends events on a single stream, and closes it.
+func sendEventsStream(ctx context.Context, client pb.ForwarderV2Client, events ...*pb.EventV2) (*pb.SendReplyV2, error) {
+	stream, err := client.SendEvents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		if err = stream.Send(event); err != nil {
+			break
+		}
+	}
+	return stream.CloseAndRecv()
+}
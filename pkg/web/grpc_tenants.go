@@ -0,0 +1,91 @@
+package web
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+type tenantContextKey struct{}
+
+// tenantFromContext returns the tenant a call is from, or nil if calls aren't authenticated.
+func tenantFromContext(ctx context.Context) *tenant {
+	t, _ := ctx.Value(tenantContextKey{}).(*tenant)
+	return t
+}
+
+// authenticateGrpc returns the tenant a call is from, or nil if it has no valid credential.  A bearer token in the
+// authorization metadata is used if the call has one, otherwise the verified client certificate.
+func (ts *Tenants) authenticateGrpc(ctx context.Context) *tenant {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if auth := md.Get("authorization"); len(auth) > 0 {
+			return ts.byBearer(auth[0])
+		}
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil
+	}
+	return ts.byCertificate(&tlsInfo.State)
+}
+
+// authenticate adds the tenant a call is from to its context, or fails the call with Unauthenticated if it has no
+// valid credential.  Quotas are taken by the methods, once they know how many series a stream has.
+func (grv *grpcReceiverV2) authenticate(ctx context.Context) (context.Context, error) {
+	t := grv.tenants.authenticateGrpc(ctx)
+	if t == nil {
+		atomic.AddUint64(&grv.requestFailureAuth, 1)
+		return nil, status.Error(codes.Unauthenticated, "a valid bearer token or client certificate is required")
+	}
+	return context.WithValue(ctx, tenantContextKey{}, t), nil
+}
+
+// unaryAuthenticator is a grpc.UnaryServerInterceptor which authenticates every call.
+func (grv *grpcReceiverV2) unaryAuthenticator(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := grv.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// streamAuthenticator is a grpc.StreamServerInterceptor which authenticates every stream, so no method can be
+// reached without a credential.
+func (grv *grpcReceiverV2) streamAuthenticator(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := grv.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+}
+
+// authenticatedStream is a grpc.ServerStream whose context has the tenant it is from.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (as *authenticatedStream) Context() context.Context {
+	return as.ctx
+}
+
+// admit takes a request and series from the quotas of the tenant a stream is from.  If either quota is exhausted, it
+// returns a ResourceExhausted error, which the forwarder retries with backoff.
+func (grv *grpcReceiverV2) admit(t *tenant, series int) error {
+	if _, ok := t.admit(time.Now(), series); !ok {
+		atomic.AddUint64(&grv.requestFailureThrottled, 1)
+		return status.Error(codes.ResourceExhausted, "tenant quota exceeded")
+	}
+	return nil
+}
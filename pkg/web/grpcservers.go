@@ -0,0 +1,181 @@
+package web
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/internal/tlsconfig"
+	"github.com/atlassian/gostatsd/pb"
+
+	"github.com/ash2k/stager/wait"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tilinna/clock"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	_ "google.golang.org/grpc/encoding/gzip" // Accept messages compressed by the forwarder
+)
+
+type grpcServer struct {
+	logger   logrus.FieldLogger
+	address  string
+	server   *grpc.Server
+	receiver *grpcReceiverV2
+}
+
+func NewGrpcServersFromViper(v *viper.Viper, logger logrus.FieldLogger, handler gostatsd.PipelineHandler) ([]*grpcServer, error) {
+	grpcServerNames := v.GetStringSlice("grpc-servers")
+	servers := make([]*grpcServer, 0, len(grpcServerNames))
+	for _, grpcServerName := range grpcServerNames {
+		server, err := newGrpcServerFromViper(logger, v, grpcServerName, handler)
+		if err != nil {
+			return nil, fmt.Errorf("failed to make grpc-server %s: %v", grpcServerName, err)
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+func newGrpcServerFromViper(
+	logger logrus.FieldLogger,
+	vMain *viper.Viper,
+	serverName string,
+	handler gostatsd.PipelineHandler,
+) (*grpcServer, error) {
+	vSub := getSubViper(vMain, "grpc."+serverName)
+	vSub.SetDefault("address", "127.0.0.1:8081")
+	vSub.SetDefault("tls-cert-path", "")
+	vSub.SetDefault("tls-key-path", "")
+	vSub.SetDefault("tls-client-ca-path", "")
+	vSub.SetDefault("tenants", []string{})
+
+	var tenants *Tenants
+	if tenantNames := vSub.GetStringSlice("tenants"); len(tenantNames) > 0 {
+		var err error
+		if tenants, err = NewTenantsFromViper(vMain, tenantNames); err != nil {
+			return nil, err
+		}
+	}
+
+	tlsConfig, err := tlsconfig.Server(
+		vSub.GetString("tls-cert-path"),
+		vSub.GetString("tls-key-path"),
+		vSub.GetString("tls-client-ca-path"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if tenants != nil && tlsConfig != nil && tlsConfig.ClientCAs != nil {
+		// Client certificates identify tenants, but aren't required with bearer tokens.
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return NewGrpcServer(
+		logger.WithField("grpc-server", serverName),
+		handler,
+		serverName,
+		vSub.GetString("address"),
+		tenants,
+		tlsConfig,
+	)
+}
+
+// NewGrpcServer returns a server which receives metrics and events from forwarders over gRPC, and dispatches them to
+// handler.  If tenants is not nil, every call must authenticate as one of them.  If tlsConfig is nil, the server does
+// not use TLS.
+func NewGrpcServer(
+	logger logrus.FieldLogger,
+	handler gostatsd.PipelineHandler,
+	serverName, address string,
+	tenants *Tenants,
+	tlsConfig *tls.Config,
+) (*grpcServer, error) {
+	receiver := newGrpcReceiverV2(logger, serverName, handler, tenants)
+
+	var opts []grpc.ServerOption
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	if tenants != nil {
+		opts = append(opts, grpc.UnaryInterceptor(receiver.unaryAuthenticator), grpc.StreamInterceptor(receiver.streamAuthenticator))
+	}
+
+	server := &grpcServer{
+		logger:   logger,
+		address:  address,
+		server:   grpc.NewServer(opts...),
+		receiver: receiver,
+	}
+	pb.RegisterForwarderV2Server(server.server, server.receiver)
+
+	logger.WithFields(logrus.Fields{
+		"address": address,
+		"tenants": tenants != nil,
+		"tls":     tlsConfig != nil,
+	}).Info("Created server")
+
+	return server, nil
+}
+
+func (gs *grpcServer) Run(ctx context.Context) {
+	listener, err := net.Listen("tcp", gs.address)
+	if err != nil {
+		gs.logger.WithError(err).Error("grpc server failed to listen")
+		return
+	}
+	gs.Serve(ctx, listener)
+}
+
+// Serve accepts connections on listener until the context is done, then stops gracefully.
+func (gs *grpcServer) Serve(ctx context.Context, listener net.Listener) {
+	var wg wait.Group
+	defer wg.Wait()
+	wg.StartWithContext(ctx, gs.receiver.RunMetrics)
+
+	chStopped := make(chan struct{}, 1)
+	go gs.waitAndStop(ctx, chStopped)
+
+	gs.logger.WithField("address", listener.Addr().String()).Info("listening")
+
+	if err := gs.server.Serve(listener); err != nil {
+		gs.logger.WithError(err).Error("grpc server failed")
+		gs.server.Stop()
+		return
+	}
+
+	// Wait for graceful shutdown of existing streams
+	timer := clock.NewTimer(ctx, 6*time.Second)
+	defer timer.Stop()
+	select {
+	case <-chStopped:
+		// happy
+	case <-timer.C:
+		gs.logger.Info("timeout waiting for grpc server to stop")
+	}
+}
+
+// waitAndStop will gracefully stop the server when the Context passed is cancelled, and stop it forcefully if streams
+// are still open after 5 seconds.  It signals on chStopped when it is done.
+func (gs *grpcServer) waitAndStop(ctx context.Context, chStopped chan<- struct{}) {
+	<-ctx.Done()
+
+	gs.logger.Info("shutting down grpc server")
+	graceful := make(chan struct{})
+	go func() {
+		gs.server.GracefulStop()
+		close(graceful)
+	}()
+	timer := clock.NewTimer(ctx, 5*time.Second)
+	defer timer.Stop()
+	select {
+	case <-graceful:
+	case <-timer.C:
+		gs.logger.Warn("failed to stop grpc server gracefully")
+		gs.server.Stop()
+	}
+	chStopped <- done
+}
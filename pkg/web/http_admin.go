@@ -0,0 +1,138 @@
+package web
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// FilterManager manages filters at runtime, in addition to the filters from the configuration.
+type FilterManager interface {
+	// Filters returns every filter, starting with the filters from the configuration.
+	Filters() []FilterStatus
+	// SetFilter adds or replaces the named runtime filter.  config uses the same keys as a filter section in the
+	// configuration file.
+	SetFilter(name string, config map[string]interface{}) error
+	// DeleteFilter removes the named runtime filter, returning false if it does not exist.
+	DeleteFilter(name string) (bool, error)
+}
+
+// FilterStatus describes a filter, and how many metrics it has matched.
+type FilterStatus struct {
+	Name    string                 `json:"name"`
+	Source  string                 `json:"source"` // "config" or "admin"
+	Config  map[string]interface{} `json:"config,omitempty"`
+	Matches uint64                 `json:"matches"`
+}
+
+// InvalidFilterError is returned by a FilterManager when a request can't be applied, as opposed to failing.
+type InvalidFilterError struct {
+	Message string
+}
+
+func (e *InvalidFilterError) Error() string {
+	return e.Message
+}
+
+type filterAdmin struct {
+	logger    logrus.FieldLogger
+	manager   FilterManager
+	tokenHash *[sha256.Size]byte // Hash of the bearer token every request must have, nil to refuse every request
+}
+
+// authorize wraps handler so it is only called for requests with the admin bearer token.
+func (fa *filterAdmin) authorize(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		const prefix = "Bearer "
+		auth := req.Header.Get("Authorization")
+		if fa.tokenHash == nil || len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		hash := sha256.Sum256([]byte(auth[len(prefix):]))
+		if subtle.ConstantTimeCompare(hash[:], fa.tokenHash[:]) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, req)
+	}
+}
+
+// list returns every filter.
+func (fa *filterAdmin) list(w http.ResponseWriter, req *http.Request) {
+	fa.writeJSON(w, http.StatusOK, fa.manager.Filters())
+}
+
+// get returns the named filter.
+func (fa *filterAdmin) get(w http.ResponseWriter, req *http.Request) {
+	status, ok := fa.find(mux.Vars(req)["name"])
+	if !ok {
+		http.Error(w, "filter not found", http.StatusNotFound)
+		return
+	}
+	fa.writeJSON(w, http.StatusOK, status)
+}
+
+// put adds or replaces the named filter, from a JSON object with the same keys as the configuration file.
+func (fa *filterAdmin) put(w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	var config map[string]interface{}
+	if err := json.NewDecoder(req.Body).Decode(&config); err != nil {
+		http.Error(w, "invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := fa.manager.SetFilter(name, config); err != nil {
+		fa.writeError(w, err)
+		return
+	}
+	fa.logger.WithField("filter", name).Info("Set filter")
+	status, _ := fa.find(name)
+	fa.writeJSON(w, http.StatusOK, status)
+}
+
+// delete removes the named filter.
+func (fa *filterAdmin) delete(w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	found, err := fa.manager.DeleteFilter(name)
+	if err != nil {
+		fa.writeError(w, err)
+		return
+	}
+	if !found {
+		http.Error(w, "filter not found", http.StatusNotFound)
+		return
+	}
+	fa.logger.WithField("filter", name).Info("Deleted filter")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (fa *filterAdmin) find(name string) (FilterStatus, bool) {
+	for _, status := range fa.manager.Filters() {
+		if status.Name == name {
+			return status, true
+		}
+	}
+	return FilterStatus{}, false
+}
+
+func (fa *filterAdmin) writeError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*InvalidFilterError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fa.logger.WithError(err).Error("Failed to update filters")
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func (fa *filterAdmin) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fa.logger.WithError(err).Warn("Failed to write response")
+	}
+}
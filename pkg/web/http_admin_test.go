@@ -0,0 +1,137 @@
+package web_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd/pkg/web"
+)
+
+type fakeFilterManager struct {
+	filters []web.FilterStatus
+	err     error
+}
+
+func (ffm *fakeFilterManager) Filters() []web.FilterStatus {
+	return ffm.filters
+}
+
+func (ffm *fakeFilterManager) SetFilter(name string, config map[string]interface{}) error {
+	if ffm.err != nil {
+		return ffm.err
+	}
+	if _, ok := config["drop-metric"]; !ok {
+		return &web.InvalidFilterError{Message: "missing drop-metric"}
+	}
+	ffm.filters = append(ffm.filters, web.FilterStatus{Name: name, Source: "admin", Config: config})
+	return nil
+}
+
+func (ffm *fakeFilterManager) DeleteFilter(name string) (bool, error) {
+	for idx, status := range ffm.filters {
+		if status.Name == name {
+			ffm.filters = append(ffm.filters[:idx], ffm.filters[idx+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func TestAdminFilters(t *testing.T) {
+	t.Parallel()
+	ffm := &fakeFilterManager{filters: []web.FilterStatus{{Name: "a", Source: "config", Matches: 3}}}
+	hs, err := web.NewHttpServer(logrus.StandardLogger(), nil, web.HttpServerOptions{
+		ServerName:    "TestAdminFilters",
+		FilterManager: ffm,
+		EnableAdmin:   true,
+	})
+	require.NoError(t, err)
+	c := httptest.NewServer(hs.Router)
+	defer c.Close()
+
+	token := ""
+	do := func(method, path, body string) (int, string) {
+		req, err := http.NewRequest(method, c.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, strings.TrimSpace(string(data))
+	}
+
+	// Nothing is allowed until a token is set, and then only with the token
+	code, _ := do("GET", "/admin/filters", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	require.NoError(t, hs.SetAdminToken("secret"))
+	code, _ = do("PUT", "/admin/filters/b", `{"drop-metric": true}`)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	token = "wrong"
+	code, _ = do("GET", "/admin/filters", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	token = "secret"
+
+	code, body := do("GET", "/admin/filters", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `[{"name":"a","source":"config","matches":3}]`, body)
+
+	code, body = do("PUT", "/admin/filters/b", `{"drop-metric": true}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"name":"b","source":"admin","config":{"drop-metric":true},"matches":0}`, body)
+
+	code, _ = do("GET", "/admin/filters/b", "")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _ = do("PUT", "/admin/filters/c", `{}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do("PUT", "/admin/filters/c", `not json`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	ffm.err = errors.New("disk full")
+	code, _ = do("PUT", "/admin/filters/c", `{"drop-metric": true}`)
+	assert.Equal(t, http.StatusInternalServerError, code)
+
+	code, _ = do("DELETE", "/admin/filters/b", "")
+	assert.Equal(t, http.StatusNoContent, code)
+	code, _ = do("DELETE", "/admin/filters/b", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = do("GET", "/admin/filters/b", "")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestAdminRequiresFilterManager(t *testing.T) {
+	t.Parallel()
+	_, err := web.NewHttpServer(logrus.StandardLogger(), nil, web.HttpServerOptions{
+		ServerName:  "TestAdminRequiresFilterManager",
+		EnableAdmin: true,
+	})
+	assert.Error(t, err)
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	t.Parallel()
+	hs, err := web.NewHttpServer(logrus.StandardLogger(), nil, web.HttpServerOptions{
+		ServerName:        "TestAdminRequiresToken",
+		EnableHealthcheck: true,
+	})
+	require.NoError(t, err)
+	assert.Error(t, hs.SetAdminToken("secret"), "admin is not enabled")
+
+	v := viper.New()
+	v.Set("http-servers", "admin")
+	v.Set("http.admin.enable-admin", true)
+	_, err = web.NewHttpServersFromViper(v, logrus.StandardLogger(), nil, nil, &fakeFilterManager{}, nil, nil)
+	assert.Error(t, err)
+}
@@ -2,12 +2,20 @@ package web
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 )
 
+// HealthReporter reports problems with downstream dependencies, which make the deep check fail.
+type HealthReporter interface {
+	// HealthProblems returns a description of each unhealthy dependency, or nothing if they are all healthy.
+	HealthProblems() []string
+}
+
 type healthChecker struct {
 	logger logrus.FieldLogger
+	health HealthReporter // May be nil
 }
 
 // healthCheck reports if the server is ready to process traffic.  It does not validate downstream dependencies.
@@ -17,8 +25,15 @@ func (hc *healthChecker) healthCheck(w http.ResponseWriter, req *http.Request) {
 }
 
 // deepCheck reports on the status of downstream dependencies.  It should be non-blocking (ie, report on the status
-// of watchdogs, rather than make roundtrips).  For now, it just reports that it's always happy.
+// of watchdogs, rather than make roundtrips).  It fails if any backend has an open circuit breaker.
 func (hc *healthChecker) deepCheck(w http.ResponseWriter, req *http.Request) {
 	hc.logger.Info("deepCheck")
+	if hc.health != nil {
+		if problems := hc.health.HealthProblems(); len(problems) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(strings.Join(problems, "\n")))
+			return
+		}
+	}
 	_, _ = w.Write([]byte("OK"))
 }
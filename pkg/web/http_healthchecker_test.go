@@ -0,0 +1,53 @@
+package web_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd/pkg/web"
+)
+
+type fakeHealthReporter struct {
+	problems []string
+}
+
+func (fhr *fakeHealthReporter) HealthProblems() []string {
+	return fhr.problems
+}
+
+func TestDeepCheckReportsProblems(t *testing.T) {
+	t.Parallel()
+	health := &fakeHealthReporter{}
+	hs, err := web.NewHttpServer(logrus.StandardLogger(), nil, web.HttpServerOptions{
+		ServerName:        "TestDeepCheckReportsProblems",
+		Health:            health,
+		EnableHealthcheck: true,
+	})
+	require.NoError(t, err)
+	c := httptest.NewServer(hs.Router)
+	defer c.Close()
+
+	get := func() (int, string) {
+		resp, err := http.Get(c.URL + "/deepcheck")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	code, body := get()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "OK", body)
+
+	health.problems = []string{"circuit breaker for backend a is open", "circuit breaker for backend b is open"}
+	code, body = get()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "circuit breaker for backend a is open\ncircuit breaker for backend b is open", body)
+}
@@ -0,0 +1,160 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// LineParser parses statsd lines received over http.
+type LineParser interface {
+	// ParseLines parses newline separated lines received from ip, returning the Metrics and Events, and the number of
+	// lines which failed to parse.
+	ParseLines(ip gostatsd.IP, msg []byte) ([]*gostatsd.Metric, []*gostatsd.Event, uint64)
+}
+
+// linesResult is the response to a request to /v1/lines.
+type linesResult struct {
+	Accepted uint64 `json:"accepted"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// LineHandler accepts newline separated statsd and DogStatsD lines, for clients which can send neither UDP nor
+// protobuf.
+func (rhh *rawHttpHandlerV2) LineHandler(w http.ResponseWriter, req *http.Request) {
+	if rhh.overloaded(w) {
+		return
+	}
+	tenant, ok := rhh.authorize(w, req)
+	if !ok {
+		return
+	}
+
+	b, errCode := rhh.readBody(w, req, maxLinesBodySize)
+
+	if errCode != 0 {
+		w.WriteHeader(errCode)
+		return
+	}
+
+	metrics, events, rejected := rhh.lines.ParseLines(rhh.sourceIP(req), b)
+	if tenant != nil {
+		if !rhh.admit(w, tenant, countMetricSeries(metrics)) {
+			return
+		}
+		for _, m := range metrics {
+			m.Name = tenant.tagName(m.Name)
+			m.Tags = tenant.tagTags(m.Tags)
+		}
+		for _, e := range events {
+			e.Tags = tenant.tagTags(e.Tags)
+		}
+		atomic.AddUint64(&tenant.eventsAccepted, uint64(len(events)))
+	}
+	if len(metrics) > 0 {
+		rhh.handler.DispatchMetrics(req.Context(), metrics)
+	}
+	for _, e := range events {
+		rhh.handler.DispatchEvent(req.Context(), e)
+	}
+
+	result := linesResult{
+		Accepted: uint64(len(metrics) + len(events)),
+		Rejected: rejected,
+	}
+	atomic.AddUint64(&rhh.metricsProcessed, uint64(len(metrics)))
+	atomic.AddUint64(&rhh.eventsProcessed, uint64(len(events)))
+	atomic.AddUint64(&rhh.linesAccepted, result.Accepted)
+	atomic.AddUint64(&rhh.linesRejected, result.Rejected)
+	atomic.AddUint64(&rhh.requestSuccess, 1)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// countMetricSeries returns the number of distinct series in metrics.
+func countMetricSeries(metrics []*gostatsd.Metric) int {
+	type series struct {
+		metricType gostatsd.MetricType
+		name       string
+		tagsKey    string
+	}
+	seen := make(map[series]struct{}, len(metrics))
+	for _, m := range metrics {
+		seen[series{m.Type, m.Name, gostatsd.FormatTagsKey(m.Hostname, m.Tags)}] = struct{}{}
+	}
+	return len(seen)
+}
+
+// sourceIP returns the address a request was sent from.  X-Forwarded-For is only believed if the request came from a
+// trusted proxy, in which case the last address in it which isn't also a trusted proxy is used.
+func (rhh *rawHttpHandlerV2) sourceIP(req *http.Request) gostatsd.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if !rhh.trustedProxy(host) {
+		return gostatsd.IP(host)
+	}
+
+	var forwarded []string
+	for _, header := range req.Header["X-Forwarded-For"] {
+		for _, address := range strings.Split(header, ",") {
+			forwarded = append(forwarded, strings.TrimSpace(address))
+		}
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		if net.ParseIP(forwarded[i]) == nil {
+			break // The last trusted proxy is the best we know
+		}
+		host = forwarded[i]
+		if !rhh.trustedProxy(host) {
+			break
+		}
+	}
+	return gostatsd.IP(host)
+}
+
+func (rhh *rawHttpHandlerV2) trustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range rhh.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses a list of addresses and CIDR ranges.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", proxy, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
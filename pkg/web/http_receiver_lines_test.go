@@ -0,0 +1,208 @@
+package web_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/statsd"
+	"github.com/atlassian/gostatsd/pkg/web"
+)
+
+func newLinesServer(t *testing.T, ch *capturingHandler, trustedProxies ...string) http.Handler {
+	parser := statsd.NewDatagramParser(nil, "", false, 0, ch, 0)
+	hs, err := web.NewHttpServer(logrus.StandardLogger(), ch, web.HttpServerOptions{
+		ServerName:      t.Name(),
+		Lines:           parser,
+		EnableIngestion: true,
+	})
+	require.NoError(t, err)
+	if len(trustedProxies) > 0 {
+		require.NoError(t, hs.SetTrustedProxies(trustedProxies))
+	}
+	return hs.Router
+}
+
+func postLines(t *testing.T, handler http.Handler, body []byte, headers map[string]string) (int, map[string]uint64) {
+	req := httptest.NewRequest("POST", "/v1/lines", bytes.NewReader(body))
+	for header, value := range headers {
+		req.Header.Set(header, value)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	var result map[string]uint64
+	if w.Code == http.StatusAccepted {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	}
+	return w.Code, result
+}
+
+func TestLineHandler(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+	handler := newLinesServer(t, ch)
+
+	code, result := postLines(t, handler, []byte("a:1|c\nb:2|g|#x:y\nnot a metric\n_e{5,4}:title|text\n"), nil)
+	require.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, map[string]uint64{"accepted": 3, "rejected": 1}, result)
+
+	metrics := ch.GetMetrics()
+	require.Len(t, metrics, 2)
+	assert.Equal(t, "a", metrics[0].Name)
+	assert.Equal(t, "b", metrics[1].Name)
+	assert.Equal(t, gostatsd.Tags{"x:y"}, metrics[1].Tags)
+	assert.Equal(t, gostatsd.IP("192.0.2.1"), metrics[0].SourceIP, "the source should be stamped from the request")
+	events := ch.GetEvents()
+	require.Len(t, events, 1)
+	assert.Equal(t, "title", events[0].Title)
+}
+
+func TestLineHandlerGzip(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+	handler := newLinesServer(t, ch)
+
+	var buf bytes.Buffer
+	compressor := gzip.NewWriter(&buf)
+	_, _ = compressor.Write([]byte("a:1|c\nb:1|c"))
+	require.NoError(t, compressor.Close())
+
+	code, result := postLines(t, handler, buf.Bytes(), map[string]string{"Content-Encoding": "gzip"})
+	require.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, map[string]uint64{"accepted": 2, "rejected": 0}, result)
+	assert.Len(t, ch.GetMetrics(), 2)
+
+	code, _ = postLines(t, handler, []byte("a:1|c"), map[string]string{"Content-Encoding": "gzip"})
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestLineHandlerTooLarge(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+	handler := newLinesServer(t, ch)
+
+	line := []byte("a:1|c\n")
+	body := bytes.Repeat(line, (1<<20)/len(line)+1)
+	code, _ := postLines(t, handler, body, nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+
+	var buf bytes.Buffer
+	compressor := gzip.NewWriter(&buf)
+	_, _ = compressor.Write(body)
+	require.NoError(t, compressor.Close())
+	require.True(t, buf.Len() < 1<<20)
+	code, _ = postLines(t, handler, buf.Bytes(), map[string]string{"Content-Encoding": "gzip"})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code, "the limit should apply after decompression too")
+	assert.Empty(t, ch.GetMetrics())
+}
+
+func TestLineHandlerForwardedFor(t *testing.T) {
+	t.Parallel()
+	for name, tc := range map[string]struct {
+		trustedProxies []string
+		forwardedFor   string
+		expected       gostatsd.IP
+	}{
+		"untrusted":       {forwardedFor: "198.51.100.7", expected: "192.0.2.1"},
+		"trusted":         {trustedProxies: []string{"192.0.2.0/24"}, forwardedFor: "198.51.100.7", expected: "198.51.100.7"},
+		"proxy chain":     {trustedProxies: []string{"192.0.2.1", "10.0.0.0/8"}, forwardedFor: "203.0.113.9, 198.51.100.7, 10.1.2.3", expected: "198.51.100.7"},
+		"spoofed":         {trustedProxies: []string{"192.0.2.1"}, forwardedFor: "garbage, 198.51.100.7", expected: "198.51.100.7"},
+		"invalid address": {trustedProxies: []string{"192.0.2.1"}, forwardedFor: "garbage", expected: "192.0.2.1"},
+		"no header":       {trustedProxies: []string{"192.0.2.1"}, expected: "192.0.2.1"},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			ch := &capturingHandler{}
+			handler := newLinesServer(t, ch, tc.trustedProxies...)
+
+			headers := map[string]string{}
+			if tc.forwardedFor != "" {
+				headers["X-Forwarded-For"] = tc.forwardedFor
+			}
+			code, _ := postLines(t, handler, []byte("a:1|c"), headers)
+			require.Equal(t, http.StatusAccepted, code)
+			metrics := ch.GetMetrics()
+			require.Len(t, metrics, 1)
+			assert.Equal(t, tc.expected, metrics[0].SourceIP)
+		})
+	}
+}
+
+func TestSetTrustedProxiesInvalid(t *testing.T) {
+	t.Parallel()
+	hs, err := web.NewHttpServer(logrus.StandardLogger(), nil, web.HttpServerOptions{
+		ServerName:      t.Name(),
+		EnableIngestion: true,
+	})
+	require.NoError(t, err)
+	assert.Error(t, hs.SetTrustedProxies([]string{"not an address"}))
+	assert.Error(t, hs.SetTrustedProxies([]string{"10.0.0.0/33"}))
+	assert.NoError(t, hs.SetTrustedProxies([]string{"10.0.0.1", "2001:db8::/32", "2001:db8::1"}))
+}
+
+func TestLineHandlerTenant(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("tenant.a.tokens", []string{"secret-a"})
+	v.Set("tenant.a.namespace", "team-a")
+	tenants, err := web.NewTenantsFromViper(v, []string{"a"})
+	require.NoError(t, err)
+
+	ch := &capturingHandler{}
+	parser := statsd.NewDatagramParser(nil, "", false, 0, ch, 0)
+	hs, err := web.NewHttpServer(logrus.StandardLogger(), ch, web.HttpServerOptions{
+		ServerName:      t.Name(),
+		Lines:           parser,
+		EnableIngestion: true,
+		Tenants:         tenants,
+	})
+	require.NoError(t, err)
+
+	code, _ := postLines(t, hs.Router, []byte("a:1|c|#tenant:b"), nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, result := postLines(t, hs.Router, []byte("a:1|c|#tenant:b"), map[string]string{"Authorization": "Bearer secret-a"})
+	require.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, map[string]uint64{"accepted": 1, "rejected": 0}, result)
+	metrics := ch.GetMetrics()
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "team-a.a", metrics[0].Name)
+	assert.Equal(t, gostatsd.Tags{"tenant:a"}, metrics[0].Tags)
+}
+
+func TestLineHandlerTenantSeriesQuota(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("tenant.a.tokens", []string{"secret-a"})
+	v.Set("tenant.a.max-series-per-second", 2)
+	v.Set("tenant.a.quota-burst", "1s")
+	tenants, err := web.NewTenantsFromViper(v, []string{"a"})
+	require.NoError(t, err)
+
+	ch := &capturingHandler{}
+	parser := statsd.NewDatagramParser(nil, "", false, 0, ch, 0)
+	hs, err := web.NewHttpServer(logrus.StandardLogger(), ch, web.HttpServerOptions{
+		ServerName:      t.Name(),
+		Lines:           parser,
+		EnableIngestion: true,
+		Tenants:         tenants,
+	})
+	require.NoError(t, err)
+
+	auth := map[string]string{"Authorization": "Bearer secret-a"}
+	code, _ := postLines(t, hs.Router, []byte("a:1|c\na:2|c\na:3|c|#x:y\na:4|c|#x:y"), auth)
+	assert.Equal(t, http.StatusAccepted, code, "four lines of two series should fit a quota of two series")
+	code, _ = postLines(t, hs.Router, []byte("b:1|c"), auth)
+	assert.Equal(t, http.StatusTooManyRequests, code)
+}
@@ -1,9 +1,14 @@
 package web
 
 import (
+	"bytes"
 	"context"
 	"io/ioutil"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"strconv"
 	"sync/atomic"
 	"time"
 
@@ -11,29 +16,59 @@ import (
 	"github.com/atlassian/gostatsd/pb"
 
 	"github.com/atlassian/gostatsd/pkg/stats"
+	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// maxBodySize is the largest body accepted by /v2/raw and /v2/event, both before and after decompression.
+	maxBodySize = 64 << 20
+	// maxLinesBodySize is the largest body accepted by /v1/lines, both before and after decompression.
+	maxLinesBodySize = 1 << 20
+)
+
 type rawHttpHandlerV2 struct {
 	requestSuccess           uint64 // atomic
 	requestFailureRead       uint64 // atomic
+	requestFailureTooLarge   uint64 // atomic
 	requestFailureDecompress uint64 // atomic
 	requestFailureEncoding   uint64 // atomic
 	requestFailureUnmarshal  uint64 // atomic
+	requestFailureAuth       uint64 // atomic
+	requestFailureThrottled  uint64 // atomic
+	requestFailureOverloaded uint64 // atomic
 	metricsProcessed         uint64 // atomic
 	eventsProcessed          uint64 // atomic
+	linesAccepted            uint64 // atomic
+	linesRejected            uint64 // atomic
 
 	logger     logrus.FieldLogger
 	handler    gostatsd.PipelineHandler
 	serverName string
+	tenants    *Tenants // nil if requests aren't authenticated
+
+	lines          LineParser   // nil if lines aren't accepted
+	trustedProxies []*net.IPNet // Proxies whose X-Forwarded-For header is believed
+
+	load               LoadReporter // nil if metrics are never refused because of load
+	overloadWatermark  float64
+	overloadRetryAfter time.Duration
+}
+
+// LoadReporter reports how far behind the pipeline downstream of the ingestion endpoints is.
+type LoadReporter interface {
+	// QueueUtilisation returns how full the fullest queue is, between 0 and 1.
+	QueueUtilisation() float64
 }
 
-func newRawHttpHandlerV2(logger logrus.FieldLogger, serverName string, handler gostatsd.PipelineHandler) *rawHttpHandlerV2 {
+func newRawHttpHandlerV2(logger logrus.FieldLogger, serverName string, handler gostatsd.PipelineHandler, lines LineParser, tenants *Tenants) *rawHttpHandlerV2 {
 	return &rawHttpHandlerV2{
 		logger:     logger,
 		handler:    handler,
 		serverName: serverName,
+		lines:      lines,
+		tenants:    tenants,
 	}
 }
 
@@ -56,24 +91,92 @@ func (rhh *rawHttpHandlerV2) RunMetrics(ctx context.Context) {
 func (rhh *rawHttpHandlerV2) emitMetrics(statser stats.Statser) {
 	requestSuccess := atomic.SwapUint64(&rhh.requestSuccess, 0)
 	requestFailureRead := atomic.SwapUint64(&rhh.requestFailureRead, 0)
+	requestFailureTooLarge := atomic.SwapUint64(&rhh.requestFailureTooLarge, 0)
 	requestFailureDecompress := atomic.SwapUint64(&rhh.requestFailureDecompress, 0)
 	requestFailureEncoding := atomic.SwapUint64(&rhh.requestFailureEncoding, 0)
 	requestFailureUnmarshal := atomic.SwapUint64(&rhh.requestFailureUnmarshal, 0)
+	requestFailureAuth := atomic.SwapUint64(&rhh.requestFailureAuth, 0)
+	requestFailureThrottled := atomic.SwapUint64(&rhh.requestFailureThrottled, 0)
+	requestFailureOverloaded := atomic.SwapUint64(&rhh.requestFailureOverloaded, 0)
 	metricsProcessed := atomic.SwapUint64(&rhh.metricsProcessed, 0)
 	eventsProcessed := atomic.SwapUint64(&rhh.eventsProcessed, 0)
+	linesAccepted := atomic.SwapUint64(&rhh.linesAccepted, 0)
+	linesRejected := atomic.SwapUint64(&rhh.linesRejected, 0)
 
 	statser.Count("http.incoming", float64(requestSuccess), []string{"result:success"})
 	statser.Count("http.incoming", float64(requestFailureRead), []string{"result:failure", "failure:read"})
+	statser.Count("http.incoming", float64(requestFailureTooLarge), []string{"result:failure", "failure:too-large"})
 	statser.Count("http.incoming", float64(requestFailureDecompress), []string{"result:failure", "failure:decompress"})
 	statser.Count("http.incoming", float64(requestFailureEncoding), []string{"result:failure", "failure:encoding"})
 	statser.Count("http.incoming", float64(requestFailureUnmarshal), []string{"result:failure", "failure:unmarshal"})
 	statser.Count("http.incoming.metrics", float64(metricsProcessed), nil)
 	statser.Count("http.incoming.events", float64(eventsProcessed), nil)
+
+	if rhh.lines != nil {
+		statser.Count("http.incoming.lines", float64(linesAccepted), []string{"result:success"})
+		statser.Count("http.incoming.lines", float64(linesRejected), []string{"result:failure", "failure:parse"})
+	}
+
+	if rhh.load != nil {
+		statser.Count("http.incoming", float64(requestFailureOverloaded), []string{"result:failure", "failure:overloaded"})
+	}
+
+	if rhh.tenants != nil {
+		statser.Count("http.incoming", float64(requestFailureAuth), []string{"result:failure", "failure:unauthorized"})
+		statser.Count("http.incoming", float64(requestFailureThrottled), []string{"result:failure", "failure:throttled"})
+		rhh.tenants.emitMetrics(statser, "http")
+	}
+}
+
+// authorize returns the tenant a request is from, or nil if requests aren't authenticated.  If the request has no
+// valid credential, the response is written and false is returned.  Nothing is taken from the tenant's quotas until
+// the request is admitted.
+func (rhh *rawHttpHandlerV2) authorize(w http.ResponseWriter, req *http.Request) (*tenant, bool) {
+	if rhh.tenants == nil {
+		return nil, true
+	}
+	t := rhh.tenants.authenticate(req)
+	if t == nil {
+		atomic.AddUint64(&rhh.requestFailureAuth, 1)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gostatsd"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, false
+	}
+	return t, true
+}
+
+// admit takes a request and series from the quotas of the tenant a request is from.  If either quota is exhausted,
+// the response is written and false is returned.
+func (rhh *rawHttpHandlerV2) admit(w http.ResponseWriter, t *tenant, series int) bool {
+	if retryAfter, ok := t.admit(time.Now(), series); !ok {
+		atomic.AddUint64(&rhh.requestFailureThrottled, 1)
+		writeThrottled(w, retryAfter)
+		return false
+	}
+	return true
 }
 
-func (rhh *rawHttpHandlerV2) readBody(req *http.Request) ([]byte, int) {
-	b, err := ioutil.ReadAll(req.Body)
+// overloaded reports if the pipeline is too far behind to accept more metrics.  If it is, a 503 response asking
+// the client to retry later is written.
+func (rhh *rawHttpHandlerV2) overloaded(w http.ResponseWriter) bool {
+	if rhh.load == nil || rhh.load.QueueUtilisation() < rhh.overloadWatermark {
+		return false
+	}
+	atomic.AddUint64(&rhh.requestFailureOverloaded, 1)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rhh.overloadRetryAfter.Seconds()))))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	return true
+}
+
+// readBody reads and decompresses the body of a request, which may be at most limit bytes both before and after it
+// is decompressed.  Returns the status code to respond with if it can't be read.
+func (rhh *rawHttpHandlerV2) readBody(w http.ResponseWriter, req *http.Request, limit int64) ([]byte, int) {
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, limit))
 	if err != nil {
+		if _, ok := err.(*http.MaxBytesError); ok {
+			atomic.AddUint64(&rhh.requestFailureTooLarge, 1)
+			return nil, http.StatusRequestEntityTooLarge
+		}
 		atomic.AddUint64(&rhh.requestFailureRead, 1)
 		rhh.logger.WithError(err).Info("failed reading body")
 		return nil, http.StatusInternalServerError
@@ -83,7 +186,22 @@ func (rhh *rawHttpHandlerV2) readBody(req *http.Request) ([]byte, int) {
 	encoding := req.Header.Get("Content-Encoding")
 	switch encoding {
 	case "deflate":
-		b, err = decompress(b)
+		b, err = decompress(b, limit)
+		if err == errBodyTooLarge {
+			atomic.AddUint64(&rhh.requestFailureTooLarge, 1)
+			return nil, http.StatusRequestEntityTooLarge
+		}
+		if err != nil {
+			atomic.AddUint64(&rhh.requestFailureDecompress, 1)
+			rhh.logger.WithError(err).Info("failed decompressing body")
+			return nil, http.StatusBadRequest
+		}
+	case "gzip":
+		b, err = gunzip(b, limit)
+		if err == errBodyTooLarge {
+			atomic.AddUint64(&rhh.requestFailureTooLarge, 1)
+			return nil, http.StatusRequestEntityTooLarge
+		}
 		if err != nil {
 			atomic.AddUint64(&rhh.requestFailureDecompress, 1)
 			rhh.logger.WithError(err).Info("failed decompressing body")
@@ -104,7 +222,15 @@ func (rhh *rawHttpHandlerV2) readBody(req *http.Request) ([]byte, int) {
 }
 
 func (rhh *rawHttpHandlerV2) MetricHandler(w http.ResponseWriter, req *http.Request) {
-	b, errCode := rhh.readBody(req)
+	if rhh.overloaded(w) {
+		return
+	}
+	tenant, ok := rhh.authorize(w, req)
+	if !ok {
+		return
+	}
+
+	b, errCode := rhh.readBody(w, req, maxBodySize)
 
 	if errCode != 0 {
 		w.WriteHeader(errCode)
@@ -112,7 +238,7 @@ func (rhh *rawHttpHandlerV2) MetricHandler(w http.ResponseWriter, req *http.Requ
 	}
 
 	var msg pb.RawMessageV2
-	err := proto.Unmarshal(b, &msg)
+	err := unmarshal(req, b, &msg)
 	if err != nil {
 		atomic.AddUint64(&rhh.requestFailureUnmarshal, 1)
 		rhh.logger.WithError(err).Error("failed to unmarshal")
@@ -120,7 +246,13 @@ func (rhh *rawHttpHandlerV2) MetricHandler(w http.ResponseWriter, req *http.Requ
 		return
 	}
 
-	mm := translateFromProtobufV2(&msg)
+	mm := pb.ToMetricMap(&msg, gostatsd.Nanotime(time.Now().UnixNano()))
+	if tenant != nil {
+		if !rhh.admit(w, tenant, countSeries(mm)) {
+			return
+		}
+		mm = tenant.tagMetricMap(mm)
+	}
 	rhh.handler.DispatchMetricMap(req.Context(), mm)
 
 	atomic.AddUint64(&rhh.requestSuccess, 1)
@@ -128,7 +260,12 @@ func (rhh *rawHttpHandlerV2) MetricHandler(w http.ResponseWriter, req *http.Requ
 }
 
 func (rhh *rawHttpHandlerV2) EventHandler(w http.ResponseWriter, req *http.Request) {
-	b, errCode := rhh.readBody(req)
+	tenant, ok := rhh.authorize(w, req)
+	if !ok {
+		return
+	}
+
+	b, errCode := rhh.readBody(w, req, maxBodySize)
 
 	if errCode != 0 {
 		w.WriteHeader(errCode)
@@ -136,7 +273,7 @@ func (rhh *rawHttpHandlerV2) EventHandler(w http.ResponseWriter, req *http.Reque
 	}
 
 	var msg pb.EventV2
-	err := proto.Unmarshal(b, &msg)
+	err := unmarshal(req, b, &msg)
 	if err != nil {
 		atomic.AddUint64(&rhh.requestFailureUnmarshal, 1)
 		rhh.logger.WithError(err).Error("failed to unmarshal")
@@ -144,6 +281,33 @@ func (rhh *rawHttpHandlerV2) EventHandler(w http.ResponseWriter, req *http.Reque
 		return
 	}
 
+	event := translateEventFromProtobufV2(&msg)
+	if tenant != nil {
+		if !rhh.admit(w, tenant, 0) {
+			return
+		}
+		event.Tags = tenant.tagTags(event.Tags)
+		atomic.AddUint64(&tenant.eventsAccepted, 1)
+	}
+	rhh.handler.DispatchEvent(req.Context(), event)
+
+	atomic.AddUint64(&rhh.eventsProcessed, 1)
+	atomic.AddUint64(&rhh.requestSuccess, 1)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// unmarshal decodes the body of a request using the protobuf JSON mapping if it has a Content-Type of
+// application/json, otherwise as binary protobuf.
+func unmarshal(req *http.Request, b []byte, msg proto.Message) error {
+	if mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type")); err == nil && mediaType == "application/json" {
+		unmarshaler := jsonpb.Unmarshaler{AllowUnknownFields: true}
+		return unmarshaler.Unmarshal(bytes.NewReader(b), msg)
+	}
+	return proto.Unmarshal(b, msg)
+}
+
+// translateEventFromProtobufV2 converts an EventV2 to an Event.
+func translateEventFromProtobufV2(msg *pb.EventV2) *gostatsd.Event {
 	event := &gostatsd.Event{
 		Title:          msg.Title,
 		Text:           msg.Text,
@@ -177,68 +341,5 @@ func (rhh *rawHttpHandlerV2) EventHandler(w http.ResponseWriter, req *http.Reque
 		event.AlertType = gostatsd.AlertInfo
 	}
 
-	rhh.handler.DispatchEvent(req.Context(), event)
-
-	atomic.AddUint64(&rhh.eventsProcessed, 1)
-	atomic.AddUint64(&rhh.requestSuccess, 1)
-	w.WriteHeader(http.StatusAccepted)
-}
-
-func translateFromProtobufV2(pbMetricMap *pb.RawMessageV2) *gostatsd.MetricMap {
-	now := gostatsd.Nanotime(time.Now().UnixNano())
-	mm := gostatsd.NewMetricMap()
-
-	for metricName, tagMap := range pbMetricMap.Gauges {
-		mm.Gauges[metricName] = map[string]gostatsd.Gauge{}
-		for tagsKey, gauge := range tagMap.TagMap {
-			mm.Gauges[metricName][tagsKey] = gostatsd.Gauge{
-				Value:     gauge.Value,
-				Timestamp: now,
-				Hostname:  gauge.Hostname,
-				Tags:      gauge.Tags,
-			}
-		}
-	}
-
-	for metricName, tagMap := range pbMetricMap.Counters {
-		mm.Counters[metricName] = map[string]gostatsd.Counter{}
-		for tagsKey, counter := range tagMap.TagMap {
-			mm.Counters[metricName][tagsKey] = gostatsd.Counter{
-				Value:     counter.Value,
-				Timestamp: now,
-				Tags:      counter.Tags,
-				Hostname:  counter.Hostname,
-			}
-		}
-	}
-
-	for metricName, tagMap := range pbMetricMap.Timers {
-		mm.Timers[metricName] = map[string]gostatsd.Timer{}
-		for tagsKey, timer := range tagMap.TagMap {
-			mm.Timers[metricName][tagsKey] = gostatsd.Timer{
-				Values:       timer.Values,
-				Timestamp:    now,
-				Tags:         timer.Tags,
-				Hostname:     timer.Hostname,
-				SampledCount: timer.SampleCount,
-			}
-		}
-	}
-
-	for metricName, tagMap := range pbMetricMap.Sets {
-		mm.Sets[metricName] = map[string]gostatsd.Set{}
-		for tagsKey, set := range tagMap.TagMap {
-			mm.Sets[metricName][tagsKey] = gostatsd.Set{
-				Values:    map[string]struct{}{},
-				Timestamp: now,
-				Tags:      set.Tags,
-				Hostname:  set.Hostname,
-			}
-			for _, value := range set.Values {
-				mm.Sets[metricName][tagsKey].Values[value] = struct{}{}
-			}
-		}
-	}
-
-	return mm
+	return event
 }
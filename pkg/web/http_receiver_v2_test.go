@@ -1,16 +1,24 @@
 package web_test
 
 import (
+	"net/http"
 	"net/http/httptest"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/ash2k/stager/wait"
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pb"
 	"github.com/atlassian/gostatsd/pkg/statsd"
 	"github.com/atlassian/gostatsd/pkg/web"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/tilinna/clock"
 )
@@ -24,16 +32,10 @@ func TestForwardingEndToEndV2(t *testing.T) {
 
 	ch := &capturingHandler{}
 
-	hs, err := web.NewHttpServer(
-		logrus.StandardLogger(),
-		ch,
-		"TestForwardingEndToEndV2",
-		"",
-		false,
-		false,
-		true,
-		false,
-	)
+	hs, err := web.NewHttpServer(logrus.StandardLogger(), ch, web.HttpServerOptions{
+		ServerName:      "TestForwardingEndToEndV2",
+		EnableIngestion: true,
+	})
 	require.NoError(t, err)
 
 	c := httptest.NewServer(hs.Router)
@@ -158,3 +160,153 @@ func TestForwardingEndToEndV2(t *testing.T) {
 	require.EqualValues(t, expected, actual)
 	testDone()
 }
+
+type fakeLoadReporter struct {
+	mu          sync.Mutex
+	utilisation float64
+}
+
+func (flr *fakeLoadReporter) QueueUtilisation() float64 {
+	flr.mu.Lock()
+	defer flr.mu.Unlock()
+	return flr.utilisation
+}
+
+func (flr *fakeLoadReporter) set(utilisation float64) {
+	flr.mu.Lock()
+	defer flr.mu.Unlock()
+	flr.utilisation = utilisation
+}
+
+func TestRawHttpHandlerV2Overloaded(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+	hs, err := web.NewHttpServer(logrus.StandardLogger(), ch, web.HttpServerOptions{
+		ServerName:      t.Name(),
+		EnableIngestion: true,
+	})
+	require.NoError(t, err)
+
+	load := &fakeLoadReporter{utilisation: 0.9}
+	require.NoError(t, hs.SetLoadReporter(load, 0.8, 1500*time.Millisecond))
+
+	w := postRaw(hs.Router, "", counterMessage("requests"))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+	assert.Empty(t, ch.GetMetrics())
+
+	load.set(0.5)
+	w = postRaw(hs.Router, "", counterMessage("requests"))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Len(t, ch.GetMetrics(), 1)
+
+	assert.Error(t, hs.SetLoadReporter(load, 1.5, time.Second), "the watermark is a fraction of the queue")
+	assert.Error(t, hs.SetLoadReporter(load, 0.8, 0), "a retry delay is required")
+
+	hs, err = web.NewHttpServer(logrus.StandardLogger(), ch, web.HttpServerOptions{
+		ServerName:        t.Name(),
+		EnableHealthcheck: true,
+	})
+	require.NoError(t, err)
+	assert.Error(t, hs.SetLoadReporter(load, 0.8, time.Second), "overload requires ingestion")
+
+	v := viper.New()
+	v.Set("http-servers", "receiver")
+	v.Set("http.receiver.enable-ingestion", true)
+	v.Set("http.receiver.overload-watermark", 0.8)
+	_, err = web.NewHttpServersFromViper(v, logrus.StandardLogger(), ch, nil, nil, nil, nil)
+	assert.Error(t, err, "overload-watermark requires a load reporter")
+	_, err = web.NewHttpServersFromViper(v, logrus.StandardLogger(), ch, nil, nil, nil, load)
+	assert.NoError(t, err)
+}
+
+func TestRawHttpHandlerV2OverloadedBeforeQuota(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("tenant.a.tokens", []string{"secret-a"})
+	v.Set("tenant.a.max-requests-per-second", 1)
+	v.Set("tenant.a.quota-burst", "1s")
+	tenants, err := web.NewTenantsFromViper(v, []string{"a"})
+	require.NoError(t, err)
+	hs, err := web.NewHttpServer(logrus.StandardLogger(), &capturingHandler{}, web.HttpServerOptions{
+		ServerName:      t.Name(),
+		EnableIngestion: true,
+		Tenants:         tenants,
+	})
+	require.NoError(t, err)
+
+	load := &fakeLoadReporter{utilisation: 0.9}
+	require.NoError(t, hs.SetLoadReporter(load, 0.8, time.Second))
+	assert.Equal(t, http.StatusServiceUnavailable, postRaw(hs.Router, "secret-a", counterMessage("requests")).Code)
+	load.set(0.5)
+	assert.Equal(t, http.StatusAccepted, postRaw(hs.Router, "secret-a", counterMessage("requests")).Code, "a refused request should not use the quota")
+}
+
+func TestToMetricMapJSONRoundTrip(t *testing.T) {
+	t.Parallel()
+	msg := &pb.RawMessageV2{
+		Counters: map[string]*pb.CounterTagV2{
+			"counter": {TagMap: map[string]*pb.RawCounterV2{
+				"":    {FloatValue: 1.5, Value: 1},
+				"a:b": {Tags: []string{"a:b"}, Hostname: "host", FloatValue: 1e12, Value: 1e12},
+			}},
+		},
+		Gauges: map[string]*pb.GaugeTagV2{
+			"gauge": {TagMap: map[string]*pb.RawGaugeV2{"a:b": {Tags: []string{"a:b"}, Value: -0.25}}},
+		},
+		Timers: map[string]*pb.TimerTagV2{
+			"timer": {TagMap: map[string]*pb.RawTimerV2{"": {Values: []float64{1, 2.5, 3}, SampleCount: 30, Hostname: "host"}}},
+		},
+		Sets: map[string]*pb.SetTagV2{
+			"set": {TagMap: map[string]*pb.RawSetV2{"a:b,c:d": {Tags: []string{"a:b", "c:d"}, Values: []string{"x", "y"}}}},
+		},
+	}
+
+	binary, err := proto.Marshal(msg)
+	require.NoError(t, err)
+	var fromBinary pb.RawMessageV2
+	require.NoError(t, proto.Unmarshal(binary, &fromBinary))
+
+	jsonBody, err := (&jsonpb.Marshaler{}).MarshalToString(msg)
+	require.NoError(t, err)
+	var fromJSON pb.RawMessageV2
+	require.NoError(t, jsonpb.UnmarshalString(jsonBody, &fromJSON))
+
+	assert.Equal(t, pb.ToMetricMap(&fromBinary, 10), pb.ToMetricMap(&fromJSON, 10))
+}
+
+func TestRawHttpHandlerV2JSON(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+	hs, err := web.NewHttpServer(logrus.StandardLogger(), ch, web.HttpServerOptions{
+		ServerName:      t.Name(),
+		EnableIngestion: true,
+	})
+	require.NoError(t, err)
+
+	post := func(path, contentType, body string) int {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		hs.Router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// As sent by curl, with the JSON names of the fields.
+	code := post("/v2/raw", "application/json; charset=utf-8", `{"Gauges":{"gauge":{"TagMap":{"a:b":{"Tags":["a:b"],"Value":10}}}}}`)
+	require.Equal(t, http.StatusAccepted, code)
+	code = post("/v2/event", "application/json", `{"Title":"deploy","Text":"done","Type":"Success","unknown":1}`)
+	require.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, http.StatusBadRequest, post("/v2/raw", "application/json", `{"Gauges":`))
+	assert.Equal(t, http.StatusBadRequest, post("/v2/raw", "application/x-protobuf", `{"Gauges":{}}`), "protobuf is the default")
+
+	metrics := ch.GetMetrics()
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "gauge", metrics[0].Name)
+	assert.Equal(t, 10.0, metrics[0].Value)
+	assert.Equal(t, gostatsd.Tags{"a:b"}, metrics[0].Tags)
+	events := ch.GetEvents()
+	require.Len(t, events, 1)
+	assert.Equal(t, "deploy", events[0].Title)
+	assert.Equal(t, gostatsd.AlertSuccess, events[0].AlertType)
+}
@@ -0,0 +1,284 @@
+package web
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+const (
+	// defaultQuotaBurst is how many seconds of quota a tenant may use at once.
+	defaultQuotaBurst = 10 * time.Second
+)
+
+// Tenants are the teams whose forwarders may send to the ingestion endpoints, identified by a bearer token or the name
+// in a client certificate.
+type Tenants struct {
+	byToken      map[[sha256.Size]byte]*tenant // Keyed by a hash, so tokens aren't compared in variable time
+	byClientName map[string]*tenant
+	all          []*tenant
+}
+
+type tenant struct {
+	requestsAccepted  uint64 // atomic
+	requestsThrottled uint64 // atomic - rejected by the request quota
+	seriesAccepted    uint64 // atomic
+	seriesThrottled   uint64 // atomic - series in requests rejected by the series quota
+	eventsAccepted    uint64 // atomic
+
+	name      string
+	namespace string              // Prefixed to the name of every metric, "" for none
+	tags      gostatsd.Tags       // Added to every metric and event
+	tagKeys   map[string]struct{} // Keys of tags, which replace any tag with the same key
+	requests  *rate.Limiter       // nil if unlimited
+	series    *rate.Limiter       // nil if unlimited
+}
+
+// NewTenantsFromViper returns the tenants with the given names, each configured by a section named tenant.<name>.
+func NewTenantsFromViper(v *viper.Viper, names []string) (*Tenants, error) {
+	tenants := &Tenants{
+		byToken:      map[[sha256.Size]byte]*tenant{},
+		byClientName: map[string]*tenant{},
+	}
+	for _, name := range names {
+		vSub := getSubViper(v, "tenant."+name)
+		vSub.SetDefault("tokens", []string{})
+		vSub.SetDefault("client-names", []string{})
+		vSub.SetDefault("tags", []string{"tenant:" + name})
+		vSub.SetDefault("namespace", "")
+		vSub.SetDefault("max-requests-per-second", 0)
+		vSub.SetDefault("max-series-per-second", 0)
+		vSub.SetDefault("quota-burst", defaultQuotaBurst)
+
+		t, err := newTenant(
+			name,
+			vSub.GetString("namespace"),
+			vSub.GetStringSlice("tags"),
+			vSub.GetFloat64("max-requests-per-second"),
+			vSub.GetFloat64("max-series-per-second"),
+			vSub.GetDuration("quota-burst"),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tenant %s: %v", name, err)
+		}
+
+		tokens := vSub.GetStringSlice("tokens")
+		clientNames := vSub.GetStringSlice("client-names")
+		if len(tokens) == 0 && len(clientNames) == 0 {
+			return nil, fmt.Errorf("invalid tenant %s: tokens or client-names are required", name)
+		}
+		for _, token := range tokens {
+			key := sha256.Sum256([]byte(token))
+			if _, ok := tenants.byToken[key]; ok || token == "" {
+				return nil, fmt.Errorf("invalid tenant %s: tokens must be unique and not empty", name)
+			}
+			tenants.byToken[key] = t
+		}
+		for _, clientName := range clientNames {
+			if _, ok := tenants.byClientName[clientName]; ok || clientName == "" {
+				return nil, fmt.Errorf("invalid tenant %s: client-names must be unique and not empty", name)
+			}
+			tenants.byClientName[clientName] = t
+		}
+		tenants.all = append(tenants.all, t)
+	}
+	return tenants, nil
+}
+
+func newTenant(name, namespace string, tags []string, requestsPerSecond, seriesPerSecond float64, burst time.Duration) (*tenant, error) {
+	if requestsPerSecond < 0 || seriesPerSecond < 0 {
+		return nil, errors.New("quotas must not be negative")
+	}
+	if burst < time.Second {
+		return nil, errors.New("quota-burst must be at least 1s")
+	}
+	t := &tenant{
+		name:      name,
+		namespace: namespace,
+		tags:      tags,
+		tagKeys:   map[string]struct{}{},
+	}
+	for _, tag := range tags {
+		t.tagKeys[tagKey(tag)] = struct{}{}
+	}
+	if requestsPerSecond > 0 {
+		t.requests = rate.NewLimiter(rate.Limit(requestsPerSecond), int(math.Ceil(requestsPerSecond*burst.Seconds())))
+	}
+	if seriesPerSecond > 0 {
+		t.series = rate.NewLimiter(rate.Limit(seriesPerSecond), int(math.Ceil(seriesPerSecond*burst.Seconds())))
+	}
+	return t, nil
+}
+
+// tagKey returns the key of a tag, which is the whole tag if it has no value.
+func tagKey(tag string) string {
+	if i := strings.IndexByte(tag, ':'); i >= 0 {
+		return tag[:i]
+	}
+	return tag
+}
+
+// authenticate returns the tenant a request is from, or nil if it has no valid credential.  A bearer token is used if
+// the request has one, otherwise the verified client certificate.
+func (ts *Tenants) authenticate(req *http.Request) *tenant {
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		return ts.byBearer(auth)
+	}
+	if req.TLS == nil {
+		return nil
+	}
+	return ts.byCertificate(req.TLS)
+}
+
+// byBearer returns the tenant with a token given in the value of an Authorization header, or nil if there isn't one.
+func (ts *Tenants) byBearer(auth string) *tenant {
+	const prefix = "Bearer "
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return nil
+	}
+	return ts.byToken[sha256.Sum256([]byte(auth[len(prefix):]))]
+}
+
+// byCertificate returns the tenant named by the verified client certificate of a connection, or nil if there isn't
+// one.
+func (ts *Tenants) byCertificate(state *tls.ConnectionState) *tenant {
+	if len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	cert := state.VerifiedChains[0][0]
+	if t, ok := ts.byClientName[cert.Subject.CommonName]; ok {
+		return t
+	}
+	for _, name := range cert.DNSNames {
+		if t, ok := ts.byClientName[name]; ok {
+			return t
+		}
+	}
+	return nil
+}
+
+// emitMetrics emits the per tenant metrics, with names starting with prefix, such as "http".
+func (ts *Tenants) emitMetrics(statser stats.Statser, prefix string) {
+	for _, t := range ts.all {
+		tags := []string{"tenant:" + t.name}
+		statser.Count(prefix+".incoming.tenant", float64(atomic.SwapUint64(&t.requestsAccepted, 0)), append(tags, "result:success"))
+		statser.Count(prefix+".incoming.tenant", float64(atomic.SwapUint64(&t.requestsThrottled, 0)), append(tags, "result:failure", "failure:throttled"))
+		statser.Count(prefix+".incoming.tenant.series", float64(atomic.SwapUint64(&t.seriesAccepted, 0)), append(tags, "result:success"))
+		statser.Count(prefix+".incoming.tenant.series", float64(atomic.SwapUint64(&t.seriesThrottled, 0)), append(tags, "result:failure", "failure:throttled"))
+		statser.Count(prefix+".incoming.tenant.events", float64(atomic.SwapUint64(&t.eventsAccepted, 0)), tags)
+	}
+}
+
+// admit takes a request from the tenant's request quota, and series from its series quota.  Nothing is taken unless
+// both quotas allow it.  If either is exhausted, it returns false and how long until it won't be, or 0 if series is
+// more than the series quota allows at once.
+func (t *tenant) admit(now time.Time, series int) (time.Duration, bool) {
+	var request *rate.Reservation
+	if t.requests != nil {
+		r, retryAfter, ok := reserve(t.requests, now, 1)
+		if !ok {
+			atomic.AddUint64(&t.requestsThrottled, 1)
+			return retryAfter, false
+		}
+		request = r
+	}
+	if t.series != nil && series > 0 {
+		if _, retryAfter, ok := reserve(t.series, now, series); !ok {
+			if request != nil {
+				request.CancelAt(now)
+			}
+			atomic.AddUint64(&t.seriesThrottled, uint64(series))
+			return retryAfter, false
+		}
+	}
+	atomic.AddUint64(&t.requestsAccepted, 1)
+	atomic.AddUint64(&t.seriesAccepted, uint64(series))
+	return 0, true
+}
+
+// reserve takes n tokens from limiter if they are available now, otherwise it returns false and how long until they
+// will be, or 0 if they never will be.  The reservation is returned so it can be cancelled.
+func reserve(limiter *rate.Limiter, now time.Time, n int) (*rate.Reservation, time.Duration, bool) {
+	r := limiter.ReserveN(now, n)
+	if !r.OK() {
+		return nil, 0, false
+	}
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return nil, delay, false
+	}
+	return r, 0, true
+}
+
+// writeThrottled responds to a request rejected by a quota, telling the client when to retry if it can.
+func writeThrottled(w http.ResponseWriter, retryAfter time.Duration) {
+	if retryAfter <= 0 {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+}
+
+// tagTags returns tags with the tenant's tags added, replacing any with the same key.
+func (t *tenant) tagTags(tags gostatsd.Tags) gostatsd.Tags {
+	newTags := make(gostatsd.Tags, 0, len(tags)+len(t.tags))
+	for _, tag := range tags {
+		if _, ok := t.tagKeys[tagKey(tag)]; !ok {
+			newTags = append(newTags, tag)
+		}
+	}
+	return append(newTags, t.tags...)
+}
+
+// tagName returns name in the tenant's namespace.
+func (t *tenant) tagName(name string) string {
+	if t.namespace == "" {
+		return name
+	}
+	return t.namespace + "." + name
+}
+
+// tagMetricMap returns mm with every metric in the tenant's namespace, and tagged with the tenant's tags.  Series
+// which become the same because a tag was replaced are merged.
+func (t *tenant) tagMetricMap(mm *gostatsd.MetricMap) *gostatsd.MetricMap {
+	mmNew := gostatsd.NewMetricMap()
+	mm.SplitByFunc(func(metricName, tagsKey *string, hostname string, tags *gostatsd.Tags) *gostatsd.MetricMap {
+		*tags = t.tagTags(*tags)
+		*metricName = t.tagName(*metricName)
+		*tagsKey = gostatsd.FormatTagsKey(hostname, *tags)
+		return mmNew
+	})
+	return mmNew
+}
+
+// countSeries returns the number of series in mm.
+func countSeries(mm *gostatsd.MetricMap) int {
+	n := 0
+	for _, series := range mm.Counters {
+		n += len(series)
+	}
+	for _, series := range mm.Gauges {
+		n += len(series)
+	}
+	for _, series := range mm.Timers {
+		n += len(series)
+	}
+	for _, series := range mm.Sets {
+		n += len(series)
+	}
+	return n
+}
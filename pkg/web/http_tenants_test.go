@@ -0,0 +1,198 @@
+package web_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pb"
+	"github.com/atlassian/gostatsd/pkg/web"
+)
+
+func newTenantServer(t *testing.T, ch *capturingHandler, config map[string]interface{}, names ...string) http.Handler {
+	v := viper.New()
+	for key, value := range config {
+		v.Set(key, value)
+	}
+	tenants, err := web.NewTenantsFromViper(v, names)
+	require.NoError(t, err)
+
+	hs, err := web.NewHttpServer(logrus.StandardLogger(), ch, web.HttpServerOptions{
+		ServerName:      t.Name(),
+		EnableIngestion: true,
+		Tenants:         tenants,
+	})
+	require.NoError(t, err)
+	return hs.Router
+}
+
+func counterMessage(names ...string) []byte {
+	msg := &pb.RawMessageV2{Counters: map[string]*pb.CounterTagV2{}}
+	for _, name := range names {
+		msg.Counters[name] = &pb.CounterTagV2{TagMap: map[string]*pb.RawCounterV2{
+			"tenant:b,x:1": {Tags: []string{"x:1", "tenant:b"}, FloatValue: 1},
+		}}
+	}
+	b, _ := proto.Marshal(msg)
+	return b
+}
+
+func postRaw(handler http.Handler, token string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/v2/raw", bytes.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestTenantAuthentication(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+	handler := newTenantServer(t, ch, map[string]interface{}{
+		"tenant.a.tokens":    []string{"secret-a"},
+		"tenant.a.namespace": "team-a",
+		"tenant.b.tokens":    []string{"secret-b"},
+	}, "a", "b")
+
+	w := postRaw(handler, "", counterMessage("requests"))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = postRaw(handler, "wrong", counterMessage("requests"))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Empty(t, ch.GetMetrics())
+
+	w = postRaw(handler, "secret-a", counterMessage("requests"))
+	require.Equal(t, http.StatusAccepted, w.Code)
+	metrics := ch.GetMetrics()
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "team-a.requests", metrics[0].Name)
+	assert.Equal(t, gostatsd.Tags{"tenant:a", "x:1"}, metrics[0].Tags, "the tenant tag should replace a spoofed one")
+	assert.Equal(t, "tenant:a,x:1", metrics[0].TagsKey)
+}
+
+func TestTenantClientCertificate(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+	handler := newTenantServer(t, ch, map[string]interface{}{
+		"tenant.a.client-names": []string{"forwarder.team-a"},
+	}, "a")
+
+	request := func(cn string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v2/raw", bytes.NewReader(counterMessage("requests")))
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, request("forwarder.team-b").Code)
+	assert.Equal(t, http.StatusAccepted, request("forwarder.team-a").Code)
+	metrics := ch.GetMetrics()
+	require.Len(t, metrics, 1)
+	assert.Equal(t, gostatsd.Tags{"tenant:a", "x:1"}, metrics[0].Tags)
+}
+
+func TestTenantRequestQuota(t *testing.T) {
+	t.Parallel()
+	handler := newTenantServer(t, &capturingHandler{}, map[string]interface{}{
+		"tenant.a.tokens":                  []string{"secret-a"},
+		"tenant.a.max-requests-per-second": 1,
+		"tenant.a.quota-burst":             "1s",
+		"tenant.b.tokens":                  []string{"secret-b"},
+	}, "a", "b")
+
+	assert.Equal(t, http.StatusAccepted, postRaw(handler, "secret-a", counterMessage("requests")).Code)
+	w := postRaw(handler, "secret-a", counterMessage("requests"))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusAccepted, postRaw(handler, "secret-b", counterMessage("requests")).Code, "quotas are per tenant")
+}
+
+func TestTenantSeriesQuota(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+	handler := newTenantServer(t, ch, map[string]interface{}{
+		"tenant.a.tokens":                []string{"secret-a"},
+		"tenant.a.max-series-per-second": 2,
+		"tenant.a.quota-burst":           "1s",
+	}, "a")
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, postRaw(handler, "secret-a", counterMessage("a", "b", "c")).Code)
+	assert.Equal(t, http.StatusAccepted, postRaw(handler, "secret-a", counterMessage("a", "b")).Code)
+	w := postRaw(handler, "secret-a", counterMessage("a"))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.Len(t, ch.GetMetrics(), 2)
+}
+
+func TestTenantQuotaTakenOnAdmission(t *testing.T) {
+	t.Parallel()
+	handler := newTenantServer(t, &capturingHandler{}, map[string]interface{}{
+		"tenant.a.tokens":                  []string{"secret-a"},
+		"tenant.a.max-requests-per-second": 1,
+		"tenant.a.max-series-per-second":   2,
+		"tenant.a.quota-burst":             "1s",
+	}, "a")
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, postRaw(handler, "secret-a", counterMessage("a", "b", "c")).Code)
+	assert.Equal(t, http.StatusAccepted, postRaw(handler, "secret-a", counterMessage("a")).Code, "a rejected request should not use the request quota")
+}
+
+func TestTenantEvent(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+	handler := newTenantServer(t, ch, map[string]interface{}{
+		"tenant.a.tokens": []string{"secret-a"},
+		"tenant.a.tags":   []string{"team:a", "env:prod"},
+	}, "a")
+
+	body, err := proto.Marshal(&pb.EventV2{Title: "deploy", Tags: []string{"team:b", "service:web"}})
+	require.NoError(t, err)
+	req := httptest.NewRequest("POST", "/v2/event", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret-a")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusAccepted, w.Code)
+	events := ch.GetEvents()
+	require.Len(t, events, 1)
+	assert.Equal(t, gostatsd.Tags{"service:web", "team:a", "env:prod"}, events[0].Tags)
+}
+
+func TestNewTenantsFromViperInvalid(t *testing.T) {
+	t.Parallel()
+	for name, config := range map[string]map[string]interface{}{
+		"no credentials":   {"tenant.b.tokens": []string{"secret-b"}},
+		"duplicate token":  {"tenant.a.tokens": []string{"secret"}, "tenant.b.tokens": []string{"secret"}},
+		"negative quota":   {"tenant.a.tokens": []string{"secret-a"}, "tenant.a.max-series-per-second": -1, "tenant.b.tokens": []string{"secret-b"}},
+		"burst too small":  {"tenant.a.tokens": []string{"secret-a"}, "tenant.a.quota-burst": "100ms", "tenant.b.tokens": []string{"secret-b"}},
+		"duplicate client": {"tenant.a.client-names": []string{"x"}, "tenant.b.client-names": []string{"x"}},
+	} {
+		v := viper.New()
+		for key, value := range config {
+			v.Set(key, value)
+		}
+		_, err := web.NewTenantsFromViper(v, []string{"a", "b"})
+		assert.Error(t, err, name)
+	}
+
+	_, err := web.NewHttpServer(logrus.StandardLogger(), nil, web.HttpServerOptions{
+		ServerName:        "TestNewTenantsFromViperInvalid",
+		EnableHealthcheck: true,
+		Tenants:           &web.Tenants{},
+	})
+	assert.Error(t, err, "tenants require ingestion")
+}
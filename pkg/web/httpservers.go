@@ -2,13 +2,17 @@ package web
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"expvar"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/internal/tlsconfig"
 
 	"github.com/ash2k/stager/wait"
 	"github.com/gorilla/mux"
@@ -19,8 +23,10 @@ import (
 type httpServer struct {
 	logger       logrus.FieldLogger
 	address      string
+	tlsConfig    *tls.Config // nil to serve plain http
 	Router       *mux.Router // should be private, but project layout is not great.
 	rawMetricsV2 *rawHttpHandlerV2
+	admin        *filterAdmin
 }
 
 type route struct {
@@ -32,11 +38,13 @@ type route struct {
 
 var done = struct{}{}
 
-func NewHttpServersFromViper(v *viper.Viper, logger logrus.FieldLogger, handler gostatsd.PipelineHandler) ([]*httpServer, error) {
+const defaultOverloadRetryAfter = 1 * time.Second
+
+func NewHttpServersFromViper(v *viper.Viper, logger logrus.FieldLogger, handler gostatsd.PipelineHandler, lines LineParser, filterManager FilterManager, health HealthReporter, load LoadReporter) ([]*httpServer, error) {
 	httpServerNames := v.GetStringSlice("http-servers")
 	servers := make([]*httpServer, 0, len(httpServerNames))
 	for _, httpServerName := range httpServerNames {
-		server, err := newHttpServerFromViper(logger, v, httpServerName, handler)
+		server, err := newHttpServerFromViper(logger, v, httpServerName, handler, lines, filterManager, health, load)
 		if err != nil {
 			return nil, fmt.Errorf("failed to make http-server %s: %v", httpServerName, err)
 		}
@@ -50,6 +58,10 @@ func newHttpServerFromViper(
 	vMain *viper.Viper,
 	serverName string,
 	handler gostatsd.PipelineHandler,
+	lines LineParser,
+	filterManager FilterManager,
+	health HealthReporter,
+	load LoadReporter,
 ) (*httpServer, error) {
 	vSub := getSubViper(vMain, "http."+serverName)
 	vSub.SetDefault("address", "127.0.0.1:8080")
@@ -57,36 +69,115 @@ func newHttpServerFromViper(
 	vSub.SetDefault("enable-expvar", false)
 	vSub.SetDefault("enable-ingestion", false)
 	vSub.SetDefault("enable-healthcheck", true)
+	vSub.SetDefault("enable-admin", false)
+	vSub.SetDefault("admin-token-file", "")
+	vSub.SetDefault("tenants", []string{})
+	vSub.SetDefault("tls-cert-path", "")
+	vSub.SetDefault("tls-key-path", "")
+	vSub.SetDefault("tls-client-ca-path", "")
+	vSub.SetDefault("overload-watermark", 0)
+	vSub.SetDefault("overload-retry-after", defaultOverloadRetryAfter)
+	vSub.SetDefault("trusted-proxies", []string{})
+
+	var tenants *Tenants
+	if tenantNames := vSub.GetStringSlice("tenants"); len(tenantNames) > 0 {
+		var err error
+		if tenants, err = NewTenantsFromViper(vMain, tenantNames); err != nil {
+			return nil, err
+		}
+	}
 
-	return NewHttpServer(
-		logger.WithField("http-server", serverName),
-		handler,
-		serverName,
-		vSub.GetString("address"),
-		vSub.GetBool("enable-prof"),
-		vSub.GetBool("enable-expvar"),
-		vSub.GetBool("enable-ingestion"),
-		vSub.GetBool("enable-healthcheck"),
+	tlsConfig, err := tlsconfig.Server(
+		vSub.GetString("tls-cert-path"),
+		vSub.GetString("tls-key-path"),
+		vSub.GetString("tls-client-ca-path"),
 	)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil && tlsConfig.ClientCAs != nil {
+		// Client certificates identify tenants, but aren't required for the healthcheck or bearer tokens.
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	server, err := NewHttpServer(logger.WithField("http-server", serverName), handler, HttpServerOptions{
+		ServerName:        serverName,
+		Address:           vSub.GetString("address"),
+		Lines:             lines,
+		FilterManager:     filterManager,
+		Health:            health,
+		EnableProf:        vSub.GetBool("enable-prof"),
+		EnableExpVar:      vSub.GetBool("enable-expvar"),
+		EnableIngestion:   vSub.GetBool("enable-ingestion"),
+		EnableHealthcheck: vSub.GetBool("enable-healthcheck"),
+		EnableAdmin:       vSub.GetBool("enable-admin"),
+		Tenants:           tenants,
+		TLSConfig:         tlsConfig,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if vSub.GetBool("enable-admin") {
+		tokenFile := vSub.GetString("admin-token-file")
+		if tokenFile == "" {
+			return nil, fmt.Errorf("enable-admin requires admin-token-file")
+		}
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read admin-token-file: %v", err)
+		}
+		if err = server.SetAdminToken(strings.TrimSpace(string(token))); err != nil {
+			return nil, err
+		}
+	}
+	if proxies := vSub.GetStringSlice("trusted-proxies"); len(proxies) > 0 {
+		if err = server.SetTrustedProxies(proxies); err != nil {
+			return nil, err
+		}
+	}
+	if watermark := vSub.GetFloat64("overload-watermark"); watermark != 0 {
+		if load == nil {
+			return nil, fmt.Errorf("overload-watermark is only supported by standalone servers")
+		}
+		if err = server.SetLoadReporter(load, watermark, vSub.GetDuration("overload-retry-after")); err != nil {
+			return nil, err
+		}
+	}
+	return server, nil
 }
 
-func NewHttpServer(
-	logger logrus.FieldLogger,
-	handler gostatsd.PipelineHandler,
-	serverName, address string,
-	enableProf,
-	enableExpVar,
-	enableIngestion,
-	enableHealthcheck bool,
-) (*httpServer, error) {
+// HttpServerOptions are the settings of an http server.  Only the endpoints which are enabled are served.
+type HttpServerOptions struct {
+	ServerName string
+	Address    string
+
+	Lines         LineParser     // nil to not accept lines on /v1/lines
+	FilterManager FilterManager  // Required by EnableAdmin
+	Health        HealthReporter // nil if the deepcheck always passes
+
+	EnableProf        bool
+	EnableExpVar      bool
+	EnableIngestion   bool
+	EnableHealthcheck bool
+	EnableAdmin       bool
+
+	Tenants   *Tenants    // nil to not authenticate ingestion
+	TLSConfig *tls.Config // nil to serve plain http
+}
+
+// NewHttpServer returns a server which serves the endpoints enabled by options, dispatching ingested metrics and
+// events to handler.
+func NewHttpServer(logger logrus.FieldLogger, handler gostatsd.PipelineHandler, options HttpServerOptions) (*httpServer, error) {
 	var routes []route
 
 	server := &httpServer{
-		logger:  logger,
-		address: address,
+		logger:    logger,
+		address:   options.Address,
+		tlsConfig: options.TLSConfig,
 	}
 
-	if enableProf {
+	if options.EnableProf {
 		profiler := &traceProfiler{}
 		routes = append(routes,
 			route{path: "/memprof", handler: profiler.MemProf, method: "POST", name: "profmem_post"},
@@ -95,30 +186,52 @@ func NewHttpServer(
 		)
 	}
 
-	if enableExpVar {
+	if options.EnableExpVar {
 		routes = append(routes,
 			route{path: "/expvar", handler: expvar.Handler().ServeHTTP, method: "GET", name: "expvar_get"},
 		)
 	}
 
-	if enableIngestion {
-		server.rawMetricsV2 = newRawHttpHandlerV2(logger, serverName, handler)
+	if options.EnableIngestion {
+		server.rawMetricsV2 = newRawHttpHandlerV2(logger, options.ServerName, handler, options.Lines, options.Tenants)
 		routes = append(routes,
 			route{path: "/v2/raw", handler: server.rawMetricsV2.MetricHandler, method: "POST", name: "metricsv2_post"},
 			route{path: "/v2/event", handler: server.rawMetricsV2.EventHandler, method: "POST", name: "eventsv2_post"},
 		)
+		if options.Lines != nil {
+			routes = append(routes,
+				route{path: "/v1/lines", handler: server.rawMetricsV2.LineHandler, method: "POST", name: "linesv1_post"},
+			)
+		}
+	} else if options.Tenants != nil {
+		return nil, fmt.Errorf("tenants require ingestion")
 	}
 
-	if enableHealthcheck {
-		hc := &healthChecker{logger}
+	if options.EnableHealthcheck {
+		hc := &healthChecker{logger: logger, health: options.Health}
 		routes = append(routes,
 			route{path: "/healthcheck", handler: hc.healthCheck, method: "GET", name: "healthcheck_get"},
 			route{path: "/deepcheck", handler: hc.deepCheck, method: "GET", name: "deepcheck_get"},
 		)
 	}
 
+	if options.EnableAdmin {
+		if options.FilterManager == nil {
+			return nil, fmt.Errorf("admin is not available")
+		}
+		// Every request is refused until SetAdminToken is called
+		server.admin = &filterAdmin{logger: logger, manager: options.FilterManager}
+		fa := server.admin
+		routes = append(routes,
+			route{path: "/admin/filters", handler: fa.authorize(fa.list), method: "GET", name: "admin_filters_get"},
+			route{path: "/admin/filters/{name}", handler: fa.authorize(fa.get), method: "GET", name: "admin_filter_get"},
+			route{path: "/admin/filters/{name}", handler: fa.authorize(fa.put), method: "PUT", name: "admin_filter_put"},
+			route{path: "/admin/filters/{name}", handler: fa.authorize(fa.delete), method: "DELETE", name: "admin_filter_delete"},
+		)
+	}
+
 	if len(routes) == 0 {
-		return nil, fmt.Errorf("must enable at least one of prof, expvar, ingestion, or healthcheck")
+		return nil, fmt.Errorf("must enable at least one of prof, expvar, ingestion, healthcheck, or admin")
 	}
 
 	router, err := createRoutes(routes)
@@ -130,16 +243,68 @@ func NewHttpServer(
 	server.Router = router
 
 	logger.WithFields(logrus.Fields{
-		"address":            address,
-		"enable-pprof":       enableProf,
-		"enable-expvar":      enableExpVar,
-		"enable-ingestion":   enableIngestion,
-		"enable-healthcheck": enableHealthcheck,
+		"address":            options.Address,
+		"enable-pprof":       options.EnableProf,
+		"enable-expvar":      options.EnableExpVar,
+		"enable-ingestion":   options.EnableIngestion,
+		"enable-healthcheck": options.EnableHealthcheck,
+		"enable-admin":       options.EnableAdmin,
+		"tenants":            options.Tenants != nil,
+		"tls":                options.TLSConfig != nil,
 	}).Info("Created server")
 
 	return server, nil
 }
 
+// SetTrustedProxies sets the addresses and CIDR ranges of proxies whose X-Forwarded-For header is believed when
+// stamping the source of lines sent to /v1/lines.
+func (hs *httpServer) SetTrustedProxies(proxies []string) error {
+	if hs.rawMetricsV2 == nil {
+		return fmt.Errorf("trusted-proxies requires ingestion")
+	}
+	networks, err := parseTrustedProxies(proxies)
+	if err != nil {
+		return err
+	}
+	hs.rawMetricsV2.trustedProxies = networks
+	return nil
+}
+
+// SetAdminToken sets the bearer token which requests to the admin endpoints must have.
+func (hs *httpServer) SetAdminToken(token string) error {
+	if hs.admin == nil {
+		return fmt.Errorf("admin-token requires admin")
+	}
+	if token == "" {
+		return fmt.Errorf("admin token must not be empty")
+	}
+	hash := sha256.Sum256([]byte(token))
+	hs.admin.tokenHash = &hash
+	return nil
+}
+
+// SetLoadReporter makes the server refuse metrics with a 503 while the utilisation reported by load is at or above
+// watermark, asking clients to retry after retryAfter.
+func (hs *httpServer) SetLoadReporter(load LoadReporter, watermark float64, retryAfter time.Duration) error {
+	if hs.rawMetricsV2 == nil {
+		return fmt.Errorf("overload-watermark requires ingestion")
+	}
+	if watermark <= 0 || watermark > 1 {
+		return fmt.Errorf("overload-watermark must be greater than 0 and at most 1")
+	}
+	if retryAfter <= 0 {
+		return fmt.Errorf("overload-retry-after must be positive")
+	}
+	hs.rawMetricsV2.load = load
+	hs.rawMetricsV2.overloadWatermark = watermark
+	hs.rawMetricsV2.overloadRetryAfter = retryAfter
+	hs.logger.WithFields(logrus.Fields{
+		"overload-watermark":   watermark,
+		"overload-retry-after": retryAfter,
+	}).Info("Refusing metrics when overloaded")
+	return nil
+}
+
 func (hs *httpServer) notFound(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(404)
 	_, _ = w.Write([]byte("not found"))
@@ -195,8 +360,9 @@ func (hs *httpServer) Run(ctx context.Context) {
 	}
 
 	server := &http.Server{
-		Addr:    hs.address,
-		Handler: hs.Router,
+		Addr:      hs.address,
+		Handler:   hs.Router,
+		TLSConfig: hs.tlsConfig,
 	}
 
 	chStopped := make(chan struct{}, 1)
@@ -204,7 +370,12 @@ func (hs *httpServer) Run(ctx context.Context) {
 
 	hs.logger.WithField("address", server.Addr).Info("listening")
 
-	err := server.ListenAndServe()
+	var err error
+	if hs.tlsConfig != nil {
+		err = server.ListenAndServeTLS("", "") // The certificate is in the TLSConfig
+	} else {
+		err = server.ListenAndServe()
+	}
 	if err != http.ErrServerClosed {
 		hs.logger.WithError(err).Error("web server failed")
 		return
@@ -2,19 +2,41 @@ package web
 
 import (
 	"bytes"
+	"compress/gzip"
 	"compress/zlib"
+	"errors"
+	"io"
 )
 
-func decompress(input []byte) ([]byte, error) {
+// errBodyTooLarge is returned when a body is larger than allowed once decompressed.
+var errBodyTooLarge = errors.New("body too large")
+
+func decompress(input []byte, limit int64) ([]byte, error) {
 	decompressor, err := zlib.NewReader(bytes.NewReader(input))
 	if err != nil {
 		return nil, err
 	}
 	defer decompressor.Close()
+	return readLimited(decompressor, limit)
+}
 
+func gunzip(input []byte, limit int64) ([]byte, error) {
+	decompressor, err := gzip.NewReader(bytes.NewReader(input))
+	if err != nil {
+		return nil, err
+	}
+	defer decompressor.Close()
+	return readLimited(decompressor, limit)
+}
+
+// readLimited reads all of r, or returns errBodyTooLarge if it has more than limit bytes.
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
 	var out bytes.Buffer
-	if _, err = out.ReadFrom(decompressor); err != nil {
+	if _, err := out.ReadFrom(io.LimitReader(r, limit+1)); err != nil {
 		return nil, err
 	}
+	if int64(out.Len()) > limit {
+		return nil, errBodyTooLarge
+	}
 	return out.Bytes(), nil
 }
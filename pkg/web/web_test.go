@@ -14,16 +14,13 @@ func TestHttpServerShutsdown(t *testing.T) {
 	testCtx, completed := testContext(t)
 	defer completed()
 
-	hs, err := web.NewHttpServer(
-		logrus.StandardLogger(),
-		nil,
-		"TestHttpServerShutsdown",
-		"127.0.0.1:0", // should pick a random port to bind to
+	hs, err := web.NewHttpServer(logrus.StandardLogger(), nil, web.HttpServerOptions{
+		ServerName: "TestHttpServerShutsdown",
+		Address:    "127.0.0.1:0",
+		EnableProf:// should pick a random port to bind to
 		false,
-		false,
-		false,
-		true,
-	)
+		EnableHealthcheck: true,
+	})
 	require.NoError(t, err)
 
 	ctx, cancel := context.WithCancel(testCtx)